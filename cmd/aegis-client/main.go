@@ -3,28 +3,43 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/cookiejar"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	httpadapter "github.com/aegis/parental-control/internal/adapter/http"
+	"github.com/aegis/parental-control/internal/adapter/signing"
 	"github.com/aegis/parental-control/internal/adapter/windows"
 	"github.com/aegis/parental-control/internal/domain"
 	"github.com/aegis/parental-control/internal/usecase/client"
 	"github.com/kardianos/service"
+	syswin "golang.org/x/sys/windows"
 	"gopkg.in/yaml.v3"
 )
 
+// usageReportInterval is how often consumed time is sent to server
+const usageReportInterval = time.Minute
+
 type config struct {
-	ServerURL string `yaml:"server_url"`
-	ClientID  string `yaml:"client_id"`
+	ServerURL    string `yaml:"server_url"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"` // sent with every request; the file is readable by admins only
+	ServerKey    string `yaml:"server_key"`    // base64 ed25519 public key pinned at install
 }
 
 type program struct {
@@ -85,15 +100,26 @@ func (p *program) run() {
 	}
 	log.Printf("Config parsed: server_url=%s, client_id=%s", cfg.ServerURL, cfg.ClientID)
 
-	if cfg.ServerURL == "" || cfg.ClientID == "" {
-		log.Printf("server_url and client_id required in config")
+	if cfg.ServerURL == "" || cfg.ClientID == "" || cfg.ClientSecret == "" || cfg.ServerKey == "" {
+		log.Printf("server_url, client_id, client_secret and server_key required in config")
+		return
+	}
+	serverKey, err := parseServerKey(cfg.ServerKey)
+	if err != nil {
+		log.Printf("Parse server_key: %v", err)
 		return
 	}
+	log.Printf("Accepting configs signed with key %s", signing.Fingerprint(serverKey))
+	// The last accepted sequence survives restarts, so old configs cannot be replayed after a reboot
+	seqPath := filepath.Join(filepath.Dir(cfgPath), "aegis-client.seq")
+	verifier := signing.NewVerifier(serverKey, cfg.ClientID, loadSequence(seqPath))
 
 	log.Printf("Creating config fetcher for server: %s", cfg.ServerURL)
-	fetcher := httpadapter.NewHTTPConfigFetcher(cfg.ServerURL, cfg.ClientID)
+	fetcher := httpadapter.NewHTTPConfigFetcher(cfg.ServerURL, cfg.ClientID, cfg.ClientSecret, verifier)
+	reporter := httpadapter.NewHTTPUsageReporter(cfg.ServerURL, cfg.ClientID, cfg.ClientSecret)
 	log.Printf("Creating user control")
 	ctrl := windows.NewUserControl()
+	tracker := client.NewUsageTracker()
 
 	var currentConfig *domain.ClientConfig
 	var lastVersion string
@@ -113,6 +139,7 @@ func (p *program) run() {
 			if err != nil {
 				log.Printf("Fetch config error: %v", err)
 			} else if fetched != nil {
+				saveSequence(seqPath, verifier.Sequence())
 				if fetched.Version != lastVersion {
 					log.Printf("Config updated: version %s -> %s", lastVersion, fetched.Version)
 					currentConfig = fetched
@@ -122,6 +149,28 @@ func (p *program) run() {
 		}
 	}()
 
+	// Usage report goroutine (for daily budgets)
+	go func() {
+		ticker := time.NewTicker(usageReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.exit:
+				return
+			case <-ticker.C:
+				// Report even when idle: server slides budget-trimmed intervals forward
+				usage := tracker.Flush()
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				err := reporter.ReportUsage(ctx, usage)
+				cancel()
+				if err != nil {
+					log.Printf("Report usage error: %v", err)
+					tracker.Restore(usage)
+				}
+			}
+		}
+	}()
+
 	// Initial config fetch
 	log.Printf("Fetching initial config from server...")
 	ctx := context.Background()
@@ -129,6 +178,7 @@ func (p *program) run() {
 	if err != nil {
 		log.Printf("Failed to fetch initial config: %v", err)
 	} else if fetched != nil {
+		saveSequence(seqPath, verifier.Sequence())
 		log.Printf("Initial config received, version: %s, users: %d", fetched.Version, len(fetched.Users))
 		currentConfig = fetched
 		lastVersion = fetched.Version
@@ -149,7 +199,9 @@ func (p *program) run() {
 			return
 		case <-stateTicker.C:
 			if currentConfig != nil {
-				lastState = client.ApplyAccessIfNeeded(ctrl, currentConfig, time.Now(), lastState)
+				now := time.Now()
+				lastState = client.ApplyAccessIfNeeded(ctrl, currentConfig, now, lastState)
+				tracker.Track(ctrl, lastState, now)
 			}
 		}
 	}
@@ -159,7 +211,10 @@ func main() {
 	installCmd := flag.NewFlagSet("install", flag.ExitOnError)
 	installServer := installCmd.String("server-url", "", "Server URL (e.g. http://server:8080)")
 	installClientID := installCmd.String("client-id", "", "Client ID (from web UI, or omit with --client-name)")
+	installClientSecret := installCmd.String("client-secret", "", "Client secret (from web UI, required with --client-id)")
 	installClientName := installCmd.String("client-name", "", "Client name (creates on server if --client-id not set)")
+	installAdmin := installCmd.String("admin", "", "Admin username to create the client with --client-name (password is asked)")
+	installServerKey := installCmd.String("server-key", "", "Server public key shown in the web UI (required)")
 
 	uninstallCmd := flag.NewFlagSet("uninstall", flag.ExitOnError)
 
@@ -177,7 +232,17 @@ func main() {
 		if *installClientID == "" && *installClientName == "" {
 			log.Fatal("--client-id or --client-name required")
 		}
-		install(*installServer, *installClientID, *installClientName)
+		if *installClientID != "" && *installClientSecret == "" {
+			log.Fatal("--client-secret required with --client-id")
+		}
+		if *installClientID == "" && *installAdmin == "" {
+			log.Fatal("--admin required with --client-name")
+		}
+		// The key is not fetched from the server: over plain HTTP anyone on the LAN could swap it
+		if *installServerKey == "" {
+			log.Fatal("--server-key required (copy it from the web UI)")
+		}
+		install(*installServer, *installClientID, *installClientSecret, *installClientName, *installAdmin, *installServerKey)
 	case "uninstall":
 		uninstallCmd.Parse(os.Args[2:])
 		uninstall()
@@ -206,17 +271,27 @@ func runAsService() {
 	}
 }
 
-func install(serverURL, clientID, clientName string) {
+func install(serverURL, clientID, clientSecret, clientName, admin, serverKey string) {
 	fmt.Printf("=== Aegis Client Installation ===\n")
 	fmt.Printf("Server URL: %s\n", serverURL)
 
+	pub, err := parseServerKey(serverKey)
+	if err != nil {
+		log.Fatalf("Parse server key: %v", err)
+	}
+	fmt.Printf("Server key fingerprint: %s (must match the one in the web UI)\n", signing.Fingerprint(pub))
+
 	if clientID == "" {
+		password, err := readPassword(fmt.Sprintf("Password of admin %s: ", admin))
+		if err != nil {
+			log.Fatalf("Read password: %v", err)
+		}
 		fmt.Printf("Creating client on server with name: %s\n", clientName)
-		id, err := createClientOnServer(serverURL, clientName)
+		id, secret, err := createClientOnServer(serverURL, clientName, admin, password)
 		if err != nil {
 			log.Fatalf("Create client on server: %v", err)
 		}
-		clientID = id
+		clientID, clientSecret = id, secret
 		fmt.Printf("Client created on server, ID: %s\n", clientID)
 	} else {
 		fmt.Printf("Using existing client ID: %s\n", clientID)
@@ -229,16 +304,20 @@ func install(serverURL, clientID, clientName string) {
 	}
 	fmt.Printf("Directory created\n")
 
-	cfg := config{ServerURL: serverURL, ClientID: clientID}
+	cfg := config{ServerURL: serverURL, ClientID: clientID, ClientSecret: clientSecret, ServerKey: serverKey}
 	data, err := yaml.Marshal(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	cfgPath := installDir + "\\aegis-client.yaml"
 	fmt.Printf("Writing config file: %s\n", cfgPath)
-	if err := os.WriteFile(cfgPath, data, 0644); err != nil {
+	if err := os.WriteFile(cfgPath, data, 0600); err != nil {
 		log.Fatalf("Write config: %v", err)
 	}
+	// The secret must not be readable by the children's accounts
+	if err := restrictToAdmins(cfgPath); err != nil {
+		log.Fatalf("Restrict access to config: %v", err)
+	}
 	fmt.Printf("Config file written\n")
 
 	exe, _ := os.Executable()
@@ -283,27 +362,118 @@ func install(serverURL, clientID, clientName string) {
 	fmt.Printf("Log file: %s\\aegis-client.log\n", installDir)
 }
 
-func createClientOnServer(serverURL, name string) (string, error) {
-	url := serverURL + "/api/clients"
-	body, _ := json.Marshal(map[string]string{"name": name})
-	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+// createClientOnServer logs in as admin and adds the client; it returns the client's ID and secret
+func createClientOnServer(serverURL, name, admin, password string) (string, string, error) {
+	jar, _ := cookiejar.New(nil)
+	hc := &http.Client{Jar: jar, Timeout: 30 * time.Second}
+	body, _ := json.Marshal(map[string]string{"username": admin, "password": password})
+	resp, err := hc.Post(serverURL+"/api/auth/login", "application/json", bytes.NewReader(body))
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("login: server returned %d", resp.StatusCode)
+	}
+	var session struct {
+		CSRFToken string `json:"csrf_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", "", err
+	}
+
+	body, _ = json.Marshal(map[string]string{"name": name})
+	req, err := http.NewRequest("POST", serverURL+"/api/clients", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", session.CSRFToken)
+	resp, err = hc.Do(req)
+	if err != nil {
+		return "", "", err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("server returned %d", resp.StatusCode)
+		return "", "", fmt.Errorf("server returned %d", resp.StatusCode)
 	}
 	var r struct {
-		ID string `json:"id"`
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", "", err
+	}
+	if r.ID == "" || r.Secret == "" {
+		return "", "", fmt.Errorf("server returned empty client id or secret")
+	}
+	return r.ID, r.Secret, nil
+}
+
+func parseServerKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("want %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// loadSequence returns the last accepted config sequence, 0 if none was saved
+func loadSequence(path string) uint64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	seq, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return seq
+}
+
+var saveSequenceMu sync.Mutex
+
+func saveSequence(path string, seq uint64) {
+	saveSequenceMu.Lock()
+	defer saveSequenceMu.Unlock()
+	if loadSequence(path) >= seq {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)+"\n"), 0600); err != nil {
+		log.Printf("Save config sequence: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Save config sequence: %v", err)
+	}
+}
+
+// readPassword reads a line from the console without echoing it
+func readPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	stdin := syswin.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := syswin.GetConsoleMode(stdin, &mode); err == nil {
+		syswin.SetConsoleMode(stdin, mode&^syswin.ENABLE_ECHO_INPUT)
+		defer syswin.SetConsoleMode(stdin, mode)
+		defer fmt.Println()
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
 		return "", err
 	}
-	if r.ID == "" {
-		return "", fmt.Errorf("server returned empty client id")
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// restrictToAdmins leaves access to path to SYSTEM and Administrators only
+func restrictToAdmins(path string) error {
+	out, err := exec.Command("icacls", path, "/inheritance:r",
+		"/grant:r", "*S-1-5-18:F", "/grant:r", "*S-1-5-32-544:F").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("icacls: %v: %s", err, out)
 	}
-	return r.ID, nil
+	return nil
 }
 
 func uninstall() {
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata" // per-client time zones must load on hosts without zoneinfo
+
+	"github.com/aegis/parental-control/internal/adapter/auth"
+	"github.com/aegis/parental-control/internal/adapter/eventlog"
+	httpadapter "github.com/aegis/parental-control/internal/adapter/http"
+	"github.com/aegis/parental-control/internal/adapter/jsonfile"
+	"github.com/aegis/parental-control/internal/adapter/signing"
+	"github.com/aegis/parental-control/internal/port"
+	"github.com/aegis/parental-control/internal/usecase/server"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	listenPort := flag.Int("port", 8080, "HTTP port")
+	addr := flag.String("addr", "", "Listen address (empty = all interfaces)")
+	dataPath := flag.String("data", "aegis-data.json", "Path to data file (directory for -storage events)")
+	storage := flag.String("storage", "json", "Storage backend: json (single file) or events (event log with history)")
+	tz := flag.String("tz", "Local", "IANA time zone for schedules (e.g. Europe/Moscow)")
+	adminsPath := flag.String("admins", "aegis-admins.json", "Path to admin accounts file")
+	keyPath := flag.String("signing-key", "aegis-signing.key", "Path to the config signing key (created on first start)")
+	resetPassword := flag.String("reset-password", "", "Set password of this admin (created if missing) from stdin and exit")
+	flag.Parse()
+
+	admins, err := auth.New(*adminsPath)
+	if err != nil {
+		log.Fatalf("Open admins %s: %v", *adminsPath, err)
+	}
+	if *resetPassword != "" {
+		if err := setAdminPassword(admins, *resetPassword, os.Stdin); err != nil {
+			log.Fatalf("Set password of %s: %v", *resetPassword, err)
+		}
+		log.Printf("Password of %s set", *resetPassword)
+		return
+	}
+	if token := admins.SetupToken(); token != "" {
+		log.Printf("No admin accounts yet: open the web UI and create the first one with setup token %s, or use -reset-password", token)
+	}
+
+	signer, err := signing.LoadOrCreate(*keyPath)
+	if err != nil {
+		log.Fatalf("Load signing key %s: %v", *keyPath, err)
+	}
+	log.Printf("Configs signed with key %s", signing.Fingerprint(signer.PublicKey()))
+
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		log.Fatalf("Load time zone %q: %v", *tz, err)
+	}
+
+	var repo port.ConfigRepository
+	switch *storage {
+	case "json":
+		repo, err = jsonfile.New(*dataPath, loc)
+	case "events":
+		repo, err = eventlog.New(*dataPath, loc)
+	default:
+		log.Fatalf("Unknown storage %q, want json or events", *storage)
+	}
+	if err != nil {
+		log.Fatalf("Open data %s: %v", *dataPath, err)
+	}
+	if c, ok := repo.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	// Refresh configs at midnight and interval changes even when nobody edits anything
+	rolloverCtx, stopRollover := context.WithCancel(context.Background())
+	defer stopRollover()
+	go server.NewRollover(repo, loc).Run(rolloverCtx)
+
+	handler := httpadapter.NewHandler(repo, loc, admins, signer)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+	handler.ServeStatic(mux)
+
+	srv := &http.Server{
+		Addr:    net.JoinHostPort(*addr, strconv.Itoa(*listenPort)),
+		Handler: mux,
+	}
+	// Release pending long-polls so Shutdown does not wait for their timeout
+	srv.RegisterOnShutdown(handler.Shutdown)
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Aegis server listening on %s (storage=%s, data=%s, tz=%s)", srv.Addr, *storage, *dataPath, loc)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Serve: %v", err)
+		}
+	case sig := <-sigCh:
+		log.Printf("Received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+		log.Printf("Server stopped")
+	}
+}
+
+// setAdminPassword reads a password line from in and sets it, creating the admin if needed
+func setAdminPassword(admins *auth.Service, username string, in io.Reader) error {
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	err = admins.SetPassword(username, password)
+	if errors.Is(err, auth.ErrAdminNotFound) {
+		err = admins.AddAdmin(username, password)
+	}
+	return err
+}
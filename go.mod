@@ -5,8 +5,8 @@ go 1.24.0
 toolchain go1.24.5
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/kardianos/service v1.2.4 // indirect
-	golang.org/x/sys v0.41.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/kardianos/service v1.2.4
+	golang.org/x/sys v0.41.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,447 @@
+// Package auth keeps admin accounts of the web UI and management API and their sessions.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// SessionLifetime is how long a login lasts
+	SessionLifetime = 30 * 24 * time.Hour
+	// maxLoginFailures failed logins from one address within loginLockout block further attempts
+	maxLoginFailures = 5
+	loginLockout     = 15 * time.Minute
+	// maxThrottledAddresses caps how many addresses with recent failures are remembered
+	maxThrottledAddresses = 10000
+
+	minPasswordLength = 8
+	maxPasswordLength = 1024
+	maxUsernameLength = 64
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrTooManyAttempts    = errors.New("too many failed logins, try again later")
+	ErrSetupDone          = errors.New("an admin account already exists")
+	ErrInvalidSetupToken  = errors.New("invalid setup token")
+	ErrAdminExists        = errors.New("admin already exists")
+	ErrAdminNotFound      = errors.New("admin not found")
+	ErrLastAdmin          = errors.New("cannot delete the last admin")
+)
+
+// Admin is an admin account as listed to admins
+type Admin struct {
+	Username     string    `json:"username"`
+	CreatedAt    time.Time `json:"created_at"`
+	HasFeedToken bool      `json:"has_feed_token"`
+}
+
+// Session is a logged-in admin. CSRF must accompany every request that changes anything.
+type Session struct {
+	Token    string
+	Username string
+	CSRF     string
+	Expires  time.Time
+}
+
+type account struct {
+	Username  string    `json:"username"`
+	Password  string    `json:"password"` // see hashPassword
+	CreatedAt time.Time `json:"created_at"`
+	FeedToken string    `json:"feed_token,omitempty"` // hash of the calendar feed token, see HashClientSecret
+}
+
+type accountsFile struct {
+	Admins []account `json:"admins"`
+}
+
+// Service keeps admin accounts in a JSON file and sessions in memory: a restart logs everyone out
+type Service struct {
+	mu       sync.Mutex
+	path     string
+	admins   map[string]account
+	sessions map[string]*Session
+	failures map[string][]time.Time // remote address -> recent failed logins
+	now      func() time.Time
+	dummy    string // hash checked for unknown usernames, so they take as long as known ones
+	// setupToken must accompany Setup; it is only shown in the server log, so the first
+	// admin cannot be created by whoever on the network reaches the web UI first
+	setupToken string
+}
+
+// New loads admin accounts from path; a missing file means none were created yet
+func New(path string) (*Service, error) {
+	s := &Service{
+		path:     path,
+		admins:   make(map[string]account),
+		sessions: make(map[string]*Session),
+		failures: make(map[string][]time.Time),
+		now:      time.Now,
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var f accountsFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for _, a := range f.Admins {
+			s.admins[a.Username] = a
+		}
+	}
+	if len(s.admins) == 0 {
+		if s.setupToken, err = randomToken(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Service) saveLocked() error {
+	f := accountsFile{Admins: make([]account, 0, len(s.admins))}
+	for _, a := range s.admins {
+		f.Admins = append(f.Admins, a)
+	}
+	sort.Slice(f.Admins, func(i, j int) bool { return f.Admins[i].Username < f.Admins[j].Username })
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	// Password hashes: readable by the server's user only
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func validateCredentials(username, password string) error {
+	if username == "" || username != strings.TrimSpace(username) || utf8.RuneCountInString(username) > maxUsernameLength {
+		return fmt.Errorf("username must be 1 to %d characters without surrounding spaces", maxUsernameLength)
+	}
+	if n := utf8.RuneCountInString(password); n < minPasswordLength || n > maxPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
+
+// SetupRequired reports whether no admin exists yet; then the first one can be created by Setup
+func (s *Service) SetupRequired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.admins) == 0
+}
+
+// SetupToken returns the one-time token Setup requires, or "" once an admin exists
+func (s *Service) SetupToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.admins) != 0 {
+		return ""
+	}
+	return s.setupToken
+}
+
+// Setup creates the first admin and logs them in; token must be the one from SetupToken
+func (s *Service) Setup(token, username, password string) (*Session, error) {
+	if err := validateCredentials(username, password); err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.admins) != 0 {
+		return nil, ErrSetupDone
+	}
+	if s.setupToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.setupToken)) != 1 {
+		return nil, ErrInvalidSetupToken
+	}
+	s.admins[username] = account{Username: username, Password: hash, CreatedAt: s.now()}
+	if err := s.saveLocked(); err != nil {
+		delete(s.admins, username)
+		return nil, err
+	}
+	s.setupToken = ""
+	return s.newSessionLocked(username)
+}
+
+// Login checks the password and starts a session. remote identifies the caller for throttling.
+func (s *Service) Login(username, password, remote string) (*Session, error) {
+	s.mu.Lock()
+	if !s.reserveAttemptLocked(remote, s.now()) {
+		s.mu.Unlock()
+		return nil, ErrTooManyAttempts
+	}
+	a, ok := s.admins[username]
+	if !ok && s.dummy == "" {
+		s.dummy, _ = hashPassword("not a password")
+	}
+	hash := a.Password
+	if !ok {
+		hash = s.dummy
+	}
+	s.mu.Unlock()
+
+	match := checkPassword(hash, password) // slow: not under the lock
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ok || !match {
+		return nil, ErrInvalidCredentials // the reserved attempt stays a failure
+	}
+	delete(s.failures, remote)
+	return s.newSessionLocked(username)
+}
+
+// reserveAttemptLocked counts a login attempt from remote as failed until its password
+// matches, so parallel guesses cannot all start before any of them is recorded. False if
+// remote has no attempts left.
+func (s *Service) reserveAttemptLocked(remote string, now time.Time) bool {
+	recent := recentFailures(s.failures[remote], now)
+	if len(recent) >= maxLoginFailures {
+		s.failures[remote] = recent
+		return false
+	}
+	if _, ok := s.failures[remote]; !ok && len(s.failures) >= maxThrottledAddresses {
+		s.sweepFailuresLocked(now)
+	}
+	s.failures[remote] = append(recent, now)
+	return true
+}
+
+// sweepFailuresLocked forgets addresses without recent failures; if that is not enough,
+// the one that failed longest ago
+func (s *Service) sweepFailuresLocked(now time.Time) {
+	oldest, oldestTime := "", now
+	for remote, failures := range s.failures {
+		recent := recentFailures(failures, now)
+		if len(recent) == 0 {
+			delete(s.failures, remote)
+			continue
+		}
+		s.failures[remote] = recent
+		if last := recent[len(recent)-1]; !last.After(oldestTime) {
+			oldest, oldestTime = remote, last
+		}
+	}
+	if len(s.failures) >= maxThrottledAddresses {
+		delete(s.failures, oldest)
+	}
+}
+
+func recentFailures(failures []time.Time, now time.Time) []time.Time {
+	recent := failures[:0]
+	for _, t := range failures {
+		if now.Sub(t) < loginLockout {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+func (s *Service) newSessionLocked(username string) (*Session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	for t, sess := range s.sessions {
+		if !sess.Expires.After(now) {
+			delete(s.sessions, t)
+		}
+	}
+	sess := &Session{Token: token, Username: username, CSRF: csrf, Expires: now.Add(SessionLifetime)}
+	s.sessions[token] = sess
+	copied := *sess
+	return &copied, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Session returns the live session with token
+func (s *Service) Session(token string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok {
+		return nil, false
+	}
+	if !sess.Expires.After(s.now()) {
+		delete(s.sessions, token)
+		return nil, false
+	}
+	copied := *sess
+	return &copied, true
+}
+
+// Logout ends the session with token
+func (s *Service) Logout(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+func (s *Service) dropSessionsLocked(username string) {
+	for t, sess := range s.sessions {
+		if sess.Username == username {
+			delete(s.sessions, t)
+		}
+	}
+}
+
+// Admins lists admin accounts by username
+func (s *Service) Admins() []Admin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Admin, 0, len(s.admins))
+	for _, a := range s.admins {
+		result = append(result, Admin{Username: a.Username, CreatedAt: a.CreatedAt, HasFeedToken: a.FeedToken != ""})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Username < result[j].Username })
+	return result
+}
+
+// AddAdmin creates another admin account
+func (s *Service) AddAdmin(username, password string) error {
+	if err := validateCredentials(username, password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.admins[username]; ok {
+		return ErrAdminExists
+	}
+	s.admins[username] = account{Username: username, Password: hash, CreatedAt: s.now()}
+	if err := s.saveLocked(); err != nil {
+		delete(s.admins, username)
+		return err
+	}
+	return nil
+}
+
+// SetPassword changes the admin's password and ends their sessions
+func (s *Service) SetPassword(username, password string) error {
+	if err := validateCredentials(username, password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.admins[username]
+	if !ok {
+		return ErrAdminNotFound
+	}
+	old := a
+	a.Password = hash
+	s.admins[username] = a
+	if err := s.saveLocked(); err != nil {
+		s.admins[username] = old
+		return err
+	}
+	s.dropSessionsLocked(username)
+	return nil
+}
+
+// DeleteAdmin removes the account and ends its sessions; the last admin cannot be removed
+func (s *Service) DeleteAdmin(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.admins[username]
+	if !ok {
+		return ErrAdminNotFound
+	}
+	if len(s.admins) == 1 {
+		return ErrLastAdmin
+	}
+	delete(s.admins, username)
+	if err := s.saveLocked(); err != nil {
+		s.admins[username] = a
+		return err
+	}
+	s.dropSessionsLocked(username)
+	return nil
+}
+
+// IssueFeedToken gives the admin a new calendar feed token, replacing the previous one.
+// Calendar apps cannot log in, so the token goes in the feed URL; only its hash is kept.
+func (s *Service) IssueFeedToken(username string) (string, error) {
+	token, hash, err := NewClientSecret()
+	if err != nil {
+		return "", err
+	}
+	if err := s.setFeedToken(username, hash); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeFeedToken stops the admin's calendar feed URLs from working
+func (s *Service) RevokeFeedToken(username string) error {
+	return s.setFeedToken(username, "")
+}
+
+func (s *Service) setFeedToken(username, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.admins[username]
+	if !ok {
+		return ErrAdminNotFound
+	}
+	old := a
+	a.FeedToken = hash
+	s.admins[username] = a
+	if err := s.saveLocked(); err != nil {
+		s.admins[username] = old
+		return err
+	}
+	return nil
+}
+
+// CheckFeedToken reports whether token is the feed token of some admin
+func (s *Service) CheckFeedToken(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.admins {
+		if CheckClientSecret(a.FeedToken, token) {
+			return true
+		}
+	}
+	return false
+}
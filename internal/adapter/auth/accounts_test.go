@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Full work factor makes every hash take a noticeable time
+	hashIterations = 1000
+	os.Exit(m.Run())
+}
+
+func TestPassword_SaltedHash(t *testing.T) {
+	a, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := hashPassword("correct horse")
+	if a == b {
+		t.Error("same hash for the same password: salt not random")
+	}
+	if !checkPassword(a, "correct horse") || !checkPassword(b, "correct horse") {
+		t.Error("password does not match its hash")
+	}
+	if checkPassword(a, "correct horsE") || checkPassword("", "") || checkPassword("plain$1$x$y", "x") {
+		t.Error("wrong password or malformed hash accepted")
+	}
+}
+
+func TestService_SetupLoginAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admins.json")
+	s, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.SetupRequired() {
+		t.Fatal("setup not required without admins")
+	}
+	token := s.SetupToken()
+	if token == "" {
+		t.Fatal("no setup token without admins")
+	}
+	for _, wrong := range []string{"", token + "x"} {
+		if _, err := s.Setup(wrong, "mom", "secret-pass"); !errors.Is(err, ErrInvalidSetupToken) {
+			t.Errorf("setup with token %q: %v, want ErrInvalidSetupToken", wrong, err)
+		}
+	}
+	if _, err := s.Setup(token, "mom", "short"); err == nil {
+		t.Error("short password accepted")
+	}
+	sess, err := s.Setup(token, "mom", "secret-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := s.Session(sess.Token); !ok || got.Username != "mom" || got.CSRF == "" {
+		t.Errorf("session after setup: %+v %v", got, ok)
+	}
+	if _, err := s.Setup(token, "kid", "another-pass"); !errors.Is(err, ErrSetupDone) {
+		t.Errorf("second setup: %v, want ErrSetupDone", err)
+	}
+	if s.SetupToken() != "" {
+		t.Error("setup token still offered after setup")
+	}
+
+	if runtime.GOOS != "windows" {
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("accounts file mode %v (%v), want 0600", fi.Mode().Perm(), err)
+		}
+	}
+
+	// Accounts survive a restart, sessions do not
+	s, err = New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Session(sess.Token); ok {
+		t.Error("session survived restart")
+	}
+	if _, err := s.Login("mom", "wrong-pass", "10.0.0.2"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: %v", err)
+	}
+	if _, err := s.Login("nobody", "secret-pass", "10.0.0.2"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown admin: %v", err)
+	}
+	if _, err := s.Login("mom", "secret-pass", "10.0.0.2"); err != nil {
+		t.Errorf("login after restart: %v", err)
+	}
+}
+
+func TestService_LoginLockout(t *testing.T) {
+	s, _ := New(filepath.Join(t.TempDir(), "admins.json"))
+	s.Setup(s.SetupToken(), "mom", "secret-pass")
+	now := time.Date(2026, 3, 2, 20, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < maxLoginFailures; i++ {
+		s.Login("mom", "guess", "10.0.0.5")
+	}
+	if _, err := s.Login("mom", "secret-pass", "10.0.0.5"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("after %d failures: %v, want ErrTooManyAttempts", maxLoginFailures, err)
+	}
+	if _, err := s.Login("mom", "secret-pass", "10.0.0.6"); err != nil {
+		t.Errorf("other address locked out too: %v", err)
+	}
+	now = now.Add(loginLockout)
+	if _, err := s.Login("mom", "secret-pass", "10.0.0.5"); err != nil {
+		t.Errorf("still locked out after %v: %v", loginLockout, err)
+	}
+
+	// Parallel guesses are counted before the slow password check
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	checked := 0
+	for i := 0; i < 2*maxLoginFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Login("mom", "guess", "10.0.0.8"); errors.Is(err, ErrInvalidCredentials) {
+				mu.Lock()
+				checked++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if checked != maxLoginFailures {
+		t.Errorf("%d parallel guesses checked, want %d", checked, maxLoginFailures)
+	}
+
+	// Addresses are forgotten once their failures expire, and never more than the cap are kept
+	s.mu.Lock()
+	for i := 0; i < maxThrottledAddresses+10; i++ {
+		s.reserveAttemptLocked(fmt.Sprintf("10.1.%d.%d", i/256, i%256), now)
+	}
+	if len(s.failures) > maxThrottledAddresses {
+		t.Errorf("%d addresses kept, want at most %d", len(s.failures), maxThrottledAddresses)
+	}
+	now = now.Add(loginLockout)
+	s.reserveAttemptLocked("10.0.0.9", now)
+	if len(s.failures) != 1 {
+		t.Errorf("%d addresses kept after expiry, want 1", len(s.failures))
+	}
+	s.mu.Unlock()
+}
+
+func TestService_ManageAdmins(t *testing.T) {
+	s, _ := New(filepath.Join(t.TempDir(), "admins.json"))
+	mom, _ := s.Setup(s.SetupToken(), "mom", "secret-pass")
+	if err := s.AddAdmin("dad", "dads-pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddAdmin("dad", "dads-pass"); !errors.Is(err, ErrAdminExists) {
+		t.Errorf("duplicate admin: %v", err)
+	}
+	if err := s.AddAdmin(" dad", "dads-pass"); err == nil {
+		t.Error("username with spaces accepted")
+	}
+	dad, _ := s.Login("dad", "dads-pass", "10.0.0.7")
+
+	// A new password ends the admin's sessions only
+	if err := s.SetPassword("dad", "new-dads-pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Session(dad.Token); ok {
+		t.Error("session kept after password change")
+	}
+	if _, ok := s.Session(mom.Token); !ok {
+		t.Error("other admin logged out by password change")
+	}
+	if _, err := s.Login("dad", "new-dads-pass", "10.0.0.7"); err != nil {
+		t.Errorf("login with new password: %v", err)
+	}
+
+	// A new feed token replaces the old one and survives a restart
+	first, _ := s.IssueFeedToken("dad")
+	second, err := s.IssueFeedToken("dad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CheckFeedToken(first) || !s.CheckFeedToken(second) || s.CheckFeedToken("") {
+		t.Error("feed token not replaced")
+	}
+	if reloaded, _ := New(s.path); !reloaded.CheckFeedToken(second) {
+		t.Error("feed token lost on restart")
+	}
+	if err := s.RevokeFeedToken("dad"); err != nil || s.CheckFeedToken(second) {
+		t.Errorf("revoked feed token still works (%v)", err)
+	}
+
+	if err := s.DeleteAdmin("dad"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteAdmin("mom"); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("deleting the last admin: %v, want ErrLastAdmin", err)
+	}
+	if got := s.Admins(); len(got) != 1 || got[0].Username != "mom" {
+		t.Errorf("admins %+v, want only mom", got)
+	}
+}
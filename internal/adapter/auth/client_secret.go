@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// NewClientSecret returns a random secret for an agent and the hash the server keeps.
+// The secret is shown once; only the hash is stored.
+func NewClientSecret() (secret, hash string, err error) {
+	secret, err = randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	return secret, HashClientSecret(secret), nil
+}
+
+// HashClientSecret hashes an agent secret. Secrets are random, so a single SHA-256 is enough.
+func HashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckClientSecret reports whether secret matches hash; an empty hash (no secret issued
+// or revoked) matches nothing
+func CheckClientSecret(hash, secret string) bool {
+	if hash == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashClientSecret(secret)), []byte(hash)) == 1
+}
@@ -0,0 +1,228 @@
+// Package eventlog is a ConfigRepository that appends every change as a typed event
+// to a local log and rebuilds state by replaying it. Snapshots written on compaction
+// speed up startup; compacted log segments are archived, so the state at any past
+// moment can still be rebuilt.
+package eventlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+	"github.com/aegis/parental-control/internal/port"
+)
+
+// EventType names a change recorded in the log
+type EventType string
+
+const (
+	ClientSaved         EventType = "ClientSaved"
+	ClientDeleted       EventType = "ClientDeleted"
+	ClientUpdated       EventType = "ClientUpdated"
+	ClientSecretSet     EventType = "ClientSecretSet"
+	UserAdded           EventType = "UserAdded"
+	UserDeleted         EventType = "UserDeleted"
+	ScheduleUpdated     EventType = "ScheduleUpdated"
+	DateOverridesSet    EventType = "DateOverridesSet"
+	DateOverrideDeleted EventType = "DateOverrideDeleted"
+	BudgetUpdated       EventType = "BudgetUpdated"
+	UsageAdded          EventType = "UsageAdded"
+	PeriodsUpdated      EventType = "PeriodsUpdated"
+	UserTemplateSet     EventType = "UserTemplateSet"
+	TemplateSaved       EventType = "TemplateSaved"
+	TemplateDeleted     EventType = "TemplateDeleted"
+	AccessGranted       EventType = "AccessGranted"
+	AccessUpdated       EventType = "AccessUpdated"
+	AccessRevoked       EventType = "AccessRevoked"
+	OverrideGranted     EventType = "OverrideGranted"
+	OverrideRevoked     EventType = "OverrideRevoked"
+	Blocked             EventType = "Blocked"
+	Unblocked           EventType = "Unblocked"
+	BlockRuleAdded      EventType = "BlockRuleAdded"
+	BlockRuleDeleted    EventType = "BlockRuleDeleted"
+	VersionBumped       EventType = "VersionBumped"
+)
+
+// Event is one line of the log. Seq increases by one per event, Time never decreases.
+type Event struct {
+	Seq      uint64          `json:"seq"`
+	Time     time.Time       `json:"time"`
+	Type     EventType       `json:"type"`
+	ClientID string          `json:"client_id,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// Event payloads. IDs, versions and dates are decided when the event is written,
+// so replay is deterministic.
+
+type clientSavedData struct {
+	Client clientRecord `json:"client"`
+}
+
+type clientUpdatedData struct {
+	Update port.ClientUpdate `json:"update"`
+}
+
+type clientSecretSetData struct {
+	SecretHash string `json:"secret_hash,omitempty"` // empty = revoked
+}
+
+type userAddedData struct {
+	User userRecord `json:"user"`
+}
+
+type userData struct {
+	UserID string `json:"user_id"`
+}
+
+type scheduleUpdatedData struct {
+	UserID   string             `json:"user_id"`
+	Schedule domain.DaySchedule `json:"schedule"`
+}
+
+type dateOverridesSetData struct {
+	UserID    string               `json:"user_id"`
+	Overrides domain.DateOverrides `json:"overrides"` // merged into existing ones
+}
+
+type dateOverrideDeletedData struct {
+	UserID string `json:"user_id"`
+	Date   string `json:"date"`
+}
+
+type budgetUpdatedData struct {
+	UserID string             `json:"user_id"`
+	Budget domain.DailyBudget `json:"budget"`
+}
+
+type usageAddedData struct {
+	Date    string         `json:"date"`    // client's local date the usage is counted for
+	Oldest  string         `json:"oldest"`  // usage of earlier dates is dropped
+	Seconds map[string]int `json:"seconds"` // username -> seconds
+}
+
+type periodsUpdatedData struct {
+	UserID  string                  `json:"user_id"`
+	Periods []domain.SchedulePeriod `json:"periods"`
+}
+
+type userTemplateSetData struct {
+	UserID     string `json:"user_id"`
+	TemplateID string `json:"template_id"`
+}
+
+type templateSavedData struct {
+	Template domain.ScheduleTemplate `json:"template"`
+	Versions map[string]string       `json:"versions,omitempty"` // new config version of each client using it
+}
+
+type templateDeletedData struct {
+	TemplateID string            `json:"template_id"`
+	Versions   map[string]string `json:"versions,omitempty"`
+}
+
+type accessGrantedData struct {
+	Request port.TemporaryAccessRequest `json:"request"`
+	Admin   string                      `json:"admin,omitempty"`
+}
+
+type accessUpdatedData struct {
+	RequestID string    `json:"request_id"`
+	Until     time.Time `json:"until"`
+}
+
+type requestData struct {
+	RequestID string `json:"request_id"`
+}
+
+type overrideGrantedData struct {
+	Grant port.OverrideGrant `json:"grant"`
+	Admin string             `json:"admin,omitempty"`
+}
+
+type blockedData struct {
+	Request port.BlockRequest `json:"request"`
+	Admin   string            `json:"admin,omitempty"`
+}
+
+type blockRuleAddedData struct {
+	Rule port.BlockRule `json:"rule"`
+}
+
+type versionBumpedData struct {
+	Version string `json:"version"`
+}
+
+// newPayload returns a pointer to an empty payload of an event of typ, nil for events
+// without one; ok is false for an unknown type
+func newPayload(typ EventType) (payload any, ok bool) {
+	switch typ {
+	case ClientSaved:
+		return &clientSavedData{}, true
+	case ClientDeleted:
+		return nil, true
+	case ClientUpdated:
+		return &clientUpdatedData{}, true
+	case ClientSecretSet:
+		return &clientSecretSetData{}, true
+	case UserAdded:
+		return &userAddedData{}, true
+	case UserDeleted:
+		return &userData{}, true
+	case ScheduleUpdated:
+		return &scheduleUpdatedData{}, true
+	case DateOverridesSet:
+		return &dateOverridesSetData{}, true
+	case DateOverrideDeleted:
+		return &dateOverrideDeletedData{}, true
+	case BudgetUpdated:
+		return &budgetUpdatedData{}, true
+	case UsageAdded:
+		return &usageAddedData{}, true
+	case PeriodsUpdated:
+		return &periodsUpdatedData{}, true
+	case UserTemplateSet:
+		return &userTemplateSetData{}, true
+	case TemplateSaved:
+		return &templateSavedData{}, true
+	case TemplateDeleted:
+		return &templateDeletedData{}, true
+	case AccessGranted:
+		return &accessGrantedData{}, true
+	case AccessUpdated:
+		return &accessUpdatedData{}, true
+	case AccessRevoked:
+		return &requestData{}, true
+	case OverrideGranted:
+		return &overrideGrantedData{}, true
+	case OverrideRevoked:
+		return &requestData{}, true
+	case Blocked:
+		return &blockedData{}, true
+	case Unblocked:
+		return &requestData{}, true
+	case BlockRuleAdded:
+		return &blockRuleAddedData{}, true
+	case BlockRuleDeleted:
+		return &requestData{}, true
+	case VersionBumped:
+		return &versionBumpedData{}, true
+	}
+	return nil, false
+}
+
+// decode parses the payload of e. It fails for malformed data and unknown types only,
+// so an event that decodes can always be applied.
+func decode(e Event) (any, error) {
+	payload, ok := newPayload(e.Type)
+	if !ok {
+		return nil, fmt.Errorf("event %d: unknown type %q", e.Seq, e.Type)
+	}
+	if payload != nil {
+		if err := json.Unmarshal(e.Data, payload); err != nil {
+			return nil, fmt.Errorf("event %d (%s): %w", e.Seq, e.Type, err)
+		}
+	}
+	return payload, nil
+}
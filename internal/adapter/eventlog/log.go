@@ -0,0 +1,279 @@
+package eventlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+	"github.com/aegis/parental-control/internal/port"
+)
+
+const (
+	logFile      = "events.log"
+	snapshotFile = "snapshot.json"
+	archiveDir   = "archive"
+)
+
+// snapshot is the model after event Seq; events up to Seq are in archived segments
+type snapshot struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	State *model    `json:"state"`
+}
+
+// readEvents calls fn for every complete event of the log at path and returns the
+// length of the complete part. A last line without newline is a torn append
+// (crash mid-write) and is not reported; a malformed complete line is an error.
+func readEvents(path string, fn func(Event) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	var n int64
+	for {
+		line, err := rd.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var e Event
+			if err := json.Unmarshal(trimmed, &e); err != nil {
+				return n, fmt.Errorf("%s at offset %d: %w", path, n, err)
+			}
+			if err := fn(e); err != nil {
+				return n, err
+			}
+		}
+		n += int64(len(line))
+	}
+}
+
+func readSnapshot(path string) (*snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if s.State == nil {
+		s.State = newModel()
+	}
+	if s.State.Clients == nil {
+		s.State.Clients = make(map[string]*clientRecord)
+	}
+	if s.State.Templates == nil {
+		s.State.Templates = make(map[string]domain.ScheduleTemplate)
+	}
+	return &s, nil
+}
+
+// writeFileSync writes data to a temp file, syncs it and renames it over path
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// archivedSegments returns paths of compacted log segments, oldest first
+func archivedSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, archiveDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "events-") && strings.HasSuffix(e.Name(), ".log") {
+			paths = append(paths, filepath.Join(dir, archiveDir, e.Name()))
+		}
+	}
+	sort.Strings(paths) // names carry the zero-padded first seq
+	return paths, nil
+}
+
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("events-%020d.log", firstSeq)
+}
+
+// segmentFirstSeq parses the first sequence number out of a segment path
+func segmentFirstSeq(path string) uint64 {
+	var seq uint64
+	fmt.Sscanf(filepath.Base(path), "events-%d.log", &seq)
+	return seq
+}
+
+// archivedSnapshot is a copy of the snapshot written on compaction. Replays to a past
+// moment start from the newest one not after it instead of from the first event.
+type archivedSnapshot struct {
+	path string
+	seq  uint64
+	time time.Time
+}
+
+func archivedSnapshotName(seq uint64, t time.Time) string {
+	return fmt.Sprintf("snapshot-%020d-%d.json", seq, t.UnixNano())
+}
+
+// archivedSnapshots returns the snapshots of the archive, oldest first
+func archivedSnapshots(dir string) ([]archivedSnapshot, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, archiveDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var result []archivedSnapshot
+	for _, e := range entries {
+		var seq uint64
+		var nanos int64
+		if n, _ := fmt.Sscanf(e.Name(), "snapshot-%d-%d.json", &seq, &nanos); n != 2 {
+			continue
+		}
+		result = append(result, archivedSnapshot{path: filepath.Join(dir, archiveDir, e.Name()), seq: seq, time: time.Unix(0, nanos)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].seq < result[j].seq })
+	return result, nil
+}
+
+// pruneArchive removes archived segments and snapshots that only matter for moments
+// before cutoff. The newest snapshot before cutoff is kept, so every later moment can
+// still be rebuilt.
+func pruneArchive(dir string, cutoff time.Time) error {
+	snapshots, err := archivedSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	var base *archivedSnapshot
+	for i := range snapshots {
+		if snapshots[i].time.Before(cutoff) {
+			base = &snapshots[i]
+		}
+	}
+	if base == nil {
+		return nil
+	}
+	for _, s := range snapshots {
+		if s.seq < base.seq {
+			if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	segments, err := archivedSegments(dir)
+	if err != nil {
+		return err
+	}
+	// A segment is covered by the base snapshot when the next one starts no later than after it
+	for i := 0; i+1 < len(segments); i++ {
+		if segmentFirstSeq(segments[i+1]) <= base.seq+1 {
+			if err := os.Remove(segments[i]); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// errStop ends a replay early once events are past the requested moment
+var errStop = errors.New("stop")
+
+// replay rebuilds the model as it was at t (zero t = after the last event): from the snapshot
+// when t is not before it, otherwise from the newest archived snapshot not after t (or the
+// first event) through the archived segments. It also returns the sequence number and time
+// of the last applied event.
+func replay(dir string, t time.Time) (*model, uint64, time.Time, error) {
+	m := newModel()
+	var seq uint64
+	var last time.Time
+	var snapSeq uint64 // events the replay must reach unless it stops before t
+	paths := []string{filepath.Join(dir, logFile)}
+	s, err := readSnapshot(filepath.Join(dir, snapshotFile))
+	switch {
+	case err == nil && (t.IsZero() || !t.Before(s.Time)):
+		m, seq, last = s.State, s.Seq, s.Time
+	case err == nil || os.IsNotExist(err):
+		if err == nil {
+			snapSeq = s.Seq
+		}
+		snapshots, err := archivedSnapshots(dir)
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		for i := len(snapshots) - 1; i >= 0; i-- {
+			if snapshots[i].time.After(t) {
+				continue
+			}
+			base, err := readSnapshot(snapshots[i].path)
+			if err != nil {
+				return nil, 0, time.Time{}, err
+			}
+			m, seq, last = base.State, base.Seq, base.Time
+			break
+		}
+		archived, err := archivedSegments(dir)
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		// Skip segments that end before the starting point: the next one starts no later than after it
+		first := 0
+		for first+1 < len(archived) && segmentFirstSeq(archived[first+1]) <= seq+1 {
+			first++
+		}
+		paths = append(archived[first:], paths...)
+	default:
+		return nil, 0, time.Time{}, err
+	}
+
+	for _, path := range paths {
+		_, err := readEvents(path, func(e Event) error {
+			if e.Seq <= seq {
+				return nil // already in the snapshot
+			}
+			if e.Seq != seq+1 {
+				return port.ErrHistoryUnavailable // segment missing or pruned
+			}
+			if !t.IsZero() && e.Time.After(t) {
+				return errStop
+			}
+			seq, last = e.Seq, e.Time
+			return m.apply(e)
+		})
+		if errors.Is(err, errStop) {
+			return m, seq, last, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, 0, time.Time{}, err
+		}
+	}
+	if seq < snapSeq {
+		return nil, 0, time.Time{}, port.ErrHistoryUnavailable // archived segments were removed
+	}
+	return m, seq, last, nil
+}
@@ -0,0 +1,424 @@
+package eventlog
+
+import (
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+	"github.com/aegis/parental-control/internal/port"
+	"github.com/aegis/parental-control/internal/usecase/server"
+)
+
+// expiredRetention hides ended temp access, overrides and blocks from GetClient and
+// drops them from the model when the next one is added; they stay in the history
+const expiredRetention = 24 * time.Hour
+
+// model is the state rebuilt by replaying events; it is also the snapshot format
+type model struct {
+	Clients   map[string]*clientRecord           `json:"clients"`
+	Templates map[string]domain.ScheduleTemplate `json:"templates,omitempty"`
+}
+
+type clientRecord struct {
+	ID                      string                        `json:"id"`
+	Name                    string                        `json:"name"`
+	Users                   []userRecord                  `json:"users"`
+	BlockRequests           []port.BlockRequest           `json:"block_requests,omitempty"`
+	TemporaryAccessRequests []port.TemporaryAccessRequest `json:"temporary_access_requests,omitempty"`
+	OverrideGrants          []port.OverrideGrant          `json:"override_grants,omitempty"`
+	BlockRules              []port.BlockRule              `json:"block_rules,omitempty"`
+	WindowDays              int                           `json:"window_days,omitempty"`
+	TimeZone                string                        `json:"time_zone,omitempty"`
+	SecretHash              string                        `json:"secret_hash,omitempty"`
+	Version                 string                        `json:"version,omitempty"`
+	History                 []port.HistoryEntry           `json:"history,omitempty"` // oldest first
+}
+
+type userRecord struct {
+	ID         string                  `json:"id"`
+	Name       string                  `json:"name"`
+	Username   string                  `json:"username"`
+	Schedule   domain.DaySchedule      `json:"schedule"`
+	TemplateID string                  `json:"template_id,omitempty"`
+	Periods    []domain.SchedulePeriod `json:"periods,omitempty"`
+	Overrides  domain.DateOverrides    `json:"overrides,omitempty"`
+	Budget     domain.DailyBudget      `json:"budget,omitempty"`
+	Usage      domain.DailyUsage       `json:"usage,omitempty"`
+}
+
+func newModel() *model {
+	return &model{
+		Clients:   make(map[string]*clientRecord),
+		Templates: make(map[string]domain.ScheduleTemplate),
+	}
+}
+
+func toUserRecord(u domain.User) userRecord {
+	return userRecord{
+		ID:         u.ID,
+		Name:       u.Name,
+		Username:   u.Username,
+		Schedule:   u.Schedule,
+		TemplateID: u.TemplateID,
+		Periods:    u.Periods,
+		Overrides:  u.Overrides,
+		Budget:     u.Budget,
+		Usage:      u.Usage,
+	}
+}
+
+func (u userRecord) user() domain.User {
+	return domain.User{
+		ID:         u.ID,
+		Name:       u.Name,
+		Username:   u.Username,
+		Schedule:   u.Schedule,
+		TemplateID: u.TemplateID,
+		Periods:    u.Periods,
+		Overrides:  u.Overrides,
+		Budget:     u.Budget,
+		Usage:      u.Usage,
+	}
+}
+
+func toClientRecord(client *port.ClientState) clientRecord {
+	users := make([]userRecord, 0, len(client.Users))
+	for _, u := range client.Users {
+		users = append(users, toUserRecord(u))
+	}
+	return clientRecord{
+		ID:                      client.ID,
+		Name:                    client.Name,
+		Users:                   users,
+		BlockRequests:           append([]port.BlockRequest(nil), client.BlockRequests...),
+		TemporaryAccessRequests: append([]port.TemporaryAccessRequest(nil), client.TemporaryAccessRequests...),
+		OverrideGrants:          append([]port.OverrideGrant(nil), client.OverrideGrants...),
+		BlockRules:              append([]port.BlockRule(nil), client.BlockRules...),
+		WindowDays:              client.WindowDays,
+		TimeZone:                client.TimeZone,
+		SecretHash:              client.SecretHash,
+		Version:                 client.LastSentVersion,
+	}
+}
+
+// portState returns a copy of the client as seen at now: entries that ended more than
+// expiredRetention before now are left out
+func (m *model) portState(cs *clientRecord, now time.Time) *port.ClientState {
+	expired := now.Add(-expiredRetention)
+	users := make([]domain.User, 0, len(cs.Users))
+	templates := make(map[string]domain.ScheduleTemplate)
+	for _, u := range cs.Users {
+		users = append(users, u.user())
+		if t, ok := m.Templates[u.TemplateID]; ok {
+			templates[t.ID] = t
+		}
+	}
+	state := &port.ClientState{
+		ID:                      cs.ID,
+		Name:                    cs.Name,
+		Users:                   users,
+		BlockRequests:           []port.BlockRequest{},
+		TemporaryAccessRequests: []port.TemporaryAccessRequest{},
+		OverrideGrants:          []port.OverrideGrant{},
+		BlockRules:              append([]port.BlockRule{}, cs.BlockRules...),
+		WindowDays:              cs.WindowDays,
+		TimeZone:                cs.TimeZone,
+		SecretHash:              cs.SecretHash,
+		Templates:               templates,
+		LastSentVersion:         cs.Version,
+	}
+	for _, b := range cs.BlockRequests {
+		if b.Until.After(expired) {
+			state.BlockRequests = append(state.BlockRequests, b)
+		}
+	}
+	for _, t := range cs.TemporaryAccessRequests {
+		if t.Until.After(expired) {
+			state.TemporaryAccessRequests = append(state.TemporaryAccessRequests, t)
+		}
+	}
+	for _, g := range cs.OverrideGrants {
+		if g.Until.After(expired) {
+			state.OverrideGrants = append(state.OverrideGrants, g)
+		}
+	}
+	return state
+}
+
+// updateUser applies fn to the user of the event's client; missing client or user is ignored,
+// as the repository does for such calls
+func (m *model) updateUser(clientID, userID string, fn func(*userRecord)) {
+	cs, ok := m.Clients[clientID]
+	if !ok {
+		return
+	}
+	for i := range cs.Users {
+		if cs.Users[i].ID == userID {
+			fn(&cs.Users[i])
+			return
+		}
+	}
+}
+
+// appendActive appends item to a copy of list, dropping entries that ended more than
+// expiredRetention before now
+func appendActive[T any](list []T, item T, until func(T) time.Time, now time.Time) []T {
+	expired := now.Add(-expiredRetention)
+	var kept []T
+	for _, t := range list {
+		if until(t).After(expired) {
+			kept = append(kept, t)
+		}
+	}
+	return append(kept, item)
+}
+
+// recordHistory archives a new grant or block of cs created by admin at now
+func (cs *clientRecord) recordHistory(typ, id, userID string, start, until time.Time, note, admin string, now time.Time) {
+	entry := port.HistoryEntry{ID: id, Type: typ, UserID: userID, Start: start, Until: until, CreatedAt: now, Note: note, Admin: admin}
+	for _, u := range cs.Users {
+		if u.ID == userID {
+			entry.Username = u.Username
+		}
+	}
+	cs.History = server.AppendHistory(cs.History, entry, now)
+}
+
+func without[T any](list []T, drop func(T) bool) []T {
+	var kept []T
+	for _, item := range list {
+		if !drop(item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// apply changes the model by one event. It depends only on the event, so replaying
+// the same log always yields the same state. Maps and slices are replaced, not mutated:
+// port states handed out earlier share them.
+func (m *model) apply(e Event) error {
+	payload, err := decode(e)
+	if err != nil {
+		return err
+	}
+	m.applyPayload(e, payload)
+	return nil
+}
+
+// applyPayload is apply with the payload already decoded; it cannot fail, so record
+// decodes an event before appending it and applies it after
+func (m *model) applyPayload(e Event, payload any) {
+	cs := m.Clients[e.ClientID]
+
+	switch e.Type {
+	case ClientSaved:
+		d := payload.(*clientSavedData)
+		if cs != nil {
+			// History is not part of the saved state
+			d.Client.History = cs.History
+		}
+		m.Clients[e.ClientID] = &d.Client
+	case ClientDeleted:
+		delete(m.Clients, e.ClientID)
+	case ClientUpdated:
+		d := payload.(*clientUpdatedData)
+		if cs == nil {
+			return
+		}
+		if d.Update.Name != nil {
+			cs.Name = *d.Update.Name
+		}
+		if d.Update.WindowDays != nil {
+			cs.WindowDays = *d.Update.WindowDays
+		}
+		if d.Update.TimeZone != nil {
+			cs.TimeZone = *d.Update.TimeZone
+		}
+	case ClientSecretSet:
+		d := payload.(*clientSecretSetData)
+		if cs != nil {
+			cs.SecretHash = d.SecretHash
+		}
+	case UserAdded:
+		d := payload.(*userAddedData)
+		if cs == nil {
+			cs = &clientRecord{ID: e.ClientID, Name: e.ClientID}
+			m.Clients[e.ClientID] = cs
+		}
+		cs.Users = append(append([]userRecord(nil), cs.Users...), d.User)
+	case UserDeleted:
+		d := payload.(*userData)
+		if cs == nil {
+			return
+		}
+		cs.Users = without(cs.Users, func(u userRecord) bool { return u.ID == d.UserID })
+		cs.TemporaryAccessRequests = without(cs.TemporaryAccessRequests, func(t port.TemporaryAccessRequest) bool { return t.UserID == d.UserID })
+		cs.OverrideGrants = without(cs.OverrideGrants, func(g port.OverrideGrant) bool { return g.UserID == d.UserID })
+		cs.BlockRules = without(cs.BlockRules, func(br port.BlockRule) bool { return br.UserID == d.UserID })
+	case ScheduleUpdated:
+		d := payload.(*scheduleUpdatedData)
+		m.updateUser(e.ClientID, d.UserID, func(u *userRecord) { u.Schedule = d.Schedule })
+	case DateOverridesSet:
+		d := payload.(*dateOverridesSetData)
+		m.updateUser(e.ClientID, d.UserID, func(u *userRecord) {
+			overrides := make(domain.DateOverrides, len(u.Overrides)+len(d.Overrides))
+			for date, o := range u.Overrides {
+				overrides[date] = o
+			}
+			for date, o := range d.Overrides {
+				overrides[date] = o
+			}
+			u.Overrides = overrides
+		})
+	case DateOverrideDeleted:
+		d := payload.(*dateOverrideDeletedData)
+		m.updateUser(e.ClientID, d.UserID, func(u *userRecord) {
+			overrides := make(domain.DateOverrides, len(u.Overrides))
+			for date, o := range u.Overrides {
+				if date != d.Date {
+					overrides[date] = o
+				}
+			}
+			u.Overrides = overrides
+		})
+	case BudgetUpdated:
+		d := payload.(*budgetUpdatedData)
+		m.updateUser(e.ClientID, d.UserID, func(u *userRecord) { u.Budget = d.Budget })
+	case UsageAdded:
+		d := payload.(*usageAddedData)
+		if cs == nil {
+			return
+		}
+		for i := range cs.Users {
+			secs, ok := d.Seconds[cs.Users[i].Username]
+			if !ok {
+				continue
+			}
+			updated := make(domain.DailyUsage)
+			for date, s := range cs.Users[i].Usage {
+				if date >= d.Oldest {
+					updated[date] = s
+				}
+			}
+			updated[d.Date] += secs
+			cs.Users[i].Usage = updated
+		}
+	case PeriodsUpdated:
+		d := payload.(*periodsUpdatedData)
+		m.updateUser(e.ClientID, d.UserID, func(u *userRecord) { u.Periods = d.Periods })
+	case UserTemplateSet:
+		d := payload.(*userTemplateSetData)
+		m.updateUser(e.ClientID, d.UserID, func(u *userRecord) { u.TemplateID = d.TemplateID })
+	case TemplateSaved:
+		d := payload.(*templateSavedData)
+		m.Templates[d.Template.ID] = d.Template
+		m.bumpTemplateUsers(d.Template.ID, d.Versions, false)
+	case TemplateDeleted:
+		d := payload.(*templateDeletedData)
+		delete(m.Templates, d.TemplateID)
+		m.bumpTemplateUsers(d.TemplateID, d.Versions, true)
+	case AccessGranted:
+		d := payload.(*accessGrantedData)
+		if cs != nil {
+			r := d.Request
+			cs.TemporaryAccessRequests = appendActive(cs.TemporaryAccessRequests, r, func(t port.TemporaryAccessRequest) time.Time { return t.Until }, e.Time)
+			cs.recordHistory(port.HistoryTemporaryAccess, r.ID, r.UserID, r.Start, r.Until, r.Note, d.Admin, e.Time)
+		}
+	case AccessUpdated:
+		d := payload.(*accessUpdatedData)
+		if cs == nil {
+			return
+		}
+		updated := append([]port.TemporaryAccessRequest(nil), cs.TemporaryAccessRequests...)
+		for i := range updated {
+			if updated[i].ID == d.RequestID {
+				updated[i].Until = d.Until
+			}
+		}
+		cs.TemporaryAccessRequests = updated
+		cs.History = server.ExtendHistory(cs.History, d.RequestID, d.Until)
+	case AccessRevoked:
+		d := payload.(*requestData)
+		if cs != nil {
+			cs.TemporaryAccessRequests = without(cs.TemporaryAccessRequests, func(t port.TemporaryAccessRequest) bool { return t.ID == d.RequestID })
+			cs.History = server.CancelHistory(cs.History, d.RequestID, e.Time)
+		}
+	case OverrideGranted:
+		d := payload.(*overrideGrantedData)
+		if cs != nil {
+			g := d.Grant
+			cs.OverrideGrants = appendActive(cs.OverrideGrants, g, func(g port.OverrideGrant) time.Time { return g.Until }, e.Time)
+			cs.recordHistory(port.HistoryAlwaysAllow, g.ID, g.UserID, g.Start, g.Until, g.Reason, d.Admin, e.Time)
+		}
+	case OverrideRevoked:
+		d := payload.(*requestData)
+		if cs != nil {
+			cs.OverrideGrants = without(cs.OverrideGrants, func(g port.OverrideGrant) bool { return g.ID == d.RequestID })
+			cs.History = server.CancelHistory(cs.History, d.RequestID, e.Time)
+		}
+	case Blocked:
+		d := payload.(*blockedData)
+		if cs != nil {
+			b := d.Request
+			cs.BlockRequests = appendActive(cs.BlockRequests, b, func(b port.BlockRequest) time.Time { return b.Until }, e.Time)
+			cs.recordHistory(port.HistoryBlock, b.ID, b.UserID, b.Start, b.Until, b.Note, d.Admin, e.Time)
+		}
+	case Unblocked:
+		d := payload.(*requestData)
+		if cs != nil {
+			cs.BlockRequests = without(cs.BlockRequests, func(b port.BlockRequest) bool { return b.ID == d.RequestID })
+			cs.History = server.CancelHistory(cs.History, d.RequestID, e.Time)
+		}
+	case BlockRuleAdded:
+		d := payload.(*blockRuleAddedData)
+		if cs != nil {
+			cs.BlockRules = append(append([]port.BlockRule(nil), cs.BlockRules...), d.Rule)
+		}
+	case BlockRuleDeleted:
+		d := payload.(*requestData)
+		if cs != nil {
+			cs.BlockRules = without(cs.BlockRules, func(br port.BlockRule) bool { return br.ID == d.RequestID })
+		}
+	case VersionBumped:
+		d := payload.(*versionBumpedData)
+		if cs != nil {
+			cs.Version = d.Version
+		}
+	}
+}
+
+// bumpTemplateUsers sets the new config versions of clients whose users reference the
+// template; references to a deleted template are dropped
+func (m *model) bumpTemplateUsers(templateID string, versions map[string]string, deleted bool) {
+	for clientID, version := range versions {
+		cs, ok := m.Clients[clientID]
+		if !ok {
+			continue
+		}
+		cs.Version = version
+		if !deleted {
+			continue
+		}
+		users := append([]userRecord(nil), cs.Users...)
+		for i := range users {
+			if users[i].TemplateID == templateID {
+				users[i].TemplateID = ""
+			}
+		}
+		cs.Users = users
+	}
+}
+
+// templateUsers returns IDs of clients with a user referencing the template
+func (m *model) templateUsers(templateID string) []string {
+	var ids []string
+	for id, cs := range m.Clients {
+		for _, u := range cs.Users {
+			if u.TemplateID == templateID {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids
+}
@@ -0,0 +1,691 @@
+package eventlog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aegis/parental-control/internal/adapter/pubsub"
+	"github.com/aegis/parental-control/internal/domain"
+	"github.com/aegis/parental-control/internal/port"
+	"github.com/aegis/parental-control/internal/usecase/server"
+	"github.com/google/uuid"
+)
+
+const (
+	// usageRetentionDays is how many days of reported usage are kept per user
+	usageRetentionDays = 14
+	// defaultCompactEvery is how many events the current log holds before it is compacted
+	defaultCompactEvery = 1000
+	// defaultArchiveRetention is how far back ClientAt can rebuild past configs
+	defaultArchiveRetention = 90 * 24 * time.Hour
+)
+
+// Repository keeps state in memory and appends every change to dir/events.log.
+// Compaction writes dir/snapshot.json and moves the log to dir/archive.
+type Repository struct {
+	mu            sync.RWMutex
+	files         sync.RWMutex // held by ClientAt replays, which compaction must not move files under
+	dir           string
+	log           *os.File
+	seq           uint64    // last written event
+	lastTime      time.Time // time of the last written event
+	segmentEvents int       // events in the current log
+	compactEvery  int
+	retention     time.Duration // archive kept for ClientAt
+	state         *model
+	computed      map[string]*domain.ClientConfig
+	lastSent      map[string]map[string][]domain.AllowedInterval
+	hub           *pubsub.Hub
+	loc           *time.Location
+}
+
+// New opens the event log in dir (created if missing) and rebuilds state from it
+func New(dir string, loc *time.Location) (*Repository, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	if err := os.MkdirAll(filepath.Join(dir, archiveDir), 0755); err != nil {
+		return nil, err
+	}
+	r := &Repository{
+		dir:          dir,
+		compactEvery: defaultCompactEvery,
+		retention:    defaultArchiveRetention,
+		computed:     make(map[string]*domain.ClientConfig),
+		lastSent:     make(map[string]map[string][]domain.AllowedInterval),
+		hub:          pubsub.New(pubsub.DefaultCoalesce),
+		loc:          loc,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Repository) load() error {
+	path := filepath.Join(r.dir, logFile)
+	// Drop a torn last line left by a crash during append
+	n, err := readEvents(path, func(Event) error {
+		r.segmentEvents++
+		return nil
+	})
+	switch {
+	case err == nil:
+		if fi, err := os.Stat(path); err == nil && fi.Size() > n {
+			log.Printf("Event log %s: dropping %d bytes of incomplete last event", path, fi.Size()-n)
+			if err := os.Truncate(path, n); err != nil {
+				return err
+			}
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	state, seq, lastTime, err := replay(r.dir, time.Time{})
+	if err != nil {
+		return err
+	}
+	r.state, r.seq, r.lastTime = state, seq, lastTime
+	r.log, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	return err
+}
+
+// Close closes the event log; the repository must not be used afterwards
+func (r *Repository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.log.Close()
+}
+
+func (r *Repository) now() time.Time {
+	return time.Now().In(r.loc)
+}
+
+// record appends an event, syncs it to disk and applies it to the state. The event is
+// decoded first: one that replay could not apply never reaches the log.
+// Must be called with r.mu held.
+func (r *Repository) record(typ EventType, clientID string, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	// Event times never go backwards, so replay up to a moment stops at the right event
+	at := r.now()
+	if at.Before(r.lastTime) {
+		at = r.lastTime
+	}
+	e := Event{Seq: r.seq + 1, Time: at, Type: typ, ClientID: clientID, Data: raw}
+	payload, err := decode(e)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	fi, err := r.log.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := r.log.Write(append(line, '\n')); err != nil {
+		r.log.Truncate(fi.Size()) // do not leave a partial line before the next event
+		return err
+	}
+	if err := r.log.Sync(); err != nil {
+		return err
+	}
+	r.seq, r.lastTime = e.Seq, e.Time
+	r.segmentEvents++
+	r.state.applyPayload(e, payload)
+	// While ClientAt replays, compaction waits for one of the next events
+	if r.segmentEvents >= r.compactEvery && r.files.TryLock() {
+		err := r.compactLocked()
+		r.files.Unlock()
+		if err != nil {
+			log.Printf("Compact event log: %v", err)
+		}
+	}
+	return nil
+}
+
+// recompute refreshes the precomputed config of client; must be called with r.mu held
+func (r *Repository) recompute(clientID string) {
+	cs, ok := r.state.Clients[clientID]
+	if !ok {
+		delete(r.computed, clientID)
+		return
+	}
+	now := r.now()
+	config, _ := server.ComputeClientConfig(now, r.state.portState(cs, now), true)
+	r.computed[clientID] = &config
+}
+
+// changed recomputes client's config and wakes its long-polls
+func (r *Repository) changed(clientID string) {
+	r.recompute(clientID)
+	r.notify(clientID)
+}
+
+func (r *Repository) notify(clientID string) {
+	r.hub.Publish(clientID)
+}
+
+func (r *Repository) hasUser(clientID, userID string) bool {
+	cs, ok := r.state.Clients[clientID]
+	if !ok {
+		return false
+	}
+	for _, u := range cs.Users {
+		if u.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Repository) portState(clientID string) *port.ClientState {
+	now := r.now()
+	state := r.state.portState(r.state.Clients[clientID], now)
+	state.ComputedConfig = r.computed[clientID]
+	state.LastSentIntervals = make(map[string][]domain.AllowedInterval)
+	for k, v := range r.lastSent[clientID] {
+		state.LastSentIntervals[k] = append([]domain.AllowedInterval(nil), v...)
+	}
+	return state
+}
+
+func (r *Repository) GetClient(ctx context.Context, clientID string) (*port.ClientState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return nil, nil
+	}
+	if r.computed[clientID] == nil {
+		r.recompute(clientID)
+	}
+	return r.portState(clientID), nil
+}
+
+func (r *Repository) History(ctx context.Context, clientID string) ([]port.HistoryEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cs, ok := r.state.Clients[clientID]
+	if !ok {
+		return nil, nil
+	}
+	result := make([]port.HistoryEntry, 0, len(cs.History))
+	for i := len(cs.History) - 1; i >= 0; i-- {
+		result = append(result, cs.History[i])
+	}
+	return result, nil
+}
+
+func (r *Repository) GetAllClients(ctx context.Context) ([]*port.ClientState, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var result []*port.ClientState
+	for id := range r.state.Clients {
+		result = append(result, r.portState(id))
+	}
+	return result, nil
+}
+
+func (r *Repository) SaveClient(ctx context.Context, client *port.ClientState) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Generate version if missing
+	if client.LastSentVersion == "" {
+		client.LastSentVersion = uuid.New().String()
+	}
+	if err := r.record(ClientSaved, client.ID, clientSavedData{Client: toClientRecord(client)}); err != nil {
+		return err
+	}
+	r.lastSent[client.ID] = client.LastSentIntervals
+	r.recompute(client.ID)
+	return nil
+}
+
+func (r *Repository) DeleteClient(ctx context.Context, clientID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return nil
+	}
+	if err := r.record(ClientDeleted, clientID, struct{}{}); err != nil {
+		return err
+	}
+	delete(r.computed, clientID)
+	delete(r.lastSent, clientID)
+	r.notify(clientID) // waiting long-polls find the client gone
+	return nil
+}
+
+func (r *Repository) UpdateClient(ctx context.Context, clientID string, update port.ClientUpdate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return port.ErrClientNotFound
+	}
+	if err := r.record(ClientUpdated, clientID, clientUpdatedData{Update: update}); err != nil {
+		return err
+	}
+	r.changed(clientID)
+	return nil
+}
+
+func (r *Repository) SetClientSecret(ctx context.Context, clientID, secretHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return port.ErrClientNotFound
+	}
+	if err := r.record(ClientSecretSet, clientID, clientSecretSetData{SecretHash: secretHash}); err != nil {
+		return err
+	}
+	r.notify(clientID) // waiting long-polls re-check the secret
+	return nil
+}
+
+func (r *Repository) AddUser(ctx context.Context, clientID string, user domain.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if user.ID == "" {
+		user.ID = uuid.New().String()
+	}
+	if err := r.record(UserAdded, clientID, userAddedData{User: toUserRecord(user)}); err != nil {
+		return err
+	}
+	r.changed(clientID)
+	return nil
+}
+
+// updateUser records an event about an existing user; missing client or user is ignored
+func (r *Repository) updateUser(clientID, userID string, typ EventType, data any) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.hasUser(clientID, userID) {
+		return nil
+	}
+	if err := r.record(typ, clientID, data); err != nil {
+		return err
+	}
+	r.changed(clientID)
+	return nil
+}
+
+func (r *Repository) UpdateUserSchedule(ctx context.Context, clientID, userID string, schedule domain.DaySchedule) error {
+	return r.updateUser(clientID, userID, ScheduleUpdated, scheduleUpdatedData{UserID: userID, Schedule: schedule})
+}
+
+func (r *Repository) SetDateOverride(ctx context.Context, clientID, userID, date string, override domain.DateOverride) error {
+	return r.SetDateOverrides(ctx, clientID, userID, domain.DateOverrides{date: override})
+}
+
+func (r *Repository) SetDateOverrides(ctx context.Context, clientID, userID string, overrides domain.DateOverrides) error {
+	return r.updateUser(clientID, userID, DateOverridesSet, dateOverridesSetData{UserID: userID, Overrides: overrides})
+}
+
+func (r *Repository) DeleteDateOverride(ctx context.Context, clientID, userID, date string) error {
+	return r.updateUser(clientID, userID, DateOverrideDeleted, dateOverrideDeletedData{UserID: userID, Date: date})
+}
+
+func (r *Repository) UpdateUserBudget(ctx context.Context, clientID, userID string, budget domain.DailyBudget) error {
+	return r.updateUser(clientID, userID, BudgetUpdated, budgetUpdatedData{UserID: userID, Budget: budget})
+}
+
+func (r *Repository) UpdateUserPeriods(ctx context.Context, clientID, userID string, periods []domain.SchedulePeriod) error {
+	return r.updateUser(clientID, userID, PeriodsUpdated, periodsUpdatedData{UserID: userID, Periods: periods})
+}
+
+func (r *Repository) SetUserTemplate(ctx context.Context, clientID, userID, templateID string) error {
+	return r.updateUser(clientID, userID, UserTemplateSet, userTemplateSetData{UserID: userID, TemplateID: templateID})
+}
+
+func (r *Repository) DeleteUser(ctx context.Context, clientID, userID string) error {
+	return r.updateUser(clientID, userID, UserDeleted, userData{UserID: userID})
+}
+
+func (r *Repository) AddUsage(ctx context.Context, clientID string, usage map[string]time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.state.Clients[clientID]
+	if !ok {
+		return nil
+	}
+	now := r.now()
+	// Usage is attributed to the client's local date
+	if loc := server.ClientLocation(cs.TimeZone); loc != nil {
+		now = now.In(loc)
+	}
+	d := usageAddedData{
+		Date:    now.Format(domain.DateLayout),
+		Oldest:  now.AddDate(0, 0, -usageRetentionDays).Format(domain.DateLayout),
+		Seconds: make(map[string]int, len(usage)),
+	}
+	for username, used := range usage {
+		d.Seconds[username] = int(used / time.Second)
+	}
+	if err := r.record(UsageAdded, clientID, d); err != nil {
+		return err
+	}
+	r.recompute(clientID)
+	return nil
+}
+
+func (r *Repository) ListTemplates(ctx context.Context) ([]domain.ScheduleTemplate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make([]domain.ScheduleTemplate, 0, len(r.state.Templates))
+	for _, t := range r.state.Templates {
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func (r *Repository) GetTemplate(ctx context.Context, templateID string) (*domain.ScheduleTemplate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.state.Templates[templateID]
+	if !ok {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+// templateVersions generates new config versions for clients using the template
+func (r *Repository) templateVersions(templateID string) map[string]string {
+	versions := make(map[string]string)
+	for _, id := range r.state.templateUsers(templateID) {
+		versions[id] = uuid.New().String()
+	}
+	return versions
+}
+
+func (r *Repository) SaveTemplate(ctx context.Context, template domain.ScheduleTemplate) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if template.ID == "" {
+		template.ID = uuid.New().String()
+	}
+	versions := r.templateVersions(template.ID)
+	if err := r.record(TemplateSaved, "", templateSavedData{Template: template, Versions: versions}); err != nil {
+		return "", err
+	}
+	for id := range versions {
+		r.changed(id)
+	}
+	return template.ID, nil
+}
+
+func (r *Repository) DeleteTemplate(ctx context.Context, templateID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Templates[templateID]; !ok {
+		return nil
+	}
+	versions := r.templateVersions(templateID)
+	if err := r.record(TemplateDeleted, "", templateDeletedData{TemplateID: templateID, Versions: versions}); err != nil {
+		return err
+	}
+	for id := range versions {
+		r.changed(id)
+	}
+	return nil
+}
+
+// updateClient records an event about an existing client; missing client is ignored
+func (r *Repository) updateClient(clientID string, typ EventType, data any) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return nil
+	}
+	if err := r.record(typ, clientID, data); err != nil {
+		return err
+	}
+	r.changed(clientID)
+	return nil
+}
+
+// updateListed records an event about an existing entry of client's list
+func (r *Repository) updateListed(clientID string, exists func(*clientRecord) bool, typ EventType, data any) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.state.Clients[clientID]
+	if !ok || !exists(cs) {
+		return nil
+	}
+	if err := r.record(typ, clientID, data); err != nil {
+		return err
+	}
+	r.changed(clientID)
+	return nil
+}
+
+func hasID[T any](list []T, id func(T) string, want string) bool {
+	for _, item := range list {
+		if id(item) == want {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Repository) GrantTemporaryAccess(ctx context.Context, clientID, userID string, start, until time.Time, note, admin string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return port.ErrClientNotFound
+	}
+	req := port.TemporaryAccessRequest{ID: uuid.New().String(), UserID: userID, Start: start, Until: until, Note: note}
+	if err := r.record(AccessGranted, clientID, accessGrantedData{Request: req, Admin: admin}); err != nil {
+		return err
+	}
+	r.changed(clientID)
+	return nil
+}
+
+func (r *Repository) UpdateTemporaryAccess(ctx context.Context, clientID, requestID string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.state.Clients[clientID]
+	if !ok {
+		return nil
+	}
+	for _, t := range cs.TemporaryAccessRequests {
+		if t.ID != requestID {
+			continue
+		}
+		if !until.After(t.Start) || !until.After(r.now()) {
+			return port.ErrInvalidUntil
+		}
+		if err := r.record(AccessUpdated, clientID, accessUpdatedData{RequestID: requestID, Until: until}); err != nil {
+			return err
+		}
+		r.changed(clientID)
+		return nil
+	}
+	return nil
+}
+
+func (r *Repository) DeleteTemporaryAccessRequest(ctx context.Context, clientID, requestID string) error {
+	return r.updateListed(clientID, func(cs *clientRecord) bool {
+		return hasID(cs.TemporaryAccessRequests, func(t port.TemporaryAccessRequest) string { return t.ID }, requestID)
+	}, AccessRevoked, requestData{RequestID: requestID})
+}
+
+func (r *Repository) GrantOverride(ctx context.Context, clientID, userID string, start, until time.Time, priority int, reason, admin string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return port.ErrClientNotFound
+	}
+	grant := port.OverrideGrant{ID: uuid.New().String(), UserID: userID, Start: start, Until: until, Priority: priority, Reason: reason}
+	if err := r.record(OverrideGranted, clientID, overrideGrantedData{Grant: grant, Admin: admin}); err != nil {
+		return err
+	}
+	r.changed(clientID)
+	return nil
+}
+
+func (r *Repository) DeleteOverrideGrant(ctx context.Context, clientID, grantID string) error {
+	return r.updateListed(clientID, func(cs *clientRecord) bool {
+		return hasID(cs.OverrideGrants, func(g port.OverrideGrant) string { return g.ID }, grantID)
+	}, OverrideRevoked, requestData{RequestID: grantID})
+}
+
+func (r *Repository) BlockClient(ctx context.Context, clientID, userID string, start, until time.Time, priority int, note, admin string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return port.ErrClientNotFound
+	}
+	req := port.BlockRequest{ID: uuid.New().String(), UserID: userID, Start: start, Until: until, Priority: priority, Note: note}
+	if err := r.record(Blocked, clientID, blockedData{Request: req, Admin: admin}); err != nil {
+		return err
+	}
+	r.changed(clientID)
+	return nil
+}
+
+func (r *Repository) DeleteBlockRequest(ctx context.Context, clientID, requestID string) error {
+	return r.updateListed(clientID, func(cs *clientRecord) bool {
+		return hasID(cs.BlockRequests, func(b port.BlockRequest) string { return b.ID }, requestID)
+	}, Unblocked, requestData{RequestID: requestID})
+}
+
+func (r *Repository) AddBlockRule(ctx context.Context, clientID string, rule port.BlockRule) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return "", port.ErrClientNotFound
+	}
+	rule.ID = uuid.New().String()
+	if err := r.record(BlockRuleAdded, clientID, blockRuleAddedData{Rule: rule}); err != nil {
+		return "", err
+	}
+	r.changed(clientID)
+	return rule.ID, nil
+}
+
+func (r *Repository) DeleteBlockRule(ctx context.Context, clientID, ruleID string) error {
+	return r.updateListed(clientID, func(cs *clientRecord) bool {
+		return hasID(cs.BlockRules, func(br port.BlockRule) string { return br.ID }, ruleID)
+	}, BlockRuleDeleted, requestData{RequestID: ruleID})
+}
+
+// UpdateLastSent keeps last sent intervals in memory only: they are not part of the history
+func (r *Repository) UpdateLastSent(ctx context.Context, clientID string, intervals map[string][]domain.AllowedInterval) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; !ok {
+		return nil
+	}
+	lastSent := make(map[string][]domain.AllowedInterval)
+	for k, v := range intervals {
+		lastSent[k] = append([]domain.AllowedInterval(nil), v...)
+	}
+	r.lastSent[clientID] = lastSent
+	return nil
+}
+
+func (r *Repository) IncrementConfigVersion(ctx context.Context, clientID string) error {
+	return r.updateClient(clientID, VersionBumped, versionBumpedData{Version: uuid.New().String()})
+}
+
+// RecomputeConfig is not an event: computed configs are derived from the state
+func (r *Repository) RecomputeConfig(ctx context.Context, clientID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.state.Clients[clientID]; ok {
+		r.recompute(clientID)
+	}
+	return nil
+}
+
+func (r *Repository) Subscribe(ctx context.Context, clientID string) <-chan struct{} {
+	return r.hub.Subscribe(ctx, clientID)
+}
+
+// Subscribers returns the number of long-polls waiting for changes of the client
+func (r *Repository) Subscribers(clientID string) int {
+	return r.hub.Subscribers(clientID)
+}
+
+// Compact writes a snapshot of the current state and moves the log to the archive,
+// so startup replays only events written after it. It also runs every compactEvery events.
+func (r *Repository) Compact() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files.Lock()
+	defer r.files.Unlock()
+	return r.compactLocked()
+}
+
+func (r *Repository) compactLocked() error {
+	if r.segmentEvents == 0 {
+		return nil
+	}
+	data, err := json.Marshal(snapshot{Seq: r.seq, Time: r.lastTime, State: r.state})
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(r.dir, snapshotFile), data); err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(r.dir, archiveDir, archivedSnapshotName(r.seq, r.lastTime)), data); err != nil {
+		return err
+	}
+	// The log is already covered by the snapshot: a crash from here on only delays archiving
+	path := filepath.Join(r.dir, logFile)
+	var first uint64
+	if _, err := readEvents(path, func(e Event) error {
+		first = e.Seq
+		return errStop
+	}); err != nil && !errors.Is(err, errStop) {
+		return err
+	}
+	if err := r.log.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(path, filepath.Join(r.dir, archiveDir, segmentName(first)))
+	r.log, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.segmentEvents = 0
+	return pruneArchive(r.dir, r.now().Add(-r.retention))
+}
+
+// ClientAt returns the client as it was at t, with config computed as if it were t;
+// nil if the client did not exist then. port.ErrHistoryUnavailable if the archive
+// no longer reaches back to t.
+func (r *Repository) ClientAt(ctx context.Context, clientID string, t time.Time) (*port.ClientState, error) {
+	// Only the files lock: events keep being written while the replay reads the log
+	r.files.RLock()
+	defer r.files.RUnlock()
+	m, _, _, err := replay(r.dir, t)
+	if err != nil {
+		return nil, fmt.Errorf("replay to %s: %w", t.Format(time.RFC3339), err)
+	}
+	cs, ok := m.Clients[clientID]
+	if !ok {
+		return nil, nil
+	}
+	state := m.portState(cs, t)
+	config, _ := server.ComputeClientConfig(t, state, true)
+	state.ComputedConfig = &config
+	return state, nil
+}
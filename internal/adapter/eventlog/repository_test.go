@@ -0,0 +1,297 @@
+package eventlog
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+	"github.com/aegis/parental-control/internal/port"
+)
+
+func open(t *testing.T, dir string) *Repository {
+	t.Helper()
+	r, err := New(dir, time.UTC)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// populate makes one change of most kinds and returns the user ID
+func populate(t *testing.T, r *Repository) string {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(r.SaveClient(ctx, &port.ClientState{ID: "pc", Name: "Детская", TimeZone: "Europe/Moscow"}))
+	must(r.AddUser(ctx, "pc", domain.User{ID: "u1", Name: "Петя", Username: "petya", Schedule: domain.DaySchedule{"monday": {{Start: "09:00", End: "12:00"}}}}))
+	must(r.AddUser(ctx, "pc", domain.User{ID: "u2", Username: "masha"}))
+	must(r.SetClientSecret(ctx, "pc", "secret-hash"))
+	windowDays := 3
+	must(r.UpdateClient(ctx, "pc", port.ClientUpdate{WindowDays: &windowDays}))
+	must(r.UpdateUserSchedule(ctx, "pc", "u1", domain.DaySchedule{"tuesday": {{Start: "10:00", End: "11:00"}}}))
+	must(r.SetDateOverrides(ctx, "pc", "u1", domain.DateOverrides{"2026-12-31": {}, "2027-01-01": {}}))
+	must(r.DeleteDateOverride(ctx, "pc", "u1", "2026-12-31"))
+	must(r.UpdateUserBudget(ctx, "pc", "u1", domain.DailyBudget{"monday": 60}))
+	must(r.AddUsage(ctx, "pc", map[string]time.Duration{"petya": 5 * time.Minute}))
+	tid, err := r.SaveTemplate(ctx, domain.ScheduleTemplate{Name: "Будни", Schedule: domain.DaySchedule{"friday": {{Start: "18:00", End: "20:00"}}}})
+	must(err)
+	must(r.SetUserTemplate(ctx, "pc", "u1", tid))
+	must(r.GrantTemporaryAccess(ctx, "pc", "u1", now, now.Add(time.Hour), "уроки", "mom"))
+	must(r.GrantOverride(ctx, "pc", "u1", now, now.Add(time.Hour), 2, "врач", "mom"))
+	must(r.BlockClient(ctx, "pc", "", now, now.Add(30*time.Minute), 1, "", "mom"))
+	_, err = r.AddBlockRule(ctx, "pc", port.BlockRule{WeeklyRange: domain.WeeklyRange{Days: []string{"monday"}, Start: "16:00", End: "18:00"}})
+	must(err)
+	must(r.DeleteUser(ctx, "pc", "u2"))
+	must(r.IncrementConfigVersion(ctx, "pc"))
+	return "u1"
+}
+
+// comparable drops fields that are not part of the persisted state
+func comparable(s *port.ClientState) *port.ClientState {
+	c := *s
+	c.ComputedConfig = nil
+	c.LastSentIntervals = nil
+	return &c
+}
+
+func TestReplay_RestoresState(t *testing.T) {
+	dir := t.TempDir()
+	r := open(t, dir)
+	populate(t, r)
+	want, _ := r.GetClient(context.Background(), "pc")
+	if len(want.Users) != 1 || want.Users[0].TemplateID == "" || len(want.OverrideGrants) != 1 || len(want.BlockRules) != 1 || want.SecretHash != "secret-hash" || want.WindowDays != 3 || want.TimeZone != "Europe/Moscow" {
+		t.Fatalf("unexpected state before reopen: %+v", want)
+	}
+	if want.ComputedConfig == nil || want.ComputedConfig.Version != want.LastSentVersion {
+		t.Fatalf("config not computed for the current version: %+v", want.ComputedConfig)
+	}
+	if err := r.SetClientSecret(context.Background(), "missing", "x"); !errors.Is(err, port.ErrClientNotFound) {
+		t.Errorf("secret of a missing client: %v, want ErrClientNotFound", err)
+	}
+	grant := want.TemporaryAccessRequests[0]
+	if err := r.UpdateTemporaryAccess(context.Background(), "pc", grant.ID, grant.Start); !errors.Is(err, port.ErrInvalidUntil) {
+		t.Errorf("until at start: %v, want ErrInvalidUntil", err)
+	}
+	r.Close()
+
+	got, _ := open(t, dir).GetClient(context.Background(), "pc")
+	if !reflect.DeepEqual(comparable(got), comparable(want)) {
+		t.Errorf("after replay:\n got %+v\nwant %+v", comparable(got), comparable(want))
+	}
+}
+
+func TestCompaction_KeepsStateAndHistory(t *testing.T) {
+	dir := t.TempDir()
+	r := open(t, dir)
+	r.compactEvery = 4
+	populate(t, r)
+	if err := r.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := r.GetClient(context.Background(), "pc")
+	segments, _ := archivedSegments(dir)
+	if len(segments) < 2 {
+		t.Fatalf("expected several archived segments, got %v", segments)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, logFile)); err != nil || fi.Size() != 0 {
+		t.Fatalf("log not emptied by compaction: %v, %v", fi, err)
+	}
+	r.Close()
+
+	r = open(t, dir)
+	got, _ := r.GetClient(context.Background(), "pc")
+	if !reflect.DeepEqual(comparable(got), comparable(want)) {
+		t.Errorf("after reopen from snapshot:\n got %+v\nwant %+v", comparable(got), comparable(want))
+	}
+	// New events continue the sequence after the snapshot
+	if err := r.IncrementConfigVersion(context.Background(), "pc"); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if got, _ := open(t, dir).GetClient(context.Background(), "pc"); got.LastSentVersion == want.LastSentVersion {
+		t.Error("event after snapshot was not replayed")
+	}
+}
+
+func TestClientAt(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := open(t, dir)
+	before := time.Now()
+	populate(t, r)
+	middle := time.Now()
+	if err := r.UpdateUserSchedule(ctx, "pc", "u1", domain.DaySchedule{"sunday": {{Start: "00:00", End: "23:59"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteClient(ctx, "pc"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string) {
+		t.Helper()
+		if s, err := r.ClientAt(ctx, "pc", before); err != nil || s != nil {
+			t.Errorf("%s: before creation got %+v, %v", name, s, err)
+		}
+		s, err := r.ClientAt(ctx, "pc", middle)
+		if err != nil || s == nil {
+			t.Fatalf("%s: at middle got %v, %v", name, s, err)
+		}
+		if _, ok := s.Users[0].Schedule["tuesday"]; !ok || s.ComputedConfig == nil {
+			t.Errorf("%s: at middle got schedule %v, config %v", name, s.Users[0].Schedule, s.ComputedConfig)
+		}
+		if s, err := r.ClientAt(ctx, "pc", time.Now()); err != nil || s != nil {
+			t.Errorf("%s: after deletion got %+v, %v", name, s, err)
+		}
+	}
+	check("log only")
+	if err := r.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction")
+
+	// Without the archive only moments after the snapshot can be rebuilt
+	os.RemoveAll(filepath.Join(dir, archiveDir))
+	if _, err := r.ClientAt(ctx, "pc", middle); !errors.Is(err, port.ErrHistoryUnavailable) {
+		t.Errorf("without archive got %v, want ErrHistoryUnavailable", err)
+	}
+	if _, err := r.ClientAt(ctx, "pc", time.Now()); err != nil {
+		t.Errorf("after snapshot: %v", err)
+	}
+}
+
+func TestClientAt_ArchivedSnapshotsAndRetention(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := open(t, dir)
+	populate(t, r)
+	if err := r.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	middle := time.Now()
+	if err := r.UpdateUserSchedule(ctx, "pc", "u1", domain.DaySchedule{"sunday": {{Start: "00:00", End: "23:59"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A moment after an archived snapshot replays from it, not from the first event
+	segments, _ := archivedSegments(dir)
+	os.Remove(segments[0])
+	s, err := r.ClientAt(ctx, "pc", middle)
+	if err != nil || s == nil {
+		t.Fatalf("at middle got %v, %v", s, err)
+	}
+	if _, ok := s.Users[0].Schedule["tuesday"]; !ok {
+		t.Errorf("at middle got schedule %v", s.Users[0].Schedule)
+	}
+
+	// Past the retention only the newest snapshot before the cutoff is kept
+	r.retention = 0
+	if err := r.UpdateUserSchedule(ctx, "pc", "u1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, _ := archivedSnapshots(dir)
+	if segments, _ := archivedSegments(dir); len(snapshots) != 1 || len(segments) != 1 {
+		t.Errorf("after pruning got %d snapshots, %d segments", len(snapshots), len(segments))
+	}
+	if _, err := r.ClientAt(ctx, "pc", middle); !errors.Is(err, port.ErrHistoryUnavailable) {
+		t.Errorf("before retention got %v, want ErrHistoryUnavailable", err)
+	}
+	if s, err := r.ClientAt(ctx, "pc", time.Now()); err != nil || s == nil {
+		t.Errorf("now got %v, %v", s, err)
+	}
+}
+
+func TestRecord_RejectsInvalidEvent(t *testing.T) {
+	dir := t.TempDir()
+	r := open(t, dir)
+	populate(t, r)
+	seq := r.seq
+	for typ, data := range map[EventType]any{"Unknown": struct{}{}, UserAdded: "not an object"} {
+		r.mu.Lock()
+		err := r.record(typ, "pc", data)
+		r.mu.Unlock()
+		if err == nil || r.seq != seq {
+			t.Errorf("%s: got %v at seq %d, want an error at seq %d", typ, err, r.seq, seq)
+		}
+	}
+	// Nothing was appended, so the log still loads
+	open(t, dir)
+}
+
+func TestLoad_DropsTornLastEvent(t *testing.T) {
+	dir := t.TempDir()
+	r := open(t, dir)
+	populate(t, r)
+	want, _ := r.GetClient(context.Background(), "pc")
+	r.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":99,"time":"2026-`)
+	f.Close()
+
+	r = open(t, dir)
+	got, _ := r.GetClient(context.Background(), "pc")
+	if !reflect.DeepEqual(comparable(got), comparable(want)) {
+		t.Fatalf("torn event changed state:\n got %+v\nwant %+v", comparable(got), comparable(want))
+	}
+	// The log stays appendable
+	if err := r.DeleteUser(context.Background(), "pc", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if got, _ := open(t, dir).GetClient(context.Background(), "pc"); len(got.Users) != 0 {
+		t.Errorf("event after torn tail lost: %+v", got.Users)
+	}
+}
+
+func TestHistory_SurvivesReplayAndCompaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := open(t, dir)
+	populate(t, r)
+	c, _ := r.GetClient(ctx, "pc")
+	if err := r.DeleteBlockRequest(ctx, "pc", c.BlockRequests[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := r.History(ctx, "pc")
+	if len(want) != 3 || want[0].Type != port.HistoryBlock || want[0].CancelledAt == nil {
+		t.Fatalf("history %+v", want)
+	}
+	if ta := want[2]; ta.Type != port.HistoryTemporaryAccess || ta.Username != "petya" || ta.Note != "уроки" || ta.Admin != "mom" {
+		t.Errorf("temporary access entry %+v", ta)
+	}
+	// Saving the client does not touch its history
+	c.Name = "Гостиная"
+	if err := r.SaveClient(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	got, _ := open(t, dir).History(ctx, "pc")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after reopen:\n got %+v\nwant %+v", got, want)
+	}
+}
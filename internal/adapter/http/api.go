@@ -2,28 +2,69 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/aegis/parental-control/internal/adapter/auth"
+	"github.com/aegis/parental-control/internal/adapter/ical"
 	"github.com/aegis/parental-control/internal/domain"
 	"github.com/aegis/parental-control/internal/port"
+	"github.com/aegis/parental-control/internal/usecase/server"
 	"github.com/google/uuid"
 )
 
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
+	// Polled by the agents on the managed computers, which have no admin session
 	mux.HandleFunc("GET /api/config", h.ServeConfig)
-	mux.HandleFunc("GET /api/clients", h.ListClients)
-	mux.HandleFunc("POST /api/clients", h.CreateClient)
-	mux.HandleFunc("GET /api/clients/{id}", h.GetClient)
-	mux.HandleFunc("GET /api/clients/{id}/preview", h.GetClientPreview)
-	mux.HandleFunc("DELETE /api/clients/{id}", h.DeleteClient)
-	mux.HandleFunc("POST /api/clients/{id}/users", h.AddUser)
-	mux.HandleFunc("PUT /api/clients/{id}/users/{uid}/schedule", h.UpdateSchedule)
-	mux.HandleFunc("DELETE /api/clients/{id}/users/{uid}", h.DeleteUser)
-	mux.HandleFunc("POST /api/clients/{id}/temporary-access", h.TemporaryAccess)
-	mux.HandleFunc("DELETE /api/clients/{id}/temporary-access/{rid}", h.DeleteTemporaryAccess)
-	mux.HandleFunc("POST /api/clients/{id}/block", h.Block)
-	mux.HandleFunc("DELETE /api/clients/{id}/block/{rid}", h.DeleteBlock)
+	mux.HandleFunc("POST /api/usage", h.ReportUsage)
+	if h.signer != nil {
+		mux.HandleFunc("GET /api/signing-key", h.SigningKey)
+	}
+	// Calendar apps subscribe with a feed token instead of a session
+	mux.HandleFunc("GET /api/clients/{id}/users/{uid}/calendar.ics", h.requireFeedToken(h.ExportCalendar))
+	h.registerAuthRoutes(mux)
+
+	// Everything else is for admins only
+	handle := func(pattern string, f http.HandlerFunc) { mux.HandleFunc(pattern, h.requireAdmin(f)) }
+	handle("GET /api/clients", h.ListClients)
+	handle("POST /api/clients", h.CreateClient)
+	handle("GET /api/clients/{id}", h.GetClient)
+	handle("GET /api/clients/{id}/preview", h.GetClientPreview)
+	handle("GET /api/clients/{id}/config-at", h.ConfigAt)
+	handle("GET /api/clients/{id}/history", h.History)
+	handle("PATCH /api/clients/{id}", h.UpdateClient)
+	handle("DELETE /api/clients/{id}", h.DeleteClient)
+	handle("POST /api/clients/{id}/secret", h.RotateClientSecret)
+	handle("DELETE /api/clients/{id}/secret", h.RevokeClientSecret)
+	handle("POST /api/clients/{id}/users", h.AddUser)
+	handle("PUT /api/clients/{id}/users/{uid}/schedule", h.UpdateSchedule)
+	handle("PUT /api/clients/{id}/users/{uid}/template", h.SetUserTemplate)
+	handle("PUT /api/clients/{id}/users/{uid}/periods", h.UpdatePeriods)
+	handle("PUT /api/clients/{id}/users/{uid}/overrides/{date}", h.SetDateOverride)
+	handle("DELETE /api/clients/{id}/users/{uid}/overrides/{date}", h.DeleteDateOverride)
+	handle("POST /api/clients/{id}/calendar-import", h.ImportCalendar)
+	handle("GET /api/clients/{id}/users/{uid}/explain", h.Explain)
+	handle("POST /api/clients/{id}/simulate", h.Simulate)
+	handle("PUT /api/clients/{id}/users/{uid}/budget", h.UpdateBudget)
+	handle("DELETE /api/clients/{id}/users/{uid}", h.DeleteUser)
+	handle("POST /api/clients/{id}/temporary-access", h.TemporaryAccess)
+	handle("PATCH /api/clients/{id}/temporary-access/{rid}", h.UpdateTemporaryAccess)
+	handle("DELETE /api/clients/{id}/temporary-access/{rid}", h.DeleteTemporaryAccess)
+	handle("POST /api/clients/{id}/always-allow", h.AlwaysAllow)
+	handle("DELETE /api/clients/{id}/always-allow/{rid}", h.DeleteAlwaysAllow)
+	handle("POST /api/clients/{id}/block", h.Block)
+	handle("DELETE /api/clients/{id}/block/{rid}", h.DeleteBlock)
+	handle("POST /api/clients/{id}/block-rules", h.AddBlockRule)
+	handle("DELETE /api/clients/{id}/block-rules/{rid}", h.DeleteBlockRule)
+	handle("GET /api/templates", h.ListTemplates)
+	handle("POST /api/templates", h.CreateTemplate)
+	handle("PUT /api/templates/{tid}", h.UpdateTemplate)
+	handle("DELETE /api/templates/{tid}", h.DeleteTemplate)
 }
 
 func (h *Handler) ListClients(w http.ResponseWriter, r *http.Request) {
@@ -33,12 +74,19 @@ func (h *Handler) ListClients(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	type clientInfo struct {
-		ID   string `json:"id"`
-		Name string `json:"name"`
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		Subscribers *int   `json:"subscribers,omitempty"` // long-polls waiting now: the computer is online
 	}
+	counter, _ := h.repo.(port.SubscriberCounter)
 	result := make([]clientInfo, 0, len(clients))
 	for _, c := range clients {
-		result = append(result, clientInfo{ID: c.ID, Name: c.Name})
+		info := clientInfo{ID: c.ID, Name: c.Name}
+		if counter != nil {
+			n := counter.Subscribers(c.ID)
+			info.Subscribers = &n
+		}
+		result = append(result, info)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
@@ -46,12 +94,27 @@ func (h *Handler) ListClients(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) CreateClient(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Name string `json:"name"`
+		Name       string `json:"name"`
+		WindowDays int    `json:"window_days,omitempty"`
+		TimeZone   string `json:"time_zone,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := validateWindowDays(req.WindowDays); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTimeZone(req.TimeZone); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret, secretHash, err := auth.NewClientSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	id := uuid.New().String()
 	state := &port.ClientState{
 		ID:                      id,
@@ -59,13 +122,67 @@ func (h *Handler) CreateClient(w http.ResponseWriter, r *http.Request) {
 		Users:                   nil,
 		BlockRequests:           nil,
 		TemporaryAccessRequests: nil,
+		WindowDays:              req.WindowDays,
+		TimeZone:                req.TimeZone,
+		SecretHash:              secretHash,
 	}
 	if err := h.repo.SaveClient(r.Context(), state); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// The secret is returned only here and on rotation: the server keeps its hash
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"id": id})
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "secret": secret})
+}
+
+// UpdateClient changes client settings; omitted fields are kept
+func (h *Handler) UpdateClient(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	var req port.ClientUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.WindowDays != nil {
+		if err := validateWindowDays(*req.WindowDays); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.TimeZone != nil {
+		if err := validateTimeZone(*req.TimeZone); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err := h.repo.UpdateClient(r.Context(), clientID, req)
+	if errors.Is(err, port.ErrClientNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func validateWindowDays(days int) error {
+	if days < 0 || days > domain.MaxWindowDays {
+		return fmt.Errorf("window_days must be between 1 and %d (0 = default)", domain.MaxWindowDays)
+	}
+	return nil
+}
+
+func validateTimeZone(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return fmt.Errorf("unknown time zone %q", name)
+	}
+	return nil
 }
 
 func (h *Handler) DeleteClient(w http.ResponseWriter, r *http.Request) {
@@ -77,6 +194,40 @@ func (h *Handler) DeleteClient(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// RotateClientSecret issues a new secret for the agent; the old one stops working
+func (h *Handler) RotateClientSecret(w http.ResponseWriter, r *http.Request) {
+	secret, secretHash, err := auth.NewClientSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !h.setClientSecret(w, r, secretHash) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret})
+}
+
+// RevokeClientSecret drops the agent's secret: its polls are rejected until a new one is issued
+func (h *Handler) RevokeClientSecret(w http.ResponseWriter, r *http.Request) {
+	if h.setClientSecret(w, r, "") {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *Handler) setClientSecret(w http.ResponseWriter, r *http.Request, secretHash string) bool {
+	err := h.repo.SetClientSecret(r.Context(), r.PathValue("id"), secretHash)
+	if errors.Is(err, port.ErrClientNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
 func (h *Handler) GetClient(w http.ResponseWriter, r *http.Request) {
 	clientID := r.PathValue("id")
 	state, err := h.repo.GetClient(r.Context(), clientID)
@@ -89,10 +240,15 @@ func (h *Handler) GetClient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	type userResp struct {
-		ID       string             `json:"id"`
-		Name     string             `json:"name"`
-		Username string             `json:"username"`
-		Schedule domain.DaySchedule `json:"schedule"`
+		ID         string                  `json:"id"`
+		Name       string                  `json:"name"`
+		Username   string                  `json:"username"`
+		Schedule   domain.DaySchedule      `json:"schedule"`
+		TemplateID string                  `json:"template_id,omitempty"`
+		Periods    []domain.SchedulePeriod `json:"periods"`
+		Overrides  domain.DateOverrides    `json:"overrides"`
+		Budget     domain.DailyBudget      `json:"budget"`
+		Usage      domain.DailyUsage       `json:"usage"`
 	}
 	resp := struct {
 		ID                      string                        `json:"id"`
@@ -100,18 +256,33 @@ func (h *Handler) GetClient(w http.ResponseWriter, r *http.Request) {
 		Users                   []userResp                    `json:"users"`
 		BlockRequests           []port.BlockRequest           `json:"block_requests"`
 		TemporaryAccessRequests []port.TemporaryAccessRequest `json:"temporary_access_requests"`
+		OverrideGrants          []port.OverrideGrant          `json:"override_grants"`
+		BlockRules              []port.BlockRule              `json:"block_rules"`
+		WindowDays              int                           `json:"window_days"`
+		TimeZone                string                        `json:"time_zone"`
+		HasSecret               bool                          `json:"has_secret"`
 	}{
 		ID:                      state.ID,
 		Name:                    state.Name,
+		WindowDays:              domain.NormalizeWindowDays(state.WindowDays),
+		TimeZone:                state.TimeZone,
+		HasSecret:               state.SecretHash != "",
 		BlockRequests:           state.BlockRequests,
 		TemporaryAccessRequests: state.TemporaryAccessRequests,
+		OverrideGrants:          state.OverrideGrants,
+		BlockRules:              state.BlockRules,
 	}
 	for _, u := range state.Users {
 		resp.Users = append(resp.Users, userResp{
-			ID:       u.ID,
-			Name:     u.Name,
-			Username: u.Username,
-			Schedule: u.Schedule,
+			ID:         u.ID,
+			Name:       u.Name,
+			Username:   u.Username,
+			Schedule:   u.Schedule,
+			TemplateID: u.TemplateID,
+			Periods:    u.Periods,
+			Overrides:  u.Overrides,
+			Budget:     u.Budget,
+			Usage:      u.Usage,
 		})
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -133,26 +304,373 @@ func (h *Handler) GetClientPreview(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "config not computed", http.StatusInternalServerError)
 		return
 	}
+	now := time.Now().In(h.loc)
+	resp := struct {
+		*domain.ClientConfig
+		Periods     map[string]map[string]string    `json:"periods"`      // username -> date -> period name
+		AlwaysAllow map[string][]port.OverrideGrant `json:"always_allow"` // username -> grants not yet ended
+	}{
+		ClientConfig: state.ComputedConfig,
+		Periods:      server.ActivePeriods(now, state),
+		AlwaysAllow:  server.ActiveOverrides(now, state),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ConfigAt returns the config the client would have received at ?t= (RFC 3339),
+// rebuilt from the history of changes. Only repositories that keep history support it.
+func (h *Handler) ConfigAt(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	history, ok := h.repo.(port.HistoryReader)
+	if !ok {
+		http.Error(w, "storage keeps no history", http.StatusNotImplemented)
+		return
+	}
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("t"))
+	if err != nil {
+		http.Error(w, "invalid t, want RFC 3339", http.StatusBadRequest)
+		return
+	}
+	state, err := history.ClientAt(r.Context(), clientID, at)
+	if errors.Is(err, port.ErrHistoryUnavailable) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if state == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*domain.ClientConfig
+		At time.Time `json:"at"`
+	}{state.ComputedConfig, at})
+}
+
+// History page size: default and maximum
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// historyItem is a history entry with the time it was in effect
+type historyItem struct {
+	port.HistoryEntry
+	Minutes int `json:"minutes"`
+}
+
+// History lists past and current grants and blocks, newest first, one page at a time.
+// Filters: ?user_id= (blocks for all users are included), ?type=, ?from= and ?to= (RFC 3339,
+// entries in effect in that range); paging: ?offset= and ?limit=. Totals cover all matches.
+func (h *Handler) History(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	q := r.URL.Query()
+	filter := server.HistoryFilter{UserID: q.Get("user_id"), Type: q.Get("type")}
+	switch filter.Type {
+	case "", port.HistoryTemporaryAccess, port.HistoryAlwaysAllow, port.HistoryBlock:
+	default:
+		http.Error(w, "invalid type", http.StatusBadRequest)
+		return
+	}
+	for _, f := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if s := q.Get(f.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, "invalid "+f.name+", want RFC 3339", http.StatusBadRequest)
+				return
+			}
+			*f.t = t
+		}
+	}
+	offset, limit := 0, defaultHistoryLimit
+	if s := q.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	state, err := h.repo.GetClient(r.Context(), clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if state == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	history, err := h.repo.History(r.Context(), clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	matched := server.FilterHistory(history, filter)
+	totalMinutes := 0
+	for _, e := range matched {
+		totalMinutes += int(server.HistoryDuration(e) / time.Minute)
+	}
+	items := []historyItem{}
+	for i := offset; i < len(matched) && i < offset+limit; i++ {
+		items = append(items, historyItem{matched[i], int(server.HistoryDuration(matched[i]) / time.Minute)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Entries      []historyItem `json:"entries"`
+		Total        int           `json:"total"`
+		TotalMinutes int           `json:"total_minutes"`
+		Offset       int           `json:"offset"`
+		Limit        int           `json:"limit"`
+	}{items, len(matched), totalMinutes, offset, limit})
+}
+
+// Explain shows why the user has or lacks access: the segment containing ?at= (RFC 3339,
+// default now) and the whole timeline from the start of today, each with its cause
+func (h *Handler) Explain(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	userID := r.PathValue("uid")
+	now := time.Now().In(h.loc)
+	at := now
+	if s := r.URL.Query().Get("at"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid at, want RFC 3339", http.StatusBadRequest)
+			return
+		}
+		at = t
+	}
+	state, err := h.repo.GetClient(r.Context(), clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if state == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	segments, ok := server.ExplainUser(now, state, userID)
+	if !ok {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	segment, ok := domain.SegmentAt(segments, at)
+	if !ok {
+		http.Error(w, "at must be between the start of today and the end of the look-ahead window", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		At       time.Time        `json:"at"`
+		Segment  domain.Segment   `json:"segment"`
+		Segments []domain.Segment `json:"segments"`
+	}{at, segment, segments})
+}
+
+// maxSimulationDays limits the range of a what-if simulation
+const maxSimulationDays = 92
+
+// simulatedUser replaces stored settings of one user in a simulation; omitted fields keep stored values
+type simulatedUser struct {
+	UserID    string                   `json:"user_id"`
+	Schedule  *domain.DaySchedule      `json:"schedule,omitempty"`
+	Periods   *[]domain.SchedulePeriod `json:"periods,omitempty"`
+	Overrides *domain.DateOverrides    `json:"overrides,omitempty"`
+	Budget    *domain.DailyBudget      `json:"budget,omitempty"`
+}
+
+// Simulate computes intervals for [from, to] with hypothetical schedules, grants and blocks
+// applied over the stored client state. Nothing is saved: the repository is only read.
+func (h *Handler) Simulate(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	var req struct {
+		From            *time.Time                     `json:"from,omitempty"` // default now
+		To              *time.Time                     `json:"to,omitempty"`   // default end of the look-ahead window
+		Users           []simulatedUser                `json:"users,omitempty"`
+		TemporaryAccess *[]port.TemporaryAccessRequest `json:"temporary_access,omitempty"` // replaces stored grants
+		AlwaysAllow     *[]port.OverrideGrant          `json:"always_allow,omitempty"`     // replaces stored overrides
+		Blocks          *[]port.BlockRequest           `json:"blocks,omitempty"`           // replaces stored blocks
+		BlockRules      *[]port.BlockRule              `json:"block_rules,omitempty"`      // replaces stored rules
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, err := h.repo.GetClient(r.Context(), clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if state == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	from := time.Now().In(h.loc)
+	if req.From != nil {
+		from = req.From.In(h.loc)
+	}
+	to := domain.WindowEnd(from, state.WindowDays)
+	if req.To != nil {
+		to = req.To.In(h.loc)
+	}
+	if !to.After(from) {
+		http.Error(w, "to must be after from", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > maxSimulationDays*24*time.Hour {
+		http.Error(w, fmt.Sprintf("range must not exceed %d days", maxSimulationDays), http.StatusBadRequest)
+		return
+	}
+
+	sim, errs := applySimulation(*state, req.Users)
+	if req.TemporaryAccess != nil {
+		sim.TemporaryAccessRequests = *req.TemporaryAccess
+		for i, t := range sim.TemporaryAccessRequests {
+			if !t.Until.After(t.Start) {
+				errs = append(errs, domain.FieldError{Field: fmt.Sprintf("temporary_access[%d].until", i), Message: "until must be after start"})
+			}
+		}
+	}
+	if req.AlwaysAllow != nil {
+		sim.OverrideGrants = *req.AlwaysAllow
+		for i, g := range sim.OverrideGrants {
+			if !g.Until.After(g.Start) {
+				errs = append(errs, domain.FieldError{Field: fmt.Sprintf("always_allow[%d].until", i), Message: "until must be after start"})
+			}
+			if g.Priority < 1 {
+				errs = append(errs, domain.FieldError{Field: fmt.Sprintf("always_allow[%d].priority", i), Message: "priority must be at least 1"})
+			}
+		}
+	}
+	if req.Blocks != nil {
+		sim.BlockRequests = *req.Blocks
+		for i, b := range sim.BlockRequests {
+			if !b.Until.After(b.Start) {
+				errs = append(errs, domain.FieldError{Field: fmt.Sprintf("blocks[%d].until", i), Message: "until must be after start"})
+			}
+		}
+	}
+	if req.BlockRules != nil {
+		sim.BlockRules = *req.BlockRules
+		for i, rule := range sim.BlockRules {
+			if err := validateWeeklyRange(rule.WeeklyRange); err != nil {
+				errs = append(errs, domain.FieldError{Field: fmt.Sprintf("block_rules[%d]", i), Message: err.Error()})
+			}
+		}
+	}
+	if errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(state.ComputedConfig)
+	json.NewEncoder(w).Encode(struct {
+		From  time.Time              `json:"from"`
+		To    time.Time              `json:"to"`
+		Users []server.SimulatedUser `json:"users"`
+	}{from, to, server.Simulate(from, to, &sim)})
+}
+
+// applySimulation returns a copy of state with users' settings replaced; the stored state is not modified
+func applySimulation(state port.ClientState, users []simulatedUser) (port.ClientState, domain.FieldErrors) {
+	var errs domain.FieldErrors
+	state.Users = append([]domain.User(nil), state.Users...)
+	for i, su := range users {
+		field := fmt.Sprintf("users[%d]", i)
+		idx := -1
+		for j := range state.Users {
+			if state.Users[j].ID == su.UserID {
+				idx = j
+				break
+			}
+		}
+		if idx < 0 {
+			errs = append(errs, domain.FieldError{Field: field + ".user_id", Message: fmt.Sprintf("unknown user %q", su.UserID)})
+			continue
+		}
+		u := &state.Users[idx]
+		if su.Schedule != nil {
+			errs = append(errs, su.Schedule.Validate(field+".schedule")...)
+			u.Schedule = *su.Schedule
+		}
+		if su.Periods != nil {
+			for j, p := range *su.Periods {
+				errs = append(errs, p.Validate(fmt.Sprintf("%s.periods[%d]", field, j))...)
+			}
+			u.Periods = *su.Periods
+		}
+		if su.Overrides != nil {
+			dates := make([]string, 0, len(*su.Overrides))
+			for date := range *su.Overrides {
+				dates = append(dates, date)
+			}
+			sort.Strings(dates)
+			for _, date := range dates {
+				for _, fe := range validateDateOverride(date, (*su.Overrides)[date]) {
+					fe.Field = fmt.Sprintf("%s.overrides[%s].%s", field, date, fe.Field)
+					errs = append(errs, fe)
+				}
+			}
+			u.Overrides = *su.Overrides
+		}
+		if su.Budget != nil {
+			errs = append(errs, validateBudget(field+".budget", *su.Budget)...)
+			u.Budget = *su.Budget
+		}
+	}
+	return state, errs
 }
 
 func (h *Handler) AddUser(w http.ResponseWriter, r *http.Request) {
 	clientID := r.PathValue("id")
 	var req struct {
-		Name     string             `json:"name"`
-		Username string             `json:"username"`
-		Schedule domain.DaySchedule `json:"schedule"`
+		Name       string             `json:"name"`
+		Username   string             `json:"username"`
+		Schedule   domain.DaySchedule `json:"schedule"`
+		TemplateID string             `json:"template_id,omitempty"`
+		Budget     domain.DailyBudget `json:"budget"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	errs := req.Schedule.Validate("schedule")
+	errs = append(errs, validateBudget("budget", req.Budget)...)
+	if errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
+	template, ok := h.lookupTemplate(w, r, req.TemplateID)
+	if !ok {
+		return
+	}
+	if errs := validateMerged(template, req.Schedule); errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
 	user := domain.User{
-		ID:       uuid.New().String(),
-		Name:     req.Name,
-		Username: req.Username,
-		Schedule: req.Schedule,
+		ID:         uuid.New().String(),
+		Name:       req.Name,
+		Username:   req.Username,
+		Schedule:   req.Schedule,
+		TemplateID: req.TemplateID,
+		Budget:     req.Budget,
 	}
 	if user.Schedule == nil {
 		user.Schedule = make(domain.DaySchedule)
@@ -176,6 +694,22 @@ func (h *Handler) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if errs := req.Schedule.Validate("schedule"); errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
+	user, ok := h.lookupUser(w, r, clientID, userID)
+	if !ok {
+		return
+	}
+	template, ok := h.lookupTemplate(w, r, user.TemplateID)
+	if !ok {
+		return
+	}
+	if errs := validateMerged(template, req.Schedule); errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
 	if err := h.repo.UpdateUserSchedule(r.Context(), clientID, userID, req.Schedule); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -184,10 +718,25 @@ func (h *Handler) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) UpdatePeriods(w http.ResponseWriter, r *http.Request) {
 	clientID := r.PathValue("id")
 	userID := r.PathValue("uid")
-	if err := h.repo.DeleteUser(r.Context(), clientID, userID); err != nil {
+	var req struct {
+		Periods []domain.SchedulePeriod `json:"periods"` // first matching period wins
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var errs domain.FieldErrors
+	for i, p := range req.Periods {
+		errs = append(errs, p.Validate(fmt.Sprintf("periods[%d]", i))...)
+	}
+	if errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
+	if err := h.repo.UpdateUserPeriods(r.Context(), clientID, userID, req.Periods); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -195,23 +744,29 @@ func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) TemporaryAccess(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) SetUserTemplate(w http.ResponseWriter, r *http.Request) {
 	clientID := r.PathValue("id")
+	userID := r.PathValue("uid")
 	var req struct {
-		UserID   string `json:"user_id"`
-		Duration int    `json:"duration"` // minutes
+		TemplateID string `json:"template_id"` // empty = own schedule only
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if req.Duration <= 0 {
-		http.Error(w, "duration must be positive", http.StatusBadRequest)
+	user, ok := h.lookupUser(w, r, clientID, userID)
+	if !ok {
 		return
 	}
-	now := time.Now().In(h.loc)
-	until := now.Add(time.Duration(req.Duration) * time.Minute)
-	if err := h.repo.GrantTemporaryAccess(r.Context(), clientID, req.UserID, until); err != nil {
+	template, ok := h.lookupTemplate(w, r, req.TemplateID)
+	if !ok {
+		return
+	}
+	if errs := validateMerged(template, user.Schedule); errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
+	if err := h.repo.SetUserTemplate(r.Context(), clientID, userID, req.TemplateID); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -219,23 +774,91 @@ func (h *Handler) TemporaryAccess(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) Block(w http.ResponseWriter, r *http.Request) {
-	clientID := r.PathValue("id")
-	var req struct {
-		UserID   string `json:"user_id,omitempty"` // empty = block all
-		Duration int    `json:"duration"`          // minutes
+// lookupTemplate returns the template templateID refers to, nil for an empty ID;
+// false after writing 400 if there is no such template
+func (h *Handler) lookupTemplate(w http.ResponseWriter, r *http.Request, templateID string) (*domain.ScheduleTemplate, bool) {
+	if templateID == "" {
+		return nil, true
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	t, err := h.repo.GetTemplate(r.Context(), templateID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if t == nil {
+		http.Error(w, "unknown template_id", http.StatusBadRequest)
+		return nil, false
+	}
+	return t, true
+}
+
+// lookupUser returns a user of the client; false after writing 404 if there is none
+func (h *Handler) lookupUser(w http.ResponseWriter, r *http.Request, clientID, userID string) (*domain.User, bool) {
+	state, err := h.repo.GetClient(r.Context(), clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if state == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return nil, false
+	}
+	for i := range state.Users {
+		if state.Users[i].ID == userID {
+			return &state.Users[i], true
+		}
+	}
+	http.Error(w, "user not found", http.StatusNotFound)
+	return nil, false
+}
+
+// validateMerged checks the schedule a user gets from template and own days together:
+// both can be valid alone while an overnight interval of one runs into the next day of the other
+func validateMerged(template *domain.ScheduleTemplate, own domain.DaySchedule) domain.FieldErrors {
+	if template == nil {
+		return nil
+	}
+	return template.Schedule.Merge(own).Validate("schedule")
+}
+
+// clientHasUser writes 404 for an unknown client and 400 for a userID (empty = all users)
+// that is not one of its users
+func (h *Handler) clientHasUser(w http.ResponseWriter, r *http.Request, clientID, userID string) bool {
+	state, err := h.repo.GetClient(r.Context(), clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if state == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return false
+	}
+	if userID == "" {
+		return true
+	}
+	for _, u := range state.Users {
+		if u.ID == userID {
+			return true
+		}
+	}
+	http.Error(w, "unknown user_id", http.StatusBadRequest)
+	return false
+}
+
+func (h *Handler) SetDateOverride(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	userID := r.PathValue("uid")
+	date := r.PathValue("date")
+	var override domain.DateOverride
+	if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if req.Duration <= 0 {
-		http.Error(w, "duration must be positive", http.StatusBadRequest)
+	if errs := validateDateOverride(date, override); errs != nil {
+		writeValidationError(w, errs)
 		return
 	}
-	now := time.Now().In(h.loc)
-	until := now.Add(time.Duration(req.Duration) * time.Minute)
-	if err := h.repo.BlockClient(r.Context(), clientID, req.UserID, now, until); err != nil {
+	if err := h.repo.SetDateOverride(r.Context(), clientID, userID, date, override); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -243,10 +866,11 @@ func (h *Handler) Block(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) DeleteBlock(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) DeleteDateOverride(w http.ResponseWriter, r *http.Request) {
 	clientID := r.PathValue("id")
-	requestID := r.PathValue("rid")
-	if err := h.repo.DeleteBlockRequest(r.Context(), clientID, requestID); err != nil {
+	userID := r.PathValue("uid")
+	date := r.PathValue("date")
+	if err := h.repo.DeleteDateOverride(r.Context(), clientID, userID, date); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -254,13 +878,606 @@ func (h *Handler) DeleteBlock(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) DeleteTemporaryAccess(w http.ResponseWriter, r *http.Request) {
+// ImportCalendar reads an .ics file from the body and turns every future date covered
+// by its events into a date override: ?use_day=sunday (default) or ?use_day=none for no access.
+// ?user_id limits the import to one user, otherwise it applies to all users of the client.
+func (h *Handler) ImportCalendar(w http.ResponseWriter, r *http.Request) {
 	clientID := r.PathValue("id")
-	requestID := r.PathValue("rid")
-	if err := h.repo.DeleteTemporaryAccessRequest(r.Context(), clientID, requestID); err != nil {
+	userID := r.URL.Query().Get("user_id")
+	override := domain.DateOverride{UseDay: r.URL.Query().Get("use_day")}
+	switch override.UseDay {
+	case "":
+		override.UseDay = "sunday"
+	case "none":
+		override.UseDay = ""
+	default:
+		if !domain.IsDayName(override.UseDay) {
+			http.Error(w, fmt.Sprintf("invalid use_day %q", override.UseDay), http.StatusBadRequest)
+			return
+		}
+	}
+	state, err := h.repo.GetClient(r.Context(), clientID)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	h.repo.IncrementConfigVersion(r.Context(), clientID)
-	w.WriteHeader(http.StatusOK)
+	if state == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	loc := h.loc
+	if clientLoc := server.ClientLocation(state.TimeZone); clientLoc != nil {
+		loc = clientLoc
+	}
+	imported, err := ical.ParseDates(http.MaxBytesReader(w, r.Body, maxCalendarBytes), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	today := time.Now().In(loc).Format(domain.DateLayout)
+	overrides := make(domain.DateOverrides)
+	for _, date := range imported.Dates {
+		if date >= today {
+			overrides[date] = override
+		}
+	}
+	found := false
+	for _, u := range state.Users {
+		if userID != "" && u.ID != userID {
+			continue
+		}
+		found = true
+		if err := h.repo.SetDateOverrides(r.Context(), clientID, u.ID, overrides); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !found {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"dates": len(overrides), "skipped": imported.Skipped})
+}
+
+// ExportCalendar serves the user's allowed intervals, as computed for the client, as an ICS feed
+func (h *Handler) ExportCalendar(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	userID := r.PathValue("uid")
+	state, err := h.repo.GetClient(r.Context(), clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if state == nil || state.ComputedConfig == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var user *domain.User
+	for i := range state.Users {
+		if state.Users[i].ID == userID {
+			user = &state.Users[i]
+		}
+	}
+	if user == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var intervals []domain.AllowedInterval
+	for _, uc := range state.ComputedConfig.Users {
+		if uc.Username == user.Username {
+			intervals = uc.AllowedIntervals
+		}
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	ical.WriteCalendar(w, "Доступ к компьютеру: "+user.Name, clientID+"-"+userID, intervals, time.Now())
+}
+
+func validateDateOverride(date string, o domain.DateOverride) domain.FieldErrors {
+	var errs domain.FieldErrors
+	if _, err := time.Parse(domain.DateLayout, date); err != nil {
+		errs = append(errs, domain.FieldError{Field: "date", Message: fmt.Sprintf("invalid date %q, want YYYY-MM-DD", date)})
+	}
+	if o.UseDay != "" {
+		if !domain.IsDayName(o.UseDay) {
+			errs = append(errs, domain.FieldError{Field: "use_day", Message: fmt.Sprintf("unknown day %q", o.UseDay)})
+		}
+		if len(o.Intervals) > 0 {
+			errs = append(errs, domain.FieldError{Field: "use_day", Message: "use_day and intervals are mutually exclusive"})
+		}
+	}
+	return append(errs, domain.ValidateDayIntervals("intervals", o.Intervals)...)
+}
+
+// writeValidationError responds 400 with every offending field so the UI can highlight them
+func writeValidationError(w http.ResponseWriter, errs domain.FieldErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{"error": errs.Error(), "fields": errs})
+}
+
+func (h *Handler) UpdateBudget(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	userID := r.PathValue("uid")
+	var req struct {
+		Budget domain.DailyBudget `json:"budget"` // day -> minutes, missing day = unlimited
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs := validateBudget("budget", req.Budget); errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
+	if err := h.repo.UpdateUserBudget(r.Context(), clientID, userID, req.Budget); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateBudget checks day names and per-day limits; field prefixes reported fields
+func validateBudget(field string, budget domain.DailyBudget) domain.FieldErrors {
+	days := make([]string, 0, len(budget))
+	for day := range budget {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	var errs domain.FieldErrors
+	for _, day := range days {
+		if !domain.IsDayName(day) {
+			errs = append(errs, domain.FieldError{
+				Field:   field + "." + day,
+				Message: "unknown day, want one of " + strings.Join(domain.DayNames, ", "),
+			})
+			continue
+		}
+		if minutes := budget[day]; minutes < 0 || minutes > 24*60 {
+			errs = append(errs, domain.FieldError{Field: field + "." + day, Message: "must be between 0 and 1440 minutes"})
+		}
+	}
+	return errs
+}
+
+func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	userID := r.PathValue("uid")
+	if err := h.repo.DeleteUser(r.Context(), clientID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) TemporaryAccess(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	var req struct {
+		UserID   string     `json:"user_id"`
+		Start    *time.Time `json:"start,omitempty"`    // empty = now
+		Until    *time.Time `json:"until,omitempty"`    // absolute end
+		Duration int        `json:"duration,omitempty"` // minutes from start, alternative to until
+		Note     string     `json:"note,omitempty"`     // kept in the history
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().In(h.loc)
+	start, until, err := parseTimeRange(now, req.Start, req.Until, req.Duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.clientHasUser(w, r, clientID, req.UserID) {
+		return
+	}
+	err = h.repo.GrantTemporaryAccess(r.Context(), clientID, req.UserID, start, until, req.Note, h.adminName(r))
+	if errors.Is(err, port.ErrClientNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// UpdateTemporaryAccess extends or shortens an existing grant: either sets new until
+// or shifts it by delta minutes (negative shortens).
+func (h *Handler) UpdateTemporaryAccess(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	requestID := r.PathValue("rid")
+	var req struct {
+		Until *time.Time `json:"until,omitempty"`
+		Delta int        `json:"delta,omitempty"` // minutes
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (req.Until == nil) == (req.Delta == 0) {
+		http.Error(w, "exactly one of until or delta required", http.StatusBadRequest)
+		return
+	}
+	state, err := h.repo.GetClient(r.Context(), clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if state == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var grant *port.TemporaryAccessRequest
+	for i := range state.TemporaryAccessRequests {
+		// Ended grants are only kept for explain: they cannot be extended
+		if state.TemporaryAccessRequests[i].ID == requestID && state.TemporaryAccessRequests[i].Until.After(time.Now()) {
+			grant = &state.TemporaryAccessRequests[i]
+			break
+		}
+	}
+	if grant == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	until := grant.Until.Add(time.Duration(req.Delta) * time.Minute)
+	if req.Until != nil {
+		until = req.Until.In(h.loc)
+	}
+	if !until.After(grant.Start) {
+		http.Error(w, "until must be after start", http.StatusBadRequest)
+		return
+	}
+	if !until.After(time.Now()) {
+		http.Error(w, "until must be in the future, delete the grant to end it now", http.StatusBadRequest)
+		return
+	}
+	err = h.repo.UpdateTemporaryAccess(r.Context(), clientID, requestID, until)
+	if errors.Is(err, port.ErrInvalidUntil) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// AlwaysAllow grants the user access that survives blocks of lower priority (e.g. an online exam
+// during a global block); like temporary access it has an expiry
+func (h *Handler) AlwaysAllow(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	var req struct {
+		UserID   string     `json:"user_id"`
+		Start    *time.Time `json:"start,omitempty"`    // empty = now
+		Until    *time.Time `json:"until,omitempty"`    // absolute end
+		Duration int        `json:"duration,omitempty"` // minutes from start, alternative to until
+		Priority int        `json:"priority,omitempty"` // 0 = 1, beats blocks without priority
+		Reason   string     `json:"reason,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	if req.Priority < 0 {
+		http.Error(w, "priority must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Priority == 0 {
+		req.Priority = 1
+	}
+	now := time.Now().In(h.loc)
+	start, until, err := parseTimeRange(now, req.Start, req.Until, req.Duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.clientHasUser(w, r, clientID, req.UserID) {
+		return
+	}
+	err = h.repo.GrantOverride(r.Context(), clientID, req.UserID, start, until, req.Priority, req.Reason, h.adminName(r))
+	if errors.Is(err, port.ErrClientNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) DeleteAlwaysAllow(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	grantID := r.PathValue("rid")
+	if err := h.repo.DeleteOverrideGrant(r.Context(), clientID, grantID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) Block(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	var req struct {
+		UserID   string     `json:"user_id,omitempty"`  // empty = block all
+		Start    *time.Time `json:"start,omitempty"`    // empty = now
+		Until    *time.Time `json:"until,omitempty"`    // absolute end
+		Duration int        `json:"duration,omitempty"` // minutes from start, alternative to until
+		Priority int        `json:"priority,omitempty"` // always-allow grants of higher priority are not blocked
+		Note     string     `json:"note,omitempty"`     // kept in the history
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Priority < 0 {
+		http.Error(w, "priority must not be negative", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().In(h.loc)
+	start, until, err := parseTimeRange(now, req.Start, req.Until, req.Duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.clientHasUser(w, r, clientID, req.UserID) {
+		return
+	}
+	err = h.repo.BlockClient(r.Context(), clientID, req.UserID, start, until, req.Priority, req.Note, h.adminName(r))
+	if errors.Is(err, port.ErrClientNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// maxScheduleAhead limits how far in the future a range may start
+const maxScheduleAhead = 366 * 24 * time.Hour
+
+// parseTimeRange resolves [start, until] from request fields: start defaults to now,
+// end is either until or start + duration minutes (exactly one must be set).
+func parseTimeRange(now time.Time, start, until *time.Time, duration int) (time.Time, time.Time, error) {
+	s := now
+	if start != nil {
+		s = start.In(now.Location())
+		if s.Before(now) {
+			s = now // already started
+		}
+	}
+	if s.Sub(now) > maxScheduleAhead {
+		return time.Time{}, time.Time{}, fmt.Errorf("start must be within a year")
+	}
+	var e time.Time
+	switch {
+	case until != nil && duration != 0:
+		return time.Time{}, time.Time{}, fmt.Errorf("until and duration are mutually exclusive")
+	case until != nil:
+		e = until.In(now.Location())
+	case duration > 0:
+		e = s.Add(time.Duration(duration) * time.Minute)
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("duration must be positive")
+	}
+	if !e.After(s) {
+		return time.Time{}, time.Time{}, fmt.Errorf("until must be after start and in the future")
+	}
+	return s, e, nil
+}
+
+func (h *Handler) DeleteBlock(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	requestID := r.PathValue("rid")
+	if err := h.repo.DeleteBlockRequest(r.Context(), clientID, requestID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) AddBlockRule(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	var rule port.BlockRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateWeeklyRange(rule.WeeklyRange); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rule.Priority < 0 {
+		http.Error(w, "priority must not be negative", http.StatusBadRequest)
+		return
+	}
+	if !h.clientHasUser(w, r, clientID, rule.UserID) {
+		return
+	}
+	id, err := h.repo.AddBlockRule(r.Context(), clientID, rule)
+	if errors.Is(err, port.ErrClientNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+func (h *Handler) DeleteBlockRule(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	ruleID := r.PathValue("rid")
+	if err := h.repo.DeleteBlockRule(r.Context(), clientID, ruleID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func validateWeeklyRange(wr domain.WeeklyRange) error {
+	if len(wr.Days) == 0 {
+		return fmt.Errorf("days required")
+	}
+	for _, d := range wr.Days {
+		if !domain.IsDayName(d) {
+			return fmt.Errorf("invalid day %q", d)
+		}
+	}
+	sh, sm, err := domain.ParseTime(wr.Start)
+	if err != nil {
+		return err
+	}
+	eh, em, err := domain.ParseTime(wr.End)
+	if err != nil {
+		return err
+	}
+	if sh == eh && sm == em {
+		return fmt.Errorf("start and end must differ")
+	}
+	return nil
+}
+
+func (h *Handler) DeleteTemporaryAccess(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	requestID := r.PathValue("rid")
+	if err := h.repo.DeleteTemporaryAccessRequest(r.Context(), clientID, requestID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.repo.IncrementConfigVersion(r.Context(), clientID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := h.repo.ListTemplates(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+func (h *Handler) CreateTemplate(w http.ResponseWriter, r *http.Request) {
+	var t domain.ScheduleTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.ID = ""
+	if errs := validateTemplate(t); errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
+	id, err := h.repo.SaveTemplate(r.Context(), t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+// UpdateTemplate replaces template; the repository bumps config version of every client using it
+func (h *Handler) UpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	templateID := r.PathValue("tid")
+	existing, err := h.repo.GetTemplate(r.Context(), templateID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var t domain.ScheduleTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.ID = templateID
+	if errs := validateTemplate(t); errs != nil {
+		writeValidationError(w, errs)
+		return
+	}
+	clients, err := h.repo.GetAllClients(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, c := range clients {
+		for _, u := range c.Users {
+			if u.TemplateID != templateID {
+				continue
+			}
+			if errs := validateMerged(&t, u.Schedule); errs != nil {
+				writeValidationError(w, append(domain.FieldErrors{{Field: "schedule", Message: fmt.Sprintf("collides with own days of %s on %s", u.Name, c.Name)}}, errs...))
+				return
+			}
+		}
+	}
+	if _, err := h.repo.SaveTemplate(r.Context(), t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteTemplate refuses to delete a template still referenced by users
+func (h *Handler) DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	templateID := r.PathValue("tid")
+	clients, err := h.repo.GetAllClients(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, c := range clients {
+		for _, u := range c.Users {
+			if u.TemplateID == templateID {
+				http.Error(w, fmt.Sprintf("template is used by %s on %s", u.Name, c.Name), http.StatusConflict)
+				return
+			}
+		}
+	}
+	if err := h.repo.DeleteTemplate(r.Context(), templateID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func validateTemplate(t domain.ScheduleTemplate) domain.FieldErrors {
+	var errs domain.FieldErrors
+	if t.Name == "" {
+		errs = append(errs, domain.FieldError{Field: "name", Message: "name required"})
+	}
+	return append(errs, t.Schedule.Validate("schedule")...)
 }
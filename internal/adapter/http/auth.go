@@ -0,0 +1,270 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/aegis/parental-control/internal/adapter/auth"
+)
+
+const (
+	sessionCookie = "aegis_session"
+	// csrfHeader must carry the session's CSRF token on requests that change anything
+	csrfHeader = "X-CSRF-Token"
+)
+
+// registerAuthRoutes adds login, logout and admin account management when auth is enabled
+func (h *Handler) registerAuthRoutes(mux *http.ServeMux) {
+	if h.auth == nil {
+		return
+	}
+	mux.HandleFunc("GET /api/auth/session", h.AuthSession)
+	mux.HandleFunc("POST /api/auth/setup", h.Setup)
+	mux.HandleFunc("POST /api/auth/login", h.Login)
+	mux.HandleFunc("POST /api/auth/logout", h.requireAdmin(h.Logout))
+	mux.HandleFunc("POST /api/auth/feed-token", h.requireAdmin(h.IssueFeedToken))
+	mux.HandleFunc("DELETE /api/auth/feed-token", h.requireAdmin(h.RevokeFeedToken))
+	mux.HandleFunc("GET /api/admins", h.requireAdmin(h.ListAdmins))
+	mux.HandleFunc("POST /api/admins", h.requireAdmin(h.AddAdmin))
+	mux.HandleFunc("PUT /api/admins/{name}/password", h.requireAdmin(h.SetAdminPassword))
+	mux.HandleFunc("DELETE /api/admins/{name}", h.requireAdmin(h.DeleteAdmin))
+}
+
+// requireAdmin lets through requests with a live session; requests that change
+// anything must also carry its CSRF token. Without an auth service everything passes.
+func (h *Handler) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	if h.auth == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := h.session(r)
+		if !ok {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(sess.CSRF)) != 1 {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireFeedToken lets calendar apps, which cannot log in, read a feed with an admin's
+// feed token in the URL (?token=); a session works too
+func (h *Handler) requireFeedToken(next http.HandlerFunc) http.HandlerFunc {
+	if h.auth == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.session(r); !ok && !h.auth.CheckFeedToken(r.URL.Query().Get("token")) {
+			http.Error(w, "feed token required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *Handler) session(r *http.Request) (*auth.Session, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	return h.auth.Session(c.Value)
+}
+
+// adminName returns the username of the logged in admin, empty when auth is off
+func (h *Handler) adminName(r *http.Request) string {
+	if h.auth == nil {
+		return ""
+	}
+	sess, ok := h.session(r)
+	if !ok {
+		return ""
+	}
+	return sess.Username
+}
+
+// sameOrigin rejects cross-site requests to the endpoints that work without a session
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, sess *auth.Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sess.Token,
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+type sessionInfo struct {
+	Username      string `json:"username,omitempty"`
+	CSRFToken     string `json:"csrf_token,omitempty"`
+	SetupRequired bool   `json:"setup_required,omitempty"`
+}
+
+func writeSession(w http.ResponseWriter, sess *auth.Session) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionInfo{Username: sess.Username, CSRFToken: sess.CSRF})
+}
+
+// authError maps auth service errors to statuses; others are bad input
+func authError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		status = http.StatusUnauthorized
+	case errors.Is(err, auth.ErrTooManyAttempts):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, auth.ErrInvalidSetupToken):
+		status = http.StatusForbidden
+	case errors.Is(err, auth.ErrAdminNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, auth.ErrSetupDone), errors.Is(err, auth.ErrAdminExists), errors.Is(err, auth.ErrLastAdmin):
+		status = http.StatusConflict
+	}
+	http.Error(w, err.Error(), status)
+}
+
+type credentials struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	SetupToken string `json:"setup_token,omitempty"` // first admin only, see auth.Service.SetupToken
+}
+
+// AuthSession returns the logged-in admin and CSRF token, or tells the login page
+// that the first admin has to be created
+func (h *Handler) AuthSession(w http.ResponseWriter, r *http.Request) {
+	if sess, ok := h.session(r); ok {
+		writeSession(w, sess)
+		return
+	}
+	if h.auth.SetupRequired() {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessionInfo{SetupRequired: true})
+		return
+	}
+	http.Error(w, "login required", http.StatusUnauthorized)
+}
+
+// Setup creates the first admin with the setup token from the server log; it fails once any admin exists
+func (h *Handler) Setup(w http.ResponseWriter, r *http.Request) {
+	h.startSession(w, r, func(c credentials) (*auth.Session, error) {
+		return h.auth.Setup(c.SetupToken, c.Username, c.Password)
+	})
+}
+
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	h.startSession(w, r, func(c credentials) (*auth.Session, error) {
+		return h.auth.Login(c.Username, c.Password, remote)
+	})
+}
+
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, start func(credentials) (*auth.Session, error)) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sess, err := start(req)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+	setSessionCookie(w, r, sess)
+	writeSession(w, sess)
+}
+
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		h.auth.Logout(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// IssueFeedToken returns a new calendar feed token of the logged-in admin; the old one stops working
+func (h *Handler) IssueFeedToken(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session(r)
+	token, err := h.auth.IssueFeedToken(sess.Username)
+	if err != nil {
+		authError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+func (h *Handler) RevokeFeedToken(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session(r)
+	if err := h.auth.RevokeFeedToken(sess.Username); err != nil {
+		authError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) ListAdmins(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.auth.Admins())
+}
+
+func (h *Handler) AddAdmin(w http.ResponseWriter, r *http.Request) {
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.auth.AddAdmin(req.Username, req.Password); err != nil {
+		authError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// SetAdminPassword changes a password; the admin's sessions end, including the caller's own
+func (h *Handler) SetAdminPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.auth.SetPassword(r.PathValue("name"), req.Password); err != nil {
+		authError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) DeleteAdmin(w http.ResponseWriter, r *http.Request) {
+	if err := h.auth.DeleteAdmin(r.PathValue("name")); err != nil {
+		authError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,25 +2,37 @@ package http
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
+	"github.com/aegis/parental-control/internal/adapter/signing"
 	"github.com/aegis/parental-control/internal/domain"
 )
 
+// maxConfigBytes limits the size of a config response
+const maxConfigBytes = 4 << 20
+
+// errSecretRejected means the client secret was rotated or revoked in the admin UI
+var errSecretRejected = errors.New("client secret rejected by server")
+
 // HTTPConfigFetcher fetches config via long-poll from server
 type HTTPConfigFetcher struct {
 	baseURL  string
 	clientID string
+	secret   string // issued by the server with the client ID
+	verifier *signing.Verifier
 	client   *http.Client
 }
 
-func NewHTTPConfigFetcher(baseURL, clientID string) *HTTPConfigFetcher {
+func NewHTTPConfigFetcher(baseURL, clientID, secret string, verifier *signing.Verifier) *HTTPConfigFetcher {
 	return &HTTPConfigFetcher{
 		baseURL:  baseURL,
 		clientID: clientID,
+		secret:   secret,
+		verifier: verifier,
 		client: &http.Client{
 			Timeout: 90 * time.Second,
 		},
@@ -28,7 +40,8 @@ func NewHTTPConfigFetcher(baseURL, clientID string) *HTTPConfigFetcher {
 }
 
 // FetchConfig long-polls until config changes. If version is not empty, sends it so server
-// can respond immediately when config version differs.
+// can respond immediately when config version differs. Configs not signed by the pinned key,
+// issued to another client or older than one already accepted are rejected.
 func (f *HTTPConfigFetcher) FetchConfig(ctx context.Context, version string) (*domain.ClientConfig, error) {
 	url := fmt.Sprintf("%s/api/config?client_id=%s", f.baseURL, f.clientID)
 	if version != "" {
@@ -38,14 +51,21 @@ func (f *HTTPConfigFetcher) FetchConfig(ctx context.Context, version string) (*d
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Authorization", "Bearer "+f.secret)
 	resp, err := f.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errSecretRejected
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
 	}
-	var cfg domain.ClientConfig
-	return &cfg, json.NewDecoder(resp.Body).Decode(&cfg)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigBytes))
+	if err != nil {
+		return nil, err
+	}
+	return f.verifier.Verify(body)
 }
@@ -1,10 +1,16 @@
 package http
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/aegis/parental-control/internal/adapter/auth"
+	"github.com/aegis/parental-control/internal/adapter/signing"
 	"github.com/aegis/parental-control/internal/domain"
 	"github.com/aegis/parental-control/internal/port"
 	"github.com/aegis/parental-control/internal/usecase/server"
@@ -13,18 +19,32 @@ import (
 const (
 	longPollTimeout     = 60 * time.Second
 	maxLongPollInterval = 55 * time.Second
+	// maxUsageReportSeconds caps a single usage report (client reports every minute)
+	maxUsageReportSeconds = 24 * 60 * 60
+	// maxCalendarBytes limits size of an imported .ics file
+	maxCalendarBytes = 1 << 20
 )
 
 type Handler struct {
-	repo port.ConfigRepository
-	loc  *time.Location
+	repo         port.ConfigRepository
+	loc          *time.Location
+	auth         *auth.Service   // nil leaves the management API open
+	signer       *signing.Signer // nil sends configs unsigned
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
-func NewHandler(repo port.ConfigRepository, loc *time.Location) *Handler {
+func NewHandler(repo port.ConfigRepository, loc *time.Location, admins *auth.Service, signer *signing.Signer) *Handler {
 	if loc == nil {
 		loc = time.UTC
 	}
-	return &Handler{repo: repo, loc: loc}
+	return &Handler{repo: repo, loc: loc, auth: admins, signer: signer, shutdown: make(chan struct{})}
+}
+
+// Shutdown releases all pending long-polls; they finish as on timeout and
+// clients reconnect. Safe to call more than once.
+func (h *Handler) Shutdown() {
+	h.shutdownOnce.Do(func() { close(h.shutdown) })
 }
 
 func (h *Handler) ServeConfig(w http.ResponseWriter, r *http.Request) {
@@ -35,7 +55,11 @@ func (h *Handler) ServeConfig(w http.ResponseWriter, r *http.Request) {
 	}
 	clientVersion := r.URL.Query().Get("version")
 
-	ctx := r.Context()
+	// Subscribe before reading the state, so a change made in between still wakes
+	// this poll; the subscription ends when the handler returns
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	subCh := h.repo.Subscribe(ctx, clientID)
 
 	// Get client state (must exist, no auto-registration)
 	state, err := h.repo.GetClient(ctx, clientID)
@@ -47,6 +71,11 @@ func (h *Handler) ServeConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "client not found", http.StatusForbidden)
 		return
 	}
+	secret := clientSecret(r)
+	if !auth.CheckClientSecret(state.SecretHash, secret) {
+		rejectClient(w)
+		return
+	}
 
 	// Get precomputed config (always today+tomorrow, full)
 	if state.ComputedConfig == nil {
@@ -81,7 +110,6 @@ func (h *Handler) ServeConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Wait for changes
-	subCh := h.repo.Subscribe(ctx, clientID)
 	deadline := time.Now().Add(longPollTimeout)
 	if nextChange.Before(deadline) {
 		deadline = nextChange
@@ -95,9 +123,9 @@ func (h *Handler) ServeConfig(w http.ResponseWriter, r *http.Request) {
 
 	select {
 	case <-subCh:
-		// Config changed, get updated precomputed config
+		// Config changed, get updated precomputed config; a secret revoked meanwhile gets nothing
 		state, _ = h.repo.GetClient(ctx, clientID)
-		if state != nil && state.ComputedConfig != nil {
+		if state != nil && state.ComputedConfig != nil && auth.CheckClientSecret(state.SecretHash, secret) {
 			newConfig := *state.ComputedConfig
 			if newConfig.Version != config.Version {
 				h.sendConfig(w, r, newConfig, clientID)
@@ -108,7 +136,7 @@ func (h *Handler) ServeConfig(w http.ResponseWriter, r *http.Request) {
 	case <-timer.C:
 		// Timeout - check if version changed
 		state, _ = h.repo.GetClient(ctx, clientID)
-		if state != nil && state.ComputedConfig != nil {
+		if state != nil && state.ComputedConfig != nil && auth.CheckClientSecret(state.SecretHash, secret) {
 			newConfig := *state.ComputedConfig
 			if newConfig.Version != config.Version {
 				h.sendConfig(w, r, newConfig, clientID)
@@ -116,12 +144,86 @@ func (h *Handler) ServeConfig(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		// Nothing changed - close connection, client will reconnect
+	case <-h.shutdown:
+		// Server is stopping - close connection, client will reconnect
 	case <-r.Context().Done():
 		return
 	}
 }
 
+// ReportUsage accepts access time consumed on the client (username -> seconds).
+// Config version is bumped only if the remaining budget changes allowed intervals.
+func (h *Handler) ReportUsage(w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" {
+		http.Error(w, "client_id required", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Usage map[string]int `json:"usage"` // username -> seconds
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	usage := make(map[string]time.Duration, len(req.Usage))
+	for username, secs := range req.Usage {
+		if secs < 0 || secs > maxUsageReportSeconds {
+			http.Error(w, "usage out of range", http.StatusBadRequest)
+			return
+		}
+		usage[username] = time.Duration(secs) * time.Second
+	}
+
+	ctx := r.Context()
+	state, err := h.repo.GetClient(ctx, clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if state == nil {
+		http.Error(w, "client not found", http.StatusForbidden)
+		return
+	}
+	if !auth.CheckClientSecret(state.SecretHash, clientSecret(r)) {
+		rejectClient(w)
+		return
+	}
+	if err := h.repo.AddUsage(ctx, clientID, usage); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state, _ = h.repo.GetClient(ctx, clientID)
+	if state != nil && state.ComputedConfig != nil && server.IntervalsChanged(state, *state.ComputedConfig) {
+		h.repo.IncrementConfigVersion(ctx, clientID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// clientSecret returns the agent's secret sent as "Authorization: Bearer <secret>"
+func clientSecret(r *http.Request) string {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return secret
+}
+
+func rejectClient(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="aegis"`)
+	http.Error(w, "invalid client secret", http.StatusUnauthorized)
+}
+
 func (h *Handler) sendConfig(w http.ResponseWriter, r *http.Request, config domain.ClientConfig, clientID string) {
+	var body any = config
+	if h.signer != nil {
+		env, err := h.signer.Sign(clientID, config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = env
+	}
 	ctx := r.Context()
 	state, _ := h.repo.GetClient(ctx, clientID)
 	if state != nil {
@@ -132,5 +234,15 @@ func (h *Handler) sendConfig(w http.ResponseWriter, r *http.Request, config doma
 		h.repo.UpdateLastSent(ctx, clientID, intervals)
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(config)
+	json.NewEncoder(w).Encode(body)
+}
+
+// SigningKey returns the public key agents pin at install to check configs
+func (h *Handler) SigningKey(w http.ResponseWriter, r *http.Request) {
+	pub := h.signer.PublicKey()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"public_key":  base64.StdEncoding.EncodeToString(pub),
+		"fingerprint": signing.Fingerprint(pub),
+	})
 }
@@ -1,13 +1,26 @@
 package http
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aegis/parental-control/internal/adapter/auth"
+	"github.com/aegis/parental-control/internal/adapter/eventlog"
 	"github.com/aegis/parental-control/internal/adapter/jsonfile"
+	"github.com/aegis/parental-control/internal/adapter/signing"
 	"github.com/aegis/parental-control/internal/domain"
 	"github.com/aegis/parental-control/internal/port"
 	"github.com/aegis/parental-control/internal/usecase/server"
@@ -31,16 +44,84 @@ func (m *mockRepo) SaveClient(ctx context.Context, client *port.ClientState) err
 	m.state = client
 	return nil
 }
+func (m *mockRepo) UpdateClient(ctx context.Context, clientID string, update port.ClientUpdate) error {
+	if m.state == nil {
+		return port.ErrClientNotFound
+	}
+	if update.Name != nil {
+		m.state.Name = *update.Name
+	}
+	if update.WindowDays != nil {
+		m.state.WindowDays = *update.WindowDays
+	}
+	if update.TimeZone != nil {
+		m.state.TimeZone = *update.TimeZone
+	}
+	return nil
+}
+func (m *mockRepo) SetClientSecret(ctx context.Context, clientID, secretHash string) error {
+	if m.state == nil {
+		return port.ErrClientNotFound
+	}
+	m.state.SecretHash = secretHash
+	return nil
+}
 func (m *mockRepo) AddUser(ctx context.Context, clientID string, user domain.User) error { return nil }
 func (m *mockRepo) UpdateUserSchedule(ctx context.Context, clientID, userID string, schedule domain.DaySchedule) error {
 	return nil
 }
+func (m *mockRepo) SetDateOverride(ctx context.Context, clientID, userID, date string, override domain.DateOverride) error {
+	return nil
+}
+func (m *mockRepo) SetDateOverrides(ctx context.Context, clientID, userID string, overrides domain.DateOverrides) error {
+	return nil
+}
+func (m *mockRepo) DeleteDateOverride(ctx context.Context, clientID, userID, date string) error {
+	return nil
+}
+func (m *mockRepo) UpdateUserBudget(ctx context.Context, clientID, userID string, budget domain.DailyBudget) error {
+	return nil
+}
+func (m *mockRepo) AddUsage(ctx context.Context, clientID string, usage map[string]time.Duration) error {
+	return nil
+}
+func (m *mockRepo) UpdateUserPeriods(ctx context.Context, clientID, userID string, periods []domain.SchedulePeriod) error {
+	return nil
+}
+func (m *mockRepo) SetUserTemplate(ctx context.Context, clientID, userID, templateID string) error {
+	return nil
+}
+func (m *mockRepo) ListTemplates(ctx context.Context) ([]domain.ScheduleTemplate, error) {
+	return nil, nil
+}
+func (m *mockRepo) GetTemplate(ctx context.Context, templateID string) (*domain.ScheduleTemplate, error) {
+	return nil, nil
+}
+func (m *mockRepo) SaveTemplate(ctx context.Context, template domain.ScheduleTemplate) (string, error) {
+	return "", nil
+}
+func (m *mockRepo) DeleteTemplate(ctx context.Context, templateID string) error   { return nil }
 func (m *mockRepo) DeleteUser(ctx context.Context, clientID, userID string) error { return nil }
 func (m *mockRepo) DeleteClient(ctx context.Context, clientID string) error       { return nil }
-func (m *mockRepo) GrantTemporaryAccess(ctx context.Context, clientID, userID string, until time.Time) error {
+func (m *mockRepo) GrantTemporaryAccess(ctx context.Context, clientID, userID string, start, until time.Time, note, admin string) error {
+	return nil
+}
+func (m *mockRepo) UpdateTemporaryAccess(ctx context.Context, clientID, requestID string, until time.Time) error {
+	return nil
+}
+func (m *mockRepo) GrantOverride(ctx context.Context, clientID, userID string, start, until time.Time, priority int, reason, admin string) error {
+	return nil
+}
+func (m *mockRepo) DeleteOverrideGrant(ctx context.Context, clientID, grantID string) error {
 	return nil
 }
-func (m *mockRepo) BlockClient(ctx context.Context, clientID, userID string, start, until time.Time) error {
+func (m *mockRepo) BlockClient(ctx context.Context, clientID, userID string, start, until time.Time, priority int, note, admin string) error {
+	return nil
+}
+func (m *mockRepo) AddBlockRule(ctx context.Context, clientID string, rule port.BlockRule) (string, error) {
+	return "", nil
+}
+func (m *mockRepo) DeleteBlockRule(ctx context.Context, clientID, ruleID string) error {
 	return nil
 }
 func (m *mockRepo) DeleteBlockRequest(ctx context.Context, clientID, requestID string) error {
@@ -55,26 +136,70 @@ func (m *mockRepo) UpdateLastSent(ctx context.Context, clientID string, interval
 func (m *mockRepo) IncrementConfigVersion(ctx context.Context, clientID string) error {
 	return nil
 }
+func (m *mockRepo) RecomputeConfig(ctx context.Context, clientID string) error {
+	return nil
+}
+func (m *mockRepo) History(ctx context.Context, clientID string) ([]port.HistoryEntry, error) {
+	return nil, nil
+}
 func (m *mockRepo) Subscribe(ctx context.Context, clientID string) <-chan struct{} {
 	ch := make(chan struct{}, 1)
 	return ch
 }
 
+// testSecret is the agent secret of clients made by tests
+const testSecret = "test-secret"
+
+// agentRequest is a request from an agent holding testSecret
+func agentRequest(method, url string) *http.Request {
+	req := httptest.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", "Bearer "+testSecret)
+	return req
+}
+
+// newTestRepo returns a repository in a temporary file, and its path, holding clients;
+// clients without a secret get testSecret
+func newTestRepo(t *testing.T, clients ...*port.ClientState) (*jsonfile.Repository, string) {
+	t.Helper()
+	path := t.TempDir() + "/test.json"
+	repo, err := jsonfile.New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients {
+		if c.SecretHash == "" {
+			c.SecretHash = auth.HashClientSecret(testSecret)
+		}
+		if err := repo.SaveClient(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo, path
+}
+
+// newMux serves the API over repo; admins and signer may be nil
+func newMux(repo port.ConfigRepository, admins *auth.Service, signer *signing.Signer) *http.ServeMux {
+	mux := http.NewServeMux()
+	NewHandler(repo, time.UTC, admins, signer).RegisterRoutes(mux)
+	return mux
+}
+
 func TestServeConfig_NewClient(t *testing.T) {
 	repo := &mockRepo{}
-	handler := NewHandler(repo, nil)
+	handler := NewHandler(repo, nil, nil, nil)
 
 	// First, save the client
 	clientState := &port.ClientState{
-		ID:    "test-123",
-		Name:  "Test Client",
-		Users: []domain.User{},
+		ID:         "test-123",
+		SecretHash: auth.HashClientSecret(testSecret),
+		Name:       "Test Client",
+		Users:      []domain.User{},
 	}
 	if err := repo.SaveClient(context.Background(), clientState); err != nil {
 		t.Fatal(err)
 	}
 
-	req := httptest.NewRequest("GET", "/api/config?client_id=test-123", nil)
+	req := agentRequest("GET", "/api/config?client_id=test-123")
 	rr := httptest.NewRecorder()
 
 	handler.ServeConfig(rr, req)
@@ -89,7 +214,7 @@ func TestServeConfig_NewClient(t *testing.T) {
 
 func TestServeConfig_NonexistentClient(t *testing.T) {
 	repo := &mockRepo{}
-	handler := NewHandler(repo, nil)
+	handler := NewHandler(repo, nil, nil, nil)
 
 	req := httptest.NewRequest("GET", "/api/config?client_id=nonexistent", nil)
 	rr := httptest.NewRecorder()
@@ -102,31 +227,1219 @@ func TestServeConfig_NonexistentClient(t *testing.T) {
 }
 
 func TestServeConfig_WithJsonfile(t *testing.T) {
-	repo, err := jsonfile.New(t.TempDir()+"/test.json", nil)
-	if err != nil {
-		t.Fatal(err)
+	repo, _ := newTestRepo(t, &port.ClientState{ID: "test-456", Name: "Test Client 456", Users: []domain.User{}})
+	handler := NewHandler(repo, nil, nil, nil)
+
+	req := agentRequest("GET", "/api/config?client_id=test-456")
+	rr := httptest.NewRecorder()
+
+	handler.ServeConfig(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rr.Code)
 	}
-	handler := NewHandler(repo, nil)
+	if rr.Body.Len() == 0 {
+		t.Error("expected non-empty body")
+	}
+}
+
+func TestServeConfig_ShutdownReleasesLongPoll(t *testing.T) {
+	repo := &mockRepo{}
+	handler := NewHandler(repo, nil, nil, nil)
 
-	// First, save the client
 	clientState := &port.ClientState{
-		ID:    "test-456",
-		Name:  "Test Client 456",
-		Users: []domain.User{},
+		ID:              "test-789",
+		Name:            "Test Client 789",
+		Users:           []domain.User{},
+		LastSentVersion: "v1",
+		SecretHash:      auth.HashClientSecret(testSecret),
 	}
 	if err := repo.SaveClient(context.Background(), clientState); err != nil {
 		t.Fatal(err)
 	}
 
-	req := httptest.NewRequest("GET", "/api/config?client_id=test-456", nil)
+	req := agentRequest("GET", "/api/config?client_id=test-789&version=v1")
 	rr := httptest.NewRecorder()
 
-	handler.ServeConfig(rr, req)
+	done := make(chan struct{})
+	go func() {
+		handler.ServeConfig(rr, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("long-poll returned before shutdown")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	handler.Shutdown()
+	handler.Shutdown() // idempotent
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("long-poll not released by shutdown")
+	}
+}
+
+// Thousands of long-polls that end (client disconnects or a change arrives) must not
+// leave subscriptions or memory behind
+func TestServeConfig_SoakLongPolls(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test")
+	}
+	repo, _ := newTestRepo(t, &port.ClientState{ID: "c1", Name: "PC"})
+	mux := newMux(repo, nil, nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, agentRequest("GET", "/api/config?client_id=c1"))
+	var config domain.ClientConfig
+	if err := json.NewDecoder(rr.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	waitSubscribers := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for repo.Subscribers("c1") != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("subscribers = %d, want %d", repo.Subscribers("c1"), want)
+			}
+			runtime.Gosched()
+		}
+	}
+	poll := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		req := agentRequest("GET", "/api/config?client_id=c1&version="+config.Version).WithContext(ctx)
+		done := make(chan struct{})
+		go func() {
+			mux.ServeHTTP(httptest.NewRecorder(), req)
+			close(done)
+		}()
+		waitSubscribers(1)
+		cancel()
+		<-done
+		waitSubscribers(0)
+	}
+	heap := func() uint64 {
+		runtime.GC()
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+
+	for i := 0; i < 500; i++ {
+		poll()
+	}
+	before := heap()
+	for i := 0; i < 5000; i++ {
+		poll()
+	}
+	after := heap()
+	if after > before && after-before > 256<<10 {
+		t.Errorf("heap grew by %d KiB over 5000 polls", (after-before)>>10)
+	}
 
+	// A change still reaches a waiting poll, once for the whole admin action
+	rr = httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		mux.ServeHTTP(rr, agentRequest("GET", "/api/config?client_id=c1&version="+config.Version))
+		close(done)
+	}()
+	waitSubscribers(1)
+	repo.AddUser(context.Background(), "c1", domain.User{ID: "u1", Username: "kid"})
+	repo.IncrementConfigVersion(context.Background(), "c1")
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("long-poll not woken by a change")
+	}
+	var changed domain.ClientConfig
+	if err := json.NewDecoder(rr.Body).Decode(&changed); err != nil || changed.Version == config.Version || len(changed.Users) != 1 {
+		t.Errorf("after change: %+v, %v", changed, err)
+	}
+	waitSubscribers(0)
+}
+
+func TestBlock_ScheduledRange(t *testing.T) {
+	repo, _ := newTestRepo(t, &port.ClientState{ID: "c1", Name: "PC"})
+	mux := newMux(repo, nil, nil)
+
+	start := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	until := start.Add(3 * time.Hour)
+	body := `{"start":"` + start.Format(time.RFC3339) + `","until":"` + until.Format(time.RFC3339) + `"}`
+	req := httptest.NewRequest("POST", "/api/clients/c1/block", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
 	if rr.Code != http.StatusOK {
-		t.Errorf("status = %d, want 200", rr.Code)
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
 	}
-	if rr.Body.Len() == 0 {
-		t.Error("expected non-empty body")
+
+	state, _ := repo.GetClient(context.Background(), "c1")
+	if len(state.BlockRequests) != 1 {
+		t.Fatalf("want 1 block, got %d", len(state.BlockRequests))
+	}
+	b := state.BlockRequests[0]
+	if !b.Start.Equal(start) || !b.Until.Equal(until) {
+		t.Errorf("block: want [%v, %v], got [%v, %v]", start, until, b.Start, b.Until)
+	}
+}
+
+func TestBlock_InvalidRange(t *testing.T) {
+	repo, _ := newTestRepo(t, &port.ClientState{ID: "c1", Name: "PC", Users: []domain.User{{ID: "u1", Username: "kid"}}})
+	mux := newMux(repo, nil, nil)
+
+	start := time.Now().Add(2 * time.Hour).UTC()
+	cases := map[string]string{
+		"until before start":  `{"start":"` + start.Format(time.RFC3339) + `","until":"` + start.Add(-time.Hour).Format(time.RFC3339) + `"}`,
+		"until and duration":  `{"until":"` + start.Format(time.RFC3339) + `","duration":30}`,
+		"no end":              `{"start":"` + start.Format(time.RFC3339) + `"}`,
+		"until in the past":   `{"until":"` + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339) + `"}`,
+		"start too far ahead": `{"start":"` + start.AddDate(2, 0, 0).Format(time.RFC3339) + `","duration":30}`,
+	}
+	for name, body := range cases {
+		req := httptest.NewRequest("POST", "/api/clients/c1/block", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, rr.Code)
+		}
+	}
+
+	// A misspelled user or client must not be stored as a block that matches nothing
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/block", strings.NewReader(`{"user_id":"u2","duration":30}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown user: status = %d, want 400", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c2/block", strings.NewReader(`{"duration":30}`)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown client: status = %d, want 404", rr.Code)
+	}
+	if state, _ := repo.GetClient(context.Background(), "c1"); len(state.BlockRequests) != 0 {
+		t.Errorf("blocks stored: %+v", state.BlockRequests)
+	}
+}
+
+func TestTemporaryAccess_ScheduleAndExtend(t *testing.T) {
+	repo, _ := newTestRepo(t, &port.ClientState{ID: "c1", Name: "PC", Users: []domain.User{{ID: "u1", Username: "kid"}}})
+	mux := newMux(repo, nil, nil)
+
+	start := time.Now().Add(5 * time.Hour).UTC().Truncate(time.Second)
+	for _, tc := range []struct {
+		name, path, body string
+		want             int
+	}{
+		{"no user", "/api/clients/c1/temporary-access", `{"duration":60}`, http.StatusBadRequest},
+		{"unknown user", "/api/clients/c1/temporary-access", `{"user_id":"u2","duration":60}`, http.StatusBadRequest},
+		{"unknown client", "/api/clients/c2/temporary-access", `{"user_id":"u1","duration":60}`, http.StatusNotFound},
+	} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body)))
+		if rr.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, rr.Code, tc.want)
+		}
+	}
+
+	body := `{"user_id":"u1","start":"` + start.Format(time.RFC3339) + `","duration":60}`
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/temporary-access", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("grant: status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	state, _ := repo.GetClient(context.Background(), "c1")
+	if len(state.TemporaryAccessRequests) != 1 {
+		t.Fatalf("want 1 grant, got %d", len(state.TemporaryAccessRequests))
+	}
+	grant := state.TemporaryAccessRequests[0]
+	if !grant.Start.Equal(start) || !grant.Until.Equal(start.Add(time.Hour)) {
+		t.Fatalf("grant: want [%v, %v], got [%v, %v]", start, start.Add(time.Hour), grant.Start, grant.Until)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/clients/c1/temporary-access/"+grant.ID, strings.NewReader(`{"delta":30}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("extend: status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	state, _ = repo.GetClient(context.Background(), "c1")
+	if len(state.TemporaryAccessRequests) != 1 {
+		t.Fatalf("extend must not add a grant, got %d", len(state.TemporaryAccessRequests))
+	}
+	if want := start.Add(90 * time.Minute); !state.TemporaryAccessRequests[0].Until.Equal(want) {
+		t.Errorf("until: want %v, got %v", want, state.TemporaryAccessRequests[0].Until)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/clients/c1/temporary-access/"+grant.ID, strings.NewReader(`{"delta":-120}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("shorten before start: status = %d, want 400", rr.Code)
+	}
+
+	// A grant running now cannot be moved to end in the past: that is a revoke
+	started := time.Now().Add(-time.Hour)
+	if err := repo.GrantTemporaryAccess(context.Background(), "c1", "u1", started, started.Add(2*time.Hour), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	state, _ = repo.GetClient(context.Background(), "c1")
+	running := state.TemporaryAccessRequests[1]
+	past := time.Now().Add(-30 * time.Minute).UTC().Format(time.RFC3339)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/clients/c1/temporary-access/"+running.ID, strings.NewReader(`{"until":"`+past+`"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("until in the past: status = %d, want 400", rr.Code)
+	}
+	if err := repo.UpdateTemporaryAccess(context.Background(), "c1", running.ID, started.Add(30*time.Minute)); !errors.Is(err, port.ErrInvalidUntil) {
+		t.Errorf("repository: until in the past got %v, want ErrInvalidUntil", err)
+	}
+	if err := repo.UpdateTemporaryAccess(context.Background(), "c1", grant.ID, start.Add(-time.Minute)); !errors.Is(err, port.ErrInvalidUntil) {
+		t.Errorf("repository: until before start got %v, want ErrInvalidUntil", err)
+	}
+
+	// An ended grant is still listed for a day, but it is gone for extension
+	if err := repo.GrantTemporaryAccess(context.Background(), "c1", "u1", started.Add(-time.Hour), started, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	state, _ = repo.GetClient(context.Background(), "c1")
+	ended := state.TemporaryAccessRequests[2]
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/clients/c1/temporary-access/"+ended.ID, strings.NewReader(`{"delta":180}`)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("extend ended grant: status = %d, want 404", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/clients/c1/temporary-access/unknown", strings.NewReader(`{"delta":30}`)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown grant: status = %d, want 404", rr.Code)
+	}
+}
+
+func TestBlockRule_PersistedAndApplied(t *testing.T) {
+	allDay := domain.DaySchedule{}
+	for _, d := range domain.DayNames {
+		allDay[d] = []domain.TimeInterval{{Start: "00:00", End: "23:59"}}
+	}
+	client := &port.ClientState{
+		ID:    "c1",
+		Name:  "PC",
+		Users: []domain.User{{ID: "u1", Name: "Kid", Username: "kid", Schedule: allDay}},
+	}
+	repo, path := newTestRepo(t, client)
+	mux := newMux(repo, nil, nil)
+
+	body := `{"days":["monday","tuesday","wednesday","thursday","friday","saturday","sunday"],"start":"16:00","end":"18:00"}`
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/block-rules", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/block-rules", strings.NewReader(`{"days":["Monday"],"start":"16:00","end":"18:00"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid day: status = %d, want 400", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/block-rules", strings.NewReader(`{"user_id":"u2","days":["monday"],"start":"16:00","end":"18:00"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown user: status = %d, want 400", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c2/block-rules", strings.NewReader(`{"days":["monday"],"start":"16:00","end":"18:00"}`)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown client: status = %d, want 404", rr.Code)
+	}
+
+	// Reload from disk
+	repo, err := jsonfile.New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, _ := repo.GetClient(context.Background(), "c1")
+	if len(state.BlockRules) != 1 {
+		t.Fatalf("want 1 rule after reload, got %d", len(state.BlockRules))
+	}
+	for _, iv := range state.ComputedConfig.Users[0].AllowedIntervals {
+		if overlap := state.BlockRules[0].Ranges(iv.Start, iv.End); len(overlap) > 0 {
+			t.Errorf("interval %v overlaps homework block %v", iv, overlap)
+		}
+	}
+}
+
+func TestUpdateClient_WindowDays(t *testing.T) {
+	allDay := domain.DaySchedule{}
+	for _, d := range domain.DayNames {
+		allDay[d] = []domain.TimeInterval{{Start: "00:00", End: "23:59"}}
+	}
+	client := &port.ClientState{
+		ID:    "c1",
+		Name:  "PC",
+		Users: []domain.User{{ID: "u1", Name: "Kid", Username: "kid", Schedule: allDay}},
+	}
+	repo, _ := newTestRepo(t, client)
+	mux := newMux(repo, nil, nil)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/clients/c1", strings.NewReader(`{"window_days":7}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	state, _ := repo.GetClient(context.Background(), "c1")
+	if state.WindowDays != 7 || state.Name != "PC" {
+		t.Fatalf("want window 7 and name kept, got %d %q", state.WindowDays, state.Name)
+	}
+	ivs := state.ComputedConfig.Users[0].AllowedIntervals
+	if last := ivs[len(ivs)-1].End; last.Before(time.Now().Add(6 * 24 * time.Hour)) {
+		t.Errorf("intervals end at %v, want at least 6 days ahead", last)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/clients/c1", strings.NewReader(`{"window_days":30}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("too long window: status = %d, want 400", rr.Code)
+	}
+}
+
+func TestUpdateClient_TimeZone(t *testing.T) {
+	daily := domain.DaySchedule{}
+	for _, d := range domain.DayNames {
+		daily[d] = []domain.TimeInterval{{Start: "09:00", End: "10:00"}}
+	}
+	client := &port.ClientState{
+		ID:    "c1",
+		Name:  "Laptop",
+		Users: []domain.User{{ID: "u1", Name: "Kid", Username: "kid", Schedule: daily}},
+	}
+	repo, _ := newTestRepo(t, client)
+	mux := newMux(repo, nil, nil)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/clients/c1", strings.NewReader(`{"time_zone":"Asia/Tokyo"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	state, _ := repo.GetClient(context.Background(), "c1")
+	ivs := state.ComputedConfig.Users[0].AllowedIntervals
+	if len(ivs) == 0 {
+		t.Fatal("want intervals")
+	}
+	for _, iv := range ivs {
+		if iv.End.In(tokyo).Hour() != 10 {
+			t.Errorf("interval %v must end at 10:00 Asia/Tokyo", iv)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/clients/c1", strings.NewReader(`{"time_zone":"Mars/Olympus"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown zone: status = %d, want 400", rr.Code)
+	}
+}
+
+func TestUpdateSchedule_ValidationErrors(t *testing.T) {
+	handler := NewHandler(&mockRepo{state: &port.ClientState{ID: "c1", Users: []domain.User{{ID: "u1"}}}}, time.UTC, nil, nil)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	body := `{"schedule":{"Monday":[{"start":"09:00","end":"10:00"}],"tuesday":[{"start":"9am","end":"10:00"},{"start":"12:00","end":"12:00"}]}}`
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/clients/c1/users/u1/schedule", strings.NewReader(body)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rr.Code)
+	}
+	var resp struct {
+		Fields []domain.FieldError `json:"fields"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, f := range resp.Fields {
+		got[f.Field] = true
+	}
+	for _, want := range []string{"schedule.Monday", "schedule.tuesday[0].start", "schedule.tuesday[1]"} {
+		if !got[want] {
+			t.Errorf("missing error for %s, got %v", want, resp.Fields)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/clients/c1/users/u1/schedule", strings.NewReader(`{"schedule":{"monday":[{"start":"09:00","end":"10:00"}]}}`)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("valid schedule: status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestUpdateBudget_ValidationErrors(t *testing.T) {
+	handler := NewHandler(&mockRepo{state: &port.ClientState{ID: "c1", Users: []domain.User{{ID: "u1"}}}}, time.UTC, nil, nil)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	for _, tc := range []struct{ method, path string }{
+		{"PUT", "/api/clients/c1/users/u1/budget"},
+		{"POST", "/api/clients/c1/users"},
+	} {
+		method, path := tc.method, tc.path
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(`{"budget":{"Monday":60,"tuesday":2000}}`)))
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s %s: status = %d, want 400", method, path, rr.Code)
+		}
+		var resp struct {
+			Fields []domain.FieldError `json:"fields"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Fields) != 2 || resp.Fields[0].Field != "budget.Monday" || resp.Fields[1].Field != "budget.tuesday" {
+			t.Errorf("%s %s: fields = %v, want budget.Monday and budget.tuesday", method, path, resp.Fields)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/clients/c1/users/u1/budget", strings.NewReader(`{"budget":{"monday":60}}`)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("valid budget: status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestTemplate_MergedScheduleValidated(t *testing.T) {
+	own := domain.DaySchedule{"tuesday": {{Start: "01:00", End: "03:00"}}}
+	repo, _ := newTestRepo(t, &port.ClientState{ID: "c1", Name: "PC", Users: []domain.User{{ID: "u1", Username: "kid", Schedule: own}}})
+	mux := newMux(repo, nil, nil)
+	tid, _ := repo.SaveTemplate(context.Background(), domain.ScheduleTemplate{Name: "Late", Schedule: domain.DaySchedule{"monday": {{Start: "22:00", End: "02:00"}}}})
+	do := func(method, url, body string) int {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	// Monday night runs into the own Tuesday morning
+	if code := do("PUT", "/api/clients/c1/users/u1/template", `{"template_id":"`+tid+`"}`); code != http.StatusBadRequest {
+		t.Errorf("apply colliding template: status = %d, want 400", code)
+	}
+	if code := do("POST", "/api/clients/c1/users", `{"username":"other","template_id":"`+tid+`","schedule":{"tuesday":[{"start":"00:30","end":"01:00"}]}}`); code != http.StatusBadRequest {
+		t.Errorf("add user with colliding template: status = %d, want 400", code)
+	}
+	if code := do("PUT", "/api/clients/c1/users/u1/schedule", `{"schedule":{"tuesday":[{"start":"09:00","end":"10:00"}]}}`); code != http.StatusOK {
+		t.Fatalf("own schedule: status = %d", code)
+	}
+	if code := do("PUT", "/api/clients/c1/users/u1/template", `{"template_id":"`+tid+`"}`); code != http.StatusOK {
+		t.Fatalf("apply template: status = %d", code)
+	}
+	if code := do("PUT", "/api/clients/c1/users/u1/schedule", `{"schedule":{"tuesday":[{"start":"01:00","end":"03:00"}]}}`); code != http.StatusBadRequest {
+		t.Errorf("colliding own schedule: status = %d, want 400", code)
+	}
+	if code := do("PUT", "/api/templates/"+tid, `{"name":"Late","schedule":{"monday":[{"start":"23:00","end":"10:00"}]}}`); code != http.StatusBadRequest {
+		t.Errorf("template colliding with a user: status = %d, want 400", code)
+	}
+}
+
+func TestTemplate_UpdateBumpsAffectedClients(t *testing.T) {
+	repo, _ := newTestRepo(t)
+	mux := newMux(repo, nil, nil)
+	ctx := context.Background()
+
+	week := func(start, end string) string {
+		var days []string
+		for _, d := range domain.DayNames {
+			days = append(days, fmt.Sprintf(`"%s":[{"start":"%s","end":"%s"}]`, d, start, end))
+		}
+		return `{"name":"School week","schedule":{` + strings.Join(days, ",") + `}}`
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/templates", strings.NewReader(week("09:00", "10:00"))))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("create: status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(rr.Body).Decode(&created)
+
+	for _, id := range []string{"c1", "c2", "c3"} {
+		client := &port.ClientState{ID: id, Name: id, Users: []domain.User{{ID: "u-" + id, Name: "Kid", Username: "kid"}}}
+		if id != "c3" {
+			client.Users[0].TemplateID = created.ID
+		}
+		if err := repo.SaveClient(ctx, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions := map[string]string{}
+	subs := map[string]<-chan struct{}{}
+	for _, id := range []string{"c1", "c2", "c3"} {
+		state, _ := repo.GetClient(ctx, id)
+		versions[id] = state.LastSentVersion
+		subs[id] = repo.Subscribe(ctx, id)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/templates/"+created.ID, strings.NewReader(week("15:00", "16:00"))))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("update: status = %d: %s", rr.Code, rr.Body.String())
+	}
+	for _, id := range []string{"c1", "c2"} {
+		state, _ := repo.GetClient(ctx, id)
+		if state.LastSentVersion == versions[id] {
+			t.Errorf("%s: version not bumped", id)
+		}
+		select {
+		case <-subs[id]:
+		case <-time.After(time.Second): // notifications are coalesced, not instant
+			t.Errorf("%s: subscriber not notified", id)
+		}
+		ivs := state.ComputedConfig.Users[0].AllowedIntervals
+		if len(ivs) == 0 || ivs[0].End.Hour() != 16 {
+			t.Errorf("%s: want intervals from updated template, got %v", id, ivs)
+		}
+	}
+	if state, _ := repo.GetClient(ctx, "c3"); state.LastSentVersion != versions["c3"] {
+		t.Error("c3 does not use the template, version must not change")
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/templates/"+created.ID, nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("delete used template: status = %d, want 409", rr.Code)
+	}
+}
+
+func TestUpdatePeriods_PreviewShowsActivePeriod(t *testing.T) {
+	client := &port.ClientState{ID: "c1", Name: "PC", Users: []domain.User{{ID: "u1", Name: "Kid", Username: "kid"}}}
+	repo, _ := newTestRepo(t, client)
+	mux := newMux(repo, nil, nil)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/clients/c1/users/u1/periods", strings.NewReader(`{"periods":[{"name":"Holidays","from":"06-01"}]}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("yearly period without end: status = %d, want 400", rr.Code)
+	}
+
+	// Open-ended period starting today is in effect on every day of the window
+	today := time.Now().UTC().Format(domain.DateLayout)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/clients/c1/users/u1/periods", strings.NewReader(`{"periods":[{"name":"Holidays","from":"`+today+`"}]}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/c1/preview", nil))
+	var preview struct {
+		Periods map[string]map[string]string `json:"periods"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	if got := preview.Periods["kid"][today]; got != "Holidays" {
+		t.Errorf("period for %s = %q, want Holidays", today, got)
+	}
+}
+
+func TestCalendar_ImportAndExport(t *testing.T) {
+	daily := domain.DaySchedule{}
+	for _, d := range domain.DayNames {
+		daily[d] = []domain.TimeInterval{{Start: "00:00", End: "23:59"}}
+	}
+	client := &port.ClientState{ID: "c1", Name: "PC", Users: []domain.User{
+		{ID: "u1", Name: "Kid", Username: "kid", Schedule: daily},
+		{ID: "u2", Name: "Teen", Username: "teen", Schedule: daily},
+	}}
+	repo, _ := newTestRepo(t, client)
+	mux := newMux(repo, nil, nil)
+
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1)
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	ics := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART;VALUE=DATE:" + tomorrow.Format("20060102") + "\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nDTSTART;VALUE=DATE:" + yesterday.Format("20060102") + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/calendar-import?user_id=u1&use_day=none", strings.NewReader(ics)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("import: status = %d: %s", rr.Code, rr.Body.String())
+	}
+	state, _ := repo.GetClient(context.Background(), "c1")
+	overrides := state.Users[0].Overrides
+	if _, ok := overrides[tomorrow.Format(domain.DateLayout)]; !ok || len(overrides) != 1 {
+		t.Errorf("want only tomorrow imported for u1, got %v", overrides)
+	}
+	if len(state.Users[1].Overrides) != 0 {
+		t.Errorf("u2 must not be affected, got %v", state.Users[1].Overrides)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/c1/users/u1/calendar.ics", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("export: status = %d, content type %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	events := strings.Count(rr.Body.String(), "BEGIN:VEVENT")
+	if want := len(state.ComputedConfig.Users[0].AllowedIntervals); events != want {
+		t.Errorf("export has %d events, want %d as sent to client", events, want)
+	}
+	if strings.Contains(rr.Body.String(), "DTSTART:"+tomorrow.Format("20060102")) {
+		t.Error("tomorrow is a holiday without access, must not be exported")
+	}
+}
+
+func TestExplain_GlobalBlock(t *testing.T) {
+	daily := domain.DaySchedule{}
+	for _, d := range domain.DayNames {
+		daily[d] = []domain.TimeInterval{{Start: "00:00", End: "23:59"}}
+	}
+	now := time.Now().UTC()
+	client := &port.ClientState{
+		ID:            "c1",
+		Name:          "PC",
+		Users:         []domain.User{{ID: "u1", Name: "Kid", Username: "kid", Schedule: daily}},
+		BlockRequests: []port.BlockRequest{{ID: "b1", Start: now.Add(-time.Minute), Until: now.Add(time.Hour)}},
+	}
+	repo, _ := newTestRepo(t, client)
+	mux := newMux(repo, nil, nil)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/c1/users/u1/explain", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Segment domain.Segment `json:"segment"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Segment.Allowed || resp.Segment.Source.Kind != domain.SourceBlock || resp.Segment.Source.ID != "b1" {
+		t.Errorf("want denied by block b1, got %+v", resp.Segment)
+	}
+
+	for path, want := range map[string]int{
+		"/api/clients/c1/users/u2/explain":                                                  http.StatusNotFound,
+		"/api/clients/c1/users/u1/explain?at=yesterday":                                     http.StatusBadRequest,
+		"/api/clients/c1/users/u1/explain?at=" + now.AddDate(0, 0, 30).Format(time.RFC3339): http.StatusBadRequest,
+	} {
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != want {
+			t.Errorf("%s: status = %d, want %d", path, rr.Code, want)
+		}
+	}
+}
+
+func TestSimulate_DoesNotTouchRepository(t *testing.T) {
+	stored := domain.DaySchedule{"monday": {{Start: "09:00", End: "12:00"}}}
+	client := &port.ClientState{
+		ID:    "c1",
+		Name:  "PC",
+		Users: []domain.User{{ID: "u1", Name: "Kid", Username: "kid", Schedule: stored}},
+	}
+	repo, _ := newTestRepo(t, client)
+	mux := newMux(repo, nil, nil)
+	before, _ := repo.GetClient(context.Background(), "c1")
+
+	// Two Mondays: 7 and 14 Jan 2030; the second is partly blocked
+	body := `{
+		"from": "2030-01-07T00:00:00Z",
+		"to": "2030-01-21T00:00:00Z",
+		"users": [{"user_id": "u1", "schedule": {"monday": [{"start": "10:00", "end": "11:00"}]}}],
+		"blocks": [{"start": "2030-01-14T10:30:00Z", "until": "2030-01-14T12:00:00Z"}]
+	}`
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/simulate", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Users []server.SimulatedUser `json:"users"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Users) != 1 {
+		t.Fatalf("want 1 user, got %d", len(resp.Users))
+	}
+	want := []domain.AllowedInterval{
+		{Start: time.Date(2030, 1, 7, 10, 0, 0, 0, time.UTC), End: time.Date(2030, 1, 7, 11, 0, 0, 0, time.UTC)},
+		{Start: time.Date(2030, 1, 14, 10, 0, 0, 0, time.UTC), End: time.Date(2030, 1, 14, 10, 30, 0, 0, time.UTC)},
+	}
+	got := resp.Users[0].AllowedIntervals
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if !got[i].Start.Equal(want[i].Start) || !got[i].End.Equal(want[i].End) {
+			t.Errorf("interval %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+	if n := len(resp.Users[0].Transitions); n != 4 {
+		t.Errorf("want 4 transitions, got %d", n)
+	}
+
+	after, _ := repo.GetClient(context.Background(), "c1")
+	if !reflect.DeepEqual(after.Users[0].Schedule, stored) || len(after.BlockRequests) != 0 {
+		t.Errorf("stored state changed: %+v", after)
+	}
+	if after.ComputedConfig.Version != before.ComputedConfig.Version {
+		t.Errorf("version changed: %s -> %s", before.ComputedConfig.Version, after.ComputedConfig.Version)
+	}
+
+	for name, body := range map[string]string{
+		"invalid schedule": `{"users": [{"user_id": "u1", "schedule": {"monday": [{"start": "10:00", "end": "10:00"}]}}]}`,
+		"unknown user":     `{"users": [{"user_id": "u2", "schedule": {}}]}`,
+		"range too long":   `{"from": "2030-01-01T00:00:00Z", "to": "2030-12-31T00:00:00Z"}`,
+	} {
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/simulate", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, rr.Code)
+		}
+	}
+}
+
+func TestAlwaysAllow_BeatsGlobalBlock(t *testing.T) {
+	now := time.Now().UTC()
+	client := &port.ClientState{
+		ID:   "c1",
+		Name: "PC",
+		Users: []domain.User{
+			{ID: "u1", Name: "Kid", Username: "kid", Schedule: domain.DaySchedule{}},
+			{ID: "u2", Name: "Sibling", Username: "sibling", Schedule: domain.DaySchedule{}},
+		},
+		BlockRequests: []port.BlockRequest{{ID: "b1", Start: now.Add(-time.Minute), Until: now.Add(3 * time.Hour)}},
+	}
+	repo, _ := newTestRepo(t, client)
+	mux := newMux(repo, nil, nil)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/always-allow",
+		strings.NewReader(`{"user_id": "u1", "duration": 90, "reason": "online exam"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c2/always-allow", strings.NewReader(`{"user_id": "u1", "duration": 90}`)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown client: status = %d, want 404", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/always-allow", strings.NewReader(`{"user_id": "u3", "duration": 90}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown user: status = %d, want 400", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/c1/preview", nil))
+	var preview struct {
+		Users       []domain.UserAccessConfig       `json:"users"`
+		AlwaysAllow map[string][]port.OverrideGrant `json:"always_allow"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range preview.Users {
+		if want := u.Username == "kid"; (len(u.AllowedIntervals) > 0) != want {
+			t.Errorf("%s: intervals %v, want access = %v", u.Username, u.AllowedIntervals, want)
+		}
+	}
+	if g := preview.AlwaysAllow["kid"]; len(g) != 1 || g[0].Priority != 1 || g[0].Reason != "online exam" {
+		t.Errorf("always_allow = %+v", preview.AlwaysAllow)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/c1/users/u1/explain", nil))
+	var explain struct {
+		Segment domain.Segment `json:"segment"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&explain); err != nil {
+		t.Fatal(err)
+	}
+	if !explain.Segment.Allowed || explain.Segment.Source.Kind != domain.SourceOverride {
+		t.Errorf("want allowed by always_allow, got %+v", explain.Segment)
+	}
+
+	// A block of the grant's priority wins again
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients/c1/block",
+		strings.NewReader(`{"user_id": "u1", "duration": 30, "priority": 1}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("block: status = %d: %s", rr.Code, rr.Body.String())
+	}
+	state, _ := repo.GetClient(context.Background(), "c1")
+	for _, u := range state.ComputedConfig.Users {
+		if u.Username == "kid" && len(u.AllowedIntervals) > 0 && !u.AllowedIntervals[0].Start.After(now) {
+			t.Errorf("kid still allowed now: %v", u.AllowedIntervals)
+		}
+	}
+}
+
+func TestConfigAt(t *testing.T) {
+	mux := http.NewServeMux()
+	NewHandler(&mockRepo{}, nil, nil, nil).RegisterRoutes(mux)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/c1/config-at?t=2026-03-01T10:00:00Z", nil))
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("without history: status = %d, want 501", rr.Code)
+	}
+
+	repo, err := eventlog.New(t.TempDir(), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	mux = newMux(repo, nil, nil)
+	ctx := context.Background()
+	if err := repo.SaveClient(ctx, &port.ClientState{ID: "c1", Name: "PC"}); err != nil {
+		t.Fatal(err)
+	}
+	allDay := domain.DaySchedule{}
+	for _, d := range domain.DayNames {
+		allDay[d] = []domain.TimeInterval{{Start: "00:00", End: "23:59"}}
+	}
+	if err := repo.AddUser(ctx, "c1", domain.User{ID: "u1", Username: "kid", Schedule: allDay}); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().UTC()
+	if err := repo.UpdateUserSchedule(ctx, "c1", "u1", domain.DaySchedule{}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(at time.Time) domain.ClientConfig {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/c1/config-at?t="+at.UTC().Format(time.RFC3339Nano), nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+		}
+		var config domain.ClientConfig
+		if err := json.NewDecoder(rr.Body).Decode(&config); err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	if c := get(before); len(c.Users) != 1 || len(c.Users[0].AllowedIntervals) == 0 {
+		t.Errorf("before the change: %+v", c)
+	}
+	if c := get(time.Now().Add(time.Second)); len(c.Users) != 1 || len(c.Users[0].AllowedIntervals) != 0 {
+		t.Errorf("after the change: %+v", c)
+	}
+}
+
+func TestHistory_FilterAndPage(t *testing.T) {
+	repo, _ := newTestRepo(t, &port.ClientState{ID: "c1", Name: "PC", Users: []domain.User{{ID: "u1", Username: "kid"}, {ID: "u2", Username: "teen"}}})
+	mux := newMux(repo, nil, nil)
+
+	post := func(path, body string) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", path, rr.Code, rr.Body.String())
+		}
+	}
+	for i := 0; i < 3; i++ {
+		post("/api/clients/c1/temporary-access", `{"user_id":"u1","duration":60,"note":"уроки"}`)
+	}
+	post("/api/clients/c1/temporary-access", `{"user_id":"u2","duration":30}`)
+	post("/api/clients/c1/block", `{"duration":120,"note":"ужин"}`)
+
+	type page struct {
+		Entries []struct {
+			Type     string `json:"type"`
+			Username string `json:"username"`
+			Note     string `json:"note"`
+			Minutes  int    `json:"minutes"`
+		} `json:"entries"`
+		Total        int `json:"total"`
+		TotalMinutes int `json:"total_minutes"`
+	}
+	get := func(query string, wantCode int) page {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/c1/history"+query, nil))
+		if rr.Code != wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", query, rr.Code, wantCode, rr.Body.String())
+		}
+		var p page
+		json.NewDecoder(rr.Body).Decode(&p)
+		return p
+	}
+
+	if p := get("", http.StatusOK); p.Total != 5 || len(p.Entries) != 5 || p.Entries[0].Type != port.HistoryBlock || p.Entries[0].Note != "ужин" {
+		t.Errorf("all: %+v", p)
+	}
+	// Blocks for all users count for every user
+	if p := get("?user_id=u1", http.StatusOK); p.Total != 4 || p.TotalMinutes != 3*60+120 {
+		t.Errorf("u1: %+v", p)
+	}
+	if p := get("?user_id=u1&type=temporary_access&limit=2&offset=2", http.StatusOK); p.Total != 3 || len(p.Entries) != 1 ||
+		p.Entries[0].Username != "kid" || p.Entries[0].Minutes != 60 || p.Entries[0].Note != "уроки" {
+		t.Errorf("u1 temporary access, page 2: %+v", p)
+	}
+	if p := get("?to="+time.Now().Add(-time.Hour).UTC().Format(time.RFC3339), http.StatusOK); p.Total != 0 || p.Entries == nil {
+		t.Errorf("before any grant: %+v", p)
+	}
+	for _, q := range []string{"?limit=0", "?limit=501", "?offset=-1", "?type=unknown", "?from=yesterday"} {
+		get(q, http.StatusBadRequest)
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/missing/history", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("missing client: status = %d, want 404", rr.Code)
+	}
+}
+
+func TestAuth_ProtectsManagementAPI(t *testing.T) {
+	admins, err := auth.New(t.TempDir() + "/admins.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, _ := newTestRepo(t, &port.ClientState{ID: "c1", Users: []domain.User{{ID: "u1", Name: "Kid", Username: "kid"}}})
+	mux := newMux(repo, admins, nil)
+	do := func(method, url, body string, setup func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if setup != nil {
+			setup(req)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("GET", "/api/clients", "", nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("clients without session: status = %d, want 401", rr.Code)
+	}
+	if rr := do("POST", "/api/clients/c1/block", `{"duration":60}`, nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("block without session: status = %d, want 401", rr.Code)
+	}
+	// Agents poll without a session
+	agent := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+testSecret) }
+	if rr := do("GET", "/api/config?client_id=c1", "", agent); rr.Code == http.StatusUnauthorized {
+		t.Error("client config endpoint requires admin login")
+	}
+	if rr := do("GET", "/api/auth/session", "", nil); !strings.Contains(rr.Body.String(), `"setup_required":true`) {
+		t.Errorf("session before setup: %d %s", rr.Code, rr.Body)
+	}
+
+	// Without the token from the server log nobody on the network can claim the server
+	if rr := do("POST", "/api/auth/setup", `{"username":"eve","password":"secret-pass"}`, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("setup without token: status = %d, want 403", rr.Code)
+	}
+	if rr := do("POST", "/api/auth/setup", `{"setup_token":"guess","username":"eve","password":"secret-pass"}`, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("setup with wrong token: status = %d, want 403", rr.Code)
+	}
+	creds := `{"setup_token":"` + admins.SetupToken() + `","username":"mom","password":"secret-pass"}`
+	crossSite := func(r *http.Request) { r.Header.Set("Origin", "http://evil.example") }
+	if rr := do("POST", "/api/auth/setup", creds, crossSite); rr.Code != http.StatusForbidden {
+		t.Errorf("cross-site setup: status = %d, want 403", rr.Code)
+	}
+	rr := do("POST", "/api/auth/setup", creds, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("setup: status = %d, body %s", rr.Code, rr.Body)
+	}
+	var session struct {
+		CSRFToken string `json:"csrf_token"`
+	}
+	json.NewDecoder(rr.Body).Decode(&session)
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode || session.CSRFToken == "" {
+		t.Fatalf("session cookie %+v, csrf %q", cookies, session.CSRFToken)
+	}
+	withCookie := func(r *http.Request) { r.AddCookie(cookies[0]) }
+	withCSRF := func(r *http.Request) { r.AddCookie(cookies[0]); r.Header.Set(csrfHeader, session.CSRFToken) }
+
+	if rr := do("GET", "/api/clients", "", withCookie); rr.Code != http.StatusOK {
+		t.Errorf("clients with session: status = %d, want 200", rr.Code)
+	}
+	if rr := do("POST", "/api/auth/logout", "", withCookie); rr.Code != http.StatusForbidden {
+		t.Errorf("change without CSRF token: status = %d, want 403", rr.Code)
+	}
+	// The history records who blocked
+	if rr := do("POST", "/api/clients/c1/block", `{"duration":60}`, withCSRF); rr.Code != http.StatusOK {
+		t.Errorf("block with session: status = %d", rr.Code)
+	}
+	if history, _ := repo.History(context.Background(), "c1"); len(history) != 1 || history[0].Admin != "mom" {
+		t.Errorf("history after block: %+v", history)
+	}
+
+	// Calendar apps have no session: the feed needs the admin's feed token in the URL
+	feed := "/api/clients/c1/users/u1/calendar.ics"
+	if rr := do("GET", feed, "", nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("feed without session or token: status = %d, want 401", rr.Code)
+	}
+	if rr := do("GET", feed, "", withCookie); rr.Code != http.StatusOK {
+		t.Errorf("feed with session: status = %d, want 200", rr.Code)
+	}
+	var issued struct{ Token string }
+	json.NewDecoder(do("POST", "/api/auth/feed-token", "", withCSRF).Body).Decode(&issued)
+	if issued.Token == "" {
+		t.Fatal("no feed token issued")
+	}
+	if rr := do("GET", feed+"?token="+issued.Token, "", nil); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "BEGIN:VCALENDAR") {
+		t.Errorf("feed with token: status = %d, body %s", rr.Code, rr.Body)
+	}
+	if rr := do("GET", feed+"?token=guess", "", nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("feed with wrong token: status = %d, want 401", rr.Code)
+	}
+	if rr := do("DELETE", "/api/auth/feed-token", "", withCSRF); rr.Code != http.StatusNoContent {
+		t.Errorf("revoke feed token: status = %d, want 204", rr.Code)
+	}
+	if rr := do("GET", feed+"?token="+issued.Token, "", nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("feed with revoked token: status = %d, want 401", rr.Code)
+	}
+
+	if rr := do("POST", "/api/auth/login", `{"username":"mom","password":"wrong-pass"}`, nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: status = %d, want 401", rr.Code)
+	}
+	if rr := do("POST", "/api/auth/logout", "", withCSRF); rr.Code != http.StatusNoContent {
+		t.Errorf("logout: status = %d, want 204", rr.Code)
+	}
+	if rr := do("GET", "/api/clients", "", withCookie); rr.Code != http.StatusUnauthorized {
+		t.Errorf("clients after logout: status = %d, want 401", rr.Code)
+	}
+}
+
+func TestClientSecret_RotateAndRevoke(t *testing.T) {
+	repo, path := newTestRepo(t)
+	mux := newMux(repo, nil, nil)
+	do := func(method, url, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(`{"name":"PC","usage":{}}`))
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/api/clients", "")
+	var created struct{ ID, Secret string }
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil || created.Secret == "" {
+		t.Fatalf("create client: %v, secret %q", err, created.Secret)
+	}
+	config := "/api/config?client_id=" + created.ID
+	usage := "/api/usage?client_id=" + created.ID
+	if rr := do("GET", config, ""); rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("poll without secret: status = %d, want 401 with a challenge", rr.Code)
+	}
+	if rr := do("GET", config, created.ID); rr.Code != http.StatusUnauthorized {
+		t.Errorf("poll with the client ID as secret: status = %d, want 401", rr.Code)
+	}
+	if rr := do("POST", usage, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("usage without secret: status = %d, want 401", rr.Code)
+	}
+	if rr := do("GET", config, created.Secret); rr.Code != http.StatusOK {
+		t.Errorf("poll with secret: status = %d, want 200", rr.Code)
+	}
+	if rr := do("POST", usage, created.Secret); rr.Code != http.StatusOK {
+		t.Errorf("usage with secret: status = %d, want 200", rr.Code)
+	}
+
+	// Only the hash is stored, and it survives a restart
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), created.Secret) {
+		t.Error("secret stored in plain text")
+	}
+	restarted, err := jsonfile.New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux = newMux(restarted, nil, nil)
+	if rr := do("GET", config, created.Secret); rr.Code != http.StatusOK {
+		t.Errorf("poll after restart: status = %d, want 200", rr.Code)
+	}
+
+	var rotated struct{ Secret string }
+	json.NewDecoder(do("POST", "/api/clients/"+created.ID+"/secret", "").Body).Decode(&rotated)
+	if rotated.Secret == "" || rotated.Secret == created.Secret {
+		t.Fatalf("rotated secret %q", rotated.Secret)
+	}
+	if rr := do("GET", config, created.Secret); rr.Code != http.StatusUnauthorized {
+		t.Errorf("poll with old secret: status = %d, want 401", rr.Code)
+	}
+	if rr := do("GET", config, rotated.Secret); rr.Code != http.StatusOK {
+		t.Errorf("poll with new secret: status = %d, want 200", rr.Code)
+	}
+
+	if rr := do("DELETE", "/api/clients/"+created.ID+"/secret", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status = %d", rr.Code)
+	}
+	if rr := do("GET", config, rotated.Secret); rr.Code != http.StatusUnauthorized {
+		t.Errorf("poll after revocation: status = %d, want 401", rr.Code)
+	}
+	if rr := do("GET", "/api/clients/"+created.ID, ""); !strings.Contains(rr.Body.String(), `"has_secret":false`) {
+		t.Errorf("client after revocation: %s", rr.Body)
+	}
+}
+
+func TestFetchConfig_SignedAndReplayProtected(t *testing.T) {
+	repo, _ := newTestRepo(t, &port.ClientState{ID: "c1", Name: "PC"})
+	signer, err := signing.LoadOrCreate(t.TempDir() + "/signing.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	mux := newMux(repo, nil, signer)
+
+	// Records every response, so the test can replay one like an attacker on the LAN
+	var responses [][]byte
+	var replay []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if replay != nil {
+			w.Write(replay)
+			return
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, r)
+		responses = append(responses, rr.Body.Bytes())
+		w.WriteHeader(rr.Code)
+		w.Write(rr.Body.Bytes())
+	}))
+	defer srv.Close()
+
+	var keyResp struct {
+		PublicKey string `json:"public_key"`
+	}
+	resp, err := http.Get(srv.URL + "/api/signing-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&keyResp)
+	resp.Body.Close()
+	pub, _ := base64.StdEncoding.DecodeString(keyResp.PublicKey)
+	if !signer.PublicKey().Equal(ed25519.PublicKey(pub)) {
+		t.Fatal("published key differs from the signing key")
+	}
+	fetcher := NewHTTPConfigFetcher(srv.URL, "c1", testSecret, signing.NewVerifier(pub, "c1", 0))
+
+	allowed, err := fetcher.FetchConfig(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowAllDay := responses[len(responses)-1]
+	repo.BlockClient(ctx, "c1", "", time.Now(), time.Now().Add(time.Hour), 0, "", "")
+	repo.IncrementConfigVersion(ctx, "c1")
+	blocked, err := fetcher.FetchConfig(ctx, "")
+	if err != nil || blocked.Version == allowed.Version {
+		t.Fatalf("after block: %+v, %v", blocked, err)
+	}
+
+	replay = allowAllDay
+	if _, err := fetcher.FetchConfig(ctx, ""); !errors.Is(err, signing.ErrRolledBack) {
+		t.Errorf("replayed config: %v, want ErrRolledBack", err)
+	}
+	unsigned, _ := json.Marshal(*allowed)
+	replay = unsigned
+	if _, err := fetcher.FetchConfig(ctx, ""); !errors.Is(err, signing.ErrUnsigned) {
+		t.Errorf("unsigned config: %v, want ErrUnsigned", err)
+	}
+	var env signing.Envelope
+	json.Unmarshal(allowAllDay, &env)
+	env.Payload = bytes.Replace(env.Payload, []byte(`"sequence":`), []byte(`"sequence":9`), 1)
+	replay, _ = json.Marshal(env)
+	if _, err := fetcher.FetchConfig(ctx, ""); !errors.Is(err, signing.ErrBadSignature) {
+		t.Errorf("config with raised sequence: %v, want ErrBadSignature", err)
 	}
 }
@@ -0,0 +1,60 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HTTPUsageReporter reports consumed access time to server
+type HTTPUsageReporter struct {
+	baseURL  string
+	clientID string
+	secret   string
+	client   *http.Client
+}
+
+func NewHTTPUsageReporter(baseURL, clientID, secret string) *HTTPUsageReporter {
+	return &HTTPUsageReporter{
+		baseURL:  baseURL,
+		clientID: clientID,
+		secret:   secret,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// ReportUsage posts usage in whole seconds (username -> seconds)
+func (r *HTTPUsageReporter) ReportUsage(ctx context.Context, usage map[string]time.Duration) error {
+	secs := make(map[string]int, len(usage))
+	for username, d := range usage {
+		secs[username] = int(d / time.Second)
+	}
+	body, err := json.Marshal(map[string]any{"usage": secs})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/api/usage?client_id=%s", r.baseURL, r.clientID)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.secret)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errSecretRejected
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -1,24 +1,85 @@
 const API = '/api';
 
+// escapeHtml makes user-supplied text (names, notes, reasons) safe to put into innerHTML
+function escapeHtml(value) {
+  return String(value ?? '').replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' })[c]);
+}
+
+// ValidationError carries per-field messages of a 400 response: [{ field, message }]
+class ValidationError extends Error {
+  constructor(body) {
+    super(body.error);
+    this.fields = body.fields || [];
+  }
+}
+
+async function checkResponse(res) {
+  if (res.ok) return;
+  const text = await res.text();
+  let body;
+  try {
+    body = JSON.parse(text);
+  } catch {
+    throw new Error(text);
+  }
+  throw new ValidationError(body);
+}
+
+// csrfToken of the admin session goes with every request that changes anything
+let csrfToken = '';
+// feedToken goes in the .ics links, so calendar apps can subscribe without a session;
+// the server keeps only its hash, so it is known only after it is issued
+let feedToken = '';
+
+// api is fetch for the management API: it adds the CSRF token and sends to the login page
+// when the session is gone
+async function api(url, options = {}) {
+  const headers = { ...options.headers };
+  if (csrfToken) headers['X-CSRF-Token'] = csrfToken;
+  const res = await fetch(url, { ...options, headers });
+  if (res.status === 401) {
+    location.href = '/login.html';
+    throw new Error('Требуется вход');
+  }
+  return res;
+}
+
+// loadSession gets the CSRF token and reports whether the page may load;
+// 404 means the server runs without admin accounts
+async function loadSession() {
+  const res = await fetch(`${API}/auth/session`);
+  if (res.status === 404) return true;
+  const session = res.ok ? await res.json() : {};
+  if (!session.username) {
+    location.href = '/login.html';
+    return false;
+  }
+  csrfToken = session.csrf_token;
+  document.getElementById('accountName').textContent = session.username;
+  document.getElementById('account').style.display = '';
+  document.getElementById('adminsSection').style.display = '';
+  return true;
+}
+
 async function getClients() {
-  const res = await fetch(`${API}/clients`);
+  const res = await api(`${API}/clients`);
   return res.json();
 }
 
 async function getClient(id) {
-  const res = await fetch(`${API}/clients/${id}`);
+  const res = await api(`${API}/clients/${id}`);
   if (!res.ok) throw new Error('Not found');
   return res.json();
 }
 
 async function getClientPreview(id) {
-  const res = await fetch(`${API}/clients/${id}/preview`);
+  const res = await api(`${API}/clients/${id}/preview`);
   if (!res.ok) return null;
   return res.json();
 }
 
 async function createClient(name) {
-  const res = await fetch(`${API}/clients`, {
+  const res = await api(`${API}/clients`, {
     method: 'POST',
     headers: { 'Content-Type': 'application/json' },
     body: JSON.stringify({ name })
@@ -27,7 +88,7 @@ async function createClient(name) {
 }
 
 async function addUser(clientId, user) {
-  const res = await fetch(`${API}/clients/${clientId}/users`, {
+  const res = await api(`${API}/clients/${clientId}/users`, {
     method: 'POST',
     headers: { 'Content-Type': 'application/json' },
     body: JSON.stringify(user)
@@ -36,43 +97,205 @@ async function addUser(clientId, user) {
 }
 
 async function updateSchedule(clientId, userId, schedule) {
-  await fetch(`${API}/clients/${clientId}/users/${userId}/schedule`, {
+  const res = await api(`${API}/clients/${clientId}/users/${userId}/schedule`, {
     method: 'PUT',
     headers: { 'Content-Type': 'application/json' },
     body: JSON.stringify({ schedule })
   });
+  await checkResponse(res);
+}
+
+async function setDateOverride(clientId, userId, date, override) {
+  const res = await api(`${API}/clients/${clientId}/users/${userId}/overrides/${date}`, {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(override)
+  });
+  await checkResponse(res);
+}
+
+async function importCalendar(clientId, userId, useDay, file) {
+  const params = new URLSearchParams({ use_day: useDay });
+  if (userId) params.set('user_id', userId);
+  const res = await api(`${API}/clients/${clientId}/calendar-import?${params}`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'text/calendar' },
+    body: file
+  });
+  if (!res.ok) throw new Error(await res.text());
+  return res.json();
+}
+
+async function deleteDateOverride(clientId, userId, date) {
+  await api(`${API}/clients/${clientId}/users/${userId}/overrides/${date}`, { method: 'DELETE' });
+}
+
+async function updateBudget(clientId, userId, budget) {
+  await api(`${API}/clients/${clientId}/users/${userId}/budget`, {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ budget })
+  });
+}
+
+async function updatePeriods(clientId, userId, periods) {
+  const res = await api(`${API}/clients/${clientId}/users/${userId}/periods`, {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ periods })
+  });
+  await checkResponse(res);
+}
+
+async function getExplanation(clientId, userId, at) {
+  const params = at ? `?at=${encodeURIComponent(at)}` : '';
+  const res = await api(`${API}/clients/${clientId}/users/${userId}/explain${params}`);
+  if (!res.ok) throw new Error(await res.text());
+  return res.json();
+}
+
+async function simulate(clientId, request) {
+  const res = await api(`${API}/clients/${clientId}/simulate`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(request)
+  });
+  await checkResponse(res);
+  return res.json();
+}
+
+async function setUserTemplate(clientId, userId, templateId) {
+  const res = await api(`${API}/clients/${clientId}/users/${userId}/template`, {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ template_id: templateId })
+  });
+  if (!res.ok) throw new Error(await res.text());
+}
+
+async function getTemplates() {
+  const res = await api(`${API}/templates`);
+  return res.json();
+}
+
+async function saveTemplate(template) {
+  const res = await api(template.id ? `${API}/templates/${template.id}` : `${API}/templates`, {
+    method: template.id ? 'PUT' : 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(template)
+  });
+  await checkResponse(res);
+}
+
+async function deleteTemplate(templateId) {
+  const res = await api(`${API}/templates/${templateId}`, { method: 'DELETE' });
+  if (!res.ok) throw new Error(await res.text());
 }
 
 async function deleteUser(clientId, userId) {
-  await fetch(`${API}/clients/${clientId}/users/${userId}`, { method: 'DELETE' });
+  await api(`${API}/clients/${clientId}/users/${userId}`, { method: 'DELETE' });
+}
+
+async function updateClient(clientId, fields) {
+  const res = await api(`${API}/clients/${clientId}`, {
+    method: 'PATCH',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(fields)
+  });
+  if (!res.ok) throw new Error(await res.text());
 }
 
 async function deleteClient(clientId) {
-  await fetch(`${API}/clients/${clientId}`, { method: 'DELETE' });
+  await api(`${API}/clients/${clientId}`, { method: 'DELETE' });
+}
+
+async function rotateClientSecret(clientId) {
+  const res = await api(`${API}/clients/${clientId}/secret`, { method: 'POST' });
+  await checkResponse(res);
+  return (await res.json()).secret;
 }
 
-async function grantTemporaryAccess(clientId, userId, duration) {
-  await fetch(`${API}/clients/${clientId}/temporary-access`, {
+async function revokeClientSecret(clientId) {
+  await checkResponse(await api(`${API}/clients/${clientId}/secret`, { method: 'DELETE' }));
+}
+
+async function grantTemporaryAccess(clientId, userId, duration, start, note) {
+  const res = await api(`${API}/clients/${clientId}/temporary-access`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ user_id: userId, duration, start: start || undefined, note: note || undefined })
+  });
+  if (!res.ok) throw new Error(await res.text());
+}
+
+async function updateTemporaryAccess(clientId, requestId, delta) {
+  const res = await api(`${API}/clients/${clientId}/temporary-access/${requestId}`, {
+    method: 'PATCH',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ delta })
+  });
+  if (!res.ok) throw new Error(await res.text());
+}
+
+async function grantAlwaysAllow(clientId, userId, duration, reason) {
+  const res = await api(`${API}/clients/${clientId}/always-allow`, {
     method: 'POST',
     headers: { 'Content-Type': 'application/json' },
-    body: JSON.stringify({ user_id: userId, duration })
+    body: JSON.stringify({ user_id: userId, duration, reason })
   });
+  if (!res.ok) throw new Error(await res.text());
+}
+
+async function deleteAlwaysAllow(clientId, grantId) {
+  await api(`${API}/clients/${clientId}/always-allow/${grantId}`, { method: 'DELETE' });
 }
 
 async function blockComputer(clientId, duration) {
-  await fetch(`${API}/clients/${clientId}/block`, {
+  await api(`${API}/clients/${clientId}/block`, {
     method: 'POST',
     headers: { 'Content-Type': 'application/json' },
     body: JSON.stringify({ duration })
   });
 }
 
+async function scheduleBlock(clientId, userId, start, until, note) {
+  const res = await api(`${API}/clients/${clientId}/block`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ user_id: userId, start, until, note: note || undefined })
+  });
+  if (!res.ok) throw new Error(await res.text());
+}
+
+async function getHistory(clientId, filter, offset) {
+  const params = new URLSearchParams({ offset, limit: HISTORY_PAGE });
+  for (const [k, v] of Object.entries(filter)) {
+    if (v) params.set(k, v);
+  }
+  const res = await api(`${API}/clients/${clientId}/history?${params}`);
+  await checkResponse(res);
+  return res.json();
+}
+
+async function addBlockRule(clientId, rule) {
+  const res = await api(`${API}/clients/${clientId}/block-rules`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(rule)
+  });
+  if (!res.ok) throw new Error(await res.text());
+}
+
+async function deleteBlockRule(clientId, ruleId) {
+  await api(`${API}/clients/${clientId}/block-rules/${ruleId}`, { method: 'DELETE' });
+}
+
 async function deleteBlock(clientId, requestId) {
-  await fetch(`${API}/clients/${clientId}/block/${requestId}`, { method: 'DELETE' });
+  await api(`${API}/clients/${clientId}/block/${requestId}`, { method: 'DELETE' });
 }
 
 async function deleteTemporaryAccess(clientId, requestId) {
-  await fetch(`${API}/clients/${clientId}/temporary-access/${requestId}`, { method: 'DELETE' });
+  await api(`${API}/clients/${clientId}/temporary-access/${requestId}`, { method: 'DELETE' });
 }
 
 const days = ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday'];
@@ -80,6 +303,7 @@ const dayLabels = { monday: 'Пн', tuesday: 'Вт', wednesday: 'Ср', thursday
 
 let currentClientId = null;
 let currentClient = null;
+let templates = [];
 
 async function selectClient() {
   const sel = document.getElementById('clientSelect');
@@ -91,13 +315,49 @@ async function selectClient() {
   currentClient = await getClient(currentClientId);
   document.getElementById('clientSection').style.display = 'block';
   document.getElementById('clientIdDisplay').textContent = currentClientId;
+  renderSecret();
+  renderWindowDays();
   renderUsers();
   renderConfigPreview();
 }
 
+async function renderSecret() {
+  document.getElementById('secretStatus').textContent = currentClient.has_secret
+    ? 'выдан'
+    : 'нет — компьютер не получает расписание';
+  document.getElementById('revokeSecret').style.display = currentClient.has_secret ? '' : 'none';
+  const key = await getSigningKey();
+  document.getElementById('serverKeyFingerprint').textContent = key ? key.fingerprint : 'конфиги не подписываются';
+}
+
+// getSigningKey returns the key configs are signed with, null if the server does not sign them
+async function getSigningKey() {
+  const res = await api(`${API}/signing-key`);
+  return res.ok ? res.json() : null;
+}
+
+// showInstallCommand shows the secret once: the server keeps only its hash.
+// The command pins the server key, so the client refuses configs not signed by this server.
+async function showInstallCommand(message, id, secret) {
+  const key = await getSigningKey();
+  const keyArg = key ? ` --server-key=${key.public_key}` : '';
+  prompt(`${message}\n\nСкопируйте команду установки клиента — секрет больше не будет показан:`,
+    `aegis-client.exe install --server-url=${location.origin} --client-id=${id} --client-secret=${secret}${keyArg}`);
+}
+
+// Times are shown in the computer's time zone when it differs from the server's
+function clientTimeZone() {
+  return currentClient && currentClient.time_zone ? { timeZone: currentClient.time_zone } : {};
+}
+
 function formatTime(isoStr) {
   const d = new Date(isoStr);
-  return d.toLocaleTimeString('ru-RU', { hour: '2-digit', minute: '2-digit' });
+  return d.toLocaleTimeString('ru-RU', { hour: '2-digit', minute: '2-digit', ...clientTimeZone() });
+}
+
+function localDateKey(d) {
+  const pad = n => String(n).padStart(2, '0');
+  return `${d.getFullYear()}-${pad(d.getMonth() + 1)}-${pad(d.getDate())}`;
 }
 
 function formatDateLabel(isoStr) {
@@ -107,7 +367,7 @@ function formatDateLabel(isoStr) {
   const tomorrow = new Date(today);
   tomorrow.setDate(tomorrow.getDate() + 1);
   const dayStart = new Date(d.getFullYear(), d.getMonth(), d.getDate());
-  const dateStr = d.toLocaleDateString('ru-RU', { day: 'numeric', month: 'long' });
+  const dateStr = d.toLocaleDateString('ru-RU', { day: 'numeric', month: 'long', ...clientTimeZone() });
   if (dayStart.getTime() === today.getTime()) return 'Сегодня, ' + dateStr;
   if (dayStart.getTime() === tomorrow.getTime()) return 'Завтра, ' + dateStr;
   return dateStr;
@@ -125,6 +385,9 @@ async function renderConfigPreview() {
   let html = '';
   for (const uc of config.users) {
     const name = (userById[uc.username] || {}).name || uc.username;
+    const periods = (config.periods || {})[uc.username] || {};
+    const alwaysAllow = ((config.always_allow || {})[uc.username] || []).map(g =>
+      `<span class="badge">Всегда разрешено до ${formatDateTime(g.until)}${g.reason ? ': ' + escapeHtml(g.reason) : ''}</span>`).join(' ');
     const byDay = {};
     for (const iv of uc.allowed_intervals || []) {
       const dayKey = iv.start.slice(0, 10);
@@ -134,14 +397,28 @@ async function renderConfigPreview() {
     const dayKeys = Object.keys(byDay).sort();
     let dayHtml = '';
     for (const k of dayKeys) {
-      const label = formatDateLabel(byDay[k].firstStart);
+      const period = periods[k] ? ` <span class="badge">${escapeHtml(periods[k])}</span>` : '';
+      const label = formatDateLabel(byDay[k].firstStart) + period;
       dayHtml += `<div class="dayBlock"><span class="dayLabel">${label}</span><div class="intervalsList">${byDay[k].intervals.join(', ')}</div></div>`;
     }
-    html += `<div class="userIntervals"><span class="userName">${name}</span>${dayHtml}</div>`;
+    html += `<div class="userIntervals"><span class="userName">${escapeHtml(name)}</span> ${alwaysAllow}${dayHtml}</div>`;
   }
   div.innerHTML = html || '<p class="dayLabel">Нет интервалов доступа</p>';
 }
 
+function renderWindowDays() {
+  const n = currentClient.window_days || 2;
+  const sel = document.getElementById('windowDays');
+  if (![...sel.options].some(o => o.value === String(n))) {
+    sel.insertAdjacentHTML('beforeend', `<option value="${n}">${n} дн.</option>`);
+  }
+  sel.value = String(n);
+  document.getElementById('timeZone').value = currentClient.time_zone || '';
+  document.getElementById('configPreviewHint').textContent = n === 2
+    ? 'Сегодня + завтра, человекопонятный формат'
+    : `${n} дн. начиная с сегодня, человекопонятный формат`;
+}
+
 function renderUsers() {
   const ul = document.getElementById('userList');
   ul.innerHTML = (currentClient.users || []).map(u => {
@@ -149,29 +426,64 @@ function renderUsers() {
     const userTempAccess = (currentClient.temporary_access_requests || []).filter(t => t.user_id === u.id);
     const userBlocks = (currentClient.block_requests || []).filter(b => b.user_id === u.id);
     const now = new Date();
-    const activeTempAccess = userTempAccess.filter(t => new Date(t.until) > now);
-    const activeBlocks = userBlocks.filter(b => new Date(b.until) > now);
+    const activeTempAccess = userTempAccess.filter(t => new Date(t.start) <= now && new Date(t.until) > now);
+    const upcomingTempAccess = userTempAccess.filter(t => new Date(t.start) > now);
+    const activeBlocks = userBlocks.filter(b => new Date(b.start) <= now && new Date(b.until) > now);
+    const alwaysAllow = (currentClient.override_grants || []).filter(g => g.user_id === u.id && new Date(g.until) > now);
+    const todayLimit = (u.budget || {})[days[(now.getDay() + 6) % 7]];
+    const usedToday = Math.floor(((u.usage || {})[localDateKey(now)] || 0) / 60);
     
     return `
     <li data-user-id="${u.id}" class="userCard">
       <div class="userHeader">
         <div>
-          <span class="userName">${u.name}</span>
-          <code>${u.username}</code>
+          <span class="userName">${escapeHtml(u.name)}</span>
+          <code>${escapeHtml(u.username)}</code>
         </div>
         <button onclick="deleteUserConfirm('${u.id}')" class="deleteBtn">×</button>
       </div>
       
+      ${todayLimit !== undefined ? `
+        <div class="userBudget">
+          <span class="badge">Лимит на сегодня</span>
+          <span class="tempAccessTime">использовано ${usedToday} из ${todayLimit} мин</span>
+        </div>
+      ` : ''}
+
       ${activeTempAccess.length > 0 ? `
         <div class="userTempAccess">
           <span class="badge">Временный доступ</span>
           ${activeTempAccess.map(t => `
             <span class="tempAccessTime">${formatTime(t.start)} — ${formatTime(t.until)}</span>
+            <button onclick="extendTempAccess('${t.id}', 15)" class="smallBtn" title="Продлить на 15 мин">+15</button>
+            <button onclick="extendTempAccess('${t.id}', -15)" class="smallBtn" title="Сократить на 15 мин">−15</button>
+            <button onclick="deleteTempAccessConfirm('${t.id}')" class="deleteBtn smallBtn">×</button>
+          `).join('')}
+        </div>
+      ` : ''}
+
+      ${upcomingTempAccess.length > 0 ? `
+        <div class="userTempAccess">
+          <span class="badge">Запланированный доступ</span>
+          ${upcomingTempAccess.map(t => `
+            <span class="tempAccessTime">${formatDateTime(t.start)} — ${formatTime(t.until)}</span>
+            <button onclick="extendTempAccess('${t.id}', 15)" class="smallBtn" title="Продлить на 15 мин">+15</button>
+            <button onclick="extendTempAccess('${t.id}', -15)" class="smallBtn" title="Сократить на 15 мин">−15</button>
             <button onclick="deleteTempAccessConfirm('${t.id}')" class="deleteBtn smallBtn">×</button>
           `).join('')}
         </div>
       ` : ''}
       
+      ${alwaysAllow.length > 0 ? `
+        <div class="userTempAccess">
+          <span class="badge">Всегда разрешено</span>
+          ${alwaysAllow.map(g => `
+            <span class="tempAccessTime">${formatDateTime(g.start)} — ${formatDateTime(g.until)}${g.reason ? ` (${escapeHtml(g.reason)})` : ''}</span>
+            <button onclick="deleteAlwaysAllowConfirm('${g.id}')" class="deleteBtn smallBtn">×</button>
+          `).join('')}
+        </div>
+      ` : ''}
+
       ${activeBlocks.length > 0 ? `
         <div class="userBlock">
           <span class="badge badgeRed">Заблокирован</span>
@@ -184,6 +496,8 @@ function renderUsers() {
       
       <div class="userActions">
         <button onclick="editSchedule('${u.id}')">📅 Расписание</button>
+        <button onclick="explainUser('${u.id}')" title="Почему сейчас есть или нет доступа">❓ Почему?</button>
+        <a href="${API}/clients/${currentClientId}/users/${u.id}/calendar.ics${feedToken ? `?token=${feedToken}` : ''}" class="smallBtn" title="Подписка на разрешённое время в календаре">🗓️ .ics</a>
         <div class="grantAccessControl">
           <select id="duration_${u.id}" class="smallSelect">
             <option value="15">15 мин</option>
@@ -199,14 +513,21 @@ function renderUsers() {
             <input type="number" id="hours_${u.id}" min="0" max="72" value="1" class="smallInput"> ч
             <input type="number" id="minutes_${u.id}" min="0" max="59" value="0" class="smallInput"> мин
           </span>
+          <label class="tempAccessTime">с <input type="datetime-local" id="grantStart_${u.id}" title="Пусто — сейчас"></label>
+          <input type="text" id="note_${u.id}" placeholder="Заметка" title="Сохраняется в истории" class="noteInput">
           <button onclick="grantAccessToUser('${u.id}')" class="primaryBtn">⏱️ Добавить время</button>
           <button onclick="blockUser('${u.id}')" class="dangerBtn">🚫 Заблокировать</button>
+          <button onclick="alwaysAllowUser('${u.id}')" title="Доступ даже при блокировке, например на время экзамена">🆘 Всегда разрешить</button>
         </div>
       </div>
+      <div id="explain_${u.id}" class="explainPanel"></div>
     </li>
   `;
   }).join('');
   
+  renderBlocks();
+  loadHistory();
+
   // Setup duration change listeners
   (currentClient.users || []).forEach(u => {
     const sel = document.getElementById(`duration_${u.id}`);
@@ -219,6 +540,88 @@ function renderUsers() {
   });
 }
 
+// History of grants and blocks, loaded page by page
+const HISTORY_PAGE = 50;
+const historyTypeLabels = { temporary_access: 'Временный доступ', always_allow: 'Всегда разрешено', block: 'Блокировка' };
+let historyEntries = [];
+
+async function loadHistory(more) {
+  const filter = {
+    user_id: document.getElementById('historyUser').value,
+    type: document.getElementById('historyType').value
+  };
+  const page = await getHistory(currentClientId, filter, more ? historyEntries.length : 0);
+  historyEntries = more ? historyEntries.concat(page.entries) : page.entries;
+  const hours = Math.floor(page.total_minutes / 60);
+  document.getElementById('historySummary').textContent =
+    `Записей: ${page.total}, всего ${hours} ч ${page.total_minutes % 60} мин`;
+  document.getElementById('historyList').innerHTML = historyEntries.length ? historyEntries.map(e => {
+    const end = e.cancelled_at && new Date(e.cancelled_at) < new Date(e.until) ? e.cancelled_at : e.until;
+    return `
+    <div class="requestItem">
+      <span>${historyTypeLabels[e.type] || e.type} · ${e.username ? escapeHtml(e.username) : 'все пользователи'}:
+        ${formatDateTime(e.start)} — ${formatDateTime(end)} (${e.minutes} мин)${e.cancelled_at ? ' · отменено' : ''}${e.note ? ` · ${escapeHtml(e.note)}` : ''}${e.admin ? ` · администратор: ${escapeHtml(e.admin)}` : ''}</span>
+    </div>
+  `;
+  }).join('') : '<p class="emptyHint">История пуста</p>';
+  document.getElementById('historyMore').style.display = historyEntries.length < page.total ? '' : 'none';
+}
+
+function formatDateTime(isoStr) {
+  const d = new Date(isoStr);
+  return d.toLocaleString('ru-RU', { day: 'numeric', month: 'short', hour: '2-digit', minute: '2-digit', ...clientTimeZone() });
+}
+
+function renderBlocks() {
+  const users = currentClient.users || [];
+  const userName = id => id ? escapeHtml((users.find(u => u.id === id) || {}).name || id) : 'Все пользователи';
+  const now = new Date();
+  const blocks = (currentClient.block_requests || []).slice().sort((a, b) => new Date(a.start) - new Date(b.start));
+  const active = blocks.filter(b => new Date(b.start) <= now && new Date(b.until) > now);
+  const upcoming = blocks.filter(b => new Date(b.start) > now);
+  const item = b => `
+    <div class="requestItem">
+      <span>${userName(b.user_id)}: ${formatDateTime(b.start)} — ${formatDateTime(b.until)}${b.note ? ` (${escapeHtml(b.note)})` : ''}</span>
+      <button onclick="deleteBlockConfirm('${b.id}')" class="deleteBtn">×</button>
+    </div>
+  `;
+  document.getElementById('blocksList').innerHTML = `
+    <h3>Активные</h3>
+    ${active.length ? active.map(item).join('') : '<p class="emptyHint">Нет активных блокировок</p>'}
+    <h3>Запланированные</h3>
+    ${upcoming.length ? upcoming.map(item).join('') : '<p class="emptyHint">Нет запланированных блокировок</p>'}
+  `;
+  const targets = '<option value="">Все пользователи</option>' +
+    users.map(u => `<option value="${u.id}">${escapeHtml(u.name)}</option>`).join('');
+  document.getElementById('blockTarget').innerHTML = targets;
+  document.getElementById('ruleTarget').innerHTML = targets;
+  const historyUser = document.getElementById('historyUser');
+  const selectedUser = historyUser.value;
+  historyUser.innerHTML = '<option value="">Все пользователи</option>' +
+    users.map(u => `<option value="${u.id}">${escapeHtml(u.name)}</option>`).join('');
+  historyUser.value = selectedUser;
+
+  const rules = currentClient.block_rules || [];
+  document.getElementById('blockRulesList').innerHTML = rules.length ? rules.map(r => `
+    <div class="requestItem">
+      <span>${userName(r.user_id)}: ${r.days.map(d => dayLabels[d] || d).join(', ')} ${r.start}–${r.end}</span>
+      <button onclick="deleteBlockRuleConfirm('${r.id}')" class="deleteBtn">×</button>
+    </div>
+  `).join('') : '<p class="emptyHint">Нет регулярных блокировок</p>';
+  const ruleDays = document.getElementById('ruleDays');
+  if (!ruleDays.children.length) {
+    ruleDays.innerHTML = days.map(d => `<label><input type="checkbox" value="${d}">${dayLabels[d]}</label>`).join('');
+  }
+}
+
+async function deleteBlockRuleConfirm(ruleId) {
+  if (!confirm('Удалить регулярную блокировку?')) return;
+  await deleteBlockRule(currentClientId, ruleId);
+  currentClient = await getClient(currentClientId);
+  renderUsers();
+  renderConfigPreview();
+}
+
 async function deleteBlockConfirm(requestId) {
   if (!confirm('Удалить блокировку?')) return;
   await deleteBlock(currentClientId, requestId);
@@ -227,6 +630,33 @@ async function deleteBlockConfirm(requestId) {
   renderConfigPreview();
 }
 
+async function deleteAlwaysAllowConfirm(grantId) {
+  if (!confirm('Отменить экстренный доступ?')) return;
+  await deleteAlwaysAllow(currentClientId, grantId);
+  currentClient = await getClient(currentClientId);
+  renderUsers();
+  renderConfigPreview();
+}
+
+async function alwaysAllowUser(userId) {
+  const duration = getDurationMinutes(userId);
+  if (duration <= 0) {
+    alert('Укажите длительность');
+    return;
+  }
+  const reason = prompt('Причина (например, онлайн-экзамен):', '');
+  if (reason === null) return;
+  try {
+    await grantAlwaysAllow(currentClientId, userId, duration, reason);
+  } catch (e) {
+    alert('Ошибка: ' + e.message);
+    return;
+  }
+  currentClient = await getClient(currentClientId);
+  renderUsers();
+  renderConfigPreview();
+}
+
 async function deleteTempAccessConfirm(requestId) {
   if (!confirm('Удалить временный доступ?')) return;
   await deleteTemporaryAccess(currentClientId, requestId);
@@ -245,13 +675,37 @@ function getDurationMinutes(userId) {
   return h * 60 + m;
 }
 
+function getNote(userId) {
+  const input = document.getElementById(`note_${userId}`);
+  return input ? input.value.trim() : '';
+}
+
 async function grantAccessToUser(userId) {
   const duration = getDurationMinutes(userId);
   if (duration <= 0) {
     alert('Укажите длительность');
     return;
   }
-  await grantTemporaryAccess(currentClientId, userId, duration);
+  const startInput = document.getElementById(`grantStart_${userId}`);
+  const start = startInput && startInput.value ? new Date(startInput.value).toISOString() : null;
+  try {
+    await grantTemporaryAccess(currentClientId, userId, duration, start, getNote(userId));
+  } catch (e) {
+    alert('Ошибка: ' + e.message);
+    return;
+  }
+  currentClient = await getClient(currentClientId);
+  renderUsers();
+  renderConfigPreview();
+}
+
+async function extendTempAccess(requestId, delta) {
+  try {
+    await updateTemporaryAccess(currentClientId, requestId, delta);
+  } catch (e) {
+    alert('Ошибка: ' + e.message);
+    return;
+  }
   currentClient = await getClient(currentClientId);
   renderUsers();
   renderConfigPreview();
@@ -263,10 +717,10 @@ async function blockUser(userId) {
     alert('Укажите длительность');
     return;
   }
-  await fetch(`${API}/clients/${currentClientId}/block`, {
+  await api(`${API}/clients/${currentClientId}/block`, {
     method: 'POST',
     headers: { 'Content-Type': 'application/json' },
-    body: JSON.stringify({ user_id: userId, duration })
+    body: JSON.stringify({ user_id: userId, duration, note: getNote(userId) || undefined })
   });
   currentClient = await getClient(currentClientId);
   renderUsers();
@@ -277,12 +731,25 @@ function renderScheduleEditor(userId) {
   const user = currentClient.users.find(u => u.id === userId);
   if (!user) return;
   const schedule = user.schedule || {};
+  const budget = user.budget || {};
   const div = document.getElementById('scheduleEditor');
-  div.innerHTML = days.map(day => {
+  div.innerHTML = `
+    <div class="quickActions">
+      <label>Шаблон:</label>
+      <select id="userTemplate" class="smallSelect">
+        <option value="">Без шаблона</option>
+        ${templates.map(t => `<option value="${t.id}" ${t.id === user.template_id ? 'selected' : ''}>${escapeHtml(t.name)}</option>`).join('')}
+      </select>
+      ${user.template_id ? '<span class="emptyHint">Дни без своих интервалов берутся из шаблона</span>' : ''}
+    </div>
+  ` + days.map(day => {
     const intervals = schedule[day] || [];
     return `
       <div class="schedule-day" data-day="${day}">
         <label>${dayLabels[day] || day}</label>
+        <div class="budget">
+          Лимит: <input type="number" min="0" max="1440" placeholder="без лимита" value="${budget[day] ?? ''}" data-field="budget"> мин в день
+        </div>
         ${intervals.map((iv, i) => `
           <div class="interval" data-day="${day}">
             <input type="time" value="${iv.start}" data-field="start">
@@ -294,9 +761,22 @@ function renderScheduleEditor(userId) {
       </div>
     `;
   }).join('');
-  div.querySelectorAll('input').forEach(input => {
+  div.querySelectorAll('.interval input').forEach(input => {
     input.addEventListener('change', () => saveScheduleFromEditor(userId));
   });
+  div.querySelectorAll('input[data-field="budget"]').forEach(input => {
+    input.addEventListener('change', () => saveBudgetFromEditor(userId));
+  });
+  document.getElementById('userTemplate').addEventListener('change', async (e) => {
+    try {
+      await setUserTemplate(currentClientId, userId, e.target.value);
+    } catch (err) {
+      alert('Ошибка: ' + err.message);
+    }
+    currentClient = await getClient(currentClientId);
+    renderScheduleEditor(userId);
+    renderConfigPreview();
+  });
 }
 
 function addInterval(userId, day) {
@@ -310,6 +790,7 @@ function addInterval(userId, day) {
 async function saveScheduleFromEditor(userId) {
   const div = document.getElementById('scheduleEditor');
   const schedule = {};
+  const elements = {}; // "schedule.monday[0]" -> interval element, for error highlighting
   days.forEach(day => {
     const dayEl = div.querySelector(`.schedule-day[data-day="${day}"]`);
     if (!dayEl) return;
@@ -318,18 +799,429 @@ async function saveScheduleFromEditor(userId) {
       const start = intervalEl.querySelector('input[data-field="start"]');
       const end = intervalEl.querySelector('input[data-field="end"]');
       if (start && end && start.value && end.value) {
+        elements[`schedule.${day}[${intervals.length}]`] = intervalEl;
         intervals.push({ start: start.value, end: end.value });
       }
     });
     if (intervals.length) schedule[day] = intervals;
   });
-  await updateSchedule(currentClientId, userId, schedule);
+  clearInvalid(div);
+  try {
+    await updateSchedule(currentClientId, userId, schedule);
+  } catch (e) {
+    if (!(e instanceof ValidationError)) {
+      alert('Ошибка: ' + e.message);
+      return;
+    }
+    e.fields.forEach(f => {
+      // "schedule.monday[0].start" highlights one input, "schedule.monday[0]" the whole interval
+      const m = f.field.match(/^(schedule\.\w+\[\d+\])(?:\.(start|end))?$/);
+      const el = m && elements[m[1]];
+      if (!el) return;
+      markInvalid(m[2] ? el.querySelector(`input[data-field="${m[2]}"]`) : el, f.message);
+    });
+    return;
+  }
   currentClient = await getClient(currentClientId);
   renderConfigPreview();
 }
 
+async function saveBudgetFromEditor(userId) {
+  const div = document.getElementById('scheduleEditor');
+  const budget = {};
+  div.querySelectorAll('.schedule-day').forEach(dayEl => {
+    const input = dayEl.querySelector('input[data-field="budget"]');
+    if (input && input.value !== '') budget[dayEl.dataset.day] = parseInt(input.value, 10);
+  });
+  await updateBudget(currentClientId, userId, budget);
+  currentClient = await getClient(currentClientId);
+  renderUsers();
+  renderConfigPreview();
+}
+
+function markInvalid(el, message) {
+  el.classList.add('invalid');
+  el.title = el.title ? `${el.title}\n${message}` : message;
+}
+
+function clearInvalid(container) {
+  container.querySelectorAll('.invalid').forEach(el => {
+    el.classList.remove('invalid');
+    el.title = '';
+  });
+}
+
+// parseIntervalsText parses "09:00-12:00, 18:00-01:00"
+function parseIntervalsText(text) {
+  return text.split(',').map(p => p.trim()).filter(Boolean).map(p => {
+    const [start, end] = p.split('-').map(t => t.trim());
+    return { start, end };
+  });
+}
+
+function formatIntervalsText(intervals) {
+  return (intervals || []).map(iv => `${iv.start}-${iv.end}`).join(', ');
+}
+
+async function loadTemplates() {
+  templates = await getTemplates();
+  renderTemplates();
+}
+
+function renderTemplates() {
+  const div = document.getElementById('templatesList');
+  div.innerHTML = templates.length === 0 ? '<p class="emptyHint">Нет шаблонов</p>' : templates.map(t => `
+    <div class="requestItem">
+      <span>${escapeHtml(t.name)}</span>
+      <span>
+        <button onclick="editTemplate('${t.id}')" class="smallBtn">Изменить</button>
+        <button onclick="deleteTemplateConfirm('${t.id}')" class="deleteBtn">×</button>
+      </span>
+    </div>
+  `).join('');
+}
+
+function editTemplate(templateId) {
+  const t = templates.find(t => t.id === templateId) || { name: '', schedule: {} };
+  const div = document.getElementById('templateEditor');
+  div.innerHTML = `
+    <div class="quickActions">
+      <input type="text" id="templateName" placeholder="Название" value="${escapeHtml(t.name)}">
+    </div>
+    ${days.map(day => `
+      <div class="quickActions templateDay">
+        <label>${dayLabels[day]}</label>
+        <input type="text" data-day="${day}" placeholder="нет доступа" value="${formatIntervalsText(t.schedule[day])}">
+      </div>
+    `).join('')}
+    <div class="quickActions">
+      <button onclick="saveTemplateFromEditor('${t.id || ''}')" class="primaryBtn">Сохранить шаблон</button>
+      <button onclick="document.getElementById('templateEditor').innerHTML = ''">Отмена</button>
+    </div>
+  `;
+}
+
+async function saveTemplateFromEditor(templateId) {
+  const div = document.getElementById('templateEditor');
+  const schedule = {};
+  div.querySelectorAll('input[data-day]').forEach(input => {
+    const intervals = parseIntervalsText(input.value);
+    if (intervals.length) schedule[input.dataset.day] = intervals;
+  });
+  clearInvalid(div);
+  try {
+    await saveTemplate({ id: templateId || undefined, name: document.getElementById('templateName').value.trim(), schedule });
+  } catch (e) {
+    if (!(e instanceof ValidationError)) {
+      alert('Ошибка: ' + e.message);
+      return;
+    }
+    e.fields.forEach(f => {
+      const m = f.field.match(/^schedule\.(\w+)/);
+      const el = f.field === 'name' ? document.getElementById('templateName') : m && div.querySelector(`input[data-day="${m[1]}"]`);
+      if (el) markInvalid(el, f.message);
+    });
+    return;
+  }
+  div.innerHTML = '';
+  await loadTemplates();
+  if (currentClientId) renderConfigPreview();
+}
+
+async function deleteTemplateConfirm(templateId) {
+  if (!confirm('Удалить шаблон?')) return;
+  try {
+    await deleteTemplate(templateId);
+  } catch (e) {
+    alert('Ошибка: ' + e.message);
+    return;
+  }
+  await loadTemplates();
+}
+
+function describeOverride(o) {
+  if (o.use_day) return `как ${dayLabels[o.use_day] || o.use_day}`;
+  if (!o.intervals || o.intervals.length === 0) return 'нет доступа';
+  return o.intervals.map(iv => `${iv.start}–${iv.end}`).join(', ');
+}
+
+function renderOverridesEditor(userId) {
+  const user = currentClient.users.find(u => u.id === userId);
+  if (!user) return;
+  const overrides = user.overrides || {};
+  const dates = Object.keys(overrides).sort();
+  const div = document.getElementById('overridesEditor');
+  div.innerHTML = `
+    <h3>Исключения по датам</h3>
+    ${dates.length === 0 ? '<p class="emptyHint">Нет исключений</p>' : dates.map(date => `
+      <div class="requestItem">
+        <span>${new Date(date + 'T00:00').toLocaleDateString('ru-RU', { day: 'numeric', month: 'long', year: 'numeric' })}: ${describeOverride(overrides[date])}</span>
+        <button onclick="deleteOverrideConfirm('${userId}', '${date}')" class="deleteBtn">×</button>
+      </div>
+    `).join('')}
+    <div class="quickActions">
+      <input type="date" id="overrideDate">
+      <select id="overrideMode" class="smallSelect">
+        <option value="intervals">Свои интервалы</option>
+        ${days.map(d => `<option value="${d}">Как ${dayLabels[d]}</option>`).join('')}
+        <option value="none">Нет доступа</option>
+      </select>
+      <input type="text" id="overrideIntervals" placeholder="09:00-12:00, 18:00-01:00">
+      <button onclick="addOverride('${userId}')" class="primaryBtn">+ Исключение</button>
+    </div>
+    <div class="quickActions">
+      <label>Каникулы из календаря (.ics):</label>
+      <input type="file" id="icsFile" accept=".ics,text/calendar">
+      <select id="icsUseDay" class="smallSelect">
+        ${days.map(d => `<option value="${d}" ${d === 'sunday' ? 'selected' : ''}>Как ${dayLabels[d]}</option>`).join('')}
+        <option value="none">Нет доступа</option>
+      </select>
+      <label><input type="checkbox" id="icsAllUsers"> всем пользователям</label>
+      <button onclick="importCalendarFile('${userId}')">Импорт</button>
+    </div>
+  `;
+  const mode = document.getElementById('overrideMode');
+  mode.addEventListener('change', () => {
+    document.getElementById('overrideIntervals').style.display = mode.value === 'intervals' ? '' : 'none';
+  });
+}
+
+async function addOverride(userId) {
+  const date = document.getElementById('overrideDate').value;
+  const mode = document.getElementById('overrideMode').value;
+  if (!date) {
+    alert('Укажите дату');
+    return;
+  }
+  const override = {};
+  if (mode === 'intervals') {
+    override.intervals = parseIntervalsText(document.getElementById('overrideIntervals').value);
+  } else if (mode !== 'none') {
+    override.use_day = mode;
+  }
+  clearInvalid(document.getElementById('overridesEditor'));
+  try {
+    await setDateOverride(currentClientId, userId, date, override);
+  } catch (e) {
+    if (e instanceof ValidationError) {
+      const inputs = { date: 'overrideDate', use_day: 'overrideMode' };
+      e.fields.forEach(f => {
+        const id = inputs[f.field] || (f.field.startsWith('intervals') ? 'overrideIntervals' : null);
+        if (id) markInvalid(document.getElementById(id), f.message);
+      });
+    }
+    alert('Ошибка: ' + e.message);
+    return;
+  }
+  currentClient = await getClient(currentClientId);
+  renderOverridesEditor(userId);
+  renderConfigPreview();
+}
+
+async function importCalendarFile(userId) {
+  const file = document.getElementById('icsFile').files[0];
+  if (!file) {
+    alert('Выберите файл .ics');
+    return;
+  }
+  const allUsers = document.getElementById('icsAllUsers').checked;
+  let result;
+  try {
+    result = await importCalendar(currentClientId, allUsers ? '' : userId, document.getElementById('icsUseDay').value, file);
+  } catch (e) {
+    alert('Ошибка: ' + e.message);
+    return;
+  }
+  alert(`Добавлено дат: ${result.dates}` + (result.skipped ? `\nПропущено повторяющихся событий: ${result.skipped}` : ''));
+  currentClient = await getClient(currentClientId);
+  renderOverridesEditor(userId);
+  renderConfigPreview();
+}
+
+async function deleteOverrideConfirm(userId, date) {
+  if (!confirm('Удалить исключение?')) return;
+  await deleteDateOverride(currentClientId, userId, date);
+  currentClient = await getClient(currentClientId);
+  renderOverridesEditor(userId);
+  renderConfigPreview();
+}
+
+function describeSource(src) {
+  switch (src.kind) {
+    case 'schedule': return `расписание: ${escapeHtml(src.detail)}`;
+    case 'temporary_access': {
+      const t = (currentClient.temporary_access_requests || []).find(t => t.id === src.id);
+      return 'временный доступ' + (t ? ` ${formatDateTime(t.start)} — ${formatDateTime(t.until)}` : '');
+    }
+    case 'block': {
+      const b = (currentClient.block_requests || []).find(b => b.id === src.id);
+      return (src.detail ? 'блокировка всех пользователей' : 'блокировка пользователя') +
+        (b ? ` ${formatDateTime(b.start)} — ${formatDateTime(b.until)}` : '');
+    }
+    case 'always_allow': return 'всегда разрешено' + (src.detail ? `: ${escapeHtml(src.detail)}` : '');
+    case 'block_rule': return `регулярная блокировка ${escapeHtml(src.detail)}`;
+    case 'budget': return `исчерпан дневной лимит (${escapeHtml(src.detail)})`;
+    default: return 'нет интервала в расписании';
+  }
+}
+
+async function explainUser(userId, at) {
+  const div = document.getElementById(`explain_${userId}`);
+  let result;
+  try {
+    result = await getExplanation(currentClientId, userId, at);
+  } catch (e) {
+    div.innerHTML = `<p class="emptyHint">Ошибка: ${escapeHtml(e.message)}</p>`;
+    return;
+  }
+  const seg = result.segment;
+  const line = s => `
+    <div class="requestItem ${s.start === seg.start && s.end === seg.end ? 'currentSegment' : ''}">
+      <span>${formatDateTime(s.start)} — ${formatDateTime(s.end)}</span>
+      <span class="${s.allowed ? 'badge' : 'badgeRed'}">${s.allowed ? 'доступ' : 'нет доступа'}: ${describeSource(s.source)}</span>
+    </div>
+  `;
+  div.innerHTML = `
+    <p><b>${formatDateTime(result.at)}: ${seg.allowed ? 'доступ есть' : 'доступа нет'}</b> — ${describeSource(seg.source)}, до ${formatDateTime(seg.end)}</p>
+    <div class="quickActions">
+      <label>На момент <input type="datetime-local" id="explainAt_${userId}"></label>
+      <button onclick="explainAt('${userId}')" class="smallBtn">Показать</button>
+      <button onclick="document.getElementById('explain_${userId}').innerHTML = ''" class="smallBtn">Скрыть</button>
+    </div>
+    ${result.segments.map(line).join('')}
+  `;
+}
+
+function explainAt(userId) {
+  const value = document.getElementById(`explainAt_${userId}`).value;
+  explainUser(userId, value ? new Date(value).toISOString() : null);
+}
+
 function editSchedule(userId) {
   renderScheduleEditor(userId);
+  renderPeriodsEditor(userId);
+  renderOverridesEditor(userId);
+}
+
+// periods: unsaved list to show instead of the stored one
+function renderPeriodsEditor(userId, periods) {
+  const user = currentClient.users.find(u => u.id === userId);
+  if (!user) return;
+  const edited = periods || user.periods || [];
+  const div = document.getElementById('periodsEditor');
+  div.innerHTML = `
+    <h3>Периоды (чередование недель, каникулы)</h3>
+    <p class="emptyHint">Дни периода заменяют дни обычного расписания. Действует первый подходящий период.</p>
+    ${edited.map((p, i) => `
+      <div class="periodBlock" data-index="${i}">
+        <div class="quickActions">
+          <input type="text" data-field="name" placeholder="Название" value="${escapeHtml(p.name)}">
+          <label>с <input type="text" data-field="from" placeholder="06-01 или 2026-06-01" value="${escapeHtml(p.from)}"></label>
+          <label>по <input type="text" data-field="to" placeholder="08-31" value="${escapeHtml(p.to)}"></label>
+          <select data-field="weeks" class="smallSelect">
+            <option value="">Каждая неделя</option>
+            <option value="odd" ${p.weeks === 'odd' ? 'selected' : ''}>Нечётные недели</option>
+            <option value="even" ${p.weeks === 'even' ? 'selected' : ''}>Чётные недели</option>
+          </select>
+          <button onclick="removePeriod('${userId}', ${i})" class="deleteBtn">×</button>
+        </div>
+        ${days.map(day => `
+          <div class="quickActions templateDay">
+            <label>${dayLabels[day]}</label>
+            <input type="text" data-day="${day}" placeholder="как обычно" value="${formatIntervalsText((p.schedule || {})[day])}">
+          </div>
+        `).join('')}
+      </div>
+    `).join('')}
+    <div class="quickActions">
+      <button onclick="addPeriod('${userId}')">+ Период</button>
+      <button onclick="savePeriodsFromEditor('${userId}')" class="primaryBtn">Сохранить периоды</button>
+    </div>
+    <div class="quickActions">
+      <label>Проверить до сохранения: с <input type="date" id="simulateFrom"></label>
+      <label>по <input type="date" id="simulateTo"></label>
+      <button onclick="simulatePeriods('${userId}')" class="smallBtn">Проверить</button>
+    </div>
+    <div id="simulation" class="explainPanel"></div>
+  `;
+}
+
+// markPeriodErrors highlights fields reported as "periods[0].schedule.monday[1]" or "periods[0].from"
+function markPeriodErrors(div, fields) {
+  fields.forEach(f => {
+    const m = f.field.match(/^periods\[(\d+)\](?:\.(name|from|to|weeks)|\.schedule\.(\w+))?/);
+    const block = m && div.querySelector(`.periodBlock[data-index="${m[1]}"]`);
+    if (!block) return;
+    const el = m[2] ? block.querySelector(`[data-field="${m[2]}"]`) : m[3] ? block.querySelector(`input[data-day="${m[3]}"]`) : block;
+    if (el) markInvalid(el, f.message);
+  });
+}
+
+// simulatePeriods shows intervals the edited, unsaved periods would give over the chosen dates
+async function simulatePeriods(userId) {
+  const div = document.getElementById('periodsEditor');
+  const out = document.getElementById('simulation');
+  const from = document.getElementById('simulateFrom').value;
+  const to = document.getElementById('simulateTo').value;
+  const request = { users: [{ user_id: userId, periods: readPeriodsEditor() }] };
+  if (from) request.from = new Date(from + 'T00:00').toISOString();
+  if (to) request.to = new Date(to + 'T00:00').toISOString();
+  clearInvalid(div);
+  let result;
+  try {
+    result = await simulate(currentClientId, request);
+  } catch (e) {
+    if (e instanceof ValidationError) {
+      markPeriodErrors(div, e.fields.map(f => ({ ...f, field: f.field.replace(/^users\[0\]\./, '') })));
+    }
+    out.innerHTML = `<p class="emptyHint">Ошибка: ${escapeHtml(e.message)}</p>`;
+    return;
+  }
+  const sim = result.users.find(u => u.user_id === userId);
+  const intervals = sim ? sim.allowed_intervals || [] : [];
+  out.innerHTML = intervals.length === 0 ? '<p class="emptyHint">Нет доступа в этот период</p>' : intervals.map(iv => `
+    <div class="requestItem">
+      <span>${formatDateTime(iv.start)} — ${formatDateTime(iv.end)}</span>
+    </div>
+  `).join('');
+}
+
+function readPeriodsEditor() {
+  return [...document.querySelectorAll('#periodsEditor .periodBlock')].map(block => {
+    const field = name => block.querySelector(`[data-field="${name}"]`).value.trim();
+    const schedule = {};
+    block.querySelectorAll('input[data-day]').forEach(input => {
+      const intervals = parseIntervalsText(input.value);
+      if (intervals.length) schedule[input.dataset.day] = intervals;
+    });
+    return { name: field('name'), from: field('from'), to: field('to'), weeks: field('weeks'), schedule };
+  });
+}
+
+function addPeriod(userId) {
+  renderPeriodsEditor(userId, [...readPeriodsEditor(), { name: '', schedule: {} }]);
+}
+
+function removePeriod(userId, index) {
+  renderPeriodsEditor(userId, readPeriodsEditor().filter((_, i) => i !== index));
+}
+
+async function savePeriodsFromEditor(userId) {
+  const div = document.getElementById('periodsEditor');
+  clearInvalid(div);
+  try {
+    await updatePeriods(currentClientId, userId, readPeriodsEditor());
+  } catch (e) {
+    if (!(e instanceof ValidationError)) {
+      alert('Ошибка: ' + e.message);
+      return;
+    }
+    markPeriodErrors(div, e.fields);
+    return;
+  }
+  currentClient = await getClient(currentClientId);
+  renderPeriodsEditor(userId);
+  renderConfigPreview();
 }
 
 async function deleteUserConfirm(userId) {
@@ -344,11 +1236,61 @@ document.getElementById('clientSelect').addEventListener('change', selectClient)
 document.getElementById('addClient').addEventListener('click', async () => {
   const name = prompt('Имя компьютера:', 'Home PC');
   if (!name) return;
-  const { id } = await createClient(name);
+  const { id, secret } = await createClient(name);
   await loadClients();
   document.getElementById('clientSelect').value = id;
   selectClient();
-  alert(`Компьютер добавлен. Client ID: ${id}\n\nСкопируйте его для установки клиента:\naegis-client.exe install --server-url=http://server:8080 --client-id=${id}`);
+  showInstallCommand('Компьютер добавлен.', id, secret);
+});
+
+document.getElementById('rotateSecret').addEventListener('click', async () => {
+  if (!currentClientId) return;
+  if (currentClient.has_secret && !confirm('Старый секрет перестанет работать: клиент на компьютере нужно будет переустановить с новым. Продолжить?')) return;
+  try {
+    const secret = await rotateClientSecret(currentClientId);
+    showInstallCommand('Новый секрет выдан.', currentClientId, secret);
+  } catch (err) {
+    alert('Ошибка: ' + err.message);
+  }
+  currentClient = await getClient(currentClientId);
+  renderSecret();
+});
+
+document.getElementById('revokeSecret').addEventListener('click', async () => {
+  if (!currentClientId) return;
+  if (!confirm('Отозвать секрет? Компьютер перестанет получать расписание, пока не будет выдан новый.')) return;
+  try {
+    await revokeClientSecret(currentClientId);
+  } catch (err) {
+    alert('Ошибка: ' + err.message);
+  }
+  currentClient = await getClient(currentClientId);
+  renderSecret();
+});
+
+document.getElementById('windowDays').addEventListener('change', async (e) => {
+  if (!currentClientId) return;
+  try {
+    await updateClient(currentClientId, { window_days: parseInt(e.target.value, 10) });
+  } catch (err) {
+    alert('Ошибка: ' + err.message);
+  }
+  currentClient = await getClient(currentClientId);
+  renderWindowDays();
+  renderConfigPreview();
+});
+
+document.getElementById('timeZone').addEventListener('change', async (e) => {
+  if (!currentClientId) return;
+  try {
+    await updateClient(currentClientId, { time_zone: e.target.value.trim() });
+  } catch (err) {
+    alert('Ошибка: ' + err.message);
+  }
+  currentClient = await getClient(currentClientId);
+  renderWindowDays();
+  renderUsers();
+  renderConfigPreview();
 });
 
 document.getElementById('copyClientId').addEventListener('click', () => {
@@ -367,6 +1309,51 @@ document.getElementById('deleteClient').addEventListener('click', async () => {
   await loadClients();
 });
 
+document.getElementById('scheduleBlock').addEventListener('click', async () => {
+  const start = document.getElementById('blockStart').value;
+  const until = document.getElementById('blockUntil').value;
+  if (!start || !until) {
+    alert('Укажите начало и конец блокировки');
+    return;
+  }
+  try {
+    await scheduleBlock(currentClientId, document.getElementById('blockTarget').value,
+      new Date(start).toISOString(), new Date(until).toISOString(), document.getElementById('blockNote').value.trim());
+  } catch (e) {
+    alert('Ошибка: ' + e.message);
+    return;
+  }
+  currentClient = await getClient(currentClientId);
+  renderUsers();
+  renderConfigPreview();
+});
+
+document.getElementById('historyUser').addEventListener('change', () => loadHistory());
+document.getElementById('historyType').addEventListener('change', () => loadHistory());
+document.getElementById('historyMore').addEventListener('click', () => loadHistory(true));
+
+document.getElementById('addBlockRule').addEventListener('click', async () => {
+  const ruleDays = [...document.querySelectorAll('#ruleDays input:checked')].map(i => i.value);
+  if (!ruleDays.length) {
+    alert('Выберите дни недели');
+    return;
+  }
+  try {
+    await addBlockRule(currentClientId, {
+      user_id: document.getElementById('ruleTarget').value,
+      days: ruleDays,
+      start: document.getElementById('ruleStart').value,
+      end: document.getElementById('ruleEnd').value
+    });
+  } catch (e) {
+    alert('Ошибка: ' + e.message);
+    return;
+  }
+  currentClient = await getClient(currentClientId);
+  renderUsers();
+  renderConfigPreview();
+});
+
 document.getElementById('addUser').addEventListener('click', async () => {
   const name = prompt('Имя (например, Александр):');
   const username = prompt('Имя учётной записи Windows:');
@@ -381,11 +1368,87 @@ async function loadClients() {
   const clients = await getClients();
   const sel = document.getElementById('clientSelect');
   sel.innerHTML = '<option value="">— Выберите компьютер —</option>' +
-    clients.map(c => `<option value="${c.id}">${c.name || c.id}</option>`).join('');
+    clients.map(c => `<option value="${c.id}">${escapeHtml(c.name || c.id)}${c.subscribers ? ' ● на связи' : ''}</option>`).join('');
   if (clients.length > 0 && !sel.value) {
     sel.value = clients[0].id;
     await selectClient();
   }
 }
 
-loadClients();
+document.getElementById('addTemplate').addEventListener('click', () => editTemplate(null));
+
+async function loadAdmins() {
+  const res = await api(`${API}/admins`);
+  const admins = await res.json();
+  const list = document.getElementById('adminsList');
+  const me = document.getElementById('accountName').textContent;
+  list.innerHTML = admins.map(a => `
+    <div class="requestItem">
+      <span>${escapeHtml(a.username)}</span>
+      ${a.username === me ? `<button type="button" data-feed-issue>Ссылка для календаря</button>` : ''}
+      ${a.username === me && a.has_feed_token ? `<button type="button" data-feed-revoke>Отозвать ссылку</button>` : ''}
+      <button type="button" data-password="${escapeHtml(a.username)}">Сменить пароль</button>
+      <button type="button" class="deleteBtn" data-delete="${escapeHtml(a.username)}">Удалить</button>
+    </div>`).join('');
+  list.querySelectorAll('[data-password]').forEach(btn => btn.addEventListener('click', async () => {
+    const password = prompt(`Новый пароль для ${btn.dataset.password} (не короче 8 символов):`);
+    if (!password) return;
+    const res = await api(`${API}/admins/${encodeURIComponent(btn.dataset.password)}/password`, {
+      method: 'PUT',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ password })
+    });
+    if (!res.ok) return alert(await res.text());
+    // Changing the own password ends the session: log in again
+    if (btn.dataset.password === document.getElementById('accountName').textContent) location.href = '/login.html';
+  }));
+  list.querySelectorAll('[data-feed-issue]').forEach(btn => btn.addEventListener('click', async () => {
+    if (!confirm('Выдать новую ссылку для подписки в календаре? Прежние ссылки перестанут работать.')) return;
+    const res = await api(`${API}/auth/feed-token`, { method: 'POST' });
+    if (!res.ok) return alert(await res.text());
+    feedToken = (await res.json()).token;
+    if (currentClient) renderUsers();
+    alert('Ссылки «🗓️ .ics» у пользователей теперь содержат токен: скопируйте ссылку в календарь.');
+    loadAdmins();
+  }));
+  list.querySelectorAll('[data-feed-revoke]').forEach(btn => btn.addEventListener('click', async () => {
+    if (!confirm('Отозвать ссылку? Календари перестанут обновляться.')) return;
+    const res = await api(`${API}/auth/feed-token`, { method: 'DELETE' });
+    if (!res.ok) return alert(await res.text());
+    feedToken = '';
+    if (currentClient) renderUsers();
+    loadAdmins();
+  }));
+  list.querySelectorAll('[data-delete]').forEach(btn => btn.addEventListener('click', async () => {
+    if (!confirm(`Удалить администратора ${btn.dataset.delete}?`)) return;
+    const res = await api(`${API}/admins/${encodeURIComponent(btn.dataset.delete)}`, { method: 'DELETE' });
+    if (!res.ok) return alert(await res.text());
+    loadAdmins();
+  }));
+}
+
+document.getElementById('addAdmin').addEventListener('click', async () => {
+  const username = prompt('Имя администратора:');
+  if (!username) return;
+  const password = prompt('Пароль (не короче 8 символов):');
+  if (!password) return;
+  const res = await api(`${API}/admins`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ username, password })
+  });
+  if (!res.ok) return alert(await res.text());
+  loadAdmins();
+});
+
+document.getElementById('logout').addEventListener('click', async () => {
+  await api(`${API}/auth/logout`, { method: 'POST' });
+  location.href = '/login.html';
+});
+
+loadSession().then(ok => {
+  if (!ok) return;
+  loadTemplates();
+  loadClients();
+  if (csrfToken) loadAdmins();
+});
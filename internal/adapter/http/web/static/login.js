@@ -0,0 +1,61 @@
+const API = '/api';
+
+// setup is true while no admin exists: the form creates the first one
+let setup = false;
+
+async function checkSession() {
+  const res = await fetch(`${API}/auth/session`);
+  // 404: the server runs without admin accounts
+  if (res.status === 404) {
+    location.href = '/';
+    return;
+  }
+  if (!res.ok) return;
+  const session = await res.json();
+  if (session.username) {
+    location.href = '/';
+    return;
+  }
+  if (session.setup_required) {
+    setup = true;
+    document.getElementById('loginTitle').textContent = 'Первый администратор';
+    document.getElementById('setupHint').style.display = '';
+    document.getElementById('setupToken').style.display = '';
+    document.getElementById('setupToken').required = true;
+    document.getElementById('password').autocomplete = 'new-password';
+    document.getElementById('passwordRepeat').style.display = '';
+    document.getElementById('loginSubmit').textContent = 'Создать и войти';
+  }
+}
+
+function loginError(status, text) {
+  if (status === 401) return 'Неверное имя или пароль';
+  if (status === 403 && setup) return 'Неверный токен установки';
+  if (status === 429) return 'Слишком много неудачных попыток, попробуйте через 15 минут';
+  return text;
+}
+
+document.getElementById('loginForm').addEventListener('submit', async (e) => {
+  e.preventDefault();
+  const username = document.getElementById('username').value;
+  const password = document.getElementById('password').value;
+  const errorEl = document.getElementById('loginError');
+  if (setup && password !== document.getElementById('passwordRepeat').value) {
+    errorEl.textContent = 'Пароли не совпадают';
+    return;
+  }
+  const body = { username, password };
+  if (setup) body.setup_token = document.getElementById('setupToken').value.trim();
+  const res = await fetch(`${API}/auth/${setup ? 'setup' : 'login'}`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(body)
+  });
+  if (!res.ok) {
+    errorEl.textContent = loginError(res.status, await res.text());
+    return;
+  }
+  location.href = '/';
+});
+
+checkSession();
@@ -0,0 +1,213 @@
+// Package ical reads dates from RFC 5545 calendars and writes allowed intervals as a calendar feed
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+)
+
+const (
+	dateLayout     = "20060102"
+	dateTimeLayout = "20060102T150405"
+	// maxEventDays caps dates taken from one event, protects from runaway ranges
+	maxEventDays = 366
+	// maxLineOctets is the RFC 5545 content line limit, longer lines are folded
+	maxLineOctets = 75
+)
+
+// Import is the result of reading a calendar
+type Import struct {
+	Dates   []string // covered dates (domain.DateLayout), sorted, unique
+	Skipped int      // events that could not be used (recurring, without start)
+}
+
+// ParseDates returns calendar dates covered by VEVENTs. All-day events cover
+// [DTSTART, DTEND); timed events cover every date they touch in loc.
+// Recurring events (RRULE) are skipped.
+func ParseDates(r io.Reader, loc *time.Location) (Import, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return Import{}, err
+	}
+	var result Import
+	dates := make(map[string]bool)
+	var ev *event
+	for _, line := range lines {
+		name, params, value := splitLine(line)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			ev = &event{}
+		case name == "END" && value == "VEVENT":
+			if ev == nil {
+				continue
+			}
+			covered, ok := ev.dates(loc)
+			if ok {
+				for _, d := range covered {
+					dates[d] = true
+				}
+			} else {
+				result.Skipped++
+			}
+			ev = nil
+		case ev == nil:
+			continue
+		case name == "DTSTART":
+			ev.start, ev.startDate, ev.startErr = parseValue(params, value, loc)
+			ev.hasStart = true
+		case name == "DTEND":
+			ev.end, ev.endDate, ev.endErr = parseValue(params, value, loc)
+			ev.hasEnd = true
+		case name == "RRULE" || name == "RDATE":
+			ev.recurring = true
+		}
+	}
+	for d := range dates {
+		result.Dates = append(result.Dates, d)
+	}
+	sort.Strings(result.Dates)
+	return result, nil
+}
+
+type event struct {
+	start, end         time.Time
+	startDate, endDate bool // VALUE=DATE
+	startErr, endErr   error
+	hasStart, hasEnd   bool
+	recurring          bool
+}
+
+func (e *event) dates(loc *time.Location) ([]string, bool) {
+	if !e.hasStart || e.startErr != nil || e.recurring {
+		return nil, false
+	}
+	first := e.start.In(loc)
+	first = time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc)
+	last := first
+	switch {
+	case e.hasEnd && e.endErr == nil:
+		end := e.end.In(loc)
+		last = time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, loc)
+		// DTEND is exclusive: all-day end date, or a timed end at midnight, is not covered
+		if (e.endDate || end.Equal(last)) && last.After(first) {
+			last = last.AddDate(0, 0, -1)
+		}
+	case e.hasEnd:
+		return nil, false
+	}
+	var result []string
+	for d := first; !d.After(last) && len(result) < maxEventDays; d = d.AddDate(0, 0, 1) {
+		result = append(result, d.Format(domain.DateLayout))
+	}
+	return result, len(result) > 0
+}
+
+// unfold joins RFC 5545 folded lines (continuations start with space or tab)
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, sc.Err()
+}
+
+// splitLine splits "NAME;PARAM=V:value" into upper-case name, params and value
+func splitLine(line string) (string, map[string]string, string) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return strings.ToUpper(line), nil, ""
+	}
+	head, value := line[:colon], line[colon+1:]
+	parts := strings.Split(head, ";")
+	params := make(map[string]string)
+	for _, p := range parts[1:] {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, strings.TrimSpace(value)
+}
+
+// parseValue parses DATE or DATE-TIME value; floating times are taken in loc
+func parseValue(params map[string]string, value string, loc *time.Location) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == len(dateLayout) {
+		t, err := time.ParseInLocation(dateLayout, value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(dateTimeLayout, strings.TrimSuffix(value, "Z"))
+		return t, false, err
+	}
+	if tzid := params["TZID"]; tzid != "" {
+		if tz, err := time.LoadLocation(tzid); err == nil {
+			loc = tz
+		}
+	}
+	t, err := time.ParseInLocation(dateTimeLayout, value, loc)
+	return t, false, err
+}
+
+// WriteCalendar writes intervals as VEVENTs. uidPrefix makes event UIDs stable between fetches.
+func WriteCalendar(w io.Writer, name, uidPrefix string, intervals []domain.AllowedInterval, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	write := func(line string) {
+		bw.WriteString(fold(line))
+		bw.WriteString("\r\n")
+	}
+	write("BEGIN:VCALENDAR")
+	write("VERSION:2.0")
+	write("PRODID:-//Aegis//Parental Control//RU")
+	write("CALSCALE:GREGORIAN")
+	write("X-WR-CALNAME:" + escapeText(name))
+	stamp := now.UTC().Format(dateTimeLayout) + "Z"
+	for _, iv := range intervals {
+		write("BEGIN:VEVENT")
+		write(fmt.Sprintf("UID:%s-%d@aegis", uidPrefix, iv.Start.Unix()))
+		write("DTSTAMP:" + stamp)
+		write("DTSTART:" + iv.Start.UTC().Format(dateTimeLayout) + "Z")
+		write("DTEND:" + iv.End.UTC().Format(dateTimeLayout) + "Z")
+		write("SUMMARY:" + escapeText(name))
+		write("TRANSP:TRANSPARENT")
+		write("END:VEVENT")
+	}
+	write("END:VCALENDAR")
+	return bw.Flush()
+}
+
+func escapeText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// fold splits a line into 75-octet chunks without breaking UTF-8 sequences
+func fold(line string) string {
+	if len(line) <= maxLineOctets {
+		return line
+	}
+	var b strings.Builder
+	limit := maxLineOctets
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > limit {
+			b.WriteString("\r\n ")
+			n = 0
+			limit = maxLineOctets - 1 // continuation starts with a space
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	return b.String()
+}
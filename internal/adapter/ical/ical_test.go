@@ -0,0 +1,80 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+)
+
+const holidays = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"SUMMARY:Осенние\r\n" +
+	" каникулы\r\n" +
+	"DTSTART;VALUE=DATE:20261026\r\n" +
+	"DTEND;VALUE=DATE:20261030\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"SUMMARY:День учителя\r\n" +
+	"DTSTART;VALUE=DATE:20261005\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"SUMMARY:Поездка\r\n" +
+	"DTSTART;TZID=Europe/Moscow:20261231T220000\r\n" +
+	"DTEND;TZID=Europe/Moscow:20270101T020000\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"SUMMARY:Кружок\r\n" +
+	"DTSTART:20261006T120000Z\r\n" +
+	"RRULE:FREQ=WEEKLY\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseDates(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip("no tzdata")
+	}
+	got, err := ParseDates(strings.NewReader(holidays), moscow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2026-10-05", "2026-10-26", "2026-10-27", "2026-10-28", "2026-10-29", "2026-12-31", "2027-01-01"}
+	if strings.Join(got.Dates, ",") != strings.Join(want, ",") {
+		t.Errorf("dates = %v, want %v", got.Dates, want)
+	}
+	if got.Skipped != 1 {
+		t.Errorf("skipped = %d, want 1 (recurring)", got.Skipped)
+	}
+}
+
+func TestWriteCalendar_RoundTrip(t *testing.T) {
+	start := time.Date(2026, 10, 5, 15, 0, 0, 0, time.UTC)
+	intervals := []domain.AllowedInterval{
+		{Start: start, End: start.Add(2 * time.Hour)},
+		{Start: start.Add(24 * time.Hour), End: start.Add(26 * time.Hour)},
+	}
+	var buf bytes.Buffer
+	name := "Доступ к компьютеру: " + strings.Repeat("Александр", 5)
+	if err := WriteCalendar(&buf, name, "c1-u1", intervals, start); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Errorf("line longer than %d octets: %q", maxLineOctets, line)
+		}
+	}
+	if !strings.Contains(buf.String(), "DTSTART:20261005T150000Z") {
+		t.Error("missing first event start")
+	}
+	got, err := ParseDates(&buf, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got.Dates, ",") != "2026-10-05,2026-10-06" {
+		t.Errorf("round trip dates = %v", got.Dates)
+	}
+}
@@ -0,0 +1,100 @@
+package jsonfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// backupCount is how many previous versions of the data file are kept as path.1 … path.N
+const backupCount = 3
+
+// backupInterval is the minimum age of path.1 before the next save rotates backups;
+// saves in between only replace the data file, so frequent writes do not push
+// older versions out
+const backupInterval = time.Hour
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// writeAtomic replaces path with data so that a crash at any moment leaves a complete file:
+// data goes to a synced temp file that is renamed over path. Once path.1 is older than
+// backupInterval, the previous content becomes path.1 and older backups shift up to path.<backups>.
+func writeAtomic(path string, data []byte, backups int) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	cleanup := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return cleanup(err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return cleanup(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return cleanup(err)
+	}
+	if err := rotateBackups(path, backups); err != nil {
+		return cleanup(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return cleanup(err)
+	}
+	syncDir(dir)
+	return nil
+}
+
+// rotateBackups shifts path.1 … path.(n-1) up by one and makes the current file path.1,
+// unless path.1 was made less than backupInterval ago
+func rotateBackups(path string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	first := backupPath(path, 1)
+	if info, err := os.Stat(first); err == nil && time.Since(info.ModTime()) < backupInterval {
+		return nil
+	}
+	for i := n - 1; i >= 1; i-- {
+		err := os.Rename(backupPath(path, i), backupPath(path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// A hard link keeps the data file in place until the new one replaces it;
+	// where links are not supported, the file moves and load falls back to path.1
+	if err := os.Remove(first); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(path, first); err != nil {
+		if err := os.Rename(path, first); err != nil {
+			return err
+		}
+	}
+	// The modification time of path.1 marks the rotation, not the write of its content
+	now := time.Now()
+	return os.Chtimes(first, now, now)
+}
+
+// syncDir makes renames in dir durable; not every OS can sync a directory, so errors are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,154 @@
+package jsonfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aegis/parental-control/internal/port"
+	"github.com/google/uuid"
+)
+
+// migration upgrades a decoded data file by one schema version. It works on the raw JSON
+// document, so it does not depend on the current persisted types.
+type migration struct {
+	name  string
+	apply func(doc map[string]any) error
+}
+
+// migrations[i] upgrades a file from schema version i to i+1. Files written before
+// versioning have no "version" field and are version 0. Append only: never reorder or edit.
+var migrations = []migration{
+	{"assign IDs to requests and block rules saved without them", assignMissingIDs},
+	{"seed history from the grants and blocks still listed", seedHistory},
+}
+
+// schemaVersion is the version written to the data file
+var schemaVersion = len(migrations)
+
+// errNewerSchema means the file was written by a newer server; falling back to an
+// older backup would silently lose its changes
+var errNewerSchema = errors.New("schema version is newer than supported, upgrade the server")
+
+// decodeData parses a data file of any supported schema version and upgrades it to
+// schemaVersion. It returns the version found in the file.
+func decodeData(data []byte) (*persistedData, int, error) {
+	var doc map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // keep numbers as written
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+	if doc == nil {
+		return nil, 0, fmt.Errorf("not a data file")
+	}
+	version := 0
+	if v, ok := doc["version"]; ok {
+		num, _ := v.(json.Number)
+		n, err := num.Int64()
+		if err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("invalid schema version %v", v)
+		}
+		version = int(n)
+	}
+	if version > schemaVersion {
+		return nil, version, fmt.Errorf("%w: %d > %d", errNewerSchema, version, schemaVersion)
+	}
+	if version < schemaVersion {
+		for i := version; i < schemaVersion; i++ {
+			if err := migrations[i].apply(doc); err != nil {
+				return nil, version, fmt.Errorf("migrate to version %d (%s): %w", i+1, migrations[i].name, err)
+			}
+		}
+		doc["version"] = schemaVersion
+		migrated, err := json.Marshal(doc)
+		if err != nil {
+			return nil, version, err
+		}
+		data = migrated
+	}
+	var pd persistedData
+	if err := json.Unmarshal(data, &pd); err != nil {
+		return nil, version, err
+	}
+	return &pd, version, nil
+}
+
+// objects returns the JSON objects of list, skipping anything else
+func objects(list any) []map[string]any {
+	items, _ := list.([]any)
+	var result []map[string]any
+	for _, item := range items {
+		if m, ok := item.(map[string]any); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// assignMissingIDs: the earliest files had blocks and temporary access without IDs,
+// so they could not be deleted individually
+func assignMissingIDs(doc map[string]any) error {
+	clients, _ := doc["clients"].(map[string]any)
+	for _, c := range clients {
+		client, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, key := range []string{"block_requests", "temporary_access_requests", "block_rules"} {
+			for _, item := range objects(client[key]) {
+				if id, _ := item["id"].(string); id == "" {
+					item["id"] = uuid.New().String()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// seedHistory: before version 2 only the current requests were kept. They become the
+// first history entries; when they were created is unknown, so their start is used.
+func seedHistory(doc map[string]any) error {
+	clients, _ := doc["clients"].(map[string]any)
+	for _, c := range clients {
+		client, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		usernames := make(map[string]any)
+		for _, u := range objects(client["users"]) {
+			if id, _ := u["id"].(string); id != "" {
+				usernames[id] = u["username"]
+			}
+		}
+		var history []any
+		for _, src := range []struct{ key, typ, note string }{
+			{"temporary_access_requests", port.HistoryTemporaryAccess, "note"},
+			{"override_grants", port.HistoryAlwaysAllow, "reason"},
+			{"block_requests", port.HistoryBlock, "note"},
+		} {
+			for _, item := range objects(client[src.key]) {
+				entry := map[string]any{
+					"id":         item["id"],
+					"type":       src.typ,
+					"start":      item["start"],
+					"until":      item["until"],
+					"created_at": item["start"],
+				}
+				if userID, _ := item["user_id"].(string); userID != "" {
+					entry["user_id"] = userID
+					entry["username"] = usernames[userID]
+				}
+				if note, ok := item[src.note]; ok {
+					entry["note"] = note
+				}
+				history = append(history, entry)
+			}
+		}
+		if len(history) > 0 {
+			client["history"] = history
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package jsonfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aegis/parental-control/internal/port"
+)
+
+// Every format the data file was ever written in, oldest first. A fixture is added
+// whenever a release changes what the file holds.
+var fixtures = []struct {
+	file  string
+	check func(t *testing.T, c *port.ClientState)
+}{
+	{"v0-baseline.json", func(t *testing.T, c *port.ClientState) {
+		if len(c.BlockRequests) != 1 || len(c.TemporaryAccessRequests) != 2 || c.TemporaryAccessRequests[0].ID != "t1" {
+			t.Errorf("requests: %+v %+v", c.BlockRequests, c.TemporaryAccessRequests)
+		}
+	}},
+	{"v0-budget.json", func(t *testing.T, c *port.ClientState) {
+		if u := c.Users[0]; u.Budget["monday"] != 90 || u.Usage["2026-01-05"] != 1800 {
+			t.Errorf("budget %v, usage %v", u.Budget, u.Usage)
+		}
+	}},
+	{"v0-overrides.json", func(t *testing.T, c *port.ClientState) {
+		o := c.Users[0].Overrides
+		if len(o) != 3 || o["2030-01-01"].UseDay != "sunday" || len(o["2030-01-02"].Intervals) != 1 {
+			t.Errorf("overrides %+v", o)
+		}
+	}},
+	{"v0-block-rules.json", func(t *testing.T, c *port.ClientState) {
+		if len(c.BlockRules) != 2 || c.BlockRules[0].ID != "r1" || c.BlockRules[1].UserID != "u1" || c.BlockRules[1].End != "07:00" {
+			t.Errorf("block rules %+v", c.BlockRules)
+		}
+	}},
+	{"v0-window.json", func(t *testing.T, c *port.ClientState) {
+		if c.WindowDays != 7 || c.TimeZone != "Asia/Yekaterinburg" {
+			t.Errorf("window %d, zone %q", c.WindowDays, c.TimeZone)
+		}
+	}},
+	{"v0-templates.json", func(t *testing.T, c *port.ClientState) {
+		u := c.Users[0]
+		if u.TemplateID != "tpl1" || c.Templates["tpl1"].Name != "Учебная неделя" || len(u.Periods) != 2 || u.Periods[1].Weeks != "even" {
+			t.Errorf("template %q %+v, periods %+v", u.TemplateID, c.Templates, u.Periods)
+		}
+	}},
+	{"v0-priorities.json", func(t *testing.T, c *port.ClientState) {
+		if c.BlockRequests[0].Priority != 2 || c.BlockRules[0].Priority != 3 ||
+			len(c.OverrideGrants) != 1 || c.OverrideGrants[0].Reason != "экзамен" {
+			t.Errorf("blocks %+v, rules %+v, grants %+v", c.BlockRequests, c.BlockRules, c.OverrideGrants)
+		}
+	}},
+	{"v1.json", func(t *testing.T, c *port.ClientState) {
+		if len(c.BlockRequests) != 1 || c.BlockRequests[0].ID != "b1" {
+			t.Errorf("blocks %+v", c.BlockRequests)
+		}
+	}},
+	{"v2.json", func(t *testing.T, c *port.ClientState) {
+		if len(c.TemporaryAccessRequests) != 1 || c.TemporaryAccessRequests[0].Note != "доделать проект" {
+			t.Errorf("temporary access %+v", c.TemporaryAccessRequests)
+		}
+	}},
+}
+
+// History seeded from the request lists of files older than version 2
+var fixtureHistory = map[string][]string{
+	"v0-priorities.json": {"b1", "g1"},
+	"v1.json":            {"b1"},
+	"v2.json":            {"t2", "b1"},
+}
+
+func copyFixture(t *testing.T, name string) (string, []byte) {
+	t.Helper()
+	original, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "data.json")
+	if err := os.WriteFile(path, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, original
+}
+
+func TestMigrations_Fixtures(t *testing.T) {
+	for _, fx := range fixtures {
+		t.Run(fx.file, func(t *testing.T) {
+			path, original := copyFixture(t, fx.file)
+			r, err := New(path, time.UTC)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			c, _ := r.GetClient(context.Background(), "c1")
+			if c == nil || len(c.Users) != 1 || c.Users[0].Username != "kid" || c.Name != "Детская" {
+				t.Fatalf("client: %+v", c)
+			}
+			if c.ComputedConfig == nil || c.LastSentVersion == "" {
+				t.Error("config not computed on load")
+			}
+			for _, b := range c.BlockRequests {
+				if b.ID == "" {
+					t.Errorf("block without ID: %+v", b)
+				}
+			}
+			for _, ta := range c.TemporaryAccessRequests {
+				if ta.ID == "" {
+					t.Errorf("temporary access without ID: %+v", ta)
+				}
+			}
+			for _, br := range c.BlockRules {
+				if br.ID == "" {
+					t.Errorf("block rule without ID: %+v", br)
+				}
+			}
+			fx.check(t, c)
+			checkHistory(t, r, fx.file)
+
+			f, err := readData(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backup := fmt.Sprintf("%s.pre-v%d", path, schemaVersion)
+			if f.version == 0 {
+				t.Fatalf("%s has no schema version after migration", path)
+			}
+			if bytes.Equal(f.raw, original) {
+				// Already current: nothing is rewritten or backed up
+				if _, err := os.Stat(backup); !os.IsNotExist(err) {
+					t.Errorf("backup made for a current file")
+				}
+				return
+			}
+			if saved, err := os.ReadFile(backup); err != nil || !bytes.Equal(saved, original) {
+				t.Errorf("pre-migration backup differs from the original: %v", err)
+			}
+			// Migrated file loads as is, with the same IDs
+			r, err = New(path, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, _ := r.GetClient(context.Background(), "c1")
+			for i := range c.BlockRequests {
+				if again.BlockRequests[i].ID != c.BlockRequests[i].ID {
+					t.Errorf("block ID changed on reload: %s -> %s", c.BlockRequests[i].ID, again.BlockRequests[i].ID)
+				}
+			}
+			fx.check(t, again)
+			checkHistory(t, r, fx.file)
+		})
+	}
+}
+
+func checkHistory(t *testing.T, r *Repository, file string) {
+	t.Helper()
+	want, ok := fixtureHistory[file]
+	if !ok {
+		return
+	}
+	history, _ := r.History(context.Background(), "c1")
+	var ids []string
+	for _, e := range history {
+		ids = append(ids, e.ID)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("history %v, want %v (newest first)", ids, want)
+	}
+}
+
+func TestMigrations_NewerSchemaRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	os.WriteFile(path, []byte(`{"version": 999, "clients": {}}`), 0644)
+	// A valid older backup must not be used instead: it would drop the newer changes
+	os.WriteFile(backupPath(path, 1), []byte(`{"version": 1, "clients": {}}`), 0644)
+	if _, err := New(path, time.UTC); !errors.Is(err, errNewerSchema) {
+		t.Errorf("got %v, want errNewerSchema", err)
+	}
+}
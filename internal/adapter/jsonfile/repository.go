@@ -3,24 +3,37 @@ package jsonfile
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/aegis/parental-control/internal/adapter/pubsub"
 	"github.com/aegis/parental-control/internal/domain"
 	"github.com/aegis/parental-control/internal/port"
 	"github.com/aegis/parental-control/internal/usecase/server"
 	"github.com/google/uuid"
 )
 
-const maxRequests = 10
+const (
+	// usageRetentionDays is how many days of reported usage are kept per user
+	usageRetentionDays = 14
+	// expiredRetention keeps ended temp access, grants and blocks in GetClient results, so
+	// explain can still attribute them; they were dropped as soon as they ended before
+	expiredRetention = 24 * time.Hour
+)
 
 type persistedBlockRequest struct {
-	ID     string    `json:"id"`
-	UserID string    `json:"user_id,omitempty"`
-	Start  time.Time `json:"start"`
-	Until  time.Time `json:"until"`
+	ID       string    `json:"id"`
+	UserID   string    `json:"user_id,omitempty"`
+	Start    time.Time `json:"start"`
+	Until    time.Time `json:"until"`
+	Priority int       `json:"priority,omitempty"`
+	Note     string    `json:"note,omitempty"`
 }
 
 type persistedTempAccessRequest struct {
@@ -28,6 +41,38 @@ type persistedTempAccessRequest struct {
 	UserID string    `json:"user_id"`
 	Start  time.Time `json:"start"`
 	Until  time.Time `json:"until"`
+	Note   string    `json:"note,omitempty"`
+}
+
+type persistedHistoryEntry struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	UserID      string     `json:"user_id,omitempty"`
+	Username    string     `json:"username,omitempty"`
+	Start       time.Time  `json:"start"`
+	Until       time.Time  `json:"until"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+	Note        string     `json:"note,omitempty"`
+	Admin       string     `json:"admin,omitempty"`
+}
+
+type persistedOverrideGrant struct {
+	ID       string    `json:"id"`
+	UserID   string    `json:"user_id"`
+	Start    time.Time `json:"start"`
+	Until    time.Time `json:"until"`
+	Priority int       `json:"priority"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+type persistedBlockRule struct {
+	ID       string   `json:"id"`
+	UserID   string   `json:"user_id,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Days     []string `json:"days"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
 }
 
 type persistedClient struct {
@@ -36,26 +81,45 @@ type persistedClient struct {
 	Users                   []persistedUser              `json:"users"`
 	BlockRequests           []persistedBlockRequest      `json:"block_requests,omitempty"`
 	TemporaryAccessRequests []persistedTempAccessRequest `json:"temporary_access_requests,omitempty"`
+	OverrideGrants          []persistedOverrideGrant     `json:"override_grants,omitempty"`
+	BlockRules              []persistedBlockRule         `json:"block_rules,omitempty"`
+	WindowDays              int                          `json:"window_days,omitempty"`
+	TimeZone                string                       `json:"time_zone,omitempty"`
+	SecretHash              string                       `json:"secret_hash,omitempty"`
+	History                 []persistedHistoryEntry      `json:"history,omitempty"`
 }
 
 type persistedUser struct {
+	ID         string                  `json:"id"`
+	Name       string                  `json:"name"`
+	Username   string                  `json:"username"`
+	Schedule   domain.DaySchedule      `json:"schedule"`
+	TemplateID string                  `json:"template_id,omitempty"`
+	Periods    []domain.SchedulePeriod `json:"periods,omitempty"`
+	Overrides  domain.DateOverrides    `json:"overrides,omitempty"`
+	Budget     domain.DailyBudget      `json:"budget,omitempty"`
+	Usage      domain.DailyUsage       `json:"usage,omitempty"`
+}
+
+type persistedTemplate struct {
 	ID       string             `json:"id"`
 	Name     string             `json:"name"`
-	Username string             `json:"username"`
 	Schedule domain.DaySchedule `json:"schedule"`
 }
 
 type persistedData struct {
-	Clients map[string]persistedClient `json:"clients"`
+	Version   int                          `json:"version"` // schema version, see migrations
+	Clients   map[string]persistedClient   `json:"clients"`
+	Templates map[string]persistedTemplate `json:"templates,omitempty"`
 }
 
 type Repository struct {
-	mu          sync.RWMutex
-	filePath    string
-	clients     map[string]*clientState
-	subscribers map[string][]chan struct{}
-	subMu       sync.Mutex
-	loc         *time.Location
+	mu        sync.RWMutex
+	filePath  string
+	clients   map[string]*clientState
+	templates map[string]domain.ScheduleTemplate
+	hub       *pubsub.Hub
+	loc       *time.Location
 }
 
 type clientState struct {
@@ -64,6 +128,12 @@ type clientState struct {
 	Users                   []domain.User
 	BlockRequests           []port.BlockRequest
 	TemporaryAccessRequests []port.TemporaryAccessRequest
+	OverrideGrants          []port.OverrideGrant
+	BlockRules              []port.BlockRule
+	WindowDays              int
+	TimeZone                string
+	SecretHash              string
+	History                 []port.HistoryEntry // oldest first
 	LastSentIntervals       map[string][]domain.AllowedInterval
 	LastSentVersion         string
 	ComputedConfig          *domain.ClientConfig
@@ -74,10 +144,11 @@ func New(filePath string, loc *time.Location) (*Repository, error) {
 		loc = time.UTC
 	}
 	r := &Repository{
-		filePath:    filePath,
-		clients:     make(map[string]*clientState),
-		subscribers: make(map[string][]chan struct{}),
-		loc:         loc,
+		filePath:  filePath,
+		clients:   make(map[string]*clientState),
+		templates: make(map[string]domain.ScheduleTemplate),
+		hub:       pubsub.New(pubsub.DefaultCoalesce),
+		loc:       loc,
 	}
 	if err := r.load(); err != nil && !os.IsNotExist(err) {
 		return nil, err
@@ -89,52 +160,154 @@ func (r *Repository) now() time.Time {
 	return time.Now().In(r.loc)
 }
 
-func (r *Repository) load() error {
-	data, err := os.ReadFile(r.filePath)
+// dataFile is a data file read from disk and upgraded to the current schema
+type dataFile struct {
+	path    string
+	raw     []byte // content as read, before migrations
+	version int    // schema version of raw
+	data    *persistedData
+}
+
+func readData(path string) (*dataFile, error) {
+	raw, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var pd persistedData
-	if err := json.Unmarshal(data, &pd); err != nil {
+	pd, version, err := decodeData(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &dataFile{path: path, raw: raw, version: version, data: pd}, nil
+}
+
+// loadBackup returns the newest backup that parses, when the data file could not be read
+// (e.g. truncated by a power cut). A corrupt data file is kept as path.corrupt.
+func (r *Repository) loadBackup(primaryErr error) (*dataFile, error) {
+	for i := 1; i <= backupCount; i++ {
+		path := backupPath(r.filePath, i)
+		f, err := readData(path)
+		if err != nil {
+			continue
+		}
+		if os.IsNotExist(primaryErr) {
+			log.Printf("Data file %s is missing, restored from backup %s", r.filePath, path)
+		} else {
+			corrupt := r.filePath + ".corrupt"
+			os.Rename(r.filePath, corrupt)
+			log.Printf("Data file is unreadable (%v), restored from backup %s; the damaged file is kept as %s", primaryErr, path, corrupt)
+		}
+		return f, nil
+	}
+	return nil, primaryErr
+}
+
+func (r *Repository) load() error {
+	f, err := readData(r.filePath)
+	if errors.Is(err, errNewerSchema) {
 		return err
 	}
+	if err != nil {
+		if f, err = r.loadBackup(err); err != nil {
+			return err
+		}
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.populate(f.data)
+	if f.version == schemaVersion {
+		return nil
+	}
+	// Keep the file as it was before migration, then write it in the current schema
+	backup := fmt.Sprintf("%s.pre-v%d", r.filePath, schemaVersion)
+	if err := writeAtomic(backup, f.raw, 0); err != nil {
+		return fmt.Errorf("back up before migration: %w", err)
+	}
+	if err := r.saveLocked(); err != nil {
+		return err
+	}
+	log.Printf("Data file %s migrated from schema version %d to %d, the previous file is kept as %s", r.filePath, f.version, schemaVersion, backup)
+	return nil
+}
+
+// populate fills the repository from a current-schema file and precomputes every client's config
+func (r *Repository) populate(pd *persistedData) {
+	for id, pt := range pd.Templates {
+		r.templates[id] = domain.ScheduleTemplate{ID: pt.ID, Name: pt.Name, Schedule: pt.Schedule}
+	}
 	for id, pc := range pd.Clients {
 		users := make([]domain.User, 0, len(pc.Users))
 		for _, pu := range pc.Users {
 			users = append(users, domain.User{
-				ID:       pu.ID,
-				Name:     pu.Name,
-				Username: pu.Username,
-				Schedule: pu.Schedule,
+				ID:         pu.ID,
+				Name:       pu.Name,
+				Username:   pu.Username,
+				Schedule:   pu.Schedule,
+				TemplateID: pu.TemplateID,
+				Periods:    pu.Periods,
+				Overrides:  pu.Overrides,
+				Budget:     pu.Budget,
+				Usage:      pu.Usage,
 			})
 		}
 		blockReqs := make([]port.BlockRequest, 0, len(pc.BlockRequests))
 		for _, b := range pc.BlockRequests {
-			id := b.ID
-			if id == "" {
-				id = uuid.New().String()
-			}
-			blockReqs = append(blockReqs, port.BlockRequest{ID: id, UserID: b.UserID, Start: b.Start, Until: b.Until})
+			blockReqs = append(blockReqs, port.BlockRequest{ID: b.ID, UserID: b.UserID, Start: b.Start, Until: b.Until, Priority: b.Priority, Note: b.Note})
 		}
 		tempReqs := make([]port.TemporaryAccessRequest, 0, len(pc.TemporaryAccessRequests))
 		for _, t := range pc.TemporaryAccessRequests {
-			id := t.ID
-			if id == "" {
-				id = uuid.New().String()
-			}
-			tempReqs = append(tempReqs, port.TemporaryAccessRequest{ID: id, UserID: t.UserID, Start: t.Start, Until: t.Until})
+			tempReqs = append(tempReqs, port.TemporaryAccessRequest{ID: t.ID, UserID: t.UserID, Start: t.Start, Until: t.Until, Note: t.Note})
+		}
+		grants := make([]port.OverrideGrant, 0, len(pc.OverrideGrants))
+		for _, g := range pc.OverrideGrants {
+			grants = append(grants, port.OverrideGrant{ID: g.ID, UserID: g.UserID, Start: g.Start, Until: g.Until, Priority: g.Priority, Reason: g.Reason})
+		}
+		rules := make([]port.BlockRule, 0, len(pc.BlockRules))
+		for _, br := range pc.BlockRules {
+			rules = append(rules, port.BlockRule{
+				ID:          br.ID,
+				UserID:      br.UserID,
+				Priority:    br.Priority,
+				WeeklyRange: domain.WeeklyRange{Days: br.Days, Start: br.Start, End: br.End},
+			})
 		}
+		history := make([]port.HistoryEntry, 0, len(pc.History))
+		for _, h := range pc.History {
+			history = append(history, port.HistoryEntry{
+				ID:          h.ID,
+				Type:        h.Type,
+				UserID:      h.UserID,
+				Username:    h.Username,
+				Start:       h.Start,
+				Until:       h.Until,
+				CreatedAt:   h.CreatedAt,
+				CancelledAt: h.CancelledAt,
+				Note:        h.Note,
+				Admin:       h.Admin,
+			})
+		}
+		// Oldest first: entries seeded by a migration are not in order
+		sort.SliceStable(history, func(i, j int) bool { return history[i].CreatedAt.Before(history[j].CreatedAt) })
 		r.clients[id] = &clientState{
 			ID:                      pc.ID,
 			Name:                    pc.Name,
 			Users:                   users,
 			BlockRequests:           blockReqs,
 			TemporaryAccessRequests: tempReqs,
+			OverrideGrants:          grants,
+			BlockRules:              rules,
+			WindowDays:              pc.WindowDays,
+			TimeZone:                pc.TimeZone,
+			SecretHash:              pc.SecretHash,
+			History:                 history,
 		}
 	}
-	return nil
+	now := r.now()
+	for _, cs := range r.clients {
+		// The config version is not persisted: every start is a new version
+		cs.LastSentVersion = uuid.New().String()
+		config, _ := server.ComputeClientConfig(now, r.toPortState(cs), true)
+		cs.ComputedConfig = &config
+	}
 }
 
 func (r *Repository) save() error {
@@ -145,33 +318,58 @@ func (r *Repository) save() error {
 
 func (r *Repository) saveLocked() error {
 	pd := persistedData{
-		Clients: make(map[string]persistedClient),
+		Version:   schemaVersion,
+		Clients:   make(map[string]persistedClient),
+		Templates: make(map[string]persistedTemplate),
+	}
+	for id, t := range r.templates {
+		pd.Templates[id] = persistedTemplate{ID: t.ID, Name: t.Name, Schedule: t.Schedule}
 	}
 	for id, cs := range r.clients {
 		users := make([]persistedUser, 0, len(cs.Users))
 		for _, u := range cs.Users {
 			users = append(users, persistedUser{
-				ID:       u.ID,
-				Name:     u.Name,
-				Username: u.Username,
-				Schedule: u.Schedule,
+				ID:         u.ID,
+				Name:       u.Name,
+				Username:   u.Username,
+				Schedule:   u.Schedule,
+				TemplateID: u.TemplateID,
+				Periods:    u.Periods,
+				Overrides:  u.Overrides,
+				Budget:     u.Budget,
+				Usage:      u.Usage,
 			})
 		}
 		blockReqs := make([]persistedBlockRequest, 0, len(cs.BlockRequests))
 		for _, b := range cs.BlockRequests {
-			id := b.ID
-			if id == "" {
-				id = uuid.New().String()
-			}
-			blockReqs = append(blockReqs, persistedBlockRequest{ID: id, UserID: b.UserID, Start: b.Start, Until: b.Until})
+			blockReqs = append(blockReqs, persistedBlockRequest{ID: b.ID, UserID: b.UserID, Start: b.Start, Until: b.Until, Priority: b.Priority, Note: b.Note})
 		}
 		tempReqs := make([]persistedTempAccessRequest, 0, len(cs.TemporaryAccessRequests))
 		for _, t := range cs.TemporaryAccessRequests {
-			id := t.ID
-			if id == "" {
-				id = uuid.New().String()
-			}
-			tempReqs = append(tempReqs, persistedTempAccessRequest{ID: id, UserID: t.UserID, Start: t.Start, Until: t.Until})
+			tempReqs = append(tempReqs, persistedTempAccessRequest{ID: t.ID, UserID: t.UserID, Start: t.Start, Until: t.Until, Note: t.Note})
+		}
+		grants := make([]persistedOverrideGrant, 0, len(cs.OverrideGrants))
+		for _, g := range cs.OverrideGrants {
+			grants = append(grants, persistedOverrideGrant{ID: g.ID, UserID: g.UserID, Start: g.Start, Until: g.Until, Priority: g.Priority, Reason: g.Reason})
+		}
+		rules := make([]persistedBlockRule, 0, len(cs.BlockRules))
+		for _, br := range cs.BlockRules {
+			rules = append(rules, persistedBlockRule{ID: br.ID, UserID: br.UserID, Priority: br.Priority, Days: br.Days, Start: br.Start, End: br.End})
+		}
+		history := make([]persistedHistoryEntry, 0, len(cs.History))
+		for _, h := range cs.History {
+			history = append(history, persistedHistoryEntry{
+				ID:          h.ID,
+				Type:        h.Type,
+				UserID:      h.UserID,
+				Username:    h.Username,
+				Start:       h.Start,
+				Until:       h.Until,
+				CreatedAt:   h.CreatedAt,
+				CancelledAt: h.CancelledAt,
+				Note:        h.Note,
+				Admin:       h.Admin,
+			})
 		}
 		pd.Clients[id] = persistedClient{
 			ID:                      id,
@@ -179,6 +377,12 @@ func (r *Repository) saveLocked() error {
 			Users:                   users,
 			BlockRequests:           blockReqs,
 			TemporaryAccessRequests: tempReqs,
+			OverrideGrants:          grants,
+			BlockRules:              rules,
+			WindowDays:              cs.WindowDays,
+			TimeZone:                cs.TimeZone,
+			SecretHash:              cs.SecretHash,
+			History:                 history,
 		}
 	}
 
@@ -190,19 +394,11 @@ func (r *Repository) saveLocked() error {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
-	return os.WriteFile(r.filePath, data, 0644)
+	return writeAtomic(r.filePath, data, backupCount)
 }
 
 func (r *Repository) notify(clientID string) {
-	r.subMu.Lock()
-	chans := r.subscribers[clientID]
-	r.subMu.Unlock()
-	for _, ch := range chans {
-		select {
-		case ch <- struct{}{}:
-		default:
-		}
-	}
+	r.hub.Publish(clientID)
 }
 
 func (r *Repository) GetClient(ctx context.Context, clientID string) (*port.ClientState, error) {
@@ -212,14 +408,14 @@ func (r *Repository) GetClient(ctx context.Context, clientID string) (*port.Clie
 	if !ok {
 		return nil, nil
 	}
-	// Clean up expired temp access and blocks
-	now := r.now()
+	// Clean up temp access, overrides and blocks that ended more than expiredRetention ago
+	expired := r.now().Add(-expiredRetention)
 	needsSave := false
 
 	// Filter expired temporary access
 	validTemp := cs.TemporaryAccessRequests[:0]
 	for _, t := range cs.TemporaryAccessRequests {
-		if t.Until.After(now) {
+		if t.Until.After(expired) {
 			validTemp = append(validTemp, t)
 		} else {
 			needsSave = true
@@ -227,10 +423,21 @@ func (r *Repository) GetClient(ctx context.Context, clientID string) (*port.Clie
 	}
 	cs.TemporaryAccessRequests = validTemp
 
+	// Filter expired overrides
+	validGrants := cs.OverrideGrants[:0]
+	for _, g := range cs.OverrideGrants {
+		if g.Until.After(expired) {
+			validGrants = append(validGrants, g)
+		} else {
+			needsSave = true
+		}
+	}
+	cs.OverrideGrants = validGrants
+
 	// Filter expired blocks
 	validBlocks := cs.BlockRequests[:0]
 	for _, b := range cs.BlockRequests {
-		if b.Until.After(now) {
+		if b.Until.After(expired) {
 			validBlocks = append(validBlocks, b)
 		} else {
 			needsSave = true
@@ -238,17 +445,6 @@ func (r *Repository) GetClient(ctx context.Context, clientID string) (*port.Clie
 	}
 	cs.BlockRequests = validBlocks
 
-	// Compute config if missing (migration for existing clients)
-	if cs.ComputedConfig == nil {
-		if cs.LastSentVersion == "" {
-			cs.LastSentVersion = uuid.New().String()
-		}
-		state := r.toPortState(cs)
-		config, _ := server.ComputeClientConfig(r.now(), state, true)
-		cs.ComputedConfig = &config
-		needsSave = true
-	}
-
 	if needsSave {
 		r.saveLocked()
 	}
@@ -263,16 +459,32 @@ func (r *Repository) toPortState(cs *clientState) *port.ClientState {
 	copy(blockReqs, cs.BlockRequests)
 	tempReqs := make([]port.TemporaryAccessRequest, len(cs.TemporaryAccessRequests))
 	copy(tempReqs, cs.TemporaryAccessRequests)
+	grants := make([]port.OverrideGrant, len(cs.OverrideGrants))
+	copy(grants, cs.OverrideGrants)
+	rules := make([]port.BlockRule, len(cs.BlockRules))
+	copy(rules, cs.BlockRules)
 	lastSent := make(map[string][]domain.AllowedInterval)
 	for k, v := range cs.LastSentIntervals {
 		lastSent[k] = append([]domain.AllowedInterval(nil), v...)
 	}
+	templates := make(map[string]domain.ScheduleTemplate)
+	for _, u := range cs.Users {
+		if t, ok := r.templates[u.TemplateID]; ok {
+			templates[t.ID] = t
+		}
+	}
 	return &port.ClientState{
 		ID:                      cs.ID,
 		Name:                    cs.Name,
 		Users:                   users,
 		BlockRequests:           blockReqs,
 		TemporaryAccessRequests: tempReqs,
+		OverrideGrants:          grants,
+		BlockRules:              rules,
+		WindowDays:              cs.WindowDays,
+		TimeZone:                cs.TimeZone,
+		SecretHash:              cs.SecretHash,
+		Templates:               templates,
 		LastSentIntervals:       lastSent,
 		LastSentVersion:         cs.LastSentVersion,
 		ComputedConfig:          cs.ComputedConfig,
@@ -298,23 +510,57 @@ func (r *Repository) SaveClient(ctx context.Context, client *port.ClientState) e
 		client.LastSentVersion = uuid.New().String()
 	}
 
-	// Compute config on save
-	config, _ := server.ComputeClientConfig(r.now(), client, true)
-
 	cs := &clientState{
 		ID:                      client.ID,
 		Name:                    client.Name,
 		Users:                   append([]domain.User(nil), client.Users...),
 		BlockRequests:           append([]port.BlockRequest(nil), client.BlockRequests...),
 		TemporaryAccessRequests: append([]port.TemporaryAccessRequest(nil), client.TemporaryAccessRequests...),
+		OverrideGrants:          append([]port.OverrideGrant(nil), client.OverrideGrants...),
+		BlockRules:              append([]port.BlockRule(nil), client.BlockRules...),
+		WindowDays:              client.WindowDays,
+		TimeZone:                client.TimeZone,
+		SecretHash:              client.SecretHash,
 		LastSentIntervals:       client.LastSentIntervals,
 		LastSentVersion:         client.LastSentVersion,
-		ComputedConfig:          &config,
 	}
+	assignIDs(cs)
+	// History is not part of ClientState: keep it
+	if old, ok := r.clients[client.ID]; ok {
+		cs.History = old.History
+	}
+	// Compute config on save
+	config, _ := server.ComputeClientConfig(r.now(), r.toPortState(cs), true)
+	cs.ComputedConfig = &config
 	r.clients[client.ID] = cs
 	return r.saveLocked()
 }
 
+// assignIDs gives IDs to blocks, grants and rules saved without them, like assignMissingIDs
+// does on load: without an ID they cannot be deleted individually
+func assignIDs(cs *clientState) {
+	for i := range cs.BlockRequests {
+		if cs.BlockRequests[i].ID == "" {
+			cs.BlockRequests[i].ID = uuid.New().String()
+		}
+	}
+	for i := range cs.TemporaryAccessRequests {
+		if cs.TemporaryAccessRequests[i].ID == "" {
+			cs.TemporaryAccessRequests[i].ID = uuid.New().String()
+		}
+	}
+	for i := range cs.OverrideGrants {
+		if cs.OverrideGrants[i].ID == "" {
+			cs.OverrideGrants[i].ID = uuid.New().String()
+		}
+	}
+	for i := range cs.BlockRules {
+		if cs.BlockRules[i].ID == "" {
+			cs.BlockRules[i].ID = uuid.New().String()
+		}
+	}
+}
+
 func (r *Repository) DeleteClient(ctx context.Context, clientID string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -322,9 +568,43 @@ func (r *Repository) DeleteClient(ctx context.Context, clientID string) error {
 		return nil
 	}
 	delete(r.clients, clientID)
-	r.subMu.Lock()
-	delete(r.subscribers, clientID)
-	r.subMu.Unlock()
+	r.notify(clientID) // waiting long-polls find the client gone
+	return r.saveLocked()
+}
+
+func (r *Repository) UpdateClient(ctx context.Context, clientID string, update port.ClientUpdate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return port.ErrClientNotFound
+	}
+	if update.Name != nil {
+		cs.Name = *update.Name
+	}
+	if update.WindowDays != nil {
+		cs.WindowDays = *update.WindowDays
+	}
+	if update.TimeZone != nil {
+		cs.TimeZone = *update.TimeZone
+	}
+	// Recompute config
+	state := r.toPortState(cs)
+	config, _ := server.ComputeClientConfig(r.now(), state, true)
+	cs.ComputedConfig = &config
+	r.notify(clientID)
+	return r.saveLocked()
+}
+
+func (r *Repository) SetClientSecret(ctx context.Context, clientID, secretHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return port.ErrClientNotFound
+	}
+	cs.SecretHash = secretHash
+	r.notify(clientID) // waiting long-polls re-check the secret
 	return r.saveLocked()
 }
 
@@ -375,6 +655,221 @@ func (r *Repository) UpdateUserSchedule(ctx context.Context, clientID, userID st
 	return nil
 }
 
+func (r *Repository) SetDateOverride(ctx context.Context, clientID, userID, date string, override domain.DateOverride) error {
+	return r.updateOverrides(clientID, userID, func(overrides domain.DateOverrides) {
+		overrides[date] = override
+	})
+}
+
+func (r *Repository) SetDateOverrides(ctx context.Context, clientID, userID string, overrides domain.DateOverrides) error {
+	return r.updateOverrides(clientID, userID, func(existing domain.DateOverrides) {
+		for date, o := range overrides {
+			existing[date] = o
+		}
+	})
+}
+
+func (r *Repository) DeleteDateOverride(ctx context.Context, clientID, userID, date string) error {
+	return r.updateOverrides(clientID, userID, func(overrides domain.DateOverrides) {
+		delete(overrides, date)
+	})
+}
+
+// updateOverrides applies fn to a copy of user's overrides (port states share the map)
+func (r *Repository) updateOverrides(clientID, userID string, fn func(domain.DateOverrides)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return nil
+	}
+	for i := range cs.Users {
+		if cs.Users[i].ID == userID {
+			overrides := make(domain.DateOverrides, len(cs.Users[i].Overrides))
+			for date, o := range cs.Users[i].Overrides {
+				overrides[date] = o
+			}
+			fn(overrides)
+			cs.Users[i].Overrides = overrides
+			// Recompute config
+			state := r.toPortState(cs)
+			config, _ := server.ComputeClientConfig(r.now(), state, true)
+			cs.ComputedConfig = &config
+			r.notify(clientID)
+			return r.saveLocked()
+		}
+	}
+	return nil
+}
+
+func (r *Repository) UpdateUserBudget(ctx context.Context, clientID, userID string, budget domain.DailyBudget) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return nil
+	}
+	for i := range cs.Users {
+		if cs.Users[i].ID == userID {
+			cs.Users[i].Budget = budget
+			// Recompute config
+			state := r.toPortState(cs)
+			config, _ := server.ComputeClientConfig(r.now(), state, true)
+			cs.ComputedConfig = &config
+			r.notify(clientID)
+			return r.saveLocked()
+		}
+	}
+	return nil
+}
+
+func (r *Repository) AddUsage(ctx context.Context, clientID string, usage map[string]time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return nil
+	}
+	now := r.now()
+	// Usage is attributed to the client's local date
+	if loc := server.ClientLocation(cs.TimeZone); loc != nil {
+		now = now.In(loc)
+	}
+	today := now.Format(domain.DateLayout)
+	oldest := now.AddDate(0, 0, -usageRetentionDays).Format(domain.DateLayout)
+	for i := range cs.Users {
+		d, ok := usage[cs.Users[i].Username]
+		if !ok {
+			continue
+		}
+		// Replace the map instead of mutating it: port states share it
+		updated := make(domain.DailyUsage)
+		for date, secs := range cs.Users[i].Usage {
+			if date >= oldest {
+				updated[date] = secs
+			}
+		}
+		updated[today] += int(d / time.Second)
+		cs.Users[i].Usage = updated
+	}
+	// Recompute config
+	state := r.toPortState(cs)
+	config, _ := server.ComputeClientConfig(now, state, true)
+	cs.ComputedConfig = &config
+	return r.saveLocked()
+}
+
+func (r *Repository) UpdateUserPeriods(ctx context.Context, clientID, userID string, periods []domain.SchedulePeriod) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return nil
+	}
+	for i := range cs.Users {
+		if cs.Users[i].ID == userID {
+			cs.Users[i].Periods = periods
+			// Recompute config
+			state := r.toPortState(cs)
+			config, _ := server.ComputeClientConfig(r.now(), state, true)
+			cs.ComputedConfig = &config
+			r.notify(clientID)
+			return r.saveLocked()
+		}
+	}
+	return nil
+}
+
+func (r *Repository) SetUserTemplate(ctx context.Context, clientID, userID, templateID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return nil
+	}
+	for i := range cs.Users {
+		if cs.Users[i].ID == userID {
+			cs.Users[i].TemplateID = templateID
+			// Recompute config
+			state := r.toPortState(cs)
+			config, _ := server.ComputeClientConfig(r.now(), state, true)
+			cs.ComputedConfig = &config
+			r.notify(clientID)
+			return r.saveLocked()
+		}
+	}
+	return nil
+}
+
+func (r *Repository) ListTemplates(ctx context.Context) ([]domain.ScheduleTemplate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make([]domain.ScheduleTemplate, 0, len(r.templates))
+	for _, t := range r.templates {
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func (r *Repository) GetTemplate(ctx context.Context, templateID string) (*domain.ScheduleTemplate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.templates[templateID]
+	if !ok {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (r *Repository) SaveTemplate(ctx context.Context, template domain.ScheduleTemplate) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if template.ID == "" {
+		template.ID = uuid.New().String()
+	}
+	r.templates[template.ID] = template
+	r.templateChangedLocked(template.ID)
+	return template.ID, r.saveLocked()
+}
+
+func (r *Repository) DeleteTemplate(ctx context.Context, templateID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.templates[templateID]; !ok {
+		return nil
+	}
+	delete(r.templates, templateID)
+	r.templateChangedLocked(templateID)
+	return r.saveLocked()
+}
+
+// templateChangedLocked bumps config version of clients whose users reference the template
+// and notifies their subscribers; references to a deleted template are dropped
+func (r *Repository) templateChangedLocked(templateID string) {
+	_, exists := r.templates[templateID]
+	for id, cs := range r.clients {
+		affected := false
+		for i := range cs.Users {
+			if cs.Users[i].TemplateID != templateID {
+				continue
+			}
+			affected = true
+			if !exists {
+				cs.Users[i].TemplateID = ""
+			}
+		}
+		if !affected {
+			continue
+		}
+		cs.LastSentVersion = uuid.New().String()
+		state := r.toPortState(cs)
+		config, _ := server.ComputeClientConfig(r.now(), state, true)
+		cs.ComputedConfig = &config
+		r.notify(id)
+	}
+}
+
 func (r *Repository) DeleteUser(ctx context.Context, clientID, userID string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -393,6 +888,21 @@ func (r *Repository) DeleteUser(ctx context.Context, clientID, userID string) er
 				}
 			}
 			cs.TemporaryAccessRequests = newTemp
+			newGrants := cs.OverrideGrants[:0]
+			for _, g := range cs.OverrideGrants {
+				if g.UserID != userID {
+					newGrants = append(newGrants, g)
+				}
+			}
+			cs.OverrideGrants = newGrants
+			// Remove recurring blocks for deleted user
+			newRules := cs.BlockRules[:0]
+			for _, br := range cs.BlockRules {
+				if br.UserID != userID {
+					newRules = append(newRules, br)
+				}
+			}
+			cs.BlockRules = newRules
 			// Recompute config
 			state := r.toPortState(cs)
 			config, _ := server.ComputeClientConfig(r.now(), state, true)
@@ -404,18 +914,59 @@ func (r *Repository) DeleteUser(ctx context.Context, clientID, userID string) er
 	return nil
 }
 
-func (r *Repository) GrantTemporaryAccess(ctx context.Context, clientID, userID string, until time.Time) error {
+func (r *Repository) GrantTemporaryAccess(ctx context.Context, clientID, userID string, start, until time.Time, note, admin string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return port.ErrClientNotFound
+	}
+	id := uuid.New().String()
+	cs.TemporaryAccessRequests = append(cs.TemporaryAccessRequests, port.TemporaryAccessRequest{ID: id, UserID: userID, Start: start, Until: until, Note: note})
+	r.recordHistory(cs, port.HistoryTemporaryAccess, id, userID, start, until, note, admin)
+	// Recompute config
+	state := r.toPortState(cs)
+	config, _ := server.ComputeClientConfig(r.now(), state, true)
+	cs.ComputedConfig = &config
+	r.notify(clientID)
+	return r.saveLocked()
+}
+
+func (r *Repository) UpdateTemporaryAccess(ctx context.Context, clientID, requestID string, until time.Time) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	cs, ok := r.clients[clientID]
 	if !ok {
 		return nil
 	}
-	now := r.now()
-	cs.TemporaryAccessRequests = append(cs.TemporaryAccessRequests, port.TemporaryAccessRequest{ID: uuid.New().String(), UserID: userID, Start: now, Until: until})
-	if len(cs.TemporaryAccessRequests) > maxRequests {
-		cs.TemporaryAccessRequests = cs.TemporaryAccessRequests[len(cs.TemporaryAccessRequests)-maxRequests:]
+	for i := range cs.TemporaryAccessRequests {
+		if cs.TemporaryAccessRequests[i].ID == requestID {
+			if !until.After(cs.TemporaryAccessRequests[i].Start) || !until.After(r.now()) {
+				return port.ErrInvalidUntil
+			}
+			cs.TemporaryAccessRequests[i].Until = until
+			cs.History = server.ExtendHistory(cs.History, requestID, until)
+			// Recompute config
+			state := r.toPortState(cs)
+			config, _ := server.ComputeClientConfig(r.now(), state, true)
+			cs.ComputedConfig = &config
+			r.notify(clientID)
+			return r.saveLocked()
+		}
 	}
+	return nil
+}
+
+func (r *Repository) GrantOverride(ctx context.Context, clientID, userID string, start, until time.Time, priority int, reason, admin string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return port.ErrClientNotFound
+	}
+	id := uuid.New().String()
+	cs.OverrideGrants = append(cs.OverrideGrants, port.OverrideGrant{ID: id, UserID: userID, Start: start, Until: until, Priority: priority, Reason: reason})
+	r.recordHistory(cs, port.HistoryAlwaysAllow, id, userID, start, until, reason, admin)
 	// Recompute config
 	state := r.toPortState(cs)
 	config, _ := server.ComputeClientConfig(r.now(), state, true)
@@ -424,17 +975,38 @@ func (r *Repository) GrantTemporaryAccess(ctx context.Context, clientID, userID
 	return r.saveLocked()
 }
 
-func (r *Repository) BlockClient(ctx context.Context, clientID, userID string, start, until time.Time) error {
+func (r *Repository) DeleteOverrideGrant(ctx context.Context, clientID, grantID string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	cs, ok := r.clients[clientID]
 	if !ok {
 		return nil
 	}
-	cs.BlockRequests = append(cs.BlockRequests, port.BlockRequest{ID: uuid.New().String(), UserID: userID, Start: start, Until: until})
-	if len(cs.BlockRequests) > maxRequests {
-		cs.BlockRequests = cs.BlockRequests[len(cs.BlockRequests)-maxRequests:]
+	for i, g := range cs.OverrideGrants {
+		if g.ID == grantID {
+			cs.OverrideGrants = append(cs.OverrideGrants[:i], cs.OverrideGrants[i+1:]...)
+			cs.History = server.CancelHistory(cs.History, grantID, r.now())
+			// Recompute config
+			state := r.toPortState(cs)
+			config, _ := server.ComputeClientConfig(r.now(), state, true)
+			cs.ComputedConfig = &config
+			r.notify(clientID)
+			return r.saveLocked()
+		}
 	}
+	return nil
+}
+
+func (r *Repository) BlockClient(ctx context.Context, clientID, userID string, start, until time.Time, priority int, note, admin string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return port.ErrClientNotFound
+	}
+	id := uuid.New().String()
+	cs.BlockRequests = append(cs.BlockRequests, port.BlockRequest{ID: id, UserID: userID, Start: start, Until: until, Priority: priority, Note: note})
+	r.recordHistory(cs, port.HistoryBlock, id, userID, start, until, note, admin)
 	// Recompute config
 	state := r.toPortState(cs)
 	config, _ := server.ComputeClientConfig(r.now(), state, true)
@@ -443,6 +1015,44 @@ func (r *Repository) BlockClient(ctx context.Context, clientID, userID string, s
 	return r.saveLocked()
 }
 
+func (r *Repository) AddBlockRule(ctx context.Context, clientID string, rule port.BlockRule) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return "", port.ErrClientNotFound
+	}
+	rule.ID = uuid.New().String()
+	cs.BlockRules = append(cs.BlockRules, rule)
+	// Recompute config
+	state := r.toPortState(cs)
+	config, _ := server.ComputeClientConfig(r.now(), state, true)
+	cs.ComputedConfig = &config
+	r.notify(clientID)
+	return rule.ID, r.saveLocked()
+}
+
+func (r *Repository) DeleteBlockRule(ctx context.Context, clientID, ruleID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return nil
+	}
+	for i, br := range cs.BlockRules {
+		if br.ID == ruleID {
+			cs.BlockRules = append(cs.BlockRules[:i], cs.BlockRules[i+1:]...)
+			// Recompute config
+			state := r.toPortState(cs)
+			config, _ := server.ComputeClientConfig(r.now(), state, true)
+			cs.ComputedConfig = &config
+			r.notify(clientID)
+			return r.saveLocked()
+		}
+	}
+	return nil
+}
+
 func (r *Repository) DeleteBlockRequest(ctx context.Context, clientID, requestID string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -453,6 +1063,7 @@ func (r *Repository) DeleteBlockRequest(ctx context.Context, clientID, requestID
 	for i, b := range cs.BlockRequests {
 		if b.ID == requestID {
 			cs.BlockRequests = append(cs.BlockRequests[:i], cs.BlockRequests[i+1:]...)
+			cs.History = server.CancelHistory(cs.History, requestID, r.now())
 			// Recompute config
 			state := r.toPortState(cs)
 			config, _ := server.ComputeClientConfig(r.now(), state, true)
@@ -474,6 +1085,7 @@ func (r *Repository) DeleteTemporaryAccessRequest(ctx context.Context, clientID,
 	for i, t := range cs.TemporaryAccessRequests {
 		if t.ID == requestID {
 			cs.TemporaryAccessRequests = append(cs.TemporaryAccessRequests[:i], cs.TemporaryAccessRequests[i+1:]...)
+			cs.History = server.CancelHistory(cs.History, requestID, r.now())
 			// Recompute config
 			state := r.toPortState(cs)
 			config, _ := server.ComputeClientConfig(r.now(), state, true)
@@ -485,6 +1097,31 @@ func (r *Repository) DeleteTemporaryAccessRequest(ctx context.Context, clientID,
 	return nil
 }
 
+// recordHistory archives a new grant or block; the request lists themselves drop it soon after it ends
+func (r *Repository) recordHistory(cs *clientState, typ, id, userID string, start, until time.Time, note, admin string) {
+	entry := port.HistoryEntry{ID: id, Type: typ, UserID: userID, Start: start, Until: until, CreatedAt: r.now(), Note: note, Admin: admin}
+	for _, u := range cs.Users {
+		if u.ID == userID {
+			entry.Username = u.Username
+		}
+	}
+	cs.History = server.AppendHistory(cs.History, entry, r.now())
+}
+
+func (r *Repository) History(ctx context.Context, clientID string) ([]port.HistoryEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return nil, nil
+	}
+	result := make([]port.HistoryEntry, 0, len(cs.History))
+	for i := len(cs.History) - 1; i >= 0; i-- {
+		result = append(result, cs.History[i])
+	}
+	return result, nil
+}
+
 func (r *Repository) UpdateLastSent(ctx context.Context, clientID string, intervals map[string][]domain.AllowedInterval) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -515,10 +1152,25 @@ func (r *Repository) IncrementConfigVersion(ctx context.Context, clientID string
 	return r.saveLocked()
 }
 
+func (r *Repository) RecomputeConfig(ctx context.Context, clientID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.clients[clientID]
+	if !ok {
+		return nil
+	}
+	// Not persisted: nothing to save
+	state := r.toPortState(cs)
+	config, _ := server.ComputeClientConfig(r.now(), state, true)
+	cs.ComputedConfig = &config
+	return nil
+}
+
 func (r *Repository) Subscribe(ctx context.Context, clientID string) <-chan struct{} {
-	ch := make(chan struct{}, 1)
-	r.subMu.Lock()
-	r.subscribers[clientID] = append(r.subscribers[clientID], ch)
-	r.subMu.Unlock()
-	return ch
+	return r.hub.Subscribe(ctx, clientID)
+}
+
+// Subscribers returns the number of long-polls waiting for changes of the client
+func (r *Repository) Subscribers(clientID string) int {
+	return r.hub.Subscribers(clientID)
 }
@@ -0,0 +1,253 @@
+package jsonfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+	"github.com/aegis/parental-control/internal/port"
+)
+
+func saveClients(t *testing.T, r *Repository, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := r.SaveClient(context.Background(), &port.ClientState{ID: name, Name: name, Users: []domain.User{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func clientIDs(t *testing.T, r *Repository) map[string]bool {
+	t.Helper()
+	clients, err := r.GetAllClients(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for _, c := range clients {
+		ids[c.ID] = true
+	}
+	return ids
+}
+
+// ageBackup makes path.1 look older than backupInterval, so the next save rotates
+func ageBackup(t *testing.T, path string) {
+	t.Helper()
+	old := time.Now().Add(-2 * backupInterval)
+	if err := os.Chtimes(backupPath(path, 1), old, old); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestSave_RotatesBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	r, err := New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		ageBackup(t, path)
+		saveClients(t, r, name)
+	}
+
+	// Backup n holds the state n rotations ago
+	for n, want := range map[int]int{1: 4, 2: 3, 3: 2} {
+		f, err := readData(backupPath(path, n))
+		if err != nil {
+			t.Fatalf("backup %d: %v", n, err)
+		}
+		if len(f.data.Clients) != want {
+			t.Errorf("backup %d has %d clients, want %d", n, len(f.data.Clients), want)
+		}
+	}
+	if _, err := os.Stat(backupPath(path, backupCount+1)); !os.IsNotExist(err) {
+		t.Errorf("more than %d backups kept", backupCount)
+	}
+	matches, _ := filepath.Glob(path + ".tmp*")
+	if len(matches) != 0 {
+		t.Errorf("temp files left: %v", matches)
+	}
+}
+
+func TestSave_FrequentSavesKeepBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	r, err := New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveClients(t, r, "a", "b")
+	ageBackup(t, path)
+	saveClients(t, r, "c", "d", "e")
+
+	// Only the first save after the interval rotates; the rest replace the data file
+	for n, want := range map[int]int{1: 2, 2: 1} {
+		f, err := readData(backupPath(path, n))
+		if err != nil {
+			t.Fatalf("backup %d: %v", n, err)
+		}
+		if len(f.data.Clients) != want {
+			t.Errorf("backup %d has %d clients, want %d", n, len(f.data.Clients), want)
+		}
+	}
+	if _, err := os.Stat(backupPath(path, 3)); !os.IsNotExist(err) {
+		t.Error("frequent saves made a third backup")
+	}
+	if f, err := readData(path); err != nil || len(f.data.Clients) != 5 {
+		t.Errorf("data file: %v, %v", f, err)
+	}
+}
+
+func TestNew_FallsBackToBackup(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(path string)
+	}{
+		{"truncated", func(path string) { os.Truncate(path, 10) }},
+		{"empty", func(path string) { os.WriteFile(path, nil, 0644) }},
+		{"missing", func(path string) { os.Remove(path) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data.json")
+			r, err := New(path, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			saveClients(t, r, "a", "b")
+			tt.damage(path)
+
+			r, err = New(path, time.UTC)
+			if err != nil {
+				t.Fatalf("New after damage: %v", err)
+			}
+			// The newest backup is the state before the last save
+			if ids := clientIDs(t, r); len(ids) != 1 || !ids["a"] {
+				t.Errorf("restored clients %v, want only a", ids)
+			}
+			// The next save writes a valid data file again
+			saveClients(t, r, "c")
+			if f, err := readData(path); err != nil || len(f.data.Clients) != 2 {
+				t.Errorf("data file after save: %v, %v", f, err)
+			}
+		})
+	}
+}
+
+func TestNew_CorruptWithoutBackupFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	os.WriteFile(path, []byte(`{"clients":`), 0644)
+	if _, err := New(path, time.UTC); err == nil {
+		t.Error("corrupt data file without backups must not start with empty state")
+	}
+}
+
+func TestHistory_OutlivesRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	r, err := New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	r.SaveClient(ctx, &port.ClientState{ID: "c1", Name: "c1", Users: []domain.User{{ID: "u1", Username: "kid"}}})
+
+	// More than the old limit of ten, all ended days ago
+	start := time.Now().Add(-30 * 24 * time.Hour)
+	for i := 0; i < 12; i++ {
+		r.GrantTemporaryAccess(ctx, "c1", "u1", start, start.Add(time.Hour), "урок", "mom")
+		start = start.Add(48 * time.Hour)
+	}
+	now := time.Now()
+	r.BlockClient(ctx, "c1", "", now, now.Add(2*time.Hour), 0, "за оценки", "mom")
+	c, _ := r.GetClient(ctx, "c1")
+	blockID := c.BlockRequests[0].ID
+	r.DeleteBlockRequest(ctx, "c1", blockID)
+	r.SaveClient(ctx, &port.ClientState{ID: "c1", Name: "renamed", Users: c.Users})
+
+	r, err = New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ = r.GetClient(ctx, "c1")
+	if len(c.TemporaryAccessRequests) != 0 || len(c.BlockRequests) != 0 {
+		t.Errorf("ended requests kept: %+v %+v", c.TemporaryAccessRequests, c.BlockRequests)
+	}
+	history, _ := r.History(ctx, "c1")
+	if len(history) != 13 {
+		t.Fatalf("history has %d entries, want 13", len(history))
+	}
+	if block := history[0]; block.ID != blockID || block.Type != port.HistoryBlock || block.Note != "за оценки" || block.Admin != "mom" || block.CancelledAt == nil {
+		t.Errorf("newest entry %+v", block)
+	}
+	if ta := history[1]; ta.Type != port.HistoryTemporaryAccess || ta.Username != "kid" || ta.Note != "урок" || ta.Admin != "mom" || ta.CancelledAt != nil {
+		t.Errorf("temporary access entry %+v", ta)
+	}
+}
+
+func TestSaveClient_AssignsMissingIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	r, err := New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	r.SaveClient(ctx, &port.ClientState{
+		ID:                      "c1",
+		Name:                    "c1",
+		Users:                   []domain.User{{ID: "u1", Username: "kid"}},
+		BlockRequests:           []port.BlockRequest{{Start: now, Until: now.Add(time.Hour)}},
+		TemporaryAccessRequests: []port.TemporaryAccessRequest{{UserID: "u1", Start: now, Until: now.Add(time.Hour)}},
+		OverrideGrants:          []port.OverrideGrant{{UserID: "u1", Start: now, Until: now.Add(time.Hour), Priority: 1}},
+		BlockRules:              []port.BlockRule{{WeeklyRange: domain.WeeklyRange{Days: []string{"monday"}, Start: "16:00", End: "18:00"}}},
+	})
+
+	r, err = New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := r.GetClient(ctx, "c1")
+	if c.BlockRequests[0].ID == "" || c.TemporaryAccessRequests[0].ID == "" || c.OverrideGrants[0].ID == "" || c.BlockRules[0].ID == "" {
+		t.Errorf("saved without IDs: %+v", c)
+	}
+}
+
+// Ended requests used to disappear from GetClient at once; now they stay for
+// expiredRetention but still grant nothing, and are dropped after it as before
+func TestGetClient_KeepsEndedRequestsForRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	r, err := New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	recent, old := now.Add(-time.Hour), now.Add(-expiredRetention-time.Hour)
+	r.SaveClient(ctx, &port.ClientState{
+		ID:                      "c1",
+		Name:                    "c1",
+		Users:                   []domain.User{{ID: "u1", Username: "kid"}},
+		TemporaryAccessRequests: []port.TemporaryAccessRequest{{ID: "recent", UserID: "u1", Start: recent.Add(-time.Hour), Until: recent}, {ID: "old", UserID: "u1", Start: old.Add(-time.Hour), Until: old}},
+		OverrideGrants:          []port.OverrideGrant{{ID: "old", UserID: "u1", Start: old.Add(-time.Hour), Until: old, Priority: 1}},
+		BlockRequests:           []port.BlockRequest{{ID: "old", Start: old.Add(-time.Hour), Until: old}},
+	})
+
+	c, _ := r.GetClient(ctx, "c1")
+	if len(c.TemporaryAccessRequests) != 1 || c.TemporaryAccessRequests[0].ID != "recent" || len(c.OverrideGrants) != 0 || len(c.BlockRequests) != 0 {
+		t.Errorf("got %+v %+v %+v, want only the recently ended grant", c.TemporaryAccessRequests, c.OverrideGrants, c.BlockRequests)
+	}
+	for _, iv := range c.ComputedConfig.Users[0].AllowedIntervals {
+		if iv.End.After(now) {
+			t.Errorf("ended grant still allows %v", iv)
+		}
+	}
+	r, err = New(path, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := r.GetClient(ctx, "c1"); len(c.TemporaryAccessRequests) != 1 {
+		t.Errorf("after reload got %+v", c.TemporaryAccessRequests)
+	}
+}
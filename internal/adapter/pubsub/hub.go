@@ -0,0 +1,104 @@
+// Package pubsub wakes long-polls waiting for changes of a client's config.
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultCoalesce is how long a hub waits after a change before waking subscribers.
+// An admin action is usually several repository calls (change, then version bump):
+// subscribers should see the result once, not every step.
+const DefaultCoalesce = 50 * time.Millisecond
+
+// Hub delivers change notifications per key (client ID). Subscriptions end with
+// their context, so the hub holds only the long-polls currently waiting.
+type Hub struct {
+	mu       sync.Mutex
+	subs     map[string]map[*subscription]struct{}
+	pending  map[string]*time.Timer // keys with a wake-up scheduled
+	coalesce time.Duration
+}
+
+type subscription struct {
+	ch chan struct{}
+}
+
+// New returns a hub that wakes subscribers coalesce after the first of a burst of changes;
+// 0 wakes them at once
+func New(coalesce time.Duration) *Hub {
+	return &Hub{
+		subs:     make(map[string]map[*subscription]struct{}),
+		pending:  make(map[string]*time.Timer),
+		coalesce: coalesce,
+	}
+}
+
+// Subscribe returns a channel that receives once per burst of changes of key, until ctx ends.
+// The channel is never closed.
+func (h *Hub) Subscribe(ctx context.Context, key string) <-chan struct{} {
+	sub := &subscription{ch: make(chan struct{}, 1)}
+	h.mu.Lock()
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[*subscription]struct{})
+	}
+	h.subs[key][sub] = struct{}{}
+	h.mu.Unlock()
+	context.AfterFunc(ctx, func() { h.unsubscribe(key, sub) })
+	return sub.ch
+}
+
+func (h *Hub) unsubscribe(key string, sub *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[key], sub)
+	if len(h.subs[key]) == 0 {
+		delete(h.subs, key)
+	}
+}
+
+// Publish reports a change of key. Changes published before the subscribers are woken
+// are delivered together.
+func (h *Hub) Publish(key string) {
+	if h.coalesce <= 0 {
+		h.wake(key)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.pending[key]; ok || len(h.subs[key]) == 0 {
+		return
+	}
+	h.pending[key] = time.AfterFunc(h.coalesce, func() { h.wake(key) })
+}
+
+func (h *Hub) wake(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.pending, key)
+	for sub := range h.subs[key] {
+		select {
+		case sub.ch <- struct{}{}:
+		default: // already signalled, not yet received
+		}
+	}
+}
+
+// Subscribers returns how many subscriptions to key are active
+func (h *Hub) Subscribers(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs[key])
+}
+
+// Total returns the number of active subscriptions of all keys
+func (h *Hub) Total() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, subs := range h.subs {
+		n += len(subs)
+	}
+	return n
+}
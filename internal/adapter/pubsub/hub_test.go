@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func received(ch <-chan struct{}, wait time.Duration) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+func TestHub_UnsubscribesWhenContextEnds(t *testing.T) {
+	h := New(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := h.Subscribe(ctx, "c1")
+	other := h.Subscribe(context.Background(), "c2")
+	if h.Subscribers("c1") != 1 || h.Total() != 2 {
+		t.Fatalf("subscribers: c1 %d, total %d", h.Subscribers("c1"), h.Total())
+	}
+	h.Publish("c1")
+	if !received(ch, time.Second) {
+		t.Fatal("subscriber not woken")
+	}
+	if received(other, 10*time.Millisecond) {
+		t.Error("subscriber of another key woken")
+	}
+
+	cancel()
+	waitUnsubscribed(t, h, "c1")
+	h.Publish("c1")
+	if received(ch, 10*time.Millisecond) {
+		t.Error("woken after unsubscribing")
+	}
+	if h.Total() != 1 {
+		t.Errorf("total %d, want 1", h.Total())
+	}
+}
+
+// waitUnsubscribed waits for subscriptions of key to end: they end shortly after their context
+func waitUnsubscribed(t *testing.T, h *Hub, key string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for h.Subscribers(key) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription outlived its context")
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestHub_CoalescesBursts(t *testing.T) {
+	h := New(20 * time.Millisecond)
+	ch := h.Subscribe(context.Background(), "c1")
+	for i := 0; i < 10; i++ {
+		h.Publish("c1")
+	}
+	if received(ch, 5*time.Millisecond) {
+		t.Error("woken before the burst settled")
+	}
+	if !received(ch, time.Second) {
+		t.Fatal("not woken after the burst")
+	}
+	if received(ch, 50*time.Millisecond) {
+		t.Error("woken more than once for one burst")
+	}
+	// The next change is a new burst
+	h.Publish("c1")
+	if !received(ch, time.Second) {
+		t.Error("not woken for a later change")
+	}
+}
+
+func TestHub_PublishWithoutSubscribers(t *testing.T) {
+	h := New(time.Millisecond)
+	h.Publish("c1")
+	if len(h.pending) != 0 {
+		t.Error("wake-up scheduled for a key nobody waits on")
+	}
+}
+
+func heapAfterGC() uint64 {
+	runtime.GC()
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// Each cycle is one long-poll of a client: subscribe, maybe get woken, end
+func TestHub_SoakMemoryFlat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test")
+	}
+	h := New(0)
+	cycle := func(i int) {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := h.Subscribe(ctx, "c1")
+		if i%2 == 0 {
+			h.Publish("c1")
+			<-ch
+		}
+		cancel()
+		waitUnsubscribed(t, h, "c1")
+	}
+	for i := 0; i < 1000; i++ {
+		cycle(i)
+	}
+	before := heapAfterGC()
+	for i := 0; i < 20000; i++ {
+		cycle(i)
+	}
+	after := heapAfterGC()
+	if after > before && after-before > 256<<10 {
+		t.Errorf("heap grew by %d KiB over 20000 cycles", (after-before)>>10)
+	}
+	if n := h.Total(); n != 0 {
+		t.Errorf("%d subscriptions left", n)
+	}
+}
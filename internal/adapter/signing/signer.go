@@ -0,0 +1,199 @@
+// Package signing signs client configs with the server's ed25519 key, so agents can
+// refuse forged and replayed configs even over plain HTTP.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+)
+
+// sequenceBlock sequence numbers are reserved on disk at a time, so the sequence keeps
+// growing across restarts without a write per response
+const sequenceBlock = 1000
+
+// Envelope is the signed response of the config endpoint. Signature covers Payload as sent,
+// so nothing has to be re-encoded to check it.
+type Envelope struct {
+	Payload   []byte `json:"payload"` // JSON of Payload
+	Signature []byte `json:"signature"`
+}
+
+// Payload is what the server vouches for
+type Payload struct {
+	ClientID string              `json:"client_id"` // a config of another computer does not verify
+	Sequence uint64              `json:"sequence"`  // grows with every config issued
+	IssuedAt time.Time           `json:"issued_at"`
+	Config   domain.ClientConfig `json:"config"`
+}
+
+// clockFloor is the lowest sequence to issue at t: microseconds since the epoch. Unless the
+// server issues over a million configs a second, numbers issued before stay below it, so a
+// lost or restored .seq file cannot make the sequence go back.
+func clockFloor(t time.Time) uint64 {
+	if us := t.UnixMicro(); us > 0 {
+		return uint64(us)
+	}
+	return 0
+}
+
+// Signer holds the server key and the sequence counter
+type Signer struct {
+	key     ed25519.PrivateKey
+	seqPath string
+	now     func() time.Time
+
+	mu       sync.Mutex
+	sequence uint64 // last issued
+	reserved uint64 // reserved on disk up to
+}
+
+// LoadOrCreate reads the PEM key at path, generating it on first start. The sequence is
+// kept in path + ".seq".
+func LoadOrCreate(path string) (*Signer, error) {
+	key, err := loadKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = createKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Signer{key: key, seqPath: path + ".seq", now: time.Now}
+	data, err := os.ReadFile(s.seqPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if s.reserved, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", s.seqPath, err)
+		}
+	}
+	// Numbers reserved by the previous run may have been issued: start after them
+	s.sequence = s.reserved
+	return s, nil
+}
+
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return key, nil
+}
+
+func createKey(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	// O_EXCL: never overwrite a key the agents have pinned
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+// PublicKey is what agents pin at install
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// Fingerprint is a short form of the public key for comparing by eye
+func Fingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sign issues config to the client under the next sequence number
+func (s *Signer) Sign(clientID string, config domain.ClientConfig) (Envelope, error) {
+	seq, err := s.next()
+	if err != nil {
+		return Envelope{}, err
+	}
+	payload, err := json.Marshal(Payload{ClientID: clientID, Sequence: seq, IssuedAt: s.now().UTC(), Config: config})
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{Payload: payload, Signature: ed25519.Sign(s.key, payload)}, nil
+}
+
+func (s *Signer) next() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sequence >= s.reserved {
+		start := max(s.sequence, clockFloor(s.now()))
+		reserved := start + sequenceBlock
+		if err := writeSynced(s.seqPath, []byte(strconv.FormatUint(reserved, 10)+"\n")); err != nil {
+			return 0, err
+		}
+		s.sequence, s.reserved = start, reserved
+	}
+	s.sequence++
+	return s.sequence, nil
+}
+
+// writeSynced replaces path with data durably: a reservation lost in a crash would let
+// the next run issue numbers agents have already accepted
+func writeSynced(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// Makes the rename durable; not every OS can sync a directory, so errors are ignored
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package signing
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+)
+
+func TestSigner_KeyAndSequenceSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing.key")
+	s, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("key file mode %v (%v), want 0600", fi.Mode().Perm(), err)
+		}
+	}
+	var last uint64
+	for i := 0; i < 3; i++ {
+		if last, err = s.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.PublicKey().Equal(s.PublicKey()) {
+		t.Error("key changed on restart")
+	}
+	if seq, _ := reloaded.next(); seq <= last {
+		t.Errorf("sequence %d after restart, want above %d", seq, last)
+	}
+}
+
+func TestSigner_SequenceNeverGoesBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing.key")
+	now := time.Date(2026, 3, 2, 20, 0, 0, 0, time.UTC)
+	s, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+	var last uint64
+	for i := 0; i < sequenceBlock+5; i++ {
+		if last, err = s.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Sequence file lost, e.g. the key restored from a backup without it
+	os.Remove(path + ".seq")
+	s, err = LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	s.now = func() time.Time { return now }
+	seq, err := s.next()
+	if err != nil || seq <= last {
+		t.Errorf("sequence %d (%v) after losing the sequence file, want above %d", seq, err, last)
+	}
+	last = seq
+
+	// Clock set back: the stored reservation still wins
+	s, _ = LoadOrCreate(path)
+	s.now = func() time.Time { return now.AddDate(-1, 0, 0) }
+	if seq, _ := s.next(); seq <= last {
+		t.Errorf("sequence %d with the clock set back, want above %d", seq, last)
+	}
+}
+
+func TestVerifier_RejectsForgedAndReplayedConfigs(t *testing.T) {
+	s, err := LoadOrCreate(filepath.Join(t.TempDir(), "signing.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 2, 20, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	v := NewVerifier(s.PublicKey(), "c1", 0)
+	v.now = s.now
+	sign := func(clientID, version string) []byte {
+		env, err := s.Sign(clientID, domain.ClientConfig{Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(env)
+		return body
+	}
+
+	allowAllDay := sign("c1", "v1")
+	blocked := sign("c1", "v2")
+	if config, err := v.Verify(blocked); err != nil || config.Version != "v2" {
+		t.Fatalf("valid config: %+v, %v", config, err)
+	}
+	if _, err := v.Verify(allowAllDay); !errors.Is(err, ErrRolledBack) {
+		t.Errorf("older config: %v, want ErrRolledBack", err)
+	}
+	if _, err := v.Verify(blocked); !errors.Is(err, ErrRolledBack) {
+		t.Errorf("replayed config: %v, want ErrRolledBack", err)
+	}
+
+	unsigned, _ := json.Marshal(domain.ClientConfig{Version: "v3"})
+	if _, err := v.Verify(unsigned); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned config: %v, want ErrUnsigned", err)
+	}
+	var env Envelope
+	json.Unmarshal(sign("c1", "v3"), &env)
+	env.Payload[len(env.Payload)/2] ^= 1
+	forged, _ := json.Marshal(env)
+	if _, err := v.Verify(forged); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered config: %v, want ErrBadSignature", err)
+	}
+	other, _ := LoadOrCreate(filepath.Join(t.TempDir(), "other.key"))
+	env, _ = other.Sign("c1", domain.ClientConfig{Version: "v3"})
+	foreign, _ := json.Marshal(env)
+	if _, err := v.Verify(foreign); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("config signed by another key: %v, want ErrBadSignature", err)
+	}
+	if _, err := v.Verify(sign("c2", "v3")); !errors.Is(err, ErrWrongClient) {
+		t.Errorf("config of another client: %v, want ErrWrongClient", err)
+	}
+
+	// After the agent lost its sequence, stale configs are still refused by age
+	stale := sign("c1", "v4")
+	restarted := NewVerifier(s.PublicKey(), "c1", 0)
+	restarted.now = func() time.Time { return now }
+	now = now.Add(maxConfigAge + time.Hour)
+	if _, err := restarted.Verify(stale); !errors.Is(err, ErrRolledBack) {
+		t.Errorf("config issued long ago: %v, want ErrRolledBack", err)
+	}
+	if v.Sequence() == 0 {
+		t.Error("accepted sequence not kept")
+	}
+}
@@ -0,0 +1,77 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+)
+
+// maxConfigAge rejects configs issued long ago by the agent's clock, in case the last
+// sequence was lost
+const maxConfigAge = 24 * time.Hour
+
+var (
+	ErrUnsigned     = errors.New("config is not signed")
+	ErrBadSignature = errors.New("config signature is invalid")
+	ErrWrongClient  = errors.New("config is issued to another client")
+	ErrRolledBack   = errors.New("config is older than the one already accepted")
+)
+
+// Verifier checks configs against the pinned server key and remembers the last accepted
+// sequence
+type Verifier struct {
+	key      ed25519.PublicKey
+	clientID string
+	now      func() time.Time
+
+	mu       sync.Mutex
+	sequence uint64
+}
+
+// NewVerifier accepts configs for clientID signed by key with a sequence above sequence
+func NewVerifier(key ed25519.PublicKey, clientID string, sequence uint64) *Verifier {
+	return &Verifier{key: key, clientID: clientID, sequence: sequence, now: time.Now}
+}
+
+// Sequence is the last accepted sequence, for the agent to keep across restarts
+func (v *Verifier) Sequence() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.sequence
+}
+
+// Verify returns the config of a signed response body
+func (v *Verifier) Verify(body []byte) (*domain.ClientConfig, error) {
+	var env Envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, err
+	}
+	if len(env.Payload) == 0 || len(env.Signature) == 0 {
+		return nil, ErrUnsigned
+	}
+	if !ed25519.Verify(v.key, env.Payload, env.Signature) {
+		return nil, ErrBadSignature
+	}
+	var p Payload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		return nil, err
+	}
+	if p.ClientID != v.clientID {
+		return nil, ErrWrongClient
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if p.Sequence <= v.sequence {
+		return nil, fmt.Errorf("%w: sequence %d, accepted %d", ErrRolledBack, p.Sequence, v.sequence)
+	}
+	if age := v.now().Sub(p.IssuedAt); age > maxConfigAge {
+		return nil, fmt.Errorf("%w: issued %v ago", ErrRolledBack, age.Round(time.Minute))
+	}
+	v.sequence = p.Sequence
+	return &p.Config, nil
+}
@@ -56,6 +56,9 @@ const (
 	WTSIsRemoteSession        = 29
 )
 
+// WTS_CONNECTSTATE_CLASS value for a session with a logged on, connected user
+const WTSActive = 0
+
 type UserControl struct{}
 
 func NewUserControl() *UserControl {
@@ -79,7 +82,8 @@ func (u *UserControl) DisconnectUserSession(username string) error {
 		return err
 	}
 	var lastErr error
-	for _, sid := range sessions {
+	for _, sess := range sessions {
+		sid := sess.ID
 		if sid == 0 {
 			continue // skip session 0 (services)
 		}
@@ -87,12 +91,7 @@ func (u *UserControl) DisconnectUserSession(username string) error {
 		if err != nil {
 			continue
 		}
-		// Match username or "DOMAIN\username"
-		namePart := uname
-		if idx := strings.Index(uname, "\\"); idx >= 0 {
-			namePart = uname[idx+1:]
-		}
-		if strings.EqualFold(namePart, username) {
+		if sessionUserMatches(uname, username) {
 			if err := logoffSession(sid); err != nil {
 				log.Printf("DisconnectUserSession: logoff session %d (%s) failed: %v", sid, uname, err)
 				lastErr = err
@@ -104,6 +103,40 @@ func (u *UserControl) DisconnectUserSession(username string) error {
 	return lastErr
 }
 
+func (u *UserControl) IsSessionActive(username string) (bool, error) {
+	sessions, err := enumerateSessions()
+	if err != nil {
+		return false, err
+	}
+	for _, sess := range sessions {
+		if sess.ID == 0 || sess.State != WTSActive {
+			continue
+		}
+		uname, err := getSessionUsername(sess.ID)
+		if err != nil {
+			continue
+		}
+		if sessionUserMatches(uname, username) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sessionUserMatches matches username or "DOMAIN\username"
+func sessionUserMatches(sessionUser, username string) bool {
+	namePart := sessionUser
+	if idx := strings.Index(sessionUser, "\\"); idx >= 0 {
+		namePart = sessionUser[idx+1:]
+	}
+	return strings.EqualFold(namePart, username)
+}
+
+type session struct {
+	ID    uint32
+	State uint32
+}
+
 // WTS_SESSION_INFO layout for 64-bit: SessionId(4) + padding(4) + pWinStationName(8) + State(4) + padding(4) = 24 bytes
 type wtsSessionInfo struct {
 	SessionID  uint32
@@ -113,7 +146,7 @@ type wtsSessionInfo struct {
 	_          uint32 // padding
 }
 
-func enumerateSessions() ([]uint32, error) {
+func enumerateSessions() ([]session, error) {
 	var infoPtr uintptr
 	var count uint32
 	r1, _, err := procWTSEnumerateSessionsW.Call(
@@ -132,11 +165,11 @@ func enumerateSessions() ([]uint32, error) {
 		return nil, nil
 	}
 
-	var sess []uint32
+	var sess []session
 	offset := infoPtr
 	for i := uint32(0); i < count; i++ {
 		si := (*wtsSessionInfo)(unsafe.Pointer(offset))
-		sess = append(sess, si.SessionID)
+		sess = append(sess, session{ID: si.SessionID, State: si.State})
 		offset += unsafe.Sizeof(wtsSessionInfo{})
 	}
 	return sess, nil
@@ -17,3 +17,7 @@ func (u *UserControl) SetPassword(username, password string) error {
 func (u *UserControl) DisconnectUserSession(username string) error {
 	return fmt.Errorf("user control only supported on Windows")
 }
+
+func (u *UserControl) IsSessionActive(username string) (bool, error) {
+	return false, fmt.Errorf("user control only supported on Windows")
+}
@@ -0,0 +1,46 @@
+package domain
+
+import "time"
+
+// DailyBudget is a map: day name -> max minutes of access per day.
+// Days without an entry are unlimited.
+type DailyBudget map[string]int
+
+// DailyUsage is a map: date (DateLayout) -> consumed seconds
+type DailyUsage map[string]int
+
+// Budget is the daily screen-time limit together with time already consumed
+type Budget struct {
+	Limits DailyBudget
+	Usage  DailyUsage
+}
+
+// Remaining returns access time left on the given day and whether the day is limited
+func (b Budget) Remaining(day time.Time) (time.Duration, bool) {
+	limit, ok := b.Limits[dayKey(day)]
+	if !ok {
+		return 0, false
+	}
+	used := time.Duration(b.Usage[day.Format(DateLayout)]) * time.Second
+	remaining := time.Duration(limit)*time.Minute - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
+
+// trimToDuration keeps intervals from the start until their total length reaches d
+func trimToDuration(intervals []AllowedInterval, d time.Duration) []AllowedInterval {
+	var result []AllowedInterval
+	for _, iv := range intervals {
+		if d <= 0 {
+			break
+		}
+		if l := iv.End.Sub(iv.Start); l > d {
+			iv.End = iv.Start.Add(d)
+		}
+		d -= iv.End.Sub(iv.Start)
+		result = append(result, iv)
+	}
+	return result
+}
@@ -0,0 +1,217 @@
+package domain
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Source kinds of an explained segment
+const (
+	SourceSchedule   = "schedule"         // weekly schedule entry (possibly from a period or date override)
+	SourceTempAccess = "temporary_access" // TemporaryAccessRequest
+	SourceOverride   = "always_allow"     // OverrideGrant, beats blocks of lower priority
+	SourceBlock      = "block"            // BlockRequest
+	SourceBlockRule  = "block_rule"       // recurring BlockRule
+	SourceBudget     = "budget"           // scheduled time beyond the daily limit
+	SourceNone       = "none"             // no schedule entry
+)
+
+// Source tells what made a segment allowed or denied
+type Source struct {
+	Kind   string `json:"kind"`
+	ID     string `json:"id,omitempty"`     // request or rule ID
+	Detail string `json:"detail,omitempty"` // human-readable origin, e.g. "monday 09:00-12:00"
+}
+
+// Segment is a span of time with the same access decision and cause
+type Segment struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Allowed bool      `json:"allowed"`
+	Source  Source    `json:"source"`
+}
+
+// dayOriginer is implemented by schedules that can tell where a day's intervals come from
+type dayOriginer interface {
+	DayOrigin(day time.Time) string
+}
+
+type sourcedInterval struct {
+	start, end time.Time
+	priority   int
+	source     Source
+}
+
+func (s sourcedInterval) covers(t time.Time) bool {
+	return !t.Before(s.start) && t.Before(s.end)
+}
+
+// ExplainIntervals splits the window from the start of today until the window end
+// into segments attributed to their cause, with the precedence ComputeAllowedIntervals uses:
+// overrides beat blocks of lower priority, other blocks beat temporary access,
+// temporary access beats schedule and budget.
+// Unlike the computed config, blocks that already ended are shown where they were in effect.
+func ExplainIntervals(
+	now time.Time,
+	schedule ScheduleSource,
+	budget Budget,
+	tempAccess []TempAccessRange,
+	blocks []BlockRange,
+	windowDays int,
+) []Segment {
+	now = now.Truncate(time.Minute)
+	windowDays = NormalizeWindowDays(windowDays)
+	windowEnd := WindowEnd(now, windowDays)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	var scheduled, allowed []sourcedInterval
+	for dayOffset := -1; dayOffset < windowDays; dayOffset++ {
+		day := today.AddDate(0, 0, dayOffset)
+		dayIntervals, ok := schedule.DayIntervals(day)
+		if !ok {
+			continue
+		}
+		origin := ""
+		if o, ok := schedule.(dayOriginer); ok {
+			origin = o.DayOrigin(day)
+		}
+		var dayScheduled []sourcedInterval
+		var plain []AllowedInterval
+		for _, iv := range dayIntervals {
+			start, end, err := parseDayInterval(day, iv.Start, iv.End)
+			if err != nil {
+				continue
+			}
+			if start.Before(today) {
+				start = today
+			}
+			if end.After(windowEnd) {
+				end = windowEnd
+			}
+			if !end.After(start) {
+				continue
+			}
+			detail := fmt.Sprintf("%s %s-%s", dayKey(day), iv.Start, iv.End)
+			if origin != "" {
+				detail += " (" + origin + ")"
+			}
+			dayScheduled = append(dayScheduled, sourcedInterval{start: start, end: end, source: Source{Kind: SourceSchedule, Detail: detail}})
+			plain = append(plain, AllowedInterval{Start: start, End: end})
+		}
+		scheduled = append(scheduled, dayScheduled...)
+		remaining, limited := budget.Remaining(day)
+		if !limited {
+			allowed = append(allowed, dayScheduled...)
+			continue
+		}
+		// Keep the parts of each entry that survive the budget trim
+		for _, kept := range applyBudget(plain, blocks, now, remaining) {
+			for _, s := range dayScheduled {
+				if s.start.Before(kept.End) && kept.Start.Before(s.end) {
+					allowed = append(allowed, sourcedInterval{start: laterOf(s.start, kept.Start), end: earlierOf(s.end, kept.End), source: s.source})
+				}
+			}
+		}
+	}
+
+	var temps, overrides, blocked []sourcedInterval
+	for _, ta := range tempAccess {
+		s := sourcedInterval{ta.Start, ta.End, ta.Priority, ta.Source}
+		if ta.Priority > 0 {
+			overrides = append(overrides, s)
+		} else {
+			temps = append(temps, s)
+		}
+	}
+	for _, b := range blocks {
+		blocked = append(blocked, sourcedInterval{b.Start, b.End, b.Priority, b.Source})
+	}
+
+	// Elementary slots between all boundaries; each slot has a single cause
+	bounds := []time.Time{today, windowEnd}
+	for _, list := range [][]sourcedInterval{scheduled, allowed, temps, overrides, blocked} {
+		for _, s := range list {
+			for _, t := range []time.Time{s.start, s.end} {
+				if t.After(today) && t.Before(windowEnd) {
+					bounds = append(bounds, t)
+				}
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].Before(bounds[j]) })
+
+	var segments []Segment
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if !end.After(start) {
+			continue
+		}
+		seg := Segment{Start: start, End: end, Source: Source{Kind: SourceNone}}
+		override, overridden := strongestCovering(overrides, start)
+		if s, ok := firstCovering(blocked, start, override.priority); ok {
+			seg.Source = s.source
+		} else if overridden {
+			seg.Allowed, seg.Source = true, override.source
+		} else if s, ok := firstCovering(temps, start, 0); ok {
+			seg.Allowed, seg.Source = true, s.source
+		} else if s, ok := firstCovering(allowed, start, 0); ok {
+			seg.Allowed, seg.Source = true, s.source
+		} else if s, ok := firstCovering(scheduled, start, 0); ok {
+			seg.Source = Source{Kind: SourceBudget, Detail: s.source.Detail}
+		}
+		if n := len(segments); n > 0 && segments[n-1].End.Equal(start) &&
+			segments[n-1].Allowed == seg.Allowed && segments[n-1].Source == seg.Source {
+			segments[n-1].End = end
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	return segments
+}
+
+// SegmentAt returns the segment containing t
+func SegmentAt(segments []Segment, t time.Time) (Segment, bool) {
+	for _, s := range segments {
+		if !t.Before(s.Start) && t.Before(s.End) {
+			return s, true
+		}
+	}
+	return Segment{}, false
+}
+
+// firstCovering returns the first entry covering t with at least minPriority
+func firstCovering(list []sourcedInterval, t time.Time, minPriority int) (sourcedInterval, bool) {
+	for _, s := range list {
+		if s.covers(t) && s.priority >= minPriority {
+			return s, true
+		}
+	}
+	return sourcedInterval{}, false
+}
+
+// strongestCovering returns the highest-priority entry covering t
+func strongestCovering(list []sourcedInterval, t time.Time) (sourcedInterval, bool) {
+	var best sourcedInterval
+	found := false
+	for _, s := range list {
+		if s.covers(t) && (!found || s.priority > best.priority) {
+			best, found = s, true
+		}
+	}
+	return best, found
+}
+
+func laterOf(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func earlierOf(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
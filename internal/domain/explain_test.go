@@ -0,0 +1,114 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func explainFixture() (time.Time, ScheduleSource, []TempAccessRange, []BlockRange) {
+	loc := time.UTC
+	// Monday 9 Feb 2026, 10:00
+	now := time.Date(2026, 2, 9, 10, 0, 0, 0, loc)
+	at := func(h, m int) time.Time { return time.Date(2026, 2, 9, h, m, 0, 0, loc) }
+	user := User{Schedule: DaySchedule{"monday": {{Start: "09:00", End: "12:00"}, {Start: "15:00", End: "17:00"}}}}
+	temp := []TempAccessRange{{Start: at(12, 0), End: at(13, 0), Source: Source{Kind: SourceTempAccess, ID: "t1"}}}
+	blocks := []BlockRange{
+		{Start: at(16, 0), End: at(16, 30), Source: Source{Kind: SourceBlock, ID: "b1"}},
+		{Start: at(8, 0), End: at(9, 30), Source: Source{Kind: SourceBlock, ID: "b0"}}, // partly in the past
+	}
+	return now, user.ScheduleSource(nil), temp, blocks
+}
+
+func TestExplainIntervals_Attribution(t *testing.T) {
+	now, schedule, temp, blocks := explainFixture()
+	segments := ExplainIntervals(now, schedule, Budget{}, temp, blocks, 1)
+	at := func(h, m int) time.Time { return time.Date(2026, 2, 9, h, m, 0, 0, time.UTC) }
+	tests := []struct {
+		at      time.Time
+		allowed bool
+		kind    string
+		id      string
+	}{
+		{at(7, 0), false, SourceNone, ""},
+		{at(9, 15), false, SourceBlock, "b0"},
+		{at(10, 30), true, SourceSchedule, ""},
+		{at(12, 30), true, SourceTempAccess, "t1"},
+		{at(13, 30), false, SourceNone, ""},
+		{at(16, 10), false, SourceBlock, "b1"},
+		{at(16, 45), true, SourceSchedule, ""},
+	}
+	for _, tt := range tests {
+		seg, ok := SegmentAt(segments, tt.at)
+		if !ok {
+			t.Fatalf("no segment at %v", tt.at)
+		}
+		if seg.Allowed != tt.allowed || seg.Source.Kind != tt.kind || seg.Source.ID != tt.id {
+			t.Errorf("at %s: got %+v, want allowed=%v %s %s", tt.at.Format("15:04"), seg, tt.allowed, tt.kind, tt.id)
+		}
+	}
+	if seg, _ := SegmentAt(segments, at(10, 30)); seg.Source.Detail != "monday 09:00-12:00" {
+		t.Errorf("schedule detail = %q", seg.Source.Detail)
+	}
+}
+
+func TestExplainIntervals_Override(t *testing.T) {
+	now, schedule, _, _ := explainFixture()
+	at := func(h, m int) time.Time { return time.Date(2026, 2, 9, h, m, 0, 0, time.UTC) }
+	overrides := []TempAccessRange{{Start: at(10, 0), End: at(11, 0), Priority: 2, Source: Source{Kind: SourceOverride, ID: "o1"}}}
+	blocks := []BlockRange{
+		{Start: at(9, 0), End: at(12, 0), Priority: 1, Source: Source{Kind: SourceBlock, ID: "b1"}},
+		{Start: at(10, 30), End: at(10, 40), Priority: 5, Source: Source{Kind: SourceBlock, ID: "b5"}},
+	}
+	segments := ExplainIntervals(now, schedule, Budget{}, overrides, blocks, 1)
+	tests := []struct {
+		at      time.Time
+		allowed bool
+		id      string
+	}{
+		{at(10, 15), true, "o1"},
+		{at(10, 35), false, "b5"},
+		{at(11, 30), false, "b1"},
+	}
+	for _, tt := range tests {
+		seg, _ := SegmentAt(segments, tt.at)
+		if seg.Allowed != tt.allowed || seg.Source.ID != tt.id {
+			t.Errorf("at %s: got %+v, want allowed=%v %s", tt.at.Format("15:04"), seg, tt.allowed, tt.id)
+		}
+	}
+}
+
+func TestExplainIntervals_Budget(t *testing.T) {
+	now, schedule, _, _ := explainFixture()
+	budget := Budget{Limits: DailyBudget{"monday": 90}}
+	segments := ExplainIntervals(now, schedule, budget, nil, nil, 1)
+	seg, _ := SegmentAt(segments, time.Date(2026, 2, 9, 11, 45, 0, 0, time.UTC))
+	if seg.Allowed || seg.Source.Kind != SourceBudget {
+		t.Errorf("after 90 minutes from now: got %+v, want budget", seg)
+	}
+}
+
+// Allowed segments from now on must match what the client receives
+func TestExplainIntervals_MatchesComputedIntervals(t *testing.T) {
+	now, schedule, temp, blocks := explainFixture()
+	// Override inside block b1
+	temp = append(temp, TempAccessRange{Start: time.Date(2026, 2, 9, 16, 10, 0, 0, time.UTC), End: time.Date(2026, 2, 9, 16, 20, 0, 0, time.UTC), Priority: 1})
+	budget := Budget{Limits: DailyBudget{"monday": 100, "tuesday": 30}, Usage: DailyUsage{"2026-02-09": 600}}
+	want, _ := ComputeAllowedIntervals(now, schedule, budget, temp, blocks, 2, false)
+
+	var got []AllowedInterval
+	for _, s := range ExplainIntervals(now, schedule, budget, temp, blocks, 2) {
+		if !s.Allowed || !s.End.After(now) {
+			continue
+		}
+		got = append(got, AllowedInterval{Start: laterOf(s.Start, now), End: s.End})
+	}
+	got = NewIntervalSet(got...).Intervals()
+	if len(got) != len(want) {
+		t.Fatalf("explain allowed %v, computed %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Start.Equal(want[i].Start) || !got[i].End.Equal(want[i].End) {
+			t.Errorf("interval %d: explain %v, computed %v", i, got[i], want[i])
+		}
+	}
+}
@@ -1,61 +1,110 @@
 package domain
 
 import (
-	"sort"
 	"strings"
 	"time"
 )
 
 const (
-	// IntervalWindowHours is today + tomorrow
-	IntervalWindowHours = 48
+	// DefaultWindowDays is today + tomorrow
+	DefaultWindowDays = 2
+	// MaxWindowDays limits how far ahead intervals can be expanded
+	MaxWindowDays = 14
 )
 
+// maxTime is used as an open upper bound when cutting intervals
+var maxTime = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
 // TempAccessRange is [Start, Until] for temporary access
 type TempAccessRange struct {
-	Start time.Time
-	End   time.Time
+	Start    time.Time
+	End      time.Time
+	Priority int    // > 0: "always allow" override that survives blocks of lower priority
+	Source   Source // request that granted it, for ExplainIntervals
 }
 
 // BlockRange is [Start, Until] for block
 type BlockRange struct {
-	Start time.Time
-	End   time.Time
+	Start    time.Time
+	End      time.Time
+	Priority int    // overrides of higher priority are not cut by this block
+	Source   Source // request or rule that caused it, for ExplainIntervals
 }
 
 // ComputeAllowedIntervals computes allowed intervals for a user
-// based on schedule, temporary access requests, and block requests.
-// 1) Build from schedule, 2) Add temp access and merge, 3) Cut out each block.
+// based on schedule, daily budget, temporary access requests, and block requests.
+// 1) Build from schedule and trim each day to its remaining budget,
+// 2) Add temp access and merge, 3) Cut out each block,
+// 4) Add back overrides, cut only by blocks of at least their priority.
+// windowDays is the look-ahead horizon in days (0 = DefaultWindowDays).
 func ComputeAllowedIntervals(
 	now time.Time,
-	schedule DaySchedule,
+	schedule ScheduleSource,
+	budget Budget,
 	tempAccess []TempAccessRange,
 	blocks []BlockRange,
+	windowDays int,
 	includePast bool,
 ) ([]AllowedInterval, time.Time) {
 	// Truncate now to minute for stable interval boundaries
 	if !includePast {
 		now = now.Truncate(time.Minute)
 	}
+	windowDays = NormalizeWindowDays(windowDays)
+	return computeIntervals(now, WindowEnd(now, windowDays), windowDays, schedule, budget, tempAccess, blocks, includePast)
+}
 
-	var intervals []AllowedInterval
+// ComputeIntervalsUntil is ComputeAllowedIntervals for an arbitrary range [from, to]
+// instead of the look-ahead window, for simulations. Intervals before from are not included.
+func ComputeIntervalsUntil(
+	from, to time.Time,
+	schedule ScheduleSource,
+	budget Budget,
+	tempAccess []TempAccessRange,
+	blocks []BlockRange,
+) ([]AllowedInterval, time.Time) {
+	from = from.Truncate(time.Minute)
+	to = to.In(from.Location())
+	first := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	last := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, from.Location())
+	days := 1
+	for d := first; d.Before(last); d = d.AddDate(0, 0, 1) {
+		days++
+	}
+	return computeIntervals(from, to, days, schedule, budget, tempAccess, blocks, false)
+}
 
-	windowEnd := now.Add(IntervalWindowHours * time.Hour)
+// computeIntervals expands the schedule for days calendar days starting today (plus yesterday
+// for overnight spill) and clips everything to windowEnd
+func computeIntervals(
+	now, windowEnd time.Time,
+	days int,
+	schedule ScheduleSource,
+	budget Budget,
+	tempAccess []TempAccessRange,
+	blocks []BlockRange,
+	includePast bool,
+) ([]AllowedInterval, time.Time) {
+	var intervals []AllowedInterval
 
-	// 1. Schedule-based intervals for today and tomorrow
+	// 1. Schedule-based intervals for today and following days of the window.
+	// Yesterday is expanded too, for overnight intervals that run past midnight.
 	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-	for dayOffset := 0; dayOffset < 2; dayOffset++ {
+	for dayOffset := -1; dayOffset < days; dayOffset++ {
 		day := today.AddDate(0, 0, dayOffset)
-		dayKey := strings.ToLower(day.Weekday().String())
-		dayIntervals, ok := schedule[dayKey]
+		dayIntervals, ok := schedule.DayIntervals(day)
 		if !ok {
 			continue
 		}
+		var dayAllowed []AllowedInterval
 		for _, iv := range dayIntervals {
 			start, end, err := parseDayInterval(day, iv.Start, iv.End)
 			if err != nil {
 				continue
 			}
+			if start.Before(today) {
+				start = today
+			}
 			if !includePast && end.Before(now) {
 				continue
 			}
@@ -69,50 +118,43 @@ func ComputeAllowedIntervals(
 				end = windowEnd
 			}
 			if end.After(start) {
-				intervals = append(intervals, AllowedInterval{Start: start, End: end})
+				dayAllowed = append(dayAllowed, AllowedInterval{Start: start, End: end})
 			}
 		}
+		if remaining, limited := budget.Remaining(day); limited {
+			dayAllowed = applyBudget(dayAllowed, blocks, now, remaining)
+		}
+		intervals = append(intervals, dayAllowed...)
 	}
 
 	// 2. Add temporary access intervals
 	for _, ta := range tempAccess {
-		if !includePast && ta.End.Before(now) {
-			continue
-		}
-		if ta.Start.After(windowEnd) {
-			continue
-		}
-		start, end := ta.Start, ta.End
-		if start.Before(now) && !includePast {
-			start = now
-		}
-		if end.After(windowEnd) {
-			end = windowEnd
-		}
-		if end.After(start) {
-			intervals = append(intervals, AllowedInterval{Start: start, End: end})
+		if iv, ok := clipTempAccess(ta, now, windowEnd, includePast); ok {
+			intervals = append(intervals, iv)
 		}
 	}
 
 	// 3. Merge overlapping intervals
-	intervals = mergeIntervals(intervals)
+	allowed := NewIntervalSet(intervals...)
 
-	// 4. Apply each block: cut out [start, end] from intervals
-	for _, b := range blocks {
-		if b.End.After(now) && b.Start.Before(b.End) {
-			intervals = subtractBlockFromIntervals(intervals, b.Start, b.End)
+	// 4. Cut out blocks
+	allowed = allowed.Subtract(blockSet(blocks, now, 0))
+
+	// 5. Overrides survive blocks of lower priority: add back what they still cover
+	for _, ta := range tempAccess {
+		if ta.Priority <= 0 {
+			continue
+		}
+		if iv, ok := clipTempAccess(ta, now, windowEnd, includePast); ok {
+			allowed = allowed.Union(NewIntervalSet(iv).Subtract(blockSet(blocks, now, ta.Priority)))
 		}
 	}
+	intervals = allowed.Intervals()
 
-	// 5. Compute next change time
+	// 6. Compute next change time
 	nextChange := windowEnd
-	for _, iv := range intervals {
-		if iv.Start.After(now) && iv.Start.Before(nextChange) {
-			nextChange = iv.Start
-		}
-		if iv.End.After(now) && iv.End.Before(nextChange) {
-			nextChange = iv.End
-		}
+	if t, ok := allowed.NextTransition(now); ok && t.Before(nextChange) {
+		nextChange = t
 	}
 	for _, ta := range tempAccess {
 		if ta.End.After(now) && ta.End.Before(nextChange) {
@@ -131,25 +173,62 @@ func ComputeAllowedIntervals(
 	return intervals, nextChange
 }
 
-// subtractBlockFromIntervals cuts [blockStart, blockUntil] out of each interval.
-// An interval may be split into two parts (before and after the block).
-func subtractBlockFromIntervals(intervals []AllowedInterval, blockStart, blockUntil time.Time) []AllowedInterval {
-	var result []AllowedInterval
-	for _, iv := range intervals {
-		// No overlap: interval entirely before block or entirely after
-		if !iv.End.After(blockStart) || !iv.Start.Before(blockUntil) {
-			result = append(result, iv)
-			continue
-		}
-		// Overlap: keep parts before blockStart and after blockUntil
-		if iv.Start.Before(blockStart) {
-			result = append(result, AllowedInterval{Start: iv.Start, End: blockStart})
-		}
-		if iv.End.After(blockUntil) {
-			result = append(result, AllowedInterval{Start: blockUntil, End: iv.End})
+// clipTempAccess clips a temporary access range to [now, windowEnd] (to the window end only with includePast)
+func clipTempAccess(ta TempAccessRange, now, windowEnd time.Time, includePast bool) (AllowedInterval, bool) {
+	if !includePast && ta.End.Before(now) {
+		return AllowedInterval{}, false
+	}
+	if ta.Start.After(windowEnd) {
+		return AllowedInterval{}, false
+	}
+	start, end := ta.Start, ta.End
+	if start.Before(now) && !includePast {
+		start = now
+	}
+	if end.After(windowEnd) {
+		end = windowEnd
+	}
+	return AllowedInterval{Start: start, End: end}, end.After(start)
+}
+
+// NormalizeWindowDays returns DefaultWindowDays for 0 and clamps to [1, MaxWindowDays]
+func NormalizeWindowDays(days int) int {
+	switch {
+	case days <= 0:
+		return DefaultWindowDays
+	case days > MaxWindowDays:
+		return MaxWindowDays
+	}
+	return days
+}
+
+// WindowEnd returns end of the look-ahead window starting at now
+func WindowEnd(now time.Time, windowDays int) time.Time {
+	return now.Add(time.Duration(NormalizeWindowDays(windowDays)) * 24 * time.Hour)
+}
+
+// blockSet returns blocks that have not ended by now and have at least minPriority
+func blockSet(blocks []BlockRange, now time.Time, minPriority int) IntervalSet {
+	var ranges []AllowedInterval
+	for _, b := range blocks {
+		if b.End.After(now) && b.Priority >= minPriority {
+			ranges = append(ranges, AllowedInterval{Start: b.Start, End: b.End})
 		}
 	}
-	return result
+	return NewIntervalSet(ranges...)
+}
+
+// applyBudget limits a day's schedule intervals to the remaining budget counted from now.
+// Blocked time is not counted; time before now (preview only) is kept as is.
+func applyBudget(intervals []AllowedInterval, blocks []BlockRange, now time.Time, remaining time.Duration) []AllowedInterval {
+	allowed := NewIntervalSet(intervals...).Subtract(blockSet(blocks, now, 0))
+	past := allowed.Subtract(NewIntervalSet(AllowedInterval{Start: now, End: maxTime}))
+	future := allowed.Subtract(NewIntervalSet(AllowedInterval{Start: time.Time{}, End: now}))
+	return append(past.Intervals(), trimToDuration(future.Intervals(), remaining)...)
+}
+
+func dayKey(day time.Time) string {
+	return strings.ToLower(day.Weekday().String())
 }
 
 func parseDayInterval(day time.Time, startStr, endStr string) (time.Time, time.Time, error) {
@@ -161,31 +240,34 @@ func parseDayInterval(day time.Time, startStr, endStr string) (time.Time, time.T
 	if err != nil {
 		return time.Time{}, time.Time{}, err
 	}
-	start := time.Date(day.Year(), day.Month(), day.Day(), sh, sm, 0, 0, day.Location())
-	end := time.Date(day.Year(), day.Month(), day.Day(), eh, em, 0, 0, day.Location())
-	if !end.After(start) {
-		end = end.Add(24 * time.Hour)
+	start := wallClock(day, sh, sm)
+	// Overnight is decided by wall clock, not by instants: on DST days they may disagree
+	endDay := day
+	if eh*60+em <= sh*60+sm {
+		endDay = day.AddDate(0, 0, 1)
 	}
+	end := wallClock(endDay, eh, em)
 	return start, end, nil
 }
 
-func mergeIntervals(intervals []AllowedInterval) []AllowedInterval {
-	if len(intervals) == 0 {
-		return nil
-	}
-	sort.Slice(intervals, func(i, j int) bool {
-		return intervals[i].Start.Before(intervals[j].Start)
-	})
-	merged := []AllowedInterval{intervals[0]}
-	for i := 1; i < len(intervals); i++ {
-		last := &merged[len(merged)-1]
-		if intervals[i].Start.Before(last.End) || intervals[i].Start.Equal(last.End) {
-			if intervals[i].End.After(last.End) {
-				last.End = intervals[i].End
-			}
-		} else {
-			merged = append(merged, intervals[i])
+// wallClock returns the instant of hour:minute on day's date in day's location.
+// A time skipped by a DST gap maps to the end of the gap;
+// a time repeated on DST fall-back maps to its first occurrence.
+func wallClock(day time.Time, hour, minute int) time.Time {
+	t := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, day.Location())
+	want := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	if !got.Equal(want) {
+		// Skipped: t was normalized to one side of the gap, the transition is the bound
+		// of t's zone period on the other side
+		zoneStart, zoneEnd := t.ZoneBounds()
+		if got.After(want) {
+			return zoneStart
 		}
+		return zoneEnd
+	}
+	if e := t.Add(-time.Hour); e.Day() == t.Day() && e.Hour() == hour && e.Minute() == minute {
+		return e
 	}
-	return merged
+	return t
 }
@@ -3,6 +3,7 @@ package domain
 import (
 	"testing"
 	"time"
+	_ "time/tzdata"
 )
 
 func TestComputeAllowedIntervals_ScheduleOnly(t *testing.T) {
@@ -12,7 +13,7 @@ func TestComputeAllowedIntervals_ScheduleOnly(t *testing.T) {
 	schedule := DaySchedule{
 		"thursday": {{Start: "07:00", End: "13:15"}},
 	}
-	intervals, _ := ComputeAllowedIntervals(now, schedule, nil, nil, false)
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
 	if len(intervals) != 1 {
 		t.Fatalf("want 1 interval, got %d", len(intervals))
 	}
@@ -38,7 +39,7 @@ func TestComputeAllowedIntervals_TempAccessOutsideSchedule(t *testing.T) {
 			End:   time.Date(2026, 2, 12, 17, 15, 0, 0, loc),
 		},
 	}
-	intervals, _ := ComputeAllowedIntervals(now, schedule, tempAccess, nil, false)
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, tempAccess, nil, 0, false)
 	// Should have: [17:00, 17:15] (temp access clipped to now at start)
 	if len(intervals) != 1 {
 		t.Fatalf("want 1 interval, got %d: %v", len(intervals), intervals)
@@ -66,7 +67,7 @@ func TestComputeAllowedIntervals_TempAccessAndSchedule(t *testing.T) {
 			End:   time.Date(2026, 2, 12, 17, 0, 0, 0, loc),
 		},
 	}
-	intervals, _ := ComputeAllowedIntervals(now, schedule, tempAccess, nil, false)
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, tempAccess, nil, 0, false)
 	// Schedule: [12:00, 13:15] (clipped)
 	// Temp: [16:00, 17:00]
 	// Merged: [12:00, 13:15], [16:00, 17:00]
@@ -87,7 +88,7 @@ func TestComputeAllowedIntervals_BlockCutsSchedule(t *testing.T) {
 			End:   time.Date(2026, 2, 12, 11, 0, 0, 0, loc),
 		},
 	}
-	intervals, _ := ComputeAllowedIntervals(now, schedule, nil, blocks, false)
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, blocks, 0, false)
 	// [10:00, 13:15] cut by [10:00, 11:00] -> [11:00, 13:15]
 	if len(intervals) != 1 {
 		t.Fatalf("want 1 interval, got %d: %v", len(intervals), intervals)
@@ -109,7 +110,7 @@ func TestComputeAllowedIntervals_NoZeroLength(t *testing.T) {
 	schedule := DaySchedule{
 		"thursday": {{Start: "07:00", End: "13:15"}},
 	}
-	intervals, _ := ComputeAllowedIntervals(now, schedule, nil, nil, false)
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
 	if len(intervals) != 0 {
 		t.Errorf("want 0 intervals (exact end time), got %d: %v", len(intervals), intervals)
 	}
@@ -121,7 +122,7 @@ func TestComputeAllowedIntervals_OvernightSchedule(t *testing.T) {
 	schedule := DaySchedule{
 		"thursday": {{Start: "22:00", End: "02:00"}},
 	}
-	intervals, _ := ComputeAllowedIntervals(now, schedule, nil, nil, false)
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
 	if len(intervals) != 1 {
 		t.Fatalf("want 1 interval, got %d", len(intervals))
 	}
@@ -151,10 +152,315 @@ func TestComputeAllowedIntervals_BlockCutsTempAccess(t *testing.T) {
 			End:   time.Date(2026, 2, 12, 17, 45, 0, 0, loc),
 		},
 	}
-	intervals, _ := ComputeAllowedIntervals(now, schedule, tempAccess, blocks, false)
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, tempAccess, blocks, 0, false)
 	// Temp clipped to now: [17:00, 18:00]
 	// Block [17:30, 17:45] cuts it -> [17:00, 17:30], [17:45, 18:00]
 	if len(intervals) != 2 {
 		t.Fatalf("want 2 intervals, got %d: %v", len(intervals), intervals)
 	}
 }
+
+func TestComputeAllowedIntervals_OverrideBeatsLowerPriorityBlock(t *testing.T) {
+	loc := time.UTC
+	now := time.Date(2026, 2, 12, 17, 0, 0, 0, loc)
+	at := func(h, m int) time.Time { return time.Date(2026, 2, 12, h, m, 0, 0, loc) }
+	schedule := DaySchedule{"thursday": {{Start: "16:00", End: "20:00"}}}
+	tempAccess := []TempAccessRange{{Start: at(17, 0), End: at(19, 0), Priority: 1}}
+	blocks := []BlockRange{
+		{Start: at(16, 0), End: at(22, 0)},                // global block, beaten by the override
+		{Start: at(18, 30), End: at(18, 45), Priority: 1}, // same priority, still blocks
+	}
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, tempAccess, blocks, 0, false)
+	want := []AllowedInterval{{Start: at(17, 0), End: at(18, 30)}, {Start: at(18, 45), End: at(19, 0)}}
+	if len(intervals) != len(want) {
+		t.Fatalf("want %v, got %v", want, intervals)
+	}
+	for i := range want {
+		if !intervals[i].Start.Equal(want[i].Start) || !intervals[i].End.Equal(want[i].End) {
+			t.Errorf("interval %d: want %v, got %v", i, want[i], intervals[i])
+		}
+	}
+
+	// Without priority the same grant is plain temporary access and the block wins
+	tempAccess[0].Priority = 0
+	if intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, tempAccess, blocks, 0, false); len(intervals) != 0 {
+		t.Errorf("plain temp access: want no intervals, got %v", intervals)
+	}
+}
+
+func TestComputeAllowedIntervals_BudgetTrimsFromNow(t *testing.T) {
+	loc := time.UTC
+	now := time.Date(2026, 2, 12, 10, 0, 0, 0, loc)
+	schedule := DaySchedule{
+		"thursday": {{Start: "07:00", End: "13:15"}},
+		"friday":   {{Start: "09:00", End: "12:00"}},
+	}
+	budget := Budget{
+		Limits: DailyBudget{"thursday": 60, "friday": 30},
+		Usage:  DailyUsage{"2026-02-12": 20 * 60},
+	}
+	intervals, nextChange := ComputeAllowedIntervals(now, schedule, budget, nil, nil, 0, false)
+	// Thursday: 60 - 20 = 40 min left -> [10:00, 10:40]
+	// Friday: full 30 min from start -> [09:00, 09:30]
+	if len(intervals) != 2 {
+		t.Fatalf("want 2 intervals, got %d: %v", len(intervals), intervals)
+	}
+	expectEnd := time.Date(2026, 2, 12, 10, 40, 0, 0, loc)
+	if !intervals[0].Start.Equal(now) || !intervals[0].End.Equal(expectEnd) {
+		t.Errorf("today: want [%v, %v], got %v", now, expectEnd, intervals[0])
+	}
+	if !nextChange.Equal(expectEnd) {
+		t.Errorf("nextChange: want %v, got %v", expectEnd, nextChange)
+	}
+	expectStart := time.Date(2026, 2, 13, 9, 0, 0, 0, loc)
+	expectEnd = time.Date(2026, 2, 13, 9, 30, 0, 0, loc)
+	if !intervals[1].Start.Equal(expectStart) || !intervals[1].End.Equal(expectEnd) {
+		t.Errorf("tomorrow: want [%v, %v], got %v", expectStart, expectEnd, intervals[1])
+	}
+}
+
+func TestComputeAllowedIntervals_BudgetSpansIntervalsAndSkipsBlocks(t *testing.T) {
+	loc := time.UTC
+	now := time.Date(2026, 2, 12, 12, 0, 0, 0, loc)
+	schedule := DaySchedule{
+		"thursday": {{Start: "07:00", End: "13:00"}, {Start: "18:00", End: "20:00"}},
+	}
+	budget := Budget{Limits: DailyBudget{"thursday": 90}}
+	blocks := []BlockRange{
+		{
+			Start: time.Date(2026, 2, 12, 12, 0, 0, 0, loc),
+			End:   time.Date(2026, 2, 12, 12, 30, 0, 0, loc),
+		},
+	}
+	intervals, _ := ComputeAllowedIntervals(now, schedule, budget, nil, blocks, 0, false)
+	// Blocked time is not charged: [12:30, 13:00] (30 min) + [18:00, 19:00] (60 min)
+	if len(intervals) != 2 {
+		t.Fatalf("want 2 intervals, got %d: %v", len(intervals), intervals)
+	}
+	expectEnd := time.Date(2026, 2, 12, 19, 0, 0, 0, loc)
+	if !intervals[1].End.Equal(expectEnd) {
+		t.Errorf("end: want %v, got %v", expectEnd, intervals[1].End)
+	}
+}
+
+func TestComputeAllowedIntervals_BudgetExhaustedKeepsTempAccess(t *testing.T) {
+	loc := time.UTC
+	now := time.Date(2026, 2, 12, 10, 0, 0, 0, loc)
+	schedule := DaySchedule{
+		"thursday": {{Start: "07:00", End: "13:15"}},
+	}
+	budget := Budget{
+		Limits: DailyBudget{"thursday": 60},
+		Usage:  DailyUsage{"2026-02-12": 2 * 60 * 60},
+	}
+	tempAccess := []TempAccessRange{
+		{
+			Start: time.Date(2026, 2, 12, 10, 0, 0, 0, loc),
+			End:   time.Date(2026, 2, 12, 10, 15, 0, 0, loc),
+		},
+	}
+	intervals, _ := ComputeAllowedIntervals(now, schedule, budget, tempAccess, nil, 0, false)
+	if len(intervals) != 1 {
+		t.Fatalf("want 1 interval (temp access only), got %d: %v", len(intervals), intervals)
+	}
+	expectEnd := time.Date(2026, 2, 12, 10, 15, 0, 0, loc)
+	if !intervals[0].End.Equal(expectEnd) {
+		t.Errorf("end: want %v, got %v", expectEnd, intervals[0].End)
+	}
+}
+
+func TestComputeAllowedIntervals_DateOverrideReplacesDay(t *testing.T) {
+	loc := time.UTC
+	// Thursday 31 Dec 2026, 20:00
+	now := time.Date(2026, 12, 31, 20, 0, 0, 0, loc)
+	schedule := OverriddenSchedule{
+		Weekly: DaySchedule{
+			"thursday": {{Start: "07:00", End: "21:00"}},
+		},
+		Overrides: DateOverrides{
+			"2026-12-31": {Intervals: []TimeInterval{{Start: "07:00", End: "01:00"}}},
+		},
+	}
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
+	if len(intervals) != 1 {
+		t.Fatalf("want 1 interval, got %d: %v", len(intervals), intervals)
+	}
+	expectEnd := time.Date(2027, 1, 1, 1, 0, 0, 0, loc)
+	if !intervals[0].End.Equal(expectEnd) {
+		t.Errorf("end: want %v, got %v", expectEnd, intervals[0].End)
+	}
+}
+
+func TestComputeAllowedIntervals_DateOverrideUsesOtherDay(t *testing.T) {
+	loc := time.UTC
+	// Sunday 8 Mar 2026, 09:00 is a holiday; Monday 9 Mar uses Sunday schedule
+	now := time.Date(2026, 3, 8, 9, 0, 0, 0, loc)
+	schedule := OverriddenSchedule{
+		Weekly: DaySchedule{
+			"sunday": {{Start: "10:00", End: "20:00"}},
+			"monday": {{Start: "15:00", End: "17:00"}},
+		},
+		Overrides: DateOverrides{
+			"2026-03-09": {UseDay: "sunday"},
+		},
+	}
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
+	if len(intervals) != 2 {
+		t.Fatalf("want 2 intervals, got %d: %v", len(intervals), intervals)
+	}
+	expectStart := time.Date(2026, 3, 9, 10, 0, 0, 0, loc)
+	expectEnd := time.Date(2026, 3, 9, 20, 0, 0, 0, loc)
+	if !intervals[1].Start.Equal(expectStart) || !intervals[1].End.Equal(expectEnd) {
+		t.Errorf("monday: want [%v, %v], got %v", expectStart, expectEnd, intervals[1])
+	}
+}
+
+func TestComputeAllowedIntervals_OvernightFromYesterday(t *testing.T) {
+	loc := time.UTC
+	// Friday 13 Feb 2026, 00:30 - inside Thursday's 22:00-02:00
+	now := time.Date(2026, 2, 13, 0, 30, 0, 0, loc)
+	schedule := DaySchedule{
+		"thursday": {{Start: "22:00", End: "02:00"}},
+	}
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
+	if len(intervals) != 1 {
+		t.Fatalf("want 1 interval, got %d: %v", len(intervals), intervals)
+	}
+	expectEnd := time.Date(2026, 2, 13, 2, 0, 0, 0, loc)
+	if !intervals[0].Start.Equal(now) || !intervals[0].End.Equal(expectEnd) {
+		t.Errorf("want [%v, %v], got %v", now, expectEnd, intervals[0])
+	}
+}
+
+func TestComputeAllowedIntervals_LongWindow(t *testing.T) {
+	loc := time.UTC
+	// Thursday 12 Feb 2026, 10:00
+	now := time.Date(2026, 2, 12, 10, 0, 0, 0, loc)
+	schedule := DaySchedule{}
+	for _, d := range DayNames {
+		schedule[d] = []TimeInterval{{Start: "18:00", End: "20:00"}}
+	}
+	intervals, nextChange := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 7, false)
+	if len(intervals) != 7 {
+		t.Fatalf("want 7 intervals, got %d: %v", len(intervals), intervals)
+	}
+	expectLast := time.Date(2026, 2, 18, 20, 0, 0, 0, loc)
+	if !intervals[6].End.Equal(expectLast) {
+		t.Errorf("last end: want %v, got %v", expectLast, intervals[6].End)
+	}
+	expectNext := time.Date(2026, 2, 12, 18, 0, 0, 0, loc)
+	if !nextChange.Equal(expectNext) {
+		t.Errorf("nextChange: want %v, got %v", expectNext, nextChange)
+	}
+
+	// Default window keeps today + tomorrow
+	intervals, _ = ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
+	if len(intervals) != 2 {
+		t.Errorf("default window: want 2 intervals, got %d", len(intervals))
+	}
+}
+
+func TestComputeIntervalsUntil_BeyondWindowLimit(t *testing.T) {
+	loc := time.UTC
+	// Thursday 12 Feb 2026, 19:00 until Sunday 15 Mar 2026, 19:00
+	from := time.Date(2026, 2, 12, 19, 0, 0, 0, loc)
+	to := time.Date(2026, 3, 15, 19, 0, 0, 0, loc)
+	schedule := DaySchedule{}
+	for _, d := range DayNames {
+		schedule[d] = []TimeInterval{{Start: "18:00", End: "20:00"}}
+	}
+	intervals, _ := ComputeIntervalsUntil(from, to, schedule, Budget{}, nil, nil)
+	// 12 Feb clipped to from, 13 Feb..14 Mar full, 15 Mar clipped to to
+	if len(intervals) != 32 {
+		t.Fatalf("want 32 intervals, got %d", len(intervals))
+	}
+	if !intervals[0].Start.Equal(from) {
+		t.Errorf("first start: want %v, got %v", from, intervals[0].Start)
+	}
+	if last := intervals[len(intervals)-1]; !last.End.Equal(to) {
+		t.Errorf("last end: want %v, got %v", to, last.End)
+	}
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestComputeAllowedIntervals_DSTSpringForward(t *testing.T) {
+	loc := mustLoadLocation(t, "Europe/Berlin")
+	// Saturday 28 Mar 2026, 23:00 CET; clocks jump 02:00 CET -> 03:00 CEST on Sunday
+	now := time.Date(2026, 3, 28, 23, 0, 0, 0, loc)
+	schedule := DaySchedule{
+		"saturday": {{Start: "22:00", End: "02:30"}},
+		"sunday":   {{Start: "02:00", End: "02:30"}, {Start: "10:00", End: "12:00"}},
+	}
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
+	// Saturday: 02:30 does not exist -> ends at 03:00 CEST (4h of wall clock, 3h real)
+	// Sunday 02:00-02:30 lies entirely in the gap -> dropped, not expanded to 24h
+	if len(intervals) != 2 {
+		t.Fatalf("want 2 intervals, got %d: %v", len(intervals), intervals)
+	}
+	if d := intervals[0].End.Sub(intervals[0].Start); d != 3*time.Hour {
+		t.Errorf("overnight into gap: want 3h, got %v (%v)", d, intervals[0])
+	}
+	expectStart := time.Date(2026, 3, 29, 10, 0, 0, 0, loc)
+	if !intervals[1].Start.Equal(expectStart) || intervals[1].End.Sub(intervals[1].Start) != 2*time.Hour {
+		t.Errorf("sunday: want 2h from %v, got %v", expectStart, intervals[1])
+	}
+}
+
+func TestComputeAllowedIntervals_DSTFallBack(t *testing.T) {
+	loc := mustLoadLocation(t, "Europe/Berlin")
+	// Saturday 24 Oct 2026, 23:00 CEST; clocks go back 03:00 CEST -> 02:00 CET on Sunday
+	now := time.Date(2026, 10, 24, 23, 0, 0, 0, loc)
+	schedule := DaySchedule{
+		"saturday": {{Start: "22:00", End: "07:00"}},
+	}
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
+	if len(intervals) != 1 {
+		t.Fatalf("want 1 interval, got %d: %v", len(intervals), intervals)
+	}
+	expectEnd := time.Date(2026, 10, 25, 7, 0, 0, 0, loc)
+	if !intervals[0].End.Equal(expectEnd) {
+		t.Errorf("end: want %v, got %v", expectEnd, intervals[0].End)
+	}
+	// 23:00 CEST -> 07:00 CET is 9 real hours
+	if d := intervals[0].End.Sub(intervals[0].Start); d != 9*time.Hour {
+		t.Errorf("duration: want 9h, got %v", d)
+	}
+
+	// Repeated wall time maps to its first occurrence
+	now = time.Date(2026, 10, 25, 0, 0, 0, 0, loc)
+	schedule = DaySchedule{
+		"sunday": {{Start: "02:30", End: "03:00"}},
+	}
+	intervals, _ = ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
+	if len(intervals) != 1 {
+		t.Fatalf("want 1 interval, got %d: %v", len(intervals), intervals)
+	}
+	if d := intervals[0].End.Sub(intervals[0].Start); d != 90*time.Minute {
+		t.Errorf("ambiguous start: want 1h30m, got %v (%v)", d, intervals[0])
+	}
+}
+
+func TestComputeAllowedIntervals_DSTGapAmericas(t *testing.T) {
+	loc := mustLoadLocation(t, "America/New_York")
+	// Sunday 8 Mar 2026: 02:00 EST -> 03:00 EDT
+	now := time.Date(2026, 3, 8, 0, 0, 0, 0, loc)
+	schedule := DaySchedule{
+		"sunday": {{Start: "02:30", End: "04:00"}},
+	}
+	intervals, _ := ComputeAllowedIntervals(now, schedule, Budget{}, nil, nil, 0, false)
+	if len(intervals) != 1 {
+		t.Fatalf("want 1 interval, got %d: %v", len(intervals), intervals)
+	}
+	expectStart := time.Date(2026, 3, 8, 3, 0, 0, 0, loc)
+	if !intervals[0].Start.Equal(expectStart) {
+		t.Errorf("start: want %v (end of gap), got %v", expectStart, intervals[0].Start)
+	}
+}
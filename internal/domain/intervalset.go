@@ -0,0 +1,154 @@
+package domain
+
+import (
+	"sort"
+	"time"
+)
+
+// IntervalSet is a set of instants kept as sorted, disjoint half-open intervals [Start, End).
+// Overlapping and touching intervals are merged and empty ones dropped, so every boundary
+// is a real transition between "in" and "out". The zero value is the empty set.
+type IntervalSet struct {
+	intervals []AllowedInterval
+}
+
+// NewIntervalSet builds a set from intervals in any order; intervals with End <= Start are ignored
+func NewIntervalSet(intervals ...AllowedInterval) IntervalSet {
+	var sorted []AllowedInterval
+	for _, iv := range intervals {
+		if iv.End.After(iv.Start) {
+			sorted = append(sorted, iv)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Before(sorted[j].Start) })
+	var merged []AllowedInterval
+	for _, iv := range sorted {
+		if n := len(merged); n > 0 && !iv.Start.After(merged[n-1].End) {
+			if iv.End.After(merged[n-1].End) {
+				merged[n-1].End = iv.End
+			}
+			continue
+		}
+		merged = append(merged, iv)
+	}
+	return IntervalSet{intervals: merged}
+}
+
+// Intervals returns the set's intervals in order, nil for the empty set
+func (s IntervalSet) Intervals() []AllowedInterval {
+	if len(s.intervals) == 0 {
+		return nil
+	}
+	return append([]AllowedInterval(nil), s.intervals...)
+}
+
+// IsEmpty reports whether the set contains no instant
+func (s IntervalSet) IsEmpty() bool {
+	return len(s.intervals) == 0
+}
+
+// Union returns instants in s or o
+func (s IntervalSet) Union(o IntervalSet) IntervalSet {
+	if o.IsEmpty() {
+		return s
+	}
+	if s.IsEmpty() {
+		return o
+	}
+	all := make([]AllowedInterval, 0, len(s.intervals)+len(o.intervals))
+	return NewIntervalSet(append(append(all, s.intervals...), o.intervals...)...)
+}
+
+// Intersect returns instants in both s and o
+func (s IntervalSet) Intersect(o IntervalSet) IntervalSet {
+	var result []AllowedInterval
+	i, j := 0, 0
+	for i < len(s.intervals) && j < len(o.intervals) {
+		a, b := s.intervals[i], o.intervals[j]
+		start, end := laterOf(a.Start, b.Start), earlierOf(a.End, b.End)
+		if end.After(start) {
+			result = append(result, AllowedInterval{Start: start, End: end})
+		}
+		// Advance the interval that ends first; the other may still overlap the next one
+		if a.End.Before(b.End) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return IntervalSet{intervals: result}
+}
+
+// Subtract returns instants in s but not in o
+func (s IntervalSet) Subtract(o IntervalSet) IntervalSet {
+	var result []AllowedInterval
+	j := 0
+	for _, iv := range s.intervals {
+		start := iv.Start
+		// Skip cuts that end before this interval; they cannot affect later ones either
+		for j < len(o.intervals) && !o.intervals[j].End.After(start) {
+			j++
+		}
+		for k := j; k < len(o.intervals) && o.intervals[k].Start.Before(iv.End); k++ {
+			cut := o.intervals[k]
+			if cut.Start.After(start) {
+				result = append(result, AllowedInterval{Start: start, End: cut.Start})
+			}
+			start = laterOf(start, cut.End)
+		}
+		if iv.End.After(start) {
+			result = append(result, AllowedInterval{Start: start, End: iv.End})
+		}
+	}
+	return IntervalSet{intervals: result}
+}
+
+// Contains reports whether t is in the set: Start is included, End is not
+func (s IntervalSet) Contains(t time.Time) bool {
+	i := sort.Search(len(s.intervals), func(i int) bool { return s.intervals[i].End.After(t) })
+	return i < len(s.intervals) && !t.Before(s.intervals[i].Start)
+}
+
+// NextTransition returns the first boundary strictly after t, where membership changes.
+// False if membership never changes after t.
+func (s IntervalSet) NextTransition(t time.Time) (time.Time, bool) {
+	i := sort.Search(len(s.intervals), func(i int) bool { return s.intervals[i].End.After(t) })
+	if i == len(s.intervals) {
+		return time.Time{}, false
+	}
+	if s.intervals[i].Start.After(t) {
+		return s.intervals[i].Start, true
+	}
+	return s.intervals[i].End, true
+}
+
+// TotalDuration returns the summed length of the set's intervals
+func (s IntervalSet) TotalDuration() time.Duration {
+	var total time.Duration
+	for _, iv := range s.intervals {
+		total += iv.End.Sub(iv.Start)
+	}
+	return total
+}
+
+// Truncate rounds every boundary down to a multiple of d (see time.Time.Truncate)
+func (s IntervalSet) Truncate(d time.Duration) IntervalSet {
+	truncated := make([]AllowedInterval, len(s.intervals))
+	for i, iv := range s.intervals {
+		truncated[i] = AllowedInterval{Start: iv.Start.Truncate(d), End: iv.End.Truncate(d)}
+	}
+	return NewIntervalSet(truncated...)
+}
+
+// Equal reports whether both sets contain the same instants, regardless of time zone
+func (s IntervalSet) Equal(o IntervalSet) bool {
+	if len(s.intervals) != len(o.intervals) {
+		return false
+	}
+	for i := range s.intervals {
+		if !s.intervals[i].Start.Equal(o.intervals[i].Start) || !s.intervals[i].End.Equal(o.intervals[i].End) {
+			return false
+		}
+	}
+	return true
+}
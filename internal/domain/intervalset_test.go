@@ -0,0 +1,166 @@
+package domain
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// The set algebra is checked against a bitmap model: slot k of a mask stands for
+// the minute [base+k, base+k+1). Masks have modelSlots slots; beyond them nothing is set.
+const modelSlots = 6
+
+var modelBase = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func slot(k int) time.Time {
+	return modelBase.Add(time.Duration(k) * time.Minute)
+}
+
+func bit(mask uint64, k int) bool {
+	return k >= 0 && mask&(1<<k) != 0
+}
+
+// setFromSlots builds a set from one interval per set slot, so touching pieces must merge
+func setFromSlots(mask uint64, slots int) IntervalSet {
+	var pieces []AllowedInterval
+	for k := slots - 1; k >= 0; k-- { // reversed on purpose, input order must not matter
+		if bit(mask, k) {
+			pieces = append(pieces, AllowedInterval{Start: slot(k), End: slot(k + 1)})
+		}
+	}
+	return NewIntervalSet(pieces...)
+}
+
+// runs returns the maximal runs of set slots: the normalized form of the mask
+func runs(mask uint64, slots int) []AllowedInterval {
+	var result []AllowedInterval
+	for k := 0; k < slots; k++ {
+		if bit(mask, k) && !bit(mask, k-1) {
+			end := k
+			for end < slots && bit(mask, end) {
+				end++
+			}
+			result = append(result, AllowedInterval{Start: slot(k), End: slot(end)})
+		}
+	}
+	return result
+}
+
+func checkSet(t *testing.T, name string, got IntervalSet, mask uint64, slots int) {
+	t.Helper()
+	want := runs(mask, slots)
+	ivs := got.Intervals()
+	if len(ivs) != len(want) {
+		t.Fatalf("%s: got %v, want %v", name, ivs, want)
+	}
+	for i := range want {
+		if !ivs[i].Start.Equal(want[i].Start) || !ivs[i].End.Equal(want[i].End) {
+			t.Fatalf("%s: got %v, want %v", name, ivs, want)
+		}
+	}
+	var ones int
+	for k := 0; k <= slots; k++ {
+		if bit(mask, k) {
+			ones++
+		}
+		// Start of a slot is in the set exactly when the slot is; so is its middle
+		if c := got.Contains(slot(k)); c != bit(mask, k) {
+			t.Fatalf("%s: Contains(slot %d) = %v", name, k, c)
+		}
+		if c := got.Contains(slot(k).Add(30 * time.Second)); c != bit(mask, k) {
+			t.Fatalf("%s: Contains(middle of slot %d) = %v", name, k, c)
+		}
+		next, ok := got.NextTransition(slot(k))
+		wantNext := -1
+		for j := k + 1; j <= slots; j++ {
+			if bit(mask, j) != bit(mask, j-1) {
+				wantNext = j
+				break
+			}
+		}
+		if ok != (wantNext >= 0) || (ok && !next.Equal(slot(wantNext))) {
+			t.Fatalf("%s: NextTransition(slot %d) = %v, %v; want slot %d", name, k, next, ok, wantNext)
+		}
+	}
+	if d := got.TotalDuration(); d != time.Duration(ones)*time.Minute {
+		t.Fatalf("%s: TotalDuration = %v, want %d minutes", name, d, ones)
+	}
+}
+
+// Every pair of sets over modelSlots minutes
+func TestIntervalSet_Exhaustive(t *testing.T) {
+	const all = 1 << modelSlots
+	for a := uint64(0); a < all; a++ {
+		sa := setFromSlots(a, modelSlots)
+		checkSet(t, "set", sa, a, modelSlots)
+		for b := uint64(0); b < all; b++ {
+			sb := setFromSlots(b, modelSlots)
+			checkSet(t, "union", sa.Union(sb), a|b, modelSlots)
+			checkSet(t, "intersect", sa.Intersect(sb), a&b, modelSlots)
+			checkSet(t, "subtract", sa.Subtract(sb), a&^b, modelSlots)
+			if sa.Equal(sb) != (a == b) {
+				t.Fatalf("Equal(%b, %b) = %v", a, b, sa.Equal(sb))
+			}
+		}
+	}
+}
+
+// Random overlapping, touching, empty and reversed intervals in mixed time zones
+func TestIntervalSet_Randomized(t *testing.T) {
+	const slots = 48
+	rng := rand.New(rand.NewSource(1))
+	zones := []*time.Location{time.UTC, time.FixedZone("UTC+3", 3*3600), time.FixedZone("UTC-5", -5*3600)}
+	random := func() (IntervalSet, uint64) {
+		var mask uint64
+		var ivs []AllowedInterval
+		for n := rng.Intn(6); n > 0; n-- {
+			s, e := rng.Intn(slots+1), rng.Intn(slots+1)
+			ivs = append(ivs, AllowedInterval{Start: slot(s).In(zones[rng.Intn(len(zones))]), End: slot(e)})
+			for k := s; k < e; k++ {
+				mask |= 1 << k
+			}
+		}
+		return NewIntervalSet(ivs...), mask
+	}
+	for i := 0; i < 5000; i++ {
+		sa, a := random()
+		sb, b := random()
+		checkSet(t, "set", sa, a, slots)
+		checkSet(t, "union", sa.Union(sb), a|b, slots)
+		checkSet(t, "intersect", sa.Intersect(sb), a&b, slots)
+		checkSet(t, "subtract", sa.Subtract(sb), a&^b, slots)
+		// Algebraic identities
+		if !sa.Subtract(sb).Union(sa.Intersect(sb)).Equal(sa) {
+			t.Fatalf("(a-b)|(a&b) != a for %v, %v", sa.Intervals(), sb.Intervals())
+		}
+		if !sa.Union(sb).Equal(sb.Union(sa)) || !sa.Intersect(sb).Equal(sb.Intersect(sa)) {
+			t.Fatalf("union or intersect not commutative for %v, %v", sa.Intervals(), sb.Intervals())
+		}
+	}
+}
+
+func TestIntervalSet_ZeroValue(t *testing.T) {
+	var s IntervalSet
+	if !s.IsEmpty() || s.Intervals() != nil || s.TotalDuration() != 0 || s.Contains(modelBase) {
+		t.Errorf("zero value is not an empty set: %v", s.Intervals())
+	}
+	if _, ok := s.NextTransition(modelBase); ok {
+		t.Error("empty set has no transitions")
+	}
+	one := NewIntervalSet(AllowedInterval{Start: slot(1), End: slot(2)})
+	if !s.Union(one).Equal(one) || !one.Subtract(s).Equal(one) || !s.Intersect(one).IsEmpty() {
+		t.Error("empty set is not neutral")
+	}
+}
+
+func TestIntervalSet_Truncate(t *testing.T) {
+	// Boundaries 10s apart collapse to the same minute: the gap disappears
+	s := NewIntervalSet(
+		AllowedInterval{Start: slot(0).Add(5 * time.Second), End: slot(1).Add(10 * time.Second)},
+		AllowedInterval{Start: slot(1).Add(20 * time.Second), End: slot(3).Add(59 * time.Second)},
+	)
+	want := NewIntervalSet(AllowedInterval{Start: slot(0), End: slot(3)})
+	if got := s.Truncate(time.Minute); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got.Intervals(), want.Intervals())
+	}
+}
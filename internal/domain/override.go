@@ -0,0 +1,71 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+// DateLayout is the key format for date-keyed maps (overrides, usage)
+const DateLayout = "2006-01-02"
+
+// ScheduleSource returns schedule intervals for a calendar day
+type ScheduleSource interface {
+	// DayIntervals returns intervals for day; false if the day has no schedule
+	DayIntervals(day time.Time) ([]TimeInterval, bool)
+}
+
+// DayIntervals looks up intervals by weekday name
+func (s DaySchedule) DayIntervals(day time.Time) ([]TimeInterval, bool) {
+	intervals, ok := s[dayKey(day)]
+	return intervals, ok
+}
+
+// DateOverride changes schedule of a single date: either replaces its intervals
+// or uses another weekday's intervals (UseDay). Empty override = no access that day.
+type DateOverride struct {
+	Intervals []TimeInterval `json:"intervals,omitempty"`
+	UseDay    string         `json:"use_day,omitempty"` // e.g. "sunday"
+}
+
+// DateOverrides is a map: date (DateLayout) -> override
+type DateOverrides map[string]DateOverride
+
+// OverriddenSchedule is a weekly schedule with period variants and date-specific exceptions
+type OverriddenSchedule struct {
+	Weekly    DaySchedule
+	Periods   []SchedulePeriod
+	Overrides DateOverrides
+}
+
+// DayIntervals applies override for the date if present, otherwise the weekly schedule
+// with the active period's days in place
+func (s OverriddenSchedule) DayIntervals(day time.Time) ([]TimeInterval, bool) {
+	weekly := s.Weekly
+	if p := ActivePeriod(s.Periods, day); p != nil {
+		weekly = weekly.Merge(p.Schedule)
+	}
+	o, ok := s.Overrides[day.Format(DateLayout)]
+	if !ok {
+		return weekly.DayIntervals(day)
+	}
+	if o.UseDay != "" {
+		intervals, ok := weekly[o.UseDay]
+		return intervals, ok
+	}
+	return o.Intervals, true
+}
+
+// DayOrigin describes where the day's intervals come from: date override, period or weekly schedule ("")
+func (s OverriddenSchedule) DayOrigin(day time.Time) string {
+	date := day.Format(DateLayout)
+	if o, ok := s.Overrides[date]; ok {
+		if o.UseDay != "" {
+			return fmt.Sprintf("override %s, as %s", date, o.UseDay)
+		}
+		return "override " + date
+	}
+	if p := ActivePeriod(s.Periods, day); p != nil {
+		return "period " + p.Name
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+// Week parity values for SchedulePeriod.Weeks, by ISO week number
+const (
+	WeeksOdd  = "odd"
+	WeeksEven = "even"
+)
+
+// yearlyLayout is the format of SchedulePeriod bounds that repeat every year
+const yearlyLayout = "01-02"
+
+// SchedulePeriod is a schedule variant in effect on some dates: a date range
+// (e.g. summer holidays), a week parity (odd/even school weeks) or both.
+// Days present in Schedule replace the weekly schedule's days while the period is active.
+type SchedulePeriod struct {
+	Name     string      `json:"name"`
+	From     string      `json:"from,omitempty"`  // first day, "YYYY-MM-DD" or yearly "MM-DD"; empty = open
+	To       string      `json:"to,omitempty"`    // last day, same format as From; empty = open
+	Weeks    string      `json:"weeks,omitempty"` // WeeksOdd, WeeksEven or empty for every week
+	Schedule DaySchedule `json:"schedule"`
+}
+
+// Contains reports whether the period is in effect on day
+func (p SchedulePeriod) Contains(day time.Time) bool {
+	if p.Weeks != "" {
+		_, week := day.ISOWeek()
+		if (week%2 == 1) != (p.Weeks == WeeksOdd) {
+			return false
+		}
+	}
+	if len(p.From) == len(yearlyLayout) {
+		md := day.Format(yearlyLayout)
+		if p.From <= p.To {
+			return md >= p.From && md <= p.To
+		}
+		// Wraps over new year, e.g. 12-25..01-08
+		return md >= p.From || md <= p.To
+	}
+	date := day.Format(DateLayout)
+	return (p.From == "" || date >= p.From) && (p.To == "" || date <= p.To)
+}
+
+// ActivePeriod returns the first period in effect on day, nil if none
+func ActivePeriod(periods []SchedulePeriod, day time.Time) *SchedulePeriod {
+	for i := range periods {
+		if periods[i].Contains(day) {
+			return &periods[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks name, bounds, week parity and the period's schedule
+func (p SchedulePeriod) Validate(field string) FieldErrors {
+	var errs FieldErrors
+	if p.Name == "" {
+		errs = append(errs, FieldError{Field: field + ".name", Message: "name required"})
+	}
+	if p.Weeks != "" && p.Weeks != WeeksOdd && p.Weeks != WeeksEven {
+		errs = append(errs, FieldError{Field: field + ".weeks", Message: fmt.Sprintf("want %q, %q or empty", WeeksOdd, WeeksEven)})
+	}
+	fromYearly, fromErr := parsePeriodBound(p.From)
+	if fromErr != nil {
+		errs = append(errs, FieldError{Field: field + ".from", Message: fromErr.Error()})
+	}
+	toYearly, toErr := parsePeriodBound(p.To)
+	if toErr != nil {
+		errs = append(errs, FieldError{Field: field + ".to", Message: toErr.Error()})
+	}
+	if fromErr == nil && toErr == nil {
+		switch {
+		case fromYearly != toYearly || (fromYearly && (p.From == "" || p.To == "")):
+			errs = append(errs, FieldError{Field: field + ".to", Message: "yearly period needs both from and to as MM-DD"})
+		case !fromYearly && p.From != "" && p.To != "" && p.To < p.From:
+			errs = append(errs, FieldError{Field: field + ".to", Message: "to must not be before from"})
+		case p.From == "" && p.To == "" && p.Weeks == "":
+			errs = append(errs, FieldError{Field: field, Message: "dates or weeks required"})
+		}
+	}
+	return append(errs, p.Schedule.Validate(field+".schedule")...)
+}
+
+// parsePeriodBound reports whether s is a yearly "MM-DD" bound; empty is a valid open bound
+func parsePeriodBound(s string) (yearly bool, err error) {
+	if s == "" {
+		return false, nil
+	}
+	if len(s) == len(yearlyLayout) {
+		// Leap year, so that 02-29 is accepted
+		if _, err := time.Parse(DateLayout, "2024-"+s); err != nil {
+			return false, fmt.Errorf("invalid date %q, want MM-DD", s)
+		}
+		return true, nil
+	}
+	if _, err := time.Parse(DateLayout, s); err != nil {
+		return false, fmt.Errorf("invalid date %q, want YYYY-MM-DD or MM-DD", s)
+	}
+	return false, nil
+}
@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulePeriod_Contains(t *testing.T) {
+	date := func(s string) time.Time {
+		d, _ := time.Parse(DateLayout, s)
+		return d
+	}
+	tests := []struct {
+		name   string
+		period SchedulePeriod
+		day    string
+		want   bool
+	}{
+		{"odd week", SchedulePeriod{Weeks: WeeksOdd}, "2026-02-09", true}, // ISO week 7
+		{"odd week on even", SchedulePeriod{Weeks: WeeksOdd}, "2026-02-16", false},
+		{"even week", SchedulePeriod{Weeks: WeeksEven}, "2026-02-16", true},
+		{"yearly inside", SchedulePeriod{From: "06-01", To: "08-31"}, "2026-08-31", true},
+		{"yearly outside", SchedulePeriod{From: "06-01", To: "08-31"}, "2026-09-01", false},
+		{"yearly over new year", SchedulePeriod{From: "12-25", To: "01-08"}, "2027-01-03", true},
+		{"yearly over new year outside", SchedulePeriod{From: "12-25", To: "01-08"}, "2026-12-24", false},
+		{"dated", SchedulePeriod{From: "2026-03-23", To: "2026-03-29"}, "2026-03-29", true},
+		{"dated open end", SchedulePeriod{From: "2026-03-23"}, "2027-01-01", true},
+		{"dated before", SchedulePeriod{From: "2026-03-23", To: "2026-03-29"}, "2026-03-22", false},
+		{"summer odd weeks", SchedulePeriod{From: "06-01", To: "08-31", Weeks: WeeksOdd}, "2026-07-15", true}, // ISO week 29
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.period.Contains(date(tt.day)); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.day, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulePeriod_Validate(t *testing.T) {
+	valid := SchedulePeriod{Name: "Summer", From: "06-01", To: "08-31"}
+	if errs := valid.Validate("periods[0]"); errs != nil {
+		t.Errorf("valid period: %v", errs)
+	}
+	invalid := []SchedulePeriod{
+		{From: "06-01", To: "08-31"},                      // no name
+		{Name: "x"},                                       // neither dates nor weeks
+		{Name: "x", Weeks: "third"},                       // bad parity
+		{Name: "x", From: "06-01"},                        // yearly without end
+		{Name: "x", From: "06-01", To: "2026-08-31"},      // mixed formats
+		{Name: "x", From: "2026-08-31", To: "2026-06-01"}, // reversed
+		{Name: "x", From: "13-01", To: "08-31"},           // bad month
+		{Name: "x", Weeks: WeeksEven, Schedule: DaySchedule{"mon": nil}},
+	}
+	for i, p := range invalid {
+		if errs := p.Validate("periods[0]"); errs == nil {
+			t.Errorf("case %d: want errors for %+v", i, p)
+		}
+	}
+}
+
+func TestComputeAllowedIntervals_SeasonalAndWeekParity(t *testing.T) {
+	loc := time.UTC
+	user := User{
+		Schedule: DaySchedule{
+			"monday":    {{Start: "15:00", End: "16:00"}},
+			"wednesday": {{Start: "15:00", End: "17:00"}},
+		},
+		Periods: []SchedulePeriod{
+			{Name: "Summer", From: "06-01", To: "08-31", Schedule: DaySchedule{"wednesday": {{Start: "10:00", End: "20:00"}}}},
+			{Name: "Even weeks", Weeks: WeeksEven, Schedule: DaySchedule{"monday": {{Start: "17:00", End: "18:00"}}}},
+		},
+	}
+	tests := []struct {
+		name    string
+		now     time.Time
+		wantEnd time.Time
+	}{
+		// Wednesday 15 Jul 2026: summer replaces wednesday
+		{"summer", time.Date(2026, 7, 15, 9, 0, 0, 0, loc), time.Date(2026, 7, 15, 20, 0, 0, 0, loc)},
+		// Wednesday 20 May 2026: weekly schedule
+		{"school", time.Date(2026, 5, 20, 9, 0, 0, 0, loc), time.Date(2026, 5, 20, 17, 0, 0, 0, loc)},
+		// Monday 16 Feb 2026, ISO week 8
+		{"even week", time.Date(2026, 2, 16, 9, 0, 0, 0, loc), time.Date(2026, 2, 16, 18, 0, 0, 0, loc)},
+		// Monday 9 Feb 2026, ISO week 7
+		{"odd week", time.Date(2026, 2, 9, 9, 0, 0, 0, loc), time.Date(2026, 2, 9, 16, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			intervals, _ := ComputeAllowedIntervals(tt.now, user.ScheduleSource(nil), Budget{}, nil, nil, 1, false)
+			if len(intervals) != 1 || !intervals[0].End.Equal(tt.wantEnd) {
+				t.Errorf("want one interval ending %v, got %v", tt.wantEnd, intervals)
+			}
+		})
+	}
+}
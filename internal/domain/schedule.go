@@ -16,10 +16,23 @@ type TimeInterval struct {
 // DaySchedule is a map: day name -> list of intervals
 type DaySchedule map[string][]TimeInterval
 
+// DayNames are valid DaySchedule keys
+var DayNames = []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+
+// IsDayName reports whether s is a valid DaySchedule key
+func IsDayName(s string) bool {
+	for _, d := range DayNames {
+		if d == s {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseTime parses "HH:MM" or "H:MM" format
 func ParseTime(s string) (hour, minute int, err error) {
 	parts := strings.Split(s, ":")
-	if len(parts) != 2 {
+	if len(parts) != 2 || !isDigits(parts[0], 1, 2) || !isDigits(parts[1], 2, 2) {
 		return 0, 0, fmt.Errorf("invalid time format: %s", s)
 	}
 	hour, err = strconv.Atoi(parts[0])
@@ -36,6 +49,19 @@ func ParseTime(s string) (hour, minute int, err error) {
 	return hour, minute, nil
 }
 
+// isDigits reports whether s consists of minLen..maxLen ASCII digits
+func isDigits(s string, minLen, maxLen int) bool {
+	if len(s) < minLen || len(s) > maxLen {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 // IsWithinInterval checks if given time is within interval (time is same day)
 func IsWithinInterval(t time.Time, start, end string) (bool, error) {
 	sh, sm, err := ParseTime(start)
@@ -0,0 +1,24 @@
+package domain
+
+// ScheduleTemplate is a named weekly schedule shared by users across clients
+type ScheduleTemplate struct {
+	ID       string      `json:"id"`
+	Name     string      `json:"name"`
+	Schedule DaySchedule `json:"schedule"`
+}
+
+// Merge returns s with days present in own replacing template days.
+// An own day with no intervals means no access on that day.
+func (s DaySchedule) Merge(own DaySchedule) DaySchedule {
+	if len(s) == 0 {
+		return own
+	}
+	merged := make(DaySchedule, len(s)+len(own))
+	for day, intervals := range s {
+		merged[day] = intervals
+	}
+	for day, intervals := range own {
+		merged[day] = intervals
+	}
+	return merged
+}
@@ -0,0 +1,24 @@
+package domain
+
+import "testing"
+
+func TestDaySchedule_Merge(t *testing.T) {
+	template := DaySchedule{
+		"monday":  {{Start: "09:00", End: "10:00"}},
+		"tuesday": {{Start: "09:00", End: "10:00"}},
+	}
+	own := DaySchedule{"tuesday": {}, "sunday": {{Start: "12:00", End: "13:00"}}}
+	merged := template.Merge(own)
+	if len(merged["monday"]) != 1 {
+		t.Error("monday must come from template")
+	}
+	if ivs, ok := merged["tuesday"]; !ok || len(ivs) != 0 {
+		t.Error("own empty tuesday must override template with no access")
+	}
+	if len(merged["sunday"]) != 1 {
+		t.Error("sunday must come from own schedule")
+	}
+	if len(template["sunday"]) != 0 {
+		t.Error("template must not be modified")
+	}
+}
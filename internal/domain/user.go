@@ -2,8 +2,24 @@ package domain
 
 // User represents a controlled user account
 type User struct {
-	ID       string
-	Name     string
-	Username string // OS account name
-	Schedule DaySchedule
+	ID         string
+	Name       string
+	Username   string           // OS account name
+	Schedule   DaySchedule      // own weekly schedule, days here override the template
+	TemplateID string           // optional ScheduleTemplate ID
+	Periods    []SchedulePeriod // seasonal and week-parity variants, first match wins
+	Overrides  DateOverrides    // date-specific exceptions to Schedule
+	Budget     DailyBudget      // optional per-day limit on total access time
+	Usage      DailyUsage       // access time reported by client
+}
+
+// BudgetState returns the user's daily limits with consumed time
+func (u User) BudgetState() Budget {
+	return Budget{Limits: u.Budget, Usage: u.Usage}
+}
+
+// ScheduleSource returns the weekly schedule with date overrides applied.
+// template is the schedule of u.TemplateID, nil if the user has none.
+func (u User) ScheduleSource(template DaySchedule) ScheduleSource {
+	return OverriddenSchedule{Weekly: template.Merge(u.Schedule), Periods: u.Periods, Overrides: u.Overrides}
 }
@@ -0,0 +1,126 @@
+package domain
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const minutesPerDay = 24 * 60
+
+// FieldError describes one invalid request field, addressed by its JSON path
+// (e.g. "schedule.monday[0].start")
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// FieldErrors is a list of validation failures; nil means valid
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// minuteRange is an interval in minutes from the start of its day;
+// end exceeds minutesPerDay for overnight intervals
+type minuteRange struct {
+	start, end int
+	index      int // position in the day's list
+}
+
+// Validate checks day names, time format, zero-length and overlapping intervals,
+// and overnight intervals colliding with the next day's intervals.
+// field is the JSON path of the schedule, used as prefix of reported fields.
+func (s DaySchedule) Validate(field string) FieldErrors {
+	var errs FieldErrors
+	var unknown []string
+	for day := range s {
+		if !IsDayName(day) {
+			unknown = append(unknown, day)
+		}
+	}
+	sort.Strings(unknown)
+	for _, day := range unknown {
+		errs = append(errs, FieldError{
+			Field:   field + "." + day,
+			Message: "unknown day, want one of " + strings.Join(DayNames, ", "),
+		})
+	}
+
+	ranges := make(map[string][]minuteRange)
+	for _, day := range DayNames {
+		dayErrs, dayRanges := validateDayIntervals(field+"."+day, s[day])
+		errs = append(errs, dayErrs...)
+		ranges[day] = dayRanges
+	}
+	for i, day := range DayNames {
+		next := DayNames[(i+1)%len(DayNames)]
+		for _, r := range ranges[day] {
+			if r.end <= minutesPerDay {
+				continue
+			}
+			spill := r.end - minutesPerDay
+			for _, n := range ranges[next] {
+				if n.start < spill {
+					errs = append(errs, FieldError{
+						Field:   fmt.Sprintf("%s.%s[%d]", field, day, r.index),
+						Message: fmt.Sprintf("overnight interval overlaps %s.%s[%d]", field, next, n.index),
+					})
+					break
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// ValidateDayIntervals checks a single day's intervals: time format, zero length and overlaps.
+// field is the JSON path of the list (e.g. "intervals").
+func ValidateDayIntervals(field string, intervals []TimeInterval) FieldErrors {
+	errs, _ := validateDayIntervals(field, intervals)
+	return errs
+}
+
+func validateDayIntervals(field string, intervals []TimeInterval) (FieldErrors, []minuteRange) {
+	var errs FieldErrors
+	var ranges []minuteRange
+	for i, iv := range intervals {
+		path := fmt.Sprintf("%s[%d]", field, i)
+		sh, sm, startErr := ParseTime(iv.Start)
+		if startErr != nil {
+			errs = append(errs, FieldError{Field: path + ".start", Message: fmt.Sprintf("invalid time %q, want HH:MM", iv.Start)})
+		}
+		eh, em, endErr := ParseTime(iv.End)
+		if endErr != nil {
+			errs = append(errs, FieldError{Field: path + ".end", Message: fmt.Sprintf("invalid time %q, want HH:MM", iv.End)})
+		}
+		if startErr != nil || endErr != nil {
+			continue
+		}
+		start, end := sh*60+sm, eh*60+em
+		if start == end {
+			errs = append(errs, FieldError{Field: path, Message: "start and end must differ"})
+			continue
+		}
+		if end < start {
+			end += minutesPerDay
+		}
+		ranges = append(ranges, minuteRange{start: start, end: end, index: i})
+	}
+	for a := range ranges {
+		for b := a + 1; b < len(ranges); b++ {
+			if ranges[a].start < ranges[b].end && ranges[b].start < ranges[a].end {
+				errs = append(errs, FieldError{
+					Field:   fmt.Sprintf("%s[%d]", field, ranges[b].index),
+					Message: fmt.Sprintf("overlaps %s[%d]", field, ranges[a].index),
+				})
+			}
+		}
+	}
+	return errs, ranges
+}
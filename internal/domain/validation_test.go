@@ -0,0 +1,72 @@
+package domain
+
+import "testing"
+
+func fieldSet(errs FieldErrors) map[string]bool {
+	set := make(map[string]bool)
+	for _, e := range errs {
+		set[e.Field] = true
+	}
+	return set
+}
+
+func TestDaySchedule_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule DaySchedule
+		want     []string
+	}{
+		{
+			name:     "valid with overnight",
+			schedule: DaySchedule{"friday": {{Start: "18:00", End: "01:00"}}, "saturday": {{Start: "10:00", End: "12:00"}}},
+		},
+		{
+			name:     "adjacent intervals",
+			schedule: DaySchedule{"monday": {{Start: "09:00", End: "12:00"}, {Start: "12:00", End: "13:00"}}},
+		},
+		{
+			name:     "unknown day",
+			schedule: DaySchedule{"mon": {{Start: "09:00", End: "10:00"}}},
+			want:     []string{"schedule.mon"},
+		},
+		{
+			name:     "bad time format",
+			schedule: DaySchedule{"monday": {{Start: "9", End: "+9:00"}}},
+			want:     []string{"schedule.monday[0].start", "schedule.monday[0].end"},
+		},
+		{
+			name:     "zero length",
+			schedule: DaySchedule{"monday": {{Start: "09:00", End: "09:00"}}},
+			want:     []string{"schedule.monday[0]"},
+		},
+		{
+			name:     "overlap",
+			schedule: DaySchedule{"monday": {{Start: "09:00", End: "12:00"}, {Start: "11:00", End: "13:00"}}},
+			want:     []string{"schedule.monday[1]"},
+		},
+		{
+			name:     "overnight overlaps same day",
+			schedule: DaySchedule{"monday": {{Start: "22:00", End: "02:00"}, {Start: "23:00", End: "23:30"}}},
+			want:     []string{"schedule.monday[1]"},
+		},
+		{
+			name:     "overnight collides with next day",
+			schedule: DaySchedule{"sunday": {{Start: "22:00", End: "08:00"}}, "monday": {{Start: "07:00", End: "09:00"}}},
+			want:     []string{"schedule.sunday[0]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.schedule.Validate("schedule")
+			if len(errs) != len(tt.want) {
+				t.Fatalf("want %d errors %v, got %v", len(tt.want), tt.want, errs)
+			}
+			got := fieldSet(errs)
+			for _, f := range tt.want {
+				if !got[f] {
+					t.Errorf("missing error for %s, got %v", f, errs)
+				}
+			}
+		})
+	}
+}
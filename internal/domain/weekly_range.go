@@ -0,0 +1,34 @@
+package domain
+
+import "time"
+
+// WeeklyRange is a time range repeated on given weekdays (e.g. homework hours)
+type WeeklyRange struct {
+	Days  []string `json:"days"`  // day names, see DayNames
+	Start string   `json:"start"` // "16:00" HH:MM
+	End   string   `json:"end"`   // "18:00" HH:MM, End <= Start means overnight
+}
+
+// Ranges returns occurrences overlapping [from, to)
+func (w WeeklyRange) Ranges(from, to time.Time) []BlockRange {
+	days := make(map[string]bool, len(w.Days))
+	for _, d := range w.Days {
+		days[d] = true
+	}
+	var result []BlockRange
+	// Start a day early: an overnight occurrence may spill into from
+	first := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location()).AddDate(0, 0, -1)
+	for day := first; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !days[dayKey(day)] {
+			continue
+		}
+		start, end, err := parseDayInterval(day, w.Start, w.End)
+		if err != nil {
+			return nil
+		}
+		if end.After(from) && start.Before(to) {
+			result = append(result, BlockRange{Start: start, End: end})
+		}
+	}
+	return result
+}
@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWeeklyRange_Ranges(t *testing.T) {
+	loc := time.UTC
+	// Thursday 12 Feb 2026, 10:00
+	now := time.Date(2026, 2, 12, 10, 0, 0, 0, loc)
+	w := WeeklyRange{Days: []string{"thursday", "friday"}, Start: "16:00", End: "18:00"}
+	ranges := w.Ranges(now, now.Add(48*time.Hour))
+	if len(ranges) != 2 {
+		t.Fatalf("want 2 ranges, got %d: %v", len(ranges), ranges)
+	}
+	expectStart := time.Date(2026, 2, 13, 16, 0, 0, 0, loc)
+	expectEnd := time.Date(2026, 2, 13, 18, 0, 0, 0, loc)
+	if !ranges[1].Start.Equal(expectStart) || !ranges[1].End.Equal(expectEnd) {
+		t.Errorf("friday: want [%v, %v], got %v", expectStart, expectEnd, ranges[1])
+	}
+}
+
+func TestWeeklyRange_OvernightFromPreviousDay(t *testing.T) {
+	loc := time.UTC
+	// Friday 13 Feb 2026, 01:00 - inside Thursday's 22:00-07:00
+	now := time.Date(2026, 2, 13, 1, 0, 0, 0, loc)
+	w := WeeklyRange{Days: []string{"thursday"}, Start: "22:00", End: "07:00"}
+	ranges := w.Ranges(now, now.Add(48*time.Hour))
+	if len(ranges) != 1 {
+		t.Fatalf("want 1 range, got %d: %v", len(ranges), ranges)
+	}
+	expectEnd := time.Date(2026, 2, 13, 7, 0, 0, 0, loc)
+	if !ranges[0].End.Equal(expectEnd) {
+		t.Errorf("end: want %v, got %v", expectEnd, ranges[0].End)
+	}
+}
+
+func TestComputeAllowedIntervals_RecurringBlockBeatsTempAccess(t *testing.T) {
+	loc := time.UTC
+	now := time.Date(2026, 2, 12, 15, 0, 0, 0, loc)
+	tempAccess := []TempAccessRange{
+		{
+			Start: time.Date(2026, 2, 12, 15, 0, 0, 0, loc),
+			End:   time.Date(2026, 2, 12, 19, 0, 0, 0, loc),
+		},
+	}
+	homework := WeeklyRange{Days: []string{"thursday"}, Start: "16:00", End: "18:00"}
+	blocks := homework.Ranges(now, WindowEnd(now, DefaultWindowDays))
+	intervals, _ := ComputeAllowedIntervals(now, DaySchedule{}, Budget{}, tempAccess, blocks, 0, false)
+	// [15:00, 19:00] minus [16:00, 18:00] -> [15:00, 16:00], [18:00, 19:00]
+	if len(intervals) != 2 {
+		t.Fatalf("want 2 intervals, got %d: %v", len(intervals), intervals)
+	}
+}
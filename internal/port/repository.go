@@ -2,6 +2,7 @@ package port
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/aegis/parental-control/internal/domain"
@@ -9,10 +10,12 @@ import (
 
 // BlockRequest is a block range [Start, Until]
 type BlockRequest struct {
-	ID     string    `json:"id"`
-	UserID string    `json:"user_id,omitempty"` // empty = block all users
-	Start  time.Time `json:"start"`
-	Until  time.Time `json:"until"`
+	ID       string    `json:"id"`
+	UserID   string    `json:"user_id,omitempty"` // empty = block all users
+	Start    time.Time `json:"start"`
+	Until    time.Time `json:"until"`
+	Priority int       `json:"priority,omitempty"` // overrides of higher priority are not blocked
+	Note     string    `json:"note,omitempty"`
 }
 
 // TemporaryAccessRequest grants access to user from Start until Until
@@ -21,6 +24,47 @@ type TemporaryAccessRequest struct {
 	UserID string    `json:"user_id"`
 	Start  time.Time `json:"start"`
 	Until  time.Time `json:"until"`
+	Note   string    `json:"note,omitempty"`
+}
+
+// OverrideGrant is an emergency "always allow" for a user from Start until Until.
+// Unlike temporary access it is not cut by blocks of lower priority.
+type OverrideGrant struct {
+	ID       string    `json:"id"`
+	UserID   string    `json:"user_id"`
+	Start    time.Time `json:"start"`
+	Until    time.Time `json:"until"`
+	Priority int       `json:"priority"` // at least 1
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// History entry types
+const (
+	HistoryTemporaryAccess = "temporary_access"
+	HistoryAlwaysAllow     = "always_allow"
+	HistoryBlock           = "block"
+)
+
+// HistoryEntry records a grant or block; it is kept after the grant ends or is removed
+type HistoryEntry struct {
+	ID          string     `json:"id"`   // ID of the request, grant or block
+	Type        string     `json:"type"` // HistoryTemporaryAccess, HistoryAlwaysAllow or HistoryBlock
+	UserID      string     `json:"user_id,omitempty"`
+	Username    string     `json:"username,omitempty"` // as of creation, kept if the user is deleted
+	Start       time.Time  `json:"start"`
+	Until       time.Time  `json:"until"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"` // removed before Until
+	Note        string     `json:"note,omitempty"`         // reason of an always-allow grant
+	Admin       string     `json:"admin,omitempty"`        // who created it; empty for entries recorded before admins were
+}
+
+// BlockRule is a recurring block (e.g. homework hours every weekday 16:00-18:00)
+type BlockRule struct {
+	ID       string `json:"id"`
+	UserID   string `json:"user_id,omitempty"`  // empty = block all users
+	Priority int    `json:"priority,omitempty"` // overrides of higher priority are not blocked
+	domain.WeeklyRange
 }
 
 // ClientState holds persistent and ephemeral data for a client
@@ -28,16 +72,31 @@ type ClientState struct {
 	ID                      string
 	Name                    string
 	Users                   []domain.User
-	BlockRequests           []BlockRequest           // last 10, persisted
-	TemporaryAccessRequests []TemporaryAccessRequest // last 10, persisted
+	BlockRequests           []BlockRequest                     // not yet ended or ended recently, persisted
+	TemporaryAccessRequests []TemporaryAccessRequest           // not yet ended or ended recently, persisted
+	OverrideGrants          []OverrideGrant                    // not yet ended or ended recently, persisted
+	BlockRules              []BlockRule                        // recurring, persisted
+	WindowDays              int                                // look-ahead horizon in days, 0 = default (today+tomorrow)
+	TimeZone                string                             // IANA zone the schedule is interpreted in, empty = server zone
+	SecretHash              string                             // hash of the agent's secret, empty = none issued: polls are rejected
+	Templates               map[string]domain.ScheduleTemplate // templates referenced by Users, by ID
 	LastSentIntervals       map[string][]domain.AllowedInterval
 	LastSentVersion         string
-	ComputedConfig          *domain.ClientConfig // precomputed intervals for today+tomorrow
+	ComputedConfig          *domain.ClientConfig // precomputed intervals for the look-ahead window
+}
+
+// ClientUpdate changes client settings; nil fields are left as they are
+type ClientUpdate struct {
+	Name       *string `json:"name,omitempty"`
+	WindowDays *int    `json:"window_days,omitempty"`
+	TimeZone   *string `json:"time_zone,omitempty"` // "" = server zone
 }
 
 // ConfigRepository persists and retrieves client configuration
 type ConfigRepository interface {
-	// GetClient returns client state by ID, nil if not found
+	// GetClient returns client state by ID, nil if not found. Temporary access, always-allow
+	// grants and blocks stay in it for a day after they end, so explain can attribute the
+	// past segments of today; callers that list current ones check Until.
 	GetClient(ctx context.Context, clientID string) (*ClientState, error)
 
 	// GetAllClients returns all clients
@@ -49,20 +108,81 @@ type ConfigRepository interface {
 	// DeleteClient removes client
 	DeleteClient(ctx context.Context, clientID string) error
 
+	// UpdateClient changes client settings and recomputes its config;
+	// ErrClientNotFound if there is no such client
+	UpdateClient(ctx context.Context, clientID string, update ClientUpdate) error
+
+	// SetClientSecret replaces the hash of the agent's secret (empty = revoke) and wakes
+	// the client's long-polls; ErrClientNotFound if there is no such client
+	SetClientSecret(ctx context.Context, clientID, secretHash string) error
+
 	// AddUser adds user to client
 	AddUser(ctx context.Context, clientID string, user domain.User) error
 
 	// UpdateUserSchedule updates schedule for user
 	UpdateUserSchedule(ctx context.Context, clientID, userID string, schedule domain.DaySchedule) error
 
+	// SetDateOverride sets schedule override for user on date (YYYY-MM-DD)
+	SetDateOverride(ctx context.Context, clientID, userID, date string, override domain.DateOverride) error
+
+	// SetDateOverrides sets several date overrides for user at once (e.g. imported holidays)
+	SetDateOverrides(ctx context.Context, clientID, userID string, overrides domain.DateOverrides) error
+
+	// DeleteDateOverride removes schedule override for user on date
+	DeleteDateOverride(ctx context.Context, clientID, userID, date string) error
+
+	// UpdateUserBudget updates daily screen-time budget for user
+	UpdateUserBudget(ctx context.Context, clientID, userID string, budget domain.DailyBudget) error
+
+	// AddUsage adds consumed access time reported by client (username -> duration) to today
+	AddUsage(ctx context.Context, clientID string, usage map[string]time.Duration) error
+
+	// UpdateUserPeriods replaces user's seasonal and week-parity schedule variants
+	UpdateUserPeriods(ctx context.Context, clientID, userID string, periods []domain.SchedulePeriod) error
+
+	// SetUserTemplate links user to a schedule template (empty = own schedule only)
+	SetUserTemplate(ctx context.Context, clientID, userID, templateID string) error
+
+	// ListTemplates returns all schedule templates
+	ListTemplates(ctx context.Context) ([]domain.ScheduleTemplate, error)
+
+	// GetTemplate returns schedule template by ID, nil if not found
+	GetTemplate(ctx context.Context, templateID string) (*domain.ScheduleTemplate, error)
+
+	// SaveTemplate creates (empty ID) or replaces schedule template, returns its ID.
+	// Every client with a user referencing the template gets a new config version.
+	SaveTemplate(ctx context.Context, template domain.ScheduleTemplate) (string, error)
+
+	// DeleteTemplate removes schedule template; its users keep only their own schedule
+	DeleteTemplate(ctx context.Context, templateID string) error
+
 	// DeleteUser removes user from client
 	DeleteUser(ctx context.Context, clientID, userID string) error
 
-	// GrantTemporaryAccess adds temporary access request, keeps last 10
-	GrantTemporaryAccess(ctx context.Context, clientID, userID string, until time.Time) error
+	// GrantTemporaryAccess adds temporary access request [start, until] with an optional note;
+	// admin is recorded in the history. ErrClientNotFound if there is no such client.
+	GrantTemporaryAccess(ctx context.Context, clientID, userID string, start, until time.Time, note, admin string) error
+
+	// UpdateTemporaryAccess changes end of existing temp access (extend or shorten);
+	// ErrInvalidUntil if the new end is not after both now and its start
+	UpdateTemporaryAccess(ctx context.Context, clientID, requestID string, until time.Time) error
+
+	// GrantOverride adds "always allow" grant for user [start, until]; admin is recorded in the history.
+	// ErrClientNotFound if there is no such client.
+	GrantOverride(ctx context.Context, clientID, userID string, start, until time.Time, priority int, reason, admin string) error
+
+	// DeleteOverrideGrant removes "always allow" grant by ID
+	DeleteOverrideGrant(ctx context.Context, clientID, grantID string) error
+
+	// BlockClient adds block request with an optional note (userID empty = block all);
+	// admin is recorded in the history. ErrClientNotFound if there is no such client.
+	BlockClient(ctx context.Context, clientID, userID string, start, until time.Time, priority int, note, admin string) error
 
-	// BlockClient adds block request, keeps last 10 (userID empty = block all)
-	BlockClient(ctx context.Context, clientID, userID string, start, until time.Time) error
+	// AddBlockRule adds recurring block rule, returns its ID; ErrClientNotFound if there is no such client
+	AddBlockRule(ctx context.Context, clientID string, rule BlockRule) (string, error)
+
+	// DeleteBlockRule removes recurring block rule by ID
+	DeleteBlockRule(ctx context.Context, clientID, ruleID string) error
 
 	// DeleteBlockRequest removes block by ID
 	DeleteBlockRequest(ctx context.Context, clientID, requestID string) error
@@ -70,12 +190,43 @@ type ConfigRepository interface {
 	// DeleteTemporaryAccessRequest removes temp access by ID
 	DeleteTemporaryAccessRequest(ctx context.Context, clientID, requestID string) error
 
+	// History returns all kept grants and blocks of client, newest first. Entries are
+	// recorded on grant, updated on extension and removal, and dropped by retention only.
+	History(ctx context.Context, clientID string) ([]HistoryEntry, error)
+
 	// UpdateLastSent updates last sent intervals for change detection
 	UpdateLastSent(ctx context.Context, clientID string, intervals map[string][]domain.AllowedInterval) error
 
 	// IncrementConfigVersion increments config version when admin makes changes
 	IncrementConfigVersion(ctx context.Context, clientID string) error
 
-	// Subscribe returns a channel that receives when config may have changed for client
+	// RecomputeConfig recomputes client's config as of now, keeping its version
+	RecomputeConfig(ctx context.Context, clientID string) error
+
+	// Subscribe returns a channel that receives when config may have changed for client;
+	// the subscription ends with ctx
 	Subscribe(ctx context.Context, clientID string) <-chan struct{}
 }
+
+// ErrClientNotFound is returned by repository methods that have to report a missing client
+var ErrClientNotFound = errors.New("client not found")
+
+// ErrInvalidUntil is returned when a grant would end before it starts or in the past;
+// ending a grant now is a revoke
+var ErrInvalidUntil = errors.New("until must be after start and in the future")
+
+// SubscriberCounter is implemented by repositories that can tell how many long-polls
+// are waiting for changes of a client
+type SubscriberCounter interface {
+	Subscribers(clientID string) int
+}
+
+// ErrHistoryUnavailable is returned by HistoryReader for a moment the kept history does not reach
+var ErrHistoryUnavailable = errors.New("history before this moment is not available")
+
+// HistoryReader is implemented by repositories that keep the history of changes
+type HistoryReader interface {
+	// ClientAt returns client state as it was at t with config computed as of t,
+	// nil if the client did not exist then
+	ClientAt(ctx context.Context, clientID string, t time.Time) (*ClientState, error)
+}
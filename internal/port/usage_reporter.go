@@ -0,0 +1,12 @@
+package port
+
+import (
+	"context"
+	"time"
+)
+
+// UsageReporter sends consumed access time to server
+type UsageReporter interface {
+	// ReportUsage reports time used since previous report (username -> duration)
+	ReportUsage(ctx context.Context, usage map[string]time.Duration) error
+}
@@ -7,4 +7,7 @@ type UserControl interface {
 
 	// DisconnectUserSession disconnects the user's session (WTSDisconnectSession)
 	DisconnectUserSession(username string) error
+
+	// IsSessionActive reports whether the user has an active session (used for budget tracking)
+	IsSessionActive(username string) (bool, error)
 }
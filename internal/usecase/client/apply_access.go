@@ -29,20 +29,22 @@ func ApplyAccessIfNeeded(ctrl port.UserControl, config *domain.ClientConfig, now
 	var changed []string
 	var statusLines []string
 	for _, uc := range config.Users {
-		required := isWithinIntervals(now, uc.AllowedIntervals)
+		allowed := domain.NewIntervalSet(uc.AllowedIntervals...)
+		required := allowed.Contains(now)
 		current := lastState[uc.Username]
 		newState[uc.Username] = required
 
 		// Build status line for logging
+		next, changes := allowed.NextTransition(now)
 		if required {
-			if d := untilNextBlock(now, uc.AllowedIntervals); d > 0 {
-				statusLines = append(statusLines, uc.Username+": allowed, should be blocked in "+formatDuration(d))
+			if changes {
+				statusLines = append(statusLines, uc.Username+": allowed, should be blocked in "+formatDuration(next.Sub(now)))
 			} else {
 				statusLines = append(statusLines, uc.Username+": allowed")
 			}
 		} else {
-			if d := untilNextUnlock(now, uc.AllowedIntervals); d > 0 {
-				statusLines = append(statusLines, uc.Username+": blocked, should be unlocked in "+formatDuration(d))
+			if changes {
+				statusLines = append(statusLines, uc.Username+": blocked, should be unlocked in "+formatDuration(next.Sub(now)))
 			} else {
 				statusLines = append(statusLines, uc.Username+": blocked")
 			}
@@ -84,39 +86,6 @@ func ApplyAccessIfNeeded(ctrl port.UserControl, config *domain.ClientConfig, now
 	return newState
 }
 
-func isWithinIntervals(t time.Time, intervals []domain.AllowedInterval) bool {
-	for _, iv := range intervals {
-		if (t.Equal(iv.Start) || t.After(iv.Start)) && t.Before(iv.End) {
-			return true
-		}
-	}
-	return false
-}
-
-// untilNextBlock returns duration until current allowed interval ends (0 if not in interval)
-func untilNextBlock(now time.Time, intervals []domain.AllowedInterval) time.Duration {
-	for _, iv := range intervals {
-		if (now.Equal(iv.Start) || now.After(iv.Start)) && now.Before(iv.End) {
-			return iv.End.Sub(now)
-		}
-	}
-	return 0
-}
-
-// untilNextUnlock returns duration until next allowed interval starts (0 if none)
-func untilNextUnlock(now time.Time, intervals []domain.AllowedInterval) time.Duration {
-	var min time.Duration
-	for _, iv := range intervals {
-		if iv.Start.After(now) {
-			d := iv.Start.Sub(now)
-			if min == 0 || d < min {
-				min = d
-			}
-		}
-	}
-	return min
-}
-
 func formatDuration(d time.Duration) string {
 	if d < time.Minute {
 		return d.Round(time.Second).String()
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aegis/parental-control/internal/port"
+)
+
+// maxTrackGap caps time counted between two Track calls (e.g. after sleep/hibernate)
+const maxTrackGap = time.Minute
+
+// UsageTracker accumulates access time of allowed users with an active session
+// until it is reported to server.
+type UsageTracker struct {
+	mu       sync.Mutex
+	pending  map[string]time.Duration
+	lastTick time.Time
+}
+
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{pending: make(map[string]time.Duration)}
+}
+
+// Track adds time elapsed since previous call for each allowed user that is logged on.
+// state: username -> true=allowed, as returned by ApplyAccessIfNeeded.
+func (t *UsageTracker) Track(ctrl port.UserControl, state map[string]bool, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed := now.Sub(t.lastTick)
+	first := t.lastTick.IsZero()
+	t.lastTick = now
+	if first || elapsed <= 0 {
+		return
+	}
+	if elapsed > maxTrackGap {
+		elapsed = maxTrackGap
+	}
+	for username, allowed := range state {
+		if !allowed {
+			continue
+		}
+		active, err := ctrl.IsSessionActive(username)
+		if err != nil || !active {
+			continue
+		}
+		t.pending[username] += elapsed
+	}
+}
+
+// Flush returns accumulated whole seconds per user and keeps the remainder
+func (t *UsageTracker) Flush() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	usage := make(map[string]time.Duration)
+	for username, d := range t.pending {
+		whole := d.Truncate(time.Second)
+		if whole > 0 {
+			usage[username] = whole
+			t.pending[username] = d - whole
+		}
+	}
+	return usage
+}
+
+// Restore puts back usage that failed to be reported
+func (t *UsageTracker) Restore(usage map[string]time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for username, d := range usage {
+		t.pending[username] += d
+	}
+}
@@ -9,33 +9,17 @@ import (
 
 // ComputeClientConfig computes ClientConfig with allowed_intervals for a client.
 // includePast: if true, includes intervals that already ended (for admin preview).
+// Schedule is interpreted in the client's time zone if set, otherwise in now's location.
 func ComputeClientConfig(now time.Time, state *port.ClientState, includePast bool) (domain.ClientConfig, time.Time) {
+	if loc := ClientLocation(state.TimeZone); loc != nil {
+		now = now.In(loc)
+	}
 	version := state.LastSentVersion
 	var users []domain.UserAccessConfig
-
-	tempAccessByUser := make(map[string][]domain.TempAccessRange)
-	for _, t := range state.TemporaryAccessRequests {
-		tempAccessByUser[t.UserID] = append(tempAccessByUser[t.UserID], domain.TempAccessRange{Start: t.Start, End: t.Until})
-	}
-
-	// Separate blocks: global (no UserID) and per-user
-	globalBlocks := make([]domain.BlockRange, 0)
-	blocksByUser := make(map[string][]domain.BlockRange)
-	for _, b := range state.BlockRequests {
-		block := domain.BlockRange{Start: b.Start, End: b.Until}
-		if b.UserID == "" {
-			globalBlocks = append(globalBlocks, block)
-		} else {
-			blocksByUser[b.UserID] = append(blocksByUser[b.UserID], block)
-		}
-	}
+	inputs := buildAccessInputs(now, domain.WindowEnd(now, state.WindowDays), state)
 
 	for _, u := range state.Users {
-		ta := tempAccessByUser[u.ID]
-		// Combine global blocks + user-specific blocks
-		userBlocks := append([]domain.BlockRange(nil), globalBlocks...)
-		userBlocks = append(userBlocks, blocksByUser[u.ID]...)
-		intervals, _ := domain.ComputeAllowedIntervals(now, u.Schedule, ta, userBlocks, includePast)
+		intervals, _ := domain.ComputeAllowedIntervals(now, u.ScheduleSource(state.Templates[u.TemplateID].Schedule), u.BudgetState(), inputs.tempAccess[u.ID], inputs.blocksFor(u.ID), state.WindowDays, includePast)
 		users = append(users, domain.UserAccessConfig{
 			Username:         u.Username,
 			AllowedIntervals: intervals,
@@ -45,16 +29,13 @@ func ComputeClientConfig(now time.Time, state *port.ClientState, includePast boo
 	// Compute next change time from first user (simplified - take min across all)
 	var nextChange time.Time
 	for i, u := range state.Users {
-		ta := tempAccessByUser[u.ID]
-		userBlocks := append([]domain.BlockRange(nil), globalBlocks...)
-		userBlocks = append(userBlocks, blocksByUser[u.ID]...)
-		_, nc := domain.ComputeAllowedIntervals(now, u.Schedule, ta, userBlocks, includePast)
+		_, nc := domain.ComputeAllowedIntervals(now, u.ScheduleSource(state.Templates[u.TemplateID].Schedule), u.BudgetState(), inputs.tempAccess[u.ID], inputs.blocksFor(u.ID), state.WindowDays, includePast)
 		if i == 0 || nc.Before(nextChange) {
 			nextChange = nc
 		}
 	}
 	if nextChange.IsZero() {
-		nextChange = now.Add(48 * time.Hour)
+		nextChange = domain.WindowEnd(now, state.WindowDays)
 	}
 
 	return domain.ClientConfig{
@@ -63,6 +44,180 @@ func ComputeClientConfig(now time.Time, state *port.ClientState, includePast boo
 	}, nextChange
 }
 
+// ExplainUser attributes every segment of the user's window, from the start of today,
+// to its cause. Returns false if the user does not exist.
+func ExplainUser(now time.Time, state *port.ClientState, userID string) ([]domain.Segment, bool) {
+	if loc := ClientLocation(state.TimeZone); loc != nil {
+		now = now.In(loc)
+	}
+	inputs := buildAccessInputs(now, domain.WindowEnd(now, state.WindowDays), state)
+	for _, u := range state.Users {
+		if u.ID == userID {
+			return domain.ExplainIntervals(now, u.ScheduleSource(state.Templates[u.TemplateID].Schedule), u.BudgetState(), inputs.tempAccess[u.ID], inputs.blocksFor(u.ID), state.WindowDays), true
+		}
+	}
+	return nil, false
+}
+
+// accessInputs holds temporary access and blocks of a client, tagged with their sources
+type accessInputs struct {
+	tempAccess   map[string][]domain.TempAccessRange // by user ID
+	globalBlocks []domain.BlockRange
+	blocksByUser map[string][]domain.BlockRange
+}
+
+// buildAccessInputs collects the client's ranges; block rules are expanded over [from, to]
+func buildAccessInputs(from, to time.Time, state *port.ClientState) accessInputs {
+	in := accessInputs{
+		tempAccess:   make(map[string][]domain.TempAccessRange),
+		blocksByUser: make(map[string][]domain.BlockRange),
+	}
+	for _, t := range state.TemporaryAccessRequests {
+		in.tempAccess[t.UserID] = append(in.tempAccess[t.UserID], domain.TempAccessRange{
+			Start:  t.Start,
+			End:    t.Until,
+			Source: domain.Source{Kind: domain.SourceTempAccess, ID: t.ID},
+		})
+	}
+	for _, g := range state.OverrideGrants {
+		in.tempAccess[g.UserID] = append(in.tempAccess[g.UserID], domain.TempAccessRange{
+			Start:    g.Start,
+			End:      g.Until,
+			Priority: g.Priority,
+			Source:   domain.Source{Kind: domain.SourceOverride, ID: g.ID, Detail: g.Reason},
+		})
+	}
+
+	// Separate blocks: global (no UserID) and per-user
+	for _, b := range state.BlockRequests {
+		block := domain.BlockRange{Start: b.Start, End: b.Until, Priority: b.Priority, Source: domain.Source{Kind: domain.SourceBlock, ID: b.ID}}
+		if b.UserID == "" {
+			block.Source.Detail = "all users"
+			in.globalBlocks = append(in.globalBlocks, block)
+		} else {
+			in.blocksByUser[b.UserID] = append(in.blocksByUser[b.UserID], block)
+		}
+	}
+	// Expand recurring rules over the interval window (from yesterday for overnight rules)
+	for _, rule := range state.BlockRules {
+		ranges := rule.Ranges(from.Add(-24*time.Hour), to)
+		source := domain.Source{Kind: domain.SourceBlockRule, ID: rule.ID, Detail: rule.Start + "-" + rule.End}
+		if rule.UserID == "" {
+			source.Detail += ", all users"
+		}
+		for i := range ranges {
+			ranges[i].Priority = rule.Priority
+			ranges[i].Source = source
+		}
+		if rule.UserID == "" {
+			in.globalBlocks = append(in.globalBlocks, ranges...)
+		} else {
+			in.blocksByUser[rule.UserID] = append(in.blocksByUser[rule.UserID], ranges...)
+		}
+	}
+	return in
+}
+
+// blocksFor combines global blocks and the user's own blocks
+func (in accessInputs) blocksFor(userID string) []domain.BlockRange {
+	blocks := append([]domain.BlockRange(nil), in.globalBlocks...)
+	return append(blocks, in.blocksByUser[userID]...)
+}
+
+// Transition is a moment the user's access switches
+type Transition struct {
+	At      time.Time `json:"at"`
+	Allowed bool      `json:"allowed"` // access from At on
+}
+
+// SimulatedUser is the outcome of Simulate for one user
+type SimulatedUser struct {
+	UserID           string                   `json:"user_id"`
+	Username         string                   `json:"username"`
+	AllowedIntervals []domain.AllowedInterval `json:"allowed_intervals"`
+	Transitions      []Transition             `json:"transitions"`
+}
+
+// Simulate computes allowed intervals of every user over [from, to] the way ComputeClientConfig
+// does for the look-ahead window. The state is only read, so it may be a hypothetical copy.
+func Simulate(from, to time.Time, state *port.ClientState) []SimulatedUser {
+	if loc := ClientLocation(state.TimeZone); loc != nil {
+		from, to = from.In(loc), to.In(loc)
+	}
+	from = from.Truncate(time.Minute)
+	inputs := buildAccessInputs(from, to, state)
+	result := []SimulatedUser{}
+	for _, u := range state.Users {
+		intervals, _ := domain.ComputeIntervalsUntil(from, to, u.ScheduleSource(state.Templates[u.TemplateID].Schedule), u.BudgetState(), inputs.tempAccess[u.ID], inputs.blocksFor(u.ID))
+		result = append(result, SimulatedUser{
+			UserID:           u.ID,
+			Username:         u.Username,
+			AllowedIntervals: intervals,
+			Transitions:      transitions(domain.NewIntervalSet(intervals...), from, to),
+		})
+	}
+	return result
+}
+
+// transitions lists boundaries strictly inside (from, to); boundaries on
+// the range edges come from clipping and are not real switches
+func transitions(allowed domain.IntervalSet, from, to time.Time) []Transition {
+	result := []Transition{}
+	for t, ok := allowed.NextTransition(from); ok && t.Before(to); t, ok = allowed.NextTransition(t) {
+		result = append(result, Transition{At: t, Allowed: allowed.Contains(t)})
+	}
+	return result
+}
+
+// ActivePeriods returns for each username the schedule period in effect on every day
+// of the look-ahead window: date (DateLayout) -> period name. Days without a period are omitted.
+func ActivePeriods(now time.Time, state *port.ClientState) map[string]map[string]string {
+	if loc := ClientLocation(state.TimeZone); loc != nil {
+		now = now.In(loc)
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	result := make(map[string]map[string]string)
+	for _, u := range state.Users {
+		for i := 0; i < domain.NormalizeWindowDays(state.WindowDays); i++ {
+			day := today.AddDate(0, 0, i)
+			p := domain.ActivePeriod(u.Periods, day)
+			if p == nil {
+				continue
+			}
+			if result[u.Username] == nil {
+				result[u.Username] = make(map[string]string)
+			}
+			result[u.Username][day.Format(domain.DateLayout)] = p.Name
+		}
+	}
+	return result
+}
+
+// ActiveOverrides returns "always allow" grants that have not ended yet, by username
+func ActiveOverrides(now time.Time, state *port.ClientState) map[string][]port.OverrideGrant {
+	result := make(map[string][]port.OverrideGrant)
+	for _, u := range state.Users {
+		for _, g := range state.OverrideGrants {
+			if g.UserID == u.ID && g.Until.After(now) {
+				result[u.Username] = append(result[u.Username], g)
+			}
+		}
+	}
+	return result
+}
+
+// ClientLocation loads client's IANA time zone, nil if not set or unknown
+func ClientLocation(timeZone string) *time.Location {
+	if timeZone == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
+
 // IntervalsChanged returns true if intervals differ from last sent
 func IntervalsChanged(state *port.ClientState, newConfig domain.ClientConfig) bool {
 	if state.LastSentVersion == "" {
@@ -73,7 +228,7 @@ func IntervalsChanged(state *port.ClientState, newConfig domain.ClientConfig) bo
 	}
 	for _, uc := range newConfig.Users {
 		last := state.LastSentIntervals[uc.Username]
-		if !intervalsEqual(last, uc.AllowedIntervals) {
+		if !domain.NewIntervalSet(last...).Truncate(comparePrecision).Equal(domain.NewIntervalSet(uc.AllowedIntervals...).Truncate(comparePrecision)) {
 			return true
 		}
 	}
@@ -96,19 +251,3 @@ func IntervalsChanged(state *port.ClientState, newConfig domain.ClientConfig) bo
 // comparePrecision truncates time for comparison to avoid false "changed" when
 // interval boundaries are clipped to "now" (which differs each poll).
 const comparePrecision = time.Minute
-
-func intervalsEqual(a, b []domain.AllowedInterval) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i := range a {
-		as := a[i].Start.Truncate(comparePrecision)
-		bs := b[i].Start.Truncate(comparePrecision)
-		ae := a[i].End.Truncate(comparePrecision)
-		be := b[i].End.Truncate(comparePrecision)
-		if !as.Equal(bs) || !ae.Equal(be) {
-			return false
-		}
-	}
-	return true
-}
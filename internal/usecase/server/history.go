@@ -0,0 +1,97 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aegis/parental-control/internal/port"
+)
+
+// Retention policy of grant and block history: entries that ended more than
+// HistoryRetention ago are dropped, and at most MaxHistoryEntries are kept per client
+const (
+	HistoryRetention  = 365 * 24 * time.Hour
+	MaxHistoryEntries = 5000
+)
+
+// AppendHistory adds entry to history (oldest first) and applies the retention policy as of now.
+// The result is a new slice: stored histories are shared with readers.
+func AppendHistory(history []port.HistoryEntry, entry port.HistoryEntry, now time.Time) []port.HistoryEntry {
+	cutoff := now.Add(-HistoryRetention)
+	result := make([]port.HistoryEntry, 0, len(history)+1)
+	for _, e := range history {
+		if HistoryEnd(e).After(cutoff) {
+			result = append(result, e)
+		}
+	}
+	result = append(result, entry)
+	if len(result) > MaxHistoryEntries {
+		result = result[len(result)-MaxHistoryEntries:]
+	}
+	return result
+}
+
+// ExtendHistory records a new end of the entry with id (temporary access extended or shortened)
+func ExtendHistory(history []port.HistoryEntry, id string, until time.Time) []port.HistoryEntry {
+	return updateHistory(history, id, func(e *port.HistoryEntry) { e.Until = until })
+}
+
+// CancelHistory records that the entry with id was removed at now; entries already ended stay as they are
+func CancelHistory(history []port.HistoryEntry, id string, now time.Time) []port.HistoryEntry {
+	return updateHistory(history, id, func(e *port.HistoryEntry) {
+		if e.CancelledAt == nil && now.Before(e.Until) {
+			e.CancelledAt = &now
+		}
+	})
+}
+
+func updateHistory(history []port.HistoryEntry, id string, fn func(*port.HistoryEntry)) []port.HistoryEntry {
+	result := append([]port.HistoryEntry(nil), history...)
+	for i := range result {
+		if result[i].ID == id {
+			fn(&result[i])
+		}
+	}
+	return result
+}
+
+// HistoryEnd returns when the grant or block actually ended: Until, or earlier if it was removed
+func HistoryEnd(e port.HistoryEntry) time.Time {
+	if e.CancelledAt != nil && e.CancelledAt.Before(e.Until) {
+		return *e.CancelledAt
+	}
+	return e.Until
+}
+
+// HistoryDuration returns how long the grant or block was in effect (or will be, if it has not ended)
+func HistoryDuration(e port.HistoryEntry) time.Duration {
+	if d := HistoryEnd(e).Sub(e.Start); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// HistoryFilter selects history entries; zero fields match everything
+type HistoryFilter struct {
+	UserID string // blocks of all users match every user
+	Type   string
+	From   time.Time // entries in effect at or after From
+	To     time.Time // entries starting before To
+}
+
+// FilterHistory returns entries matching filter, newest first
+func FilterHistory(history []port.HistoryEntry, filter HistoryFilter) []port.HistoryEntry {
+	var result []port.HistoryEntry
+	for _, e := range history {
+		switch {
+		case filter.UserID != "" && e.UserID != "" && e.UserID != filter.UserID:
+		case filter.Type != "" && e.Type != filter.Type:
+		case !filter.From.IsZero() && !HistoryEnd(e).After(filter.From):
+		case !filter.To.IsZero() && !e.Start.Before(filter.To):
+		default:
+			result = append(result, e)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return result
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aegis/parental-control/internal/port"
+)
+
+// maxRolloverSleep bounds how long the scheduler sleeps, so clients added and changed
+// in the meantime get their refresh times planned
+const maxRolloverSleep = 5 * time.Minute
+
+// Rollover keeps computed configs current as time passes. Admin changes recompute a
+// client's config, but nothing else does: after midnight the window would still start
+// yesterday and miss its last day. Rollover refreshes every client at its next local
+// midnight and at the next change of its intervals, and bumps the version when the
+// client's intervals differ from what it was last sent, so long-polls wake up.
+type Rollover struct {
+	repo port.ConfigRepository
+	loc  *time.Location       // for clients without their own time zone
+	due  map[string]time.Time // client ID -> next refresh
+}
+
+func NewRollover(repo port.ConfigRepository, loc *time.Location) *Rollover {
+	if loc == nil {
+		loc = time.Local
+	}
+	return &Rollover{repo: repo, loc: loc, due: make(map[string]time.Time)}
+}
+
+// Run refreshes clients when they are due until ctx ends
+func (s *Rollover) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		now := time.Now()
+		next, err := s.Tick(ctx, now)
+		if err != nil {
+			log.Printf("Rollover: %v", err)
+		}
+		timer.Reset(next.Sub(now))
+	}
+}
+
+// Tick refreshes the clients due by now and plans the others. It returns when to call it next.
+// Clients seen for the first time are only planned: their config was computed on load.
+func (s *Rollover) Tick(ctx context.Context, now time.Time) (time.Time, error) {
+	clients, err := s.repo.GetAllClients(ctx)
+	if err != nil {
+		return now.Add(maxRolloverSleep), err
+	}
+	next := now.Add(maxRolloverSleep)
+	seen := make(map[string]bool, len(clients))
+	var firstErr error
+	for _, c := range clients {
+		seen[c.ID] = true
+		due, ok := s.due[c.ID]
+		switch {
+		case ok && !due.After(now):
+			state, err := s.refresh(ctx, c.ID)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if state != nil {
+				c = state
+			}
+			due = s.nextRefresh(now, c)
+		case ok:
+			// Admin changes may have moved the next change earlier
+			if d := s.nextRefresh(now, c); d.Before(due) {
+				due = d
+			}
+		default:
+			due = s.nextRefresh(now, c)
+		}
+		s.due[c.ID] = due
+		if due.Before(next) {
+			next = due
+		}
+	}
+	for id := range s.due {
+		if !seen[id] {
+			delete(s.due, id)
+		}
+	}
+	return next, firstErr
+}
+
+// refresh recomputes the client's config and bumps its version if the client has not
+// been sent these intervals
+func (s *Rollover) refresh(ctx context.Context, clientID string) (*port.ClientState, error) {
+	if err := s.repo.RecomputeConfig(ctx, clientID); err != nil {
+		return nil, err
+	}
+	state, err := s.repo.GetClient(ctx, clientID)
+	if err != nil || state == nil || state.ComputedConfig == nil {
+		return state, err
+	}
+	if IntervalsChanged(state, *state.ComputedConfig) {
+		if err := s.repo.IncrementConfigVersion(ctx, clientID); err != nil {
+			return state, err
+		}
+	}
+	return state, nil
+}
+
+// nextRefresh returns the earlier of the client's next interval change and its next local midnight
+func (s *Rollover) nextRefresh(now time.Time, state *port.ClientState) time.Time {
+	loc := s.loc
+	if l := ClientLocation(state.TimeZone); l != nil {
+		loc = l
+	}
+	local := now.In(loc)
+	next := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc)
+	if _, change := ComputeClientConfig(now, state, true); change.After(now) && change.Before(next) {
+		next = change
+	}
+	return next
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aegis/parental-control/internal/domain"
+	"github.com/aegis/parental-control/internal/port"
+)
+
+// rolloverRepo keeps one client and computes its config at a fixed clock
+type rolloverRepo struct {
+	port.ConfigRepository
+	now        time.Time
+	client     *port.ClientState
+	recomputes int
+	bumps      int
+}
+
+func (r *rolloverRepo) GetAllClients(ctx context.Context) ([]*port.ClientState, error) {
+	return []*port.ClientState{r.client}, nil
+}
+
+func (r *rolloverRepo) GetClient(ctx context.Context, clientID string) (*port.ClientState, error) {
+	return r.client, nil
+}
+
+func (r *rolloverRepo) RecomputeConfig(ctx context.Context, clientID string) error {
+	r.recomputes++
+	config, _ := ComputeClientConfig(r.now, r.client, true)
+	r.client.ComputedConfig = &config
+	return nil
+}
+
+func (r *rolloverRepo) IncrementConfigVersion(ctx context.Context, clientID string) error {
+	r.bumps++
+	r.client.LastSentVersion = r.now.Format(time.RFC3339)
+	return r.RecomputeConfig(ctx, clientID)
+}
+
+// deliver records the current config as sent to the client
+func (r *rolloverRepo) deliver() {
+	r.client.LastSentIntervals = make(map[string][]domain.AllowedInterval)
+	for _, u := range r.client.ComputedConfig.Users {
+		r.client.LastSentIntervals[u.Username] = u.AllowedIntervals
+	}
+}
+
+func TestRollover_RefreshesAtMidnightAndChanges(t *testing.T) {
+	ctx := context.Background()
+	daily := domain.DaySchedule{}
+	for _, d := range domain.DayNames {
+		daily[d] = []domain.TimeInterval{{Start: "09:00", End: "10:00"}}
+	}
+	repo := &rolloverRepo{
+		now: time.Date(2026, 3, 2, 20, 0, 0, 0, time.UTC),
+		client: &port.ClientState{
+			ID: "c1", TimeZone: "UTC", LastSentVersion: "v1",
+			Users: []domain.User{{ID: "u1", Username: "kid", Schedule: daily}},
+		},
+	}
+	repo.RecomputeConfig(ctx, "c1")
+	repo.deliver()
+	s := NewRollover(repo, time.UTC)
+	midnight := time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC)
+
+	// First sight only plans; sleeps are capped so new changes get planned
+	next, err := s.Tick(ctx, repo.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.Equal(repo.now.Add(maxRolloverSleep)) || !s.due["c1"].Equal(midnight) {
+		t.Errorf("next tick %v, due %v; want capped sleep and midnight", next, s.due["c1"])
+	}
+
+	// A block added by the admin starts before midnight: planned earlier
+	blockStart := time.Date(2026, 3, 2, 22, 0, 0, 0, time.UTC)
+	repo.client.BlockRequests = []port.BlockRequest{{ID: "b1", Start: blockStart, Until: blockStart.Add(time.Hour)}}
+	s.Tick(ctx, repo.now.Add(time.Minute))
+	if !s.due["c1"].Equal(blockStart) {
+		t.Errorf("due %v after a block was added, want %v", s.due["c1"], blockStart)
+	}
+	repo.client.BlockRequests = nil
+	s.due["c1"] = midnight
+	if s.Tick(ctx, midnight.Add(-time.Minute)); repo.recomputes != 1 {
+		t.Error("refreshed before midnight")
+	}
+
+	// After midnight the window moves on a day: the client must be woken
+	repo.now = midnight.Add(30 * time.Second)
+	s.Tick(ctx, repo.now)
+	if repo.recomputes < 2 || repo.bumps != 1 {
+		t.Fatalf("at midnight: %d recomputes, %d bumps; want a refresh and a bump", repo.recomputes, repo.bumps)
+	}
+	ivs := repo.client.ComputedConfig.Users[0].AllowedIntervals
+	if len(ivs) == 0 || ivs[0].Start.Day() != 3 {
+		t.Errorf("window still starts yesterday: %v", ivs)
+	}
+	if want := time.Date(2026, 3, 3, 9, 0, 0, 0, time.UTC); !s.due["c1"].Equal(want) {
+		t.Errorf("due %v, want the next interval change %v", s.due["c1"], want)
+	}
+
+	// Refreshed again at the change, but nothing new for the client: no bump
+	repo.deliver()
+	repo.now = s.due["c1"]
+	s.Tick(ctx, repo.now)
+	if repo.bumps != 1 {
+		t.Errorf("bumped %d times, want 1: intervals did not change", repo.bumps)
+	}
+}